@@ -0,0 +1,489 @@
+// Package droidrunclient submits and follows tasks on a droidrun server.
+//
+//	c := droidrunclient.New(
+//		droidrunclient.WithBaseURL("http://phone-rig:8000"),
+//		droidrunclient.WithServerKey(os.Getenv("DROIDRUN_SERVER_KEY")),
+//	)
+//	resp, err := c.Submit(ctx, droidrunclient.TaskRequest{Goal: "Open settings"})
+//
+// The droidrun-client CLI is built on it.
+package droidrunclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the server a Client talks to without WithBaseURL.
+const DefaultBaseURL = "http://localhost:8000"
+
+// TaskRequest is the body of POST /run
+type TaskRequest struct {
+	Goal           string            `json:"goal"`
+	App            string            `json:"app,omitempty"`
+	Deeplink       string            `json:"deeplink,omitempty"`
+	Setup          []SetupStep       `json:"setup,omitempty"` // Run in order before the goal, after App and Deeplink
+	Provider       string            `json:"provider,omitempty"`
+	Model          string            `json:"model,omitempty"`
+	BaseURL        string            `json:"base_url,omitempty"`
+	Reasoning      bool              `json:"reasoning"`
+	Vision         *bool             `json:"vision,omitempty"` // Omitted unless set, so the server may enable it for goals that need it
+	MaxSteps       int               `json:"max_steps,omitempty"`
+	RunIf          *RunCondition     `json:"run_if,omitempty"`
+	Cacheable      bool              `json:"cacheable,omitempty"`
+	AssertContains string            `json:"assert_contains,omitempty"`
+	AssertRegex    string            `json:"assert_regex,omitempty"`
+	Locale         string            `json:"locale,omitempty"`
+	Timezone       string            `json:"timezone,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+// RunCondition holds a task until another task finishes with a matching outcome
+type RunCondition struct {
+	TaskID    string `json:"task_id"`
+	Condition string `json:"condition"`
+}
+
+// SetupStep is one step of a task's setup: an app to launch (a package or
+// package/activity) or a deep link to open, exactly one of them
+type SetupStep struct {
+	App      string `json:"app,omitempty"`
+	Deeplink string `json:"deeplink,omitempty"`
+}
+
+type SubmitResponse struct {
+	TaskID   string `json:"task_id"`
+	Status   string `json:"status"`
+	Position int    `json:"position"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"` // Machine-readable, e.g. goal_required or queue_full
+}
+
+// TaskStatus is a task as returned by GET /task/{id}
+type TaskStatus struct {
+	ID         string            `json:"id"`
+	Request    TaskStatusRequest `json:"request"`
+	Status     string            `json:"status"`
+	Success    bool              `json:"success"`
+	Result     string            `json:"result"`
+	Error      string            `json:"error"`
+	SkipReason string            `json:"skip_reason"`
+	FromCache  string            `json:"served_from_cache"`
+	Logs       string            `json:"logs"`
+	Steps      any               `json:"steps"`
+	CreatedAt  string            `json:"created_at"`
+	StartedAt  string            `json:"started_at"`
+	FinishedAt string            `json:"finished_at"`
+}
+
+// Done reports whether the task has finished one way or another.
+func (s TaskStatus) Done() bool {
+	switch s.Status {
+	case "completed", "failed", "cancelled", "skipped":
+		return true
+	}
+	return false
+}
+
+// TaskStatusRequest is the sanitized request echoed back in a task's status
+type TaskStatusRequest struct {
+	Goal     string `json:"goal"`
+	App      string `json:"app"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+// TaskSummary is a task's compact view from GET /task/{id}?format=summary
+type TaskSummary struct {
+	Text     string `json:"text"`
+	TaskID   string `json:"task_id"`
+	Status   string `json:"status"`
+	Success  bool   `json:"success"`
+	Goal     string `json:"goal"`
+	Result   string `json:"result,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// TimelineStep is a step from GET /task/{id}/steps?format=timeline
+type TimelineStep struct {
+	Index      int    `json:"index"`
+	Action     string `json:"action,omitempty"`
+	Screenshot string `json:"screenshot,omitempty"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	Raw        any    `json:"raw,omitempty"`
+}
+
+// Health is the server's state from GET /health
+type Health struct {
+	Status    string   `json:"status"` // ok, paused, draining, or worker_unavailable
+	Paused    bool     `json:"paused"`
+	WorkerOK  bool     `json:"worker_ok"`
+	Reason    string   `json:"reason"` // Why the worker is unavailable
+	Version   string   `json:"version"`
+	QueueSize int      `json:"queue_size"`
+	Running   []string `json:"current_task"`
+	Message   string   `json:"message"` // The operator message, if one is set
+}
+
+// Error is an error response from the server.
+type Error struct {
+	StatusCode int
+	Code       string // The server's error code, e.g. invalid_provider ("" from older servers)
+	Message    string // The server's error message, or the status without one
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// QueueFullError reports a submission the server rejected with 429, usually
+// because its queue is full or the client is over its rate limit. It is
+// worth retrying after RetryAfter.
+type QueueFullError struct {
+	Code       string // queue_full or rate_limited
+	Message    string
+	RetryAfter time.Duration // From the Retry-After header (0 = not sent)
+}
+
+func (e *QueueFullError) Error() string {
+	return "server busy (429): " + e.Message
+}
+
+// Client talks to one droidrun server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	serverKey  string
+	apiKey     string
+	httpClient *http.Client
+
+	retries      int
+	retryDelay   time.Duration
+	retryNotices io.Writer
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithBaseURL sets the server's URL, e.g. http://phone-rig:8000.
+func WithBaseURL(u string) Option {
+	return func(c *Client) { c.baseURL = strings.TrimRight(u, "/") }
+}
+
+// WithServerKey sets the key sent as X-Server-Key, for servers started with
+// -server-key or -server-keys.
+func WithServerKey(key string) Option {
+	return func(c *Client) { c.serverKey = key }
+}
+
+// WithAPIKey sets the LLM provider key sent as X-API-Key with submissions.
+// Without one the server uses its own key for the provider, if it has one.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient sets the http.Client requests are sent with
+// (default http.DefaultClient).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithConnectRetries retries requests up to n times while the server can't
+// be connected to, waiting delay and doubling the wait each time. Each retry
+// is reported to notices, if not nil. Without it requests fail at once.
+func WithConnectRetries(n int, delay time.Duration, notices io.Writer) Option {
+	return func(c *Client) { c.retries, c.retryDelay, c.retryNotices = n, delay, notices }
+}
+
+// New returns a Client for DefaultBaseURL unless options say otherwise.
+func New(opts ...Option) *Client {
+	c := &Client{baseURL: DefaultBaseURL, httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Submit queues a task with POST /run. The LLM API key travels in the
+// X-API-Key header, never in the JSON body. A 429 is returned as a
+// *QueueFullError.
+func (c *Client) Submit(ctx context.Context, req TaskRequest) (*SubmitResponse, error) {
+	body, _ := json.Marshal(req)
+	return c.post(ctx, "/run", body)
+}
+
+// Rerun resubmits task id with overrides (request fields by their JSON name)
+// merged over its stored request.
+func (c *Client) Rerun(ctx context.Context, id string, overrides map[string]any) (*SubmitResponse, error) {
+	body, _ := json.Marshal(overrides)
+	return c.post(ctx, "/task/"+url.PathEscape(id)+"/rerun", body)
+}
+
+// post sends a submission body to path and decodes the SubmitResponse.
+func (c *Client) post(ctx context.Context, path string, body []byte) (*SubmitResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", c.apiKey)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, submitError(resp)
+	}
+
+	var submitResp SubmitResponse
+	if err := json.NewDecoder(resp.Body).Decode(&submitResp); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return &submitResp, nil
+}
+
+// submitError reads a rejected submission's error, a *QueueFullError for a
+// 429 and an *Error otherwise.
+func submitError(resp *http.Response) error {
+	err := errorFrom(resp)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return err
+	}
+	full := &QueueFullError{Code: err.Code, Message: err.Message}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		full.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return full
+}
+
+// Poll fetches a task's current status with GET /task/{id}. It doesn't wait
+// for the task to finish; call it again until the status is Done.
+func (c *Client) Poll(ctx context.Context, id string) (*TaskStatus, error) {
+	resp, err := c.get(ctx, "/task/"+url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFrom(resp)
+	}
+	var status TaskStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("unreadable response (%s): %w", resp.Status, err)
+	}
+	return &status, nil
+}
+
+// TaskLogs is a piece of a task's worker logs, from GET /task/{id}/logs
+type TaskLogs struct {
+	Text   string // The logs from the requested offset
+	Size   int    // The logs' whole size, the offset to ask for next
+	Status string // The task's status when the logs were read
+}
+
+// Logs fetches task id's worker logs from byte offset on. While the task
+// runs they hold the complete lines written so far; call it again with
+// Size as the offset for what's new. A Size below the offset means the
+// logs were cut short (see the server's -max-output) since the last call.
+func (c *Client) Logs(ctx context.Context, id string, offset int) (*TaskLogs, error) {
+	target := "/task/" + url.PathEscape(id) + "/logs"
+	if offset > 0 {
+		target += "?offset=" + strconv.Itoa(offset)
+	}
+	resp, err := c.get(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFrom(resp)
+	}
+	text, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading logs: %w", err)
+	}
+	logs := &TaskLogs{Text: string(text), Status: resp.Header.Get("X-Task-Status")}
+	if logs.Size, err = strconv.Atoi(resp.Header.Get("X-Log-Size")); err != nil {
+		// An older server: the body is the whole logs
+		logs.Size = offset + len(text)
+	}
+	return logs, nil
+}
+
+// Done reports whether the task had finished when the logs were read, so
+// they won't grow any more.
+func (l TaskLogs) Done() bool {
+	return TaskStatus{Status: l.Status}.Done()
+}
+
+// Summary fetches a task's compact view with GET /task/{id}?format=summary.
+func (c *Client) Summary(ctx context.Context, id string) (*TaskSummary, error) {
+	resp, err := c.get(ctx, "/task/"+url.PathEscape(id)+"?format=summary")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFrom(resp)
+	}
+	var summary TaskSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("unreadable response (%s): %w", resp.Status, err)
+	}
+	return &summary, nil
+}
+
+// timelinePage is how many steps Timeline asks for at a time.
+const timelinePage = 500
+
+// Timeline fetches all of a task's steps from
+// GET /task/{id}/steps?format=timeline, a page at a time.
+func (c *Client) Timeline(ctx context.Context, id string) ([]TimelineStep, error) {
+	var steps []TimelineStep
+	for {
+		target := fmt.Sprintf("/task/%s/steps?format=timeline&limit=%d&offset=%d", url.PathEscape(id), timelinePage, len(steps))
+		resp, err := c.get(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := errorFrom(resp)
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		var page struct {
+			Total int            `json:"total"`
+			Steps []TimelineStep `json:"steps"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unreadable response (%s): %w", resp.Status, err)
+		}
+		steps = append(steps, page.Steps...)
+		if len(page.Steps) == 0 || len(steps) >= page.Total {
+			return steps, nil
+		}
+	}
+}
+
+// Artifacts opens a zip of a task's logs, result, and screenshots from
+// GET /task/{id}/artifacts.zip. The caller must close it.
+func (c *Client) Artifacts(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.get(ctx, "/task/"+url.PathEscape(id)+"/artifacts.zip")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+		return nil, errorFrom(resp)
+	}
+	return resp.Body, nil
+}
+
+// Cancel cancels a queued or running task with DELETE /task/{id}.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.baseURL+"/task/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errorFrom(resp)
+	}
+	return nil
+}
+
+// Deeplinks lists the deep links app (a package name) declares, from
+// GET /deeplinks.
+func (c *Client) Deeplinks(ctx context.Context, app string) ([]string, error) {
+	resp, err := c.get(ctx, "/deeplinks?app="+url.QueryEscape(app))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFrom(resp)
+	}
+	var result struct {
+		Deeplinks []string `json:"deeplinks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return result.Deeplinks, nil
+}
+
+// Status fetches the server's compact status line from GET /status.
+func (c *Client) Status(ctx context.Context) (string, error) {
+	resp, err := c.get(ctx, "/status")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", errorFrom(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Health fetches the server's state from GET /health. A server whose worker
+// is unavailable answers 503, which is returned as a Health, not an error.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	resp, err := c.get(ctx, "/health")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, errorFrom(resp)
+	}
+	var health Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("unreadable response (%s): %w", resp.Status, err)
+	}
+	return &health, nil
+}
+
+func (c *Client) get(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// errorFrom reads a non-2xx response's error message, falling back to its
+// body, or its status when that's empty.
+func errorFrom(resp *http.Response) *Error {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	msg := strings.TrimSpace(string(bodyBytes))
+	var errResp ErrorResponse
+	if json.Unmarshal(bodyBytes, &errResp) == nil && errResp.Error != "" {
+		msg = errResp.Error
+	}
+	if msg == "" {
+		msg = "server returned " + resp.Status
+	}
+	return &Error{StatusCode: resp.StatusCode, Code: errResp.Code, Message: msg}
+}
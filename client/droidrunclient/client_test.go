@@ -0,0 +1,159 @@
+package droidrunclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	var cancelled string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Server-Key") != "server-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"error": "invalid or missing X-Server-Key"}`)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/run":
+			var req TaskRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if req.Goal == "" || r.Header.Get("X-API-Key") != "llm-key" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = io.WriteString(w, `{"error": "goal is required", "code": "goal_required"}`)
+				return
+			}
+			_, _ = io.WriteString(w, `{"task_id": "abc123", "status": "queued", "position": 2}`)
+		case r.Method == "GET" && r.URL.Path == "/task/abc123":
+			_, _ = io.WriteString(w, `{"id": "abc123", "status": "completed", "success": true, "result": "done"}`)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/task/"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"error": "task not found"}`)
+		case r.Method == "DELETE" && r.URL.Path == "/task/abc123":
+			cancelled = "abc123"
+			_, _ = io.WriteString(w, `{"status": "cancelled"}`)
+		case r.URL.Path == "/deeplinks":
+			_, _ = io.WriteString(w, `{"app": "`+r.URL.Query().Get("app")+`", "deeplinks": ["instagram://mainfeed"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New(WithBaseURL(srv.URL+"/"), WithServerKey("server-secret"), WithAPIKey("llm-key"))
+
+	resp, err := c.Submit(ctx, TaskRequest{Goal: "open settings"})
+	if err != nil || resp.TaskID != "abc123" || resp.Position != 2 {
+		t.Fatalf("Submit: got %+v, %v", resp, err)
+	}
+	_, err = c.Submit(ctx, TaskRequest{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "goal_required" || apiErr.Message != "goal is required" {
+		t.Errorf("expected the server's 400, got %v", err)
+	}
+
+	status, err := c.Poll(ctx, "abc123")
+	if err != nil || !status.Done() || status.Result != "done" {
+		t.Errorf("Poll: got %+v, %v", status, err)
+	}
+	if _, err := c.Poll(ctx, "missing"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 for an unknown task, got %v", err)
+	}
+
+	if err := c.Cancel(ctx, "abc123"); err != nil || cancelled != "abc123" {
+		t.Errorf("Cancel: %v (cancelled %q)", err, cancelled)
+	}
+
+	links, err := c.Deeplinks(ctx, "com.instagram.android")
+	if err != nil || len(links) != 1 || links[0] != "instagram://mainfeed" {
+		t.Errorf("Deeplinks: got %v, %v", links, err)
+	}
+
+	// Without the server key every call is refused
+	_, err = New(WithBaseURL(srv.URL)).Poll(ctx, "abc123")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401 without the server key, got %v", err)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	const logs = "one\ntwo\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/task/abc123/logs" {
+			http.NotFound(w, r)
+			return
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		w.Header().Set("X-Log-Size", strconv.Itoa(len(logs)))
+		w.Header().Set("X-Task-Status", "running")
+		_, _ = io.WriteString(w, logs[offset:])
+	}))
+	defer srv.Close()
+
+	c := New(WithBaseURL(srv.URL))
+	got, err := c.Logs(context.Background(), "abc123", 0)
+	if err != nil || got.Text != logs || got.Size != len(logs) || got.Status != "running" || got.Done() {
+		t.Fatalf("Logs: got %+v, %v", got, err)
+	}
+	got, err = c.Logs(context.Background(), "abc123", 4)
+	if err != nil || got.Text != "two\n" || got.Size != len(logs) {
+		t.Errorf("Logs from an offset: got %+v, %v", got, err)
+	}
+}
+
+func TestSubmitQueueFull(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = io.WriteString(w, `{"error": "queue is full", "code": "queue_full"}`)
+	}))
+	defer srv.Close()
+
+	_, err := New(WithBaseURL(srv.URL)).Submit(context.Background(), TaskRequest{Goal: "test"})
+	var full *QueueFullError
+	if !errors.As(err, &full) || full.Code != "queue_full" || full.Message != "queue is full" || full.RetryAfter != 7*time.Second {
+		t.Errorf("expected a QueueFullError with Retry-After, got %#v", err)
+	}
+}
+
+func TestConnectRetriesStopWithContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	c := New(WithBaseURL("http://"+addr), WithConnectRetries(5, time.Hour, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Submit(ctx, TaskRequest{Goal: "test"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("kept waiting %s after the context was done", elapsed)
+	}
+}
+
+func TestHealthWorkerUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, `{"status": "worker_unavailable", "worker_ok": false, "reason": "no device", "message": "rig offline"}`)
+	}))
+	defer srv.Close()
+
+	health, err := New(WithBaseURL(srv.URL)).Health(context.Background())
+	if err != nil || health.Status != "worker_unavailable" || health.Reason != "no device" || health.Message != "rig offline" {
+		t.Errorf("expected the 503's health, got %+v, %v", health, err)
+	}
+}
@@ -0,0 +1,136 @@
+package droidrunclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TaskEvent is a progress update streamed from GET /events or
+// GET /task/{id}/events
+type TaskEvent struct {
+	TaskID   string `json:"task_id"`
+	Status   string `json:"status"`
+	Position int    `json:"position"`
+	Steps    int    `json:"steps"`
+	Success  bool   `json:"success"`
+	Result   string `json:"result"`
+	Error    string `json:"error"`
+}
+
+// Done reports whether the event is the task's last: it has finished one
+// way or another, or the server doesn't know it (not_found).
+func (e TaskEvent) Done() bool {
+	switch e.Status {
+	case "waiting", "queued", "running":
+		return false
+	}
+	return true
+}
+
+// errStreamEnded is returned when an event stream closes before its end.
+var errStreamEnded = errors.New("event stream ended early")
+
+// Watch follows several tasks over one GET /events stream, calling fn for
+// each status change, until every task has finished.
+func (c *Client) Watch(ctx context.Context, ids []string, fn func(TaskEvent)) error {
+	resp, err := c.get(ctx, "/events?tasks="+url.QueryEscape(strings.Join(ids, ",")))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errorFrom(resp)
+	}
+
+	done := false
+	err = readEvents(resp.Body, func(event, data string) bool {
+		if event == "done" {
+			done = true
+			return false
+		}
+		var ev TaskEvent
+		if event == "task" && json.Unmarshal([]byte(data), &ev) == nil {
+			fn(ev)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if !done {
+		return errStreamEnded
+	}
+	return nil
+}
+
+// Follow reads GET /task/{id}/events, calling fn for each event, until the
+// task finishes. Servers older than the endpoint answer 404; poll them
+// instead.
+func (c *Client) Follow(ctx context.Context, id string, fn func(TaskEvent)) error {
+	resp, err := c.get(ctx, "/task/"+url.PathEscape(id)+"/events")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errorFrom(resp)
+	}
+
+	finished := false
+	err = readEvents(resp.Body, func(event, data string) bool {
+		if event != "task" {
+			return event != "done"
+		}
+		var ev TaskEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return true
+		}
+		fn(ev)
+		finished = ev.Done()
+		return !finished
+	})
+	if err != nil {
+		return err
+	}
+	if !finished {
+		return errStreamEnded
+	}
+	return nil
+}
+
+// readEvents parses a Server-Sent Events stream, calling fn for each event
+// until fn returns false or the stream ends.
+func readEvents(r io.Reader, fn func(event, data string) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event != "" || len(data) > 0 {
+				if event == "" {
+					event = "message"
+				}
+				if !fn(event, strings.Join(data, "\n")) {
+					return nil
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// Comment / keepalive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,47 @@
+package droidrunclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFollowAndWatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := []string{
+			`event: task`, `data: {"task_id":"a","status":"queued","position":1}`, ``,
+			`: keepalive`, ``,
+			`event: task`, `data: {"task_id":"a","status":"completed","success":true}`, ``,
+		}
+		if r.URL.Query().Get("tasks") == "a" {
+			events = append(events, `event: done`, `data: {}`, ``)
+		}
+		_, _ = w.Write([]byte(strings.Join(events, "\n") + "\n"))
+	}))
+	defer srv.Close()
+
+	c := New(WithBaseURL(srv.URL))
+	var statuses []string
+	if err := c.Follow(context.Background(), "a", func(ev TaskEvent) { statuses = append(statuses, ev.Status) }); err != nil {
+		t.Fatalf("Follow: %v", err)
+	}
+	if strings.Join(statuses, ",") != "queued,completed" {
+		t.Errorf("unexpected events %v", statuses)
+	}
+
+	statuses = nil
+	if err := c.Watch(context.Background(), []string{"a"}, func(ev TaskEvent) { statuses = append(statuses, ev.Status) }); err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if strings.Join(statuses, ",") != "queued,completed" {
+		t.Errorf("unexpected events %v", statuses)
+	}
+
+	// Without the done event the stream was cut short
+	if err := c.Watch(context.Background(), []string{"b"}, func(TaskEvent) {}); err == nil || !strings.Contains(err.Error(), "ended early") {
+		t.Errorf("expected an early end, got %v", err)
+	}
+}
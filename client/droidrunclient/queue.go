@@ -0,0 +1,185 @@
+package droidrunclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// BatchResult is the outcome of one task in a POST /batch, in request order
+type BatchResult struct {
+	Index    int    `json:"index"`
+	Status   int    `json:"status"`
+	TaskID   string `json:"task_id"`
+	Position int    `json:"position"`
+	Error    string `json:"error"`
+	Code     string `json:"code,omitempty"`
+}
+
+// Queue is the server's task list from GET /queue. Tasks are kept as the
+// server sent them, keyed by ID.
+type Queue struct {
+	Running []string                   `json:"current_task"`
+	Tasks   map[string]json.RawMessage `json:"tasks"`
+}
+
+// QueueState is the response to POST /queue/pause and /queue/resume
+type QueueState struct {
+	Paused    bool     `json:"paused"`
+	QueueSize int      `json:"queue_size"`
+	Running   []string `json:"current_task"`
+}
+
+// ConfirmError is the server's 409 when DELETE /queue needs confirming, or
+// the queue changed since it was confirmed. It says what a clear would
+// remove now.
+type ConfirmError struct {
+	Message string
+	Tasks   int      // The number of unfinished tasks the clear would remove
+	Running []string // The IDs of the running tasks among them
+	Confirm string   // The X-Confirm value that would go ahead
+}
+
+func (e *ConfirmError) Error() string { return e.Message }
+
+// Batch submits several tasks with one POST /batch. Each request is sent as
+// it is, so fields TaskRequest lacks (such as priority) pass through. A 207
+// (some tasks rejected) is not an error; the rejected results carry their
+// own Error. A 429 is returned as a *QueueFullError.
+func (c *Client) Batch(ctx context.Context, reqs []json.RawMessage) ([]BatchResult, error) {
+	body, err := json.Marshal(reqs)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", c.apiKey)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultiStatus {
+		return nil, submitError(resp)
+	}
+
+	var results []BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return results, nil
+}
+
+// Queue lists the server's tasks with GET /queue. query filters them, e.g.
+// status=failed or label=team:checkout; nil lists them all.
+func (c *Client) Queue(ctx context.Context, query url.Values) (*Queue, error) {
+	target := "/queue"
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	resp, err := c.get(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFrom(resp)
+	}
+	var queue Queue
+	if err := json.NewDecoder(resp.Body).Decode(&queue); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return &queue, nil
+}
+
+// Clear clears every task with DELETE /queue, or with a filter (label and
+// provider query parameters) cancels only the matching unfinished ones.
+// confirm is sent as X-Confirm: the number of unfinished tasks the caller
+// agreed to clear, as a ConfirmError's Confirm. Without it, or when it no
+// longer matches, the server refuses with a *ConfirmError saying what would
+// be cleared. It returns the number cleared.
+func (c *Client) Clear(ctx context.Context, filter url.Values, confirm string) (int, error) {
+	target := "/queue"
+	if len(filter) > 0 {
+		target += "?" + filter.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.baseURL+target, nil)
+	if err != nil {
+		return 0, err
+	}
+	if confirm != "" {
+		req.Header.Set("X-Confirm", confirm)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusConflict {
+		var conflict struct {
+			Error   string   `json:"error"`
+			Tasks   int      `json:"tasks"`
+			Running []string `json:"running"`
+			Confirm *int     `json:"confirm"`
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(body, &conflict) != nil || conflict.Error == "" {
+			conflict.Error = "server returned " + resp.Status
+		}
+		if conflict.Confirm == nil {
+			// Older servers: the count to confirm is the task count
+			conflict.Confirm = &conflict.Tasks
+		}
+		return 0, &ConfirmError{Message: conflict.Error, Tasks: conflict.Tasks, Running: conflict.Running, Confirm: strconv.Itoa(*conflict.Confirm)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errorFrom(resp)
+	}
+	var result struct {
+		Cleared int `json:"cleared"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("decoding response: %w", err)
+	}
+	return result.Cleared, nil
+}
+
+// Pause stops the server starting queued tasks, with POST /queue/pause.
+// Running tasks finish.
+func (c *Client) Pause(ctx context.Context) (*QueueState, error) {
+	return c.setPaused(ctx, "/queue/pause")
+}
+
+// Resume starts queued tasks again after Pause, with POST /queue/resume.
+func (c *Client) Resume(ctx context.Context) (*QueueState, error) {
+	return c.setPaused(ctx, "/queue/resume")
+}
+
+func (c *Client) setPaused(ctx context.Context, path string) (*QueueState, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorFrom(resp)
+	}
+	var state QueueState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return &state, nil
+}
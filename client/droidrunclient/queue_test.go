@@ -0,0 +1,108 @@
+package droidrunclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	full := false
+	var gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if full {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = io.WriteString(w, `{"error": "queue is full", "code": "queue_full"}`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.WriteHeader(http.StatusMultiStatus)
+		_, _ = io.WriteString(w, `[{"index": 0, "status": 200, "task_id": "abc"}, {"index": 1, "status": 400, "error": "goal is required"}]`)
+	}))
+	defer srv.Close()
+
+	c := New(WithBaseURL(srv.URL))
+	reqs := []json.RawMessage{json.RawMessage(`{"goal":"a","priority":5}`), json.RawMessage(`{"goal":""}`)}
+	results, err := c.Batch(context.Background(), reqs)
+	if err != nil || len(results) != 2 || results[0].TaskID != "abc" || results[1].Error != "goal is required" {
+		t.Fatalf("expected per-task results from a 207, got %+v, %v", results, err)
+	}
+	if gotBody != `[{"goal":"a","priority":5},{"goal":""}]` {
+		t.Errorf("expected the requests sent as they are, got %s", gotBody)
+	}
+
+	full = true
+	_, err = c.Batch(context.Background(), reqs)
+	var fullErr *QueueFullError
+	if !errors.As(err, &fullErr) || fullErr.RetryAfter != 3*time.Second {
+		t.Errorf("expected a QueueFullError, got %v", err)
+	}
+}
+
+func TestClear(t *testing.T) {
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		if r.Header.Get("X-Confirm") != "2" {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = io.WriteString(w, `{"error": "confirm cancelling 2 tasks", "tasks": 2, "confirm": 2, "running": ["a"]}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"cleared": 2}`)
+	}))
+	defer srv.Close()
+
+	c := New(WithBaseURL(srv.URL))
+	filter := url.Values{"provider": {"Ollama"}}
+	_, err := c.Clear(context.Background(), filter, "")
+	var conflict *ConfirmError
+	if !errors.As(err, &conflict) || conflict.Tasks != 2 || conflict.Confirm != "2" || len(conflict.Running) != 1 || conflict.Message != "confirm cancelling 2 tasks" {
+		t.Fatalf("expected a ConfirmError, got %#v", err)
+	}
+	if gotQuery != "provider=Ollama" {
+		t.Errorf("expected the filter sent, got %q", gotQuery)
+	}
+	if cleared, err := c.Clear(context.Background(), filter, conflict.Confirm); err != nil || cleared != 2 {
+		t.Errorf("Clear: got %d, %v", cleared, err)
+	}
+}
+
+func TestQueueAndPause(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.RequestURI())
+		switch r.URL.Path {
+		case "/queue":
+			_, _ = io.WriteString(w, `{"current_task": ["a"], "tasks": {"a": {"id": "a"}, "b": {"id": "b"}}}`)
+		case "/queue/pause":
+			_, _ = io.WriteString(w, `{"paused": true, "queue_size": 1, "current_task": ["a"]}`)
+		default:
+			_, _ = io.WriteString(w, `{"paused": false, "queue_size": 1, "current_task": ["a"]}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(WithBaseURL(srv.URL))
+	queue, err := c.Queue(context.Background(), url.Values{"status": {"queued,running"}})
+	if err != nil || len(queue.Tasks) != 2 || len(queue.Running) != 1 {
+		t.Errorf("Queue: got %+v, %v", queue, err)
+	}
+	if state, err := c.Pause(context.Background()); err != nil || !state.Paused || state.QueueSize != 1 {
+		t.Errorf("Pause: got %+v, %v", state, err)
+	}
+	if state, err := c.Resume(context.Background()); err != nil || state.Paused {
+		t.Errorf("Resume: got %+v, %v", state, err)
+	}
+	want := []string{"GET /queue?status=queued%2Crunning", "POST /queue/pause", "POST /queue/resume"}
+	if len(paths) != len(want) || paths[0] != want[0] || paths[1] != want[1] || paths[2] != want[2] {
+		t.Errorf("expected requests %v, got %v", want, paths)
+	}
+}
@@ -0,0 +1,55 @@
+package droidrunclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxConnectRetryDelay caps the backoff between connection retries.
+const maxConnectRetryDelay = 30 * time.Second
+
+// Do sends req with the client's server key, retrying as WithConnectRetries
+// set while the server can't be connected to. Only failures to connect are
+// retried: the request never reached the server, so a submission is never
+// sent twice. Any response, including a 4xx, is returned as it is.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.serverKey != "" && req.Header.Get("X-Server-Key") == "" {
+		req.Header.Set("X-Server-Key", c.serverKey)
+	}
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := c.httpClient.Do(req)
+		if err == nil || !isConnectError(err) || attempt > c.retries {
+			return resp, err
+		}
+		if c.retryNotices != nil {
+			fmt.Fprintf(c.retryNotices, "Server unreachable (%v), retrying in %s (%d/%d)\n", err, delay, attempt, c.retries)
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxConnectRetryDelay)
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// isConnectError reports whether err is a failure to connect to the server
+// (refused, unresolvable, or timed out dialling), as opposed to one after
+// the request may have been sent.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Values of -format.
+const (
+	formatText = "text" // Human-readable progress and result (or -quiet JSON)
+	formatJSON = "json" // The final task status as indented JSON
+	formatYAML = "yaml" // The same, as YAML
+)
+
+// statusOutput is the final task status written with -format json or yaml,
+// plus the -timing breakdown when asked for.
+type statusOutput struct {
+	TaskStatus
+	Timing *taskTiming `json:"timing,omitempty"`
+}
+
+// writeStatus writes v in format (json or yaml). YAML is produced from the
+// JSON encoding, so both have the same field names and order.
+func writeStatus(w io.Writer, format string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case formatJSON:
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case formatYAML:
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		blockStyle(&doc)
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// blockStyle clears the flow and quoting styles that parsing JSON leaves on
+// n and its children, so they encode as ordinary block YAML.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// exitCodeOf is the client's exit status for a finished task: 0 if it
+// succeeded, 130 if it was cancelled, and 1 otherwise.
+func exitCodeOf(status TaskStatus) int {
+	switch {
+	case status.Status == "completed" && status.Success:
+		return 0
+	case status.Status == "cancelled":
+		return 130
+	}
+	return 1
+}
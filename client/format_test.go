@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteStatusFormats(t *testing.T) {
+	status := statusOutput{
+		TaskStatus: TaskStatus{
+			ID:      "abc123",
+			Status:  "completed",
+			Success: true,
+			Result:  "Battery: 85%\nCharging",
+			Request: TaskStatusRequest{Goal: "check battery", Provider: "Google"},
+		},
+		Timing: &taskTiming{RunMs: 42000},
+	}
+
+	var buf bytes.Buffer
+	if err := writeStatus(&buf, formatJSON, status); err != nil {
+		t.Fatal(err)
+	}
+	var got TaskStatus
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got.ID != "abc123" || got.Result != status.Result {
+		t.Errorf("expected the status as JSON, got %s (%v)", buf.String(), err)
+	}
+
+	buf.Reset()
+	if err := writeStatus(&buf, formatYAML, status); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"id: abc123\n", "status: completed\n", "success: true\n", "request:\n  goal: check battery\n", "timing:\n", "run_ms: 42000\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected YAML to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "{") || strings.Contains(out, `"status"`) {
+		t.Errorf("expected block-style YAML, got:\n%s", out)
+	}
+}
+
+func TestExitCodeOf(t *testing.T) {
+	for _, tt := range []struct {
+		status TaskStatus
+		want   int
+	}{
+		{TaskStatus{Status: "completed", Success: true}, 0},
+		{TaskStatus{Status: "completed"}, 1},
+		{TaskStatus{Status: "failed"}, 1},
+		{TaskStatus{Status: "skipped"}, 1},
+		{TaskStatus{Status: "cancelled"}, 130},
+	} {
+		if got := exitCodeOf(tt.status); got != tt.want {
+			t.Errorf("%+v: expected exit %d, got %d", tt.status, tt.want, got)
+		}
+	}
+}
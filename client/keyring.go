@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+// keyringService is the OS keyring service name; the server URL is the
+// account, so each server can have its own key.
+const keyringService = "droidrun"
+
+// keyringGet and keyringSet are variables so tests can stub the OS keyring.
+var (
+	keyringGet = func(server string) (string, error) { return keyring.Get(keyringService, server) }
+	keyringSet = func(server, key string) error { return keyring.Set(keyringService, server, key) }
+)
+
+// resolveServerKey picks the server key from, in order: the -server-key flag,
+// the DROIDRUN_SERVER_KEY env var, then the OS keyring. A missing or
+// unavailable keyring just means no key.
+func resolveServerKey(flagKey, envKey, server string) string {
+	if flagKey != "" {
+		return flagKey
+	}
+	if envKey != "" {
+		return envKey
+	}
+	key, err := keyringGet(server)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// storeServerKey reads a key from r (first line) and saves it in the keyring
+// for server.
+func storeServerKey(server string, r io.Reader) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	key := strings.TrimSpace(line)
+	if key == "" {
+		return fmt.Errorf("no key provided on stdin")
+	}
+	if err := keyringSet(server, key); err != nil {
+		return fmt.Errorf("keyring unavailable: %w", err)
+	}
+	return nil
+}
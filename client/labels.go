@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelKeyPattern mirrors the server's rule for label keys.
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// labelFlags collects -label key=value flags.
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	pairs := make([]string, 0, len(l))
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("expected key=value with a key like project or team.name, got %q", s)
+	}
+	l[key] = value
+	return nil
+}
+
+// Get lets -rerun send the labels as an override.
+func (l labelFlags) Get() any { return map[string]string(l) }
+
+// labelQuery adds a label=key=value /queue filter for each label to q.
+func labelQuery(q url.Values, labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		q.Add("label", k+"="+labels[k])
+	}
+}
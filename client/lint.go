@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // Check timezones even where the OS has no zoneinfo
+
+	"github.com/BurntSushi/toml"
+)
+
+// validProviders mirrors the server's provider list.
+var validProviders = map[string]bool{
+	"Google":      true,
+	"GoogleGenAI": true,
+	"Anthropic":   true,
+	"OpenAI":      true,
+	"DeepSeek":    true,
+	"Ollama":      true,
+}
+
+// appPattern and localePattern mirror the server's validation of the app
+// (package or package/activity) and locale fields.
+var (
+	appPattern    = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z0-9_]+)+(/\.?[a-zA-Z_][a-zA-Z0-9_$]*(\.[a-zA-Z_][a-zA-Z0-9_$]*)*)?$`)
+	localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z]{4})?(-([a-zA-Z]{2}|[0-9]{3}))?(-([a-zA-Z0-9]{5,8}|[0-9][a-zA-Z0-9]{3}))*$`)
+)
+
+// maxSetupSteps mirrors the server's limit on setup steps.
+const maxSetupSteps = 10
+
+// taskProblem is a validation failure in a task file field.
+type taskProblem struct {
+	Field string // TOML key path, e.g. task.goal.prompt
+	Msg   string
+}
+
+func (p taskProblem) String() string {
+	return p.Field + ": " + p.Msg
+}
+
+// validateTaskConfig checks a task file the way the server would check the
+// request built from it, so mistakes surface before anything is submitted.
+func validateTaskConfig(tc TaskConfig) []taskProblem {
+	var problems []taskProblem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, taskProblem{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(tc.Goal.Prompt) == "" {
+		add("task.goal.prompt", "required")
+	}
+	// Fields with ${NAME} references are checked once expanded, when the
+	// task is run
+	if tc.Goal.App != "" && !hasVarRef(tc.Goal.App) && !appPattern.MatchString(tc.Goal.App) {
+		add("task.goal.app", "invalid app package %q (want com.example.app or com.example.app/.Activity)", tc.Goal.App)
+	}
+	if tc.Goal.Deeplink != "" && !hasVarRef(tc.Goal.Deeplink) && !strings.Contains(tc.Goal.Deeplink, "://") {
+		add("task.goal.deeplink", "invalid deeplink %q (must contain ://)", tc.Goal.Deeplink)
+	}
+	for i, s := range tc.Goal.Setup {
+		field := fmt.Sprintf("task.goal.setup[%d]", i)
+		switch {
+		case (s.App == "") == (s.Deeplink == ""):
+			add(field, "needs exactly one of app or deeplink")
+		case s.App != "" && !hasVarRef(s.App) && !appPattern.MatchString(s.App):
+			add(field+".app", "invalid app package %q (want com.example.app or com.example.app/.Activity)", s.App)
+		case s.Deeplink != "" && !hasVarRef(s.Deeplink) && !strings.Contains(s.Deeplink, "://"):
+			add(field+".deeplink", "invalid deeplink %q (must contain ://)", s.Deeplink)
+		}
+	}
+	if len(tc.Goal.Setup) > maxSetupSteps {
+		add("task.goal.setup", "%d steps, max %d", len(tc.Goal.Setup), maxSetupSteps)
+	}
+	for k := range tc.Labels {
+		if !labelKeyPattern.MatchString(k) {
+			add("task.labels", "invalid label key %q (want letters, digits, _ . -)", k)
+		}
+	}
+	if tc.Model.Provider != "" && !validProviders[tc.Model.Provider] {
+		add("task.model.provider", "invalid provider %q (valid: Google, Anthropic, OpenAI, DeepSeek, Ollama)", tc.Model.Provider)
+	}
+	if tc.Model.BaseURL != "" {
+		if u, err := url.Parse(tc.Model.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("task.model.base_url", "invalid base_url %q (want an http or https URL)", tc.Model.BaseURL)
+		}
+	}
+	if tc.Options.MaxSteps < 0 || tc.Options.MaxSteps > 100 {
+		add("task.options.max_steps", "must be between 1 and 100, got %d", tc.Options.MaxSteps)
+	}
+	if tc.Options.Locale != "" && !localePattern.MatchString(tc.Options.Locale) {
+		add("task.options.locale", "invalid locale %q (want a BCP-47 tag like en-US)", tc.Options.Locale)
+	}
+	if tc.Options.Timezone != "" {
+		if _, err := time.LoadLocation(tc.Options.Timezone); err != nil || tc.Options.Timezone == "Local" {
+			add("task.options.timezone", "invalid timezone %q (want an IANA name like Europe/Berlin)", tc.Options.Timezone)
+		}
+	}
+	if tc.Assert.Regex != "" {
+		if _, err := regexp.Compile(tc.Assert.Regex); err != nil {
+			add("task.assert.regex", "invalid regex: %v", err)
+		}
+	}
+	return problems
+}
+
+// lintTaskFile parses a task file and validates it. Unknown keys are
+// reported too, since they are usually typos the client would ignore.
+func lintTaskFile(path string) ([]taskProblem, error) {
+	var tf TaskFile
+	md, err := toml.DecodeFile(path, &tf)
+	if err != nil {
+		return nil, err
+	}
+	problems := validateTaskConfig(tf.Task)
+	for _, key := range md.Undecoded() {
+		problems = append(problems, taskProblem{Field: key.String(), Msg: "unknown field"})
+	}
+	return problems, nil
+}
+
+// lintPaths lints each file, and every .toml file under each directory,
+// writing one "file: field: problem" line per problem to out. It reports
+// whether everything passed.
+func lintPaths(paths []string, out io.Writer) (bool, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return false, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		err = filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(path, ".toml") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	sort.Strings(files)
+
+	ok := true
+	for _, file := range files {
+		problems, err := lintTaskFile(file)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %v\n", file, err)
+			ok = false
+			continue
+		}
+		for _, p := range problems {
+			fmt.Fprintf(out, "%s: %s\n", file, p)
+			ok = false
+		}
+	}
+	return ok, nil
+}
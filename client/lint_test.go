@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintValidTaskFile(t *testing.T) {
+	problems, err := lintTaskFile("testdata/lint/valid.toml")
+	if err != nil {
+		t.Fatalf("lintTaskFile: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func TestLintInvalidTaskFile(t *testing.T) {
+	var out strings.Builder
+	ok, err := lintPaths([]string{"testdata/lint/invalid.toml"}, &out)
+	if err != nil {
+		t.Fatalf("lintPaths: %v", err)
+	}
+	if ok {
+		t.Fatal("expected lint to fail")
+	}
+	for _, field := range []string{
+		"task.labels",
+		"task.goal.prompt",
+		"task.goal.app",
+		"task.goal.deeplink",
+		"task.goal.setup[0]: needs exactly one of app or deeplink",
+		"task.goal.setup[1].app",
+		"task.model.provider",
+		"task.model.base_url",
+		"task.options.max_steps",
+		"task.options.timezone",
+		"task.options.max_retries: unknown field",
+		"task.assert.regex",
+	} {
+		if !strings.Contains(out.String(), "testdata/lint/invalid.toml: "+field) {
+			t.Errorf("expected a problem for %s, got:\n%s", field, out.String())
+		}
+	}
+}
+
+func TestLintDirectory(t *testing.T) {
+	var out strings.Builder
+	ok, err := lintPaths([]string{"testdata/lint"}, &out)
+	if err != nil {
+		t.Fatalf("lintPaths: %v", err)
+	}
+	if ok {
+		t.Error("expected lint to fail")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if !strings.HasPrefix(line, "testdata/lint/invalid.toml: ") {
+			t.Errorf("expected only invalid.toml to fail, got %q", line)
+		}
+	}
+
+	// The task files shipped with the repo must stay valid
+	out.Reset()
+	if ok, err := lintPaths([]string{"../tasks"}, &out); err != nil || !ok {
+		t.Errorf("shipped tasks failed lint (err %v):\n%s", err, out.String())
+	}
+}
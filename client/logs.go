@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// tailLogs writes task id's worker logs to out. With follow it keeps
+// fetching what's new every interval until the task has finished, riding
+// out server restarts as pollStatus does; notices get reconnection and
+// truncation messages.
+func tailLogs(server, srvKey, id string, follow bool, grace time.Duration, interval func() time.Duration, out, notices io.Writer) error {
+	c := serverClient(server, srvKey)
+	down := reconnecting{grace: grace, notices: notices}
+	offset := 0
+	for {
+		logs, err := c.Logs(context.Background(), id, offset)
+		if err != nil {
+			if !follow {
+				return err
+			}
+			if err := down.failed(err); err != nil {
+				return err
+			}
+			time.Sleep(interval())
+			continue
+		}
+		down.reconnected()
+
+		if logs.Size < offset {
+			// Cut to -max-output when the worker exited, without -steps-dir
+			// to keep them whole: what's left was already shown
+			fmt.Fprintf(notices, "\n[logs truncated by the server; see GET /task/%s/logs]\n", id)
+		} else if _, err := io.WriteString(out, logs.Text); err != nil {
+			return err
+		}
+		offset = logs.Size
+		if follow && logs.Status == "" {
+			return fmt.Errorf("the server is too old to follow logs (no X-Task-Status)")
+		}
+		if !follow || logs.Done() {
+			return nil
+		}
+		time.Sleep(interval())
+	}
+}
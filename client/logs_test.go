@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTailLogsFollow(t *testing.T) {
+	// The worker writes a line per request; the third request fails as if
+	// the server were restarting
+	lines := []string{"starting\n", "tapping\n", "", "done\n"}
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		logs := strings.Join(lines[:calls], "")
+		status := "running"
+		if calls == len(lines) {
+			status = "completed"
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		w.Header().Set("X-Log-Size", strconv.Itoa(len(logs)))
+		w.Header().Set("X-Task-Status", status)
+		_, _ = io.WriteString(w, logs[offset:])
+	}))
+	defer srv.Close()
+
+	var out, notices strings.Builder
+	interval := func() time.Duration { return time.Millisecond }
+	if err := tailLogs(srv.URL, "", "abc123", true, 5*time.Second, interval, &out, &notices); err != nil {
+		t.Fatalf("tailLogs: %v", err)
+	}
+	if out.String() != "starting\ntapping\ndone\n" {
+		t.Errorf("expected each line once, got %q", out.String())
+	}
+	if !strings.Contains(notices.String(), "server unreachable, retrying") {
+		t.Errorf("expected a reconnect notice, got %q", notices.String())
+	}
+}
+
+func TestTailLogsOnce(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/task/abc123/logs" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"error": "task not found"}`)
+			return
+		}
+		w.Header().Set("X-Log-Size", "6")
+		w.Header().Set("X-Task-Status", "running")
+		_, _ = io.WriteString(w, "so far")
+	}))
+	defer srv.Close()
+
+	interval := func() time.Duration { return time.Millisecond }
+	var out strings.Builder
+	if err := tailLogs(srv.URL, "", "abc123", false, 0, interval, &out, io.Discard); err != nil || out.String() != "so far" {
+		t.Errorf("expected the logs so far without following, got %q, %v", out.String(), err)
+	}
+	if err := tailLogs(srv.URL, "", "gone", true, 0, interval, io.Discard, io.Discard); err == nil || err.Error() != "task not found" {
+		t.Errorf("expected the server's 404 without retrying, got %v", err)
+	}
+}
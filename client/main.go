@@ -1,17 +1,24 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
+	"maps"
+	"math/rand"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
+	"droidrun-client/droidrunclient"
 	"github.com/BurntSushi/toml"
 )
 
@@ -24,87 +31,174 @@ type TaskFile struct {
 }
 
 type TaskConfig struct {
-	Name        string      `toml:"name"`
-	Description string      `toml:"description"`
-	Goal        GoalConfig  `toml:"goal"`
-	Model       ModelConfig `toml:"model"`
-	Options     Options     `toml:"options"`
+	Name        string            `toml:"name"`
+	Description string            `toml:"description"`
+	Labels      map[string]string `toml:"labels"` // key/values to find the task by later
+	Goal        GoalConfig        `toml:"goal"`
+	Model       ModelConfig       `toml:"model"`
+	Options     Options           `toml:"options"`
+	Assert      AssertConfig      `toml:"assert"`
 }
 
 type GoalConfig struct {
-	Prompt   string `toml:"prompt"`
-	App      string `toml:"app"`      // package name to launch first
-	Deeplink string `toml:"deeplink"` // deep link URI to open (e.g. instagram://mainfeed)
+	Prompt   string        `toml:"prompt"`
+	App      string        `toml:"app"`      // package name to launch first
+	Deeplink string        `toml:"deeplink"` // deep link URI to open (e.g. instagram://mainfeed)
+	Setup    []SetupConfig `toml:"setup"`    // apps to launch and deep links to open, in order, after app and deeplink
 }
 
-type ModelConfig struct {
-	Provider string `toml:"provider"`
-	Model    string `toml:"model"`
+// SetupConfig is a [[task.goal.setup]] step: app or deeplink, not both
+type SetupConfig struct {
+	App      string `toml:"app"`
+	Deeplink string `toml:"deeplink"`
 }
 
-type Options struct {
-	Reasoning bool `toml:"reasoning"`
-	Vision    bool `toml:"vision"`
-	MaxSteps  int  `toml:"max_steps"`
+// AssertConfig declares what a successful result must contain; the server
+// marks the task unsuccessful when the result doesn't match.
+type AssertConfig struct {
+	Contains string `toml:"contains"`
+	Regex    string `toml:"regex"`
 }
 
-// API structs
-type TaskRequest struct {
-	Goal      string `json:"goal"`
-	App       string `json:"app,omitempty"`
-	Deeplink  string `json:"deeplink,omitempty"`
-	Provider  string `json:"provider,omitempty"`
-	Model     string `json:"model,omitempty"`
-	Reasoning bool   `json:"reasoning"`
-	Vision    bool   `json:"vision"`
-	MaxSteps  int    `json:"max_steps,omitempty"`
-}
-
-type SubmitResponse struct {
-	TaskID   string `json:"task_id"`
-	Status   string `json:"status"`
-	Position int    `json:"position"`
+type ModelConfig struct {
+	Provider string `toml:"provider"`
+	Model    string `toml:"model"`
+	BaseURL  string `toml:"base_url"` // provider endpoint, e.g. a remote Ollama
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+type Options struct {
+	Reasoning bool   `toml:"reasoning"`
+	Vision    bool   `toml:"vision"`
+	MaxSteps  int    `toml:"max_steps"`
+	Cacheable bool   `toml:"cacheable"` // reuse a recent identical successful result
+	Locale    string `toml:"locale"`    // BCP-47 tag, e.g. en-US
+	Timezone  string `toml:"timezone"`  // IANA zone, e.g. Europe/Berlin
 }
 
-type TaskStatus struct {
-	ID         string `json:"id"`
-	Status     string `json:"status"`
-	Success    bool   `json:"success"`
-	Result     string `json:"result"`
-	Error      string `json:"error"`
-	Logs       string `json:"logs"`
-	Steps      any    `json:"steps"`
-	CreatedAt  string `json:"created_at"`
-	StartedAt  string `json:"started_at"`
-	FinishedAt string `json:"finished_at"`
-}
+// API structs, shared with the droidrunclient package
+type (
+	TaskRequest       = droidrunclient.TaskRequest
+	RunCondition      = droidrunclient.RunCondition
+	SetupStep         = droidrunclient.SetupStep
+	SubmitResponse    = droidrunclient.SubmitResponse
+	ErrorResponse     = droidrunclient.ErrorResponse
+	TaskStatus        = droidrunclient.TaskStatus
+	TaskStatusRequest = droidrunclient.TaskStatusRequest
+	BatchResult       = droidrunclient.BatchResult
+	TaskEvent         = droidrunclient.TaskEvent
+	TaskSummary       = droidrunclient.TaskSummary
+	TimelineStep      = droidrunclient.TimelineStep
+)
 
 func main() {
 	server := flag.String("server", "http://localhost:8000", "Server URL")
-	provider := flag.String("provider", "", "LLM provider (overrides task file)")
+	provider := flag.String("provider", "", "LLM provider (overrides task file). With -clear, only tasks for this provider")
 	model := flag.String("model", "", "Model name (overrides task file)")
+	baseURL := flag.String("base-url", "", "Provider API endpoint, e.g. http://gpu-box:11434 for a remote Ollama or an OpenAI-compatible gateway (overrides task file; needs your own key)")
 	reasoning := flag.Bool("reasoning", true, "Use reasoning mode")
 	vision := flag.Bool("vision", false, "Use vision mode")
 	maxSteps := flag.Int("steps", 30, "Max steps")
 	apiKey := flag.String("key", "", "API key (or set env var based on provider)")
+	apiKeyFile := flag.String("key-file", "", "Read API key from file (avoids exposing it in process listings)")
 	taskFile := flag.String("task", "", "Task file (TOML)")
+	taskVars := varFlags{}
+	flag.Var(taskVars, "var", "Set a ${name} variable used in the task file's prompt, app, and deeplink, as name=value (repeatable; overrides the environment)")
 	appPkg := flag.String("app", "", "App package to launch first (e.g. com.whatsapp)")
 	deeplink := flag.String("deeplink", "", "Deep link URI to open (e.g. instagram://mainfeed)")
+	locale := flag.String("locale", "", "Locale for the task as a BCP-47 tag (e.g. en-US; overrides task file)")
+	labels := labelFlags{}
+	flag.Var(labels, "label", "Tag the task with key=value, e.g. project=alpha (repeatable; overrides task file). With -list or -clear, only tasks with these labels")
+	timezone := flag.String("timezone", "", "Timezone for the task as an IANA name (e.g. Europe/Berlin; overrides task file)")
+	cacheable := flag.Bool("cacheable", false, "Allow the server to reuse a recent identical successful result")
+	runIf := flag.String("run-if", "", "Run only after another task finishes, as task_id[:success|failure|completed]")
+	downloadArtifacts := flag.String("download-artifacts", "", "Download a task's artifacts (task.json, logs, steps) as <id>-artifacts.zip, or to -o, and exit")
+	outPath := flag.String("o", "", "Output path for -download-artifacts")
 	deeplinksApp := flag.String("deeplinks", "", "Discover deep links for an app package (e.g. com.instagram.android)")
-	clearTasks := flag.Bool("clear", false, "Clear all tasks from server queue")
+	list := flag.Bool("list", false, "List the server's tasks, oldest first, and exit (the raw JSON array with -quiet)")
+	listStatus := flag.String("list-status", "", "With -list, show only tasks in these states (comma-separated, e.g. running,failed)")
+	timelineID := flag.String("timeline", "", "Print a task's steps by ID as a timeline and exit (the steps JSON with -quiet)")
+	logsID := flag.String("logs", "", "Print a task's worker logs (stderr) by ID and exit")
+	follow := flag.Bool("follow", false, "With -logs, keep printing new log lines as the task runs until it finishes")
+	summaryID := flag.String("summary", "", "Print a one-line summary of a task by ID and exit (the summary JSON with -quiet)")
+	clearTasks := flag.Bool("clear", false, "Clear all tasks from server queue, including running ones (asks first unless -yes)")
+	yes := flag.Bool("yes", false, "Don't ask for confirmation with -clear")
+	pause := flag.Bool("pause", false, "Pause the server's queue so no more tasks start (running ones finish), and exit")
+	resume := flag.Bool("resume", false, "Resume the server's queue after -pause, and exit")
+	batchFile := flag.String("batch", "", "Submit the JSON array of task requests in this file in one request, print each task ID, and exit")
+	rerun := flag.String("rerun", "", "Resubmit an existing task by ID; -provider, -model, -steps and other set flags override its request")
+	watch := flag.String("watch", "", "Watch existing tasks (comma-separated IDs) until they all finish")
+	stream := flag.Bool("stream", false, "Follow the task over a Server-Sent Events stream instead of polling (falls back to polling if the server lacks it)")
+	pollInterval := flag.Duration("poll-interval", 2*time.Second, "How often to poll for task status")
+	reconnectGrace := flag.Duration("reconnect-grace", 0, "Give up if the server stays unreachable this long while waiting (0 = keep retrying)")
+	pollJitter := flag.Float64("poll-jitter", 0.25, "Randomize each poll interval by up to this fraction (0-1) to spread load")
+	reportPath := flag.String("report", "", "Write a self-contained HTML report of the finished task to this path")
+	retryFull := flag.Int("retry-full", 0, "Retry a submission up to this many times while the server is busy (429, e.g. its queue is full)")
+	retries := flag.Int("retries", connectRetries, "Retry submitting (and -clear, -deeplinks) up to this many times while the server can't be connected to, backing off exponentially (0 = fail at once)")
+	retryDelay := flag.Duration("retry-delay", connectRetryDelay, "Wait before the first -retries attempt, doubling for each one after (up to 30s)")
+	retryFullDelay := flag.Duration("retry-full-delay", 10*time.Second, "Wait between -retry-full attempts when the server doesn't send Retry-After")
+	detach := flag.Bool("detach", false, "Submit the task, print its ID (JSON with -quiet), and exit without waiting for it")
+	showTiming := flag.Bool("timing", false, "Print how long submission, queue wait, and execution took (a \"timing\" field with -quiet)")
 	quiet := flag.Bool("quiet", false, "Quiet mode - minimal output for scripting")
+	format := flag.String("format", formatText, "Output of a finished task: text, or json or yaml for its full status (with no progress output); the exit status is the same")
+	showStatus := flag.Bool("status", false, "Print the server's one-line status and exit")
 	showVersion := flag.Bool("version", false, "Show version and exit")
-	serverKey := flag.String("server-key", "", "Server authentication key (or DROIDRUN_SERVER_KEY env)")
+	lint := flag.Bool("lint", false, "Validate the task files or directories given as arguments without a server, and exit")
+	serverKey := flag.String("server-key", "", "Server authentication key (or DROIDRUN_SERVER_KEY env, or the OS keyring)")
+	keyringSetFlag := flag.Bool("keyring-set", false, "Read a server key from stdin, store it in the OS keyring for -server, and exit")
+	keyringGetFlag := flag.Bool("keyring-get", false, "Print the server key stored in the OS keyring for -server, and exit")
 	flag.Parse()
 
-	// Get server key from flag or env
-	srvKey := *serverKey
-	if srvKey == "" {
-		srvKey = os.Getenv("DROIDRUN_SERVER_KEY")
+	// Handle -keyring-set / -keyring-get
+	if *keyringSetFlag {
+		if err := storeServerKey(*server, os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Server key stored in keyring for %s\n", *server)
+		os.Exit(0)
+	}
+	if *keyringGetFlag {
+		key, err := keyringGet(*server)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: no server key in keyring for %s: %v\n", *server, err)
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		os.Exit(0)
+	}
+
+	switch *format {
+	case formatText, formatJSON, formatYAML:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -format %q (expected text, json, or yaml)\n", *format)
+		os.Exit(1)
+	}
+	if *format != formatText {
+		// Keep stdout to the one document
+		*quiet = true
+	}
+	if *retries < 0 || *retryDelay <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -retries must be 0 or more and -retry-delay positive\n")
+		os.Exit(1)
+	}
+	connectRetries, connectRetryDelay = *retries, *retryDelay
+
+	// Get server key from flag, env, or keyring
+	srvKey := resolveServerKey(*serverKey, os.Getenv("DROIDRUN_SERVER_KEY"), *server)
+	opts := waitOptions{
+		server:         *server,
+		srvKey:         srvKey,
+		quiet:          *quiet,
+		detach:         *detach,
+		stream:         *stream,
+		showTiming:     *showTiming,
+		format:         *format,
+		reportPath:     *reportPath,
+		pollInterval:   *pollInterval,
+		pollJitter:     *pollJitter,
+		reconnectGrace: *reconnectGrace,
+		retryFull:      *retryFull,
+		retryFullDelay: *retryFullDelay,
 	}
 
 	// Handle -version flag
@@ -113,92 +207,350 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Handle -lint flag
+	if *lint {
+		if flag.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "Usage: droidrun-client -lint <file-or-dir>...")
+			os.Exit(1)
+		}
+		ok, err := lintPaths(flag.Args(), os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		if !*quiet {
+			fmt.Println("All task files OK")
+		}
+		os.Exit(0)
+	}
+
+	// Handle -status flag
+	if *showStatus {
+		line, err := fetchStatus(*server)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(line)
+		os.Exit(0)
+	}
+
+	// Handle -list flag
+	if *list {
+		tasks, err := listTasks(*server, srvKey, *listStatus, labels)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *quiet {
+			output, _ := json.Marshal(tasks)
+			fmt.Println(string(output))
+			os.Exit(0)
+		}
+		if len(tasks) == 0 {
+			fmt.Println("No tasks")
+			os.Exit(0)
+		}
+		writeTaskList(os.Stdout, tasks)
+		os.Exit(0)
+	}
+
+	// Handle -logs flag
+	if *follow && *logsID == "" {
+		fmt.Fprintln(os.Stderr, "Error: -follow needs -logs <task_id>")
+		os.Exit(1)
+	}
+	if *logsID != "" {
+		interval := func() time.Duration { return jitter(*pollInterval, *pollJitter) }
+		if err := tailLogs(*server, srvKey, *logsID, *follow, *reconnectGrace, interval, os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Handle -summary flag
+	if *summaryID != "" {
+		summary, err := fetchSummary(*server, srvKey, *summaryID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *quiet {
+			output, _ := json.Marshal(summary)
+			fmt.Println(string(output))
+		} else {
+			fmt.Println(summary.Text)
+		}
+		os.Exit(0)
+	}
+
+	// Handle -timeline flag
+	if *timelineID != "" {
+		steps, err := fetchTimeline(*server, srvKey, *timelineID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *quiet {
+			output, _ := json.Marshal(steps)
+			fmt.Println(string(output))
+			os.Exit(0)
+		}
+		writeTimeline(os.Stdout, steps)
+		os.Exit(0)
+	}
+
 	// Handle -clear flag
 	if *clearTasks {
-		req, _ := http.NewRequest("DELETE", *server+"/queue", nil)
-		if srvKey != "" {
-			req.Header.Set("X-Server-Key", srvKey)
+		// With -label or -provider, only the matching unfinished tasks are
+		// cancelled
+		filter := url.Values{}
+		labelQuery(filter, labels)
+		if *provider != "" {
+			filter.Set("provider", *provider)
 		}
-		resp, err := http.DefaultClient.Do(req)
+		verb, done := "Clear", "Cleared"
+		if len(filter) > 0 {
+			verb, done = "Cancel", "Cancelled"
+		}
+		confirm := func(tasks int, running []string) bool {
+			fmt.Printf("%s %d tasks (%d running) on %s? [y/N] ", verb, tasks, len(running), *server)
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			return answer == "y" || answer == "yes"
+		}
+		cleared, err := clearQueue(*server, srvKey, filter, *yes, confirm)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		defer func() { _ = resp.Body.Close() }()
-		var result map[string]any
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			fmt.Fprintf(os.Stderr, "Error decoding response: %v\n", err)
+		if cleared < 0 {
+			fmt.Println("Not cleared")
 			os.Exit(1)
 		}
 		if !*quiet {
-			fmt.Printf("Cleared %v tasks\n", result["cleared"])
+			fmt.Printf("%s %d tasks\n", done, cleared)
 		}
 		os.Exit(0)
 	}
 
-	// Handle -deeplinks flag: discover deep links for an app
-	if *deeplinksApp != "" {
-		dlReq, _ := http.NewRequest("GET", *server+"/deeplinks?app="+*deeplinksApp, nil)
-		if srvKey != "" {
-			dlReq.Header.Set("X-Server-Key", srvKey)
+	// Handle -pause / -resume
+	if *pause || *resume {
+		if *pause && *resume {
+			fmt.Fprintln(os.Stderr, "Error: -pause and -resume are exclusive")
+			os.Exit(1)
 		}
-		dlResp, err := http.DefaultClient.Do(dlReq)
+		state, err := setQueuePaused(*server, srvKey, *pause)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		defer func() { _ = dlResp.Body.Close() }()
-
-		if dlResp.StatusCode != http.StatusOK {
-			var errResp ErrorResponse
-			bodyBytes, _ := io.ReadAll(dlResp.Body)
-			if json.Unmarshal(bodyBytes, &errResp) == nil && errResp.Error != "" {
-				fmt.Fprintf(os.Stderr, "Error: %s\n", errResp.Error)
-			} else {
-				fmt.Fprintf(os.Stderr, "Error: %s\n", string(bodyBytes))
+		if !*quiet {
+			verb := "resumed"
+			if state.Paused {
+				verb = "paused"
 			}
-			os.Exit(1)
+			fmt.Printf("Queue %s (%d queued, %d running)\n", verb, state.QueueSize, len(state.Running))
 		}
+		os.Exit(0)
+	}
 
-		var dlResult struct {
-			App       string   `json:"app"`
-			Deeplinks []string `json:"deeplinks"`
+	// Handle -download-artifacts flag
+	if *downloadArtifacts != "" {
+		path := *outPath
+		if path == "" {
+			path = *downloadArtifacts + "-artifacts.zip"
+		}
+		if err := fetchArtifacts(*server, srvKey, *downloadArtifacts, path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !*quiet {
+			fmt.Printf("Artifacts: %s\n", path)
 		}
-		if err := json.NewDecoder(dlResp.Body).Decode(&dlResult); err != nil {
-			fmt.Fprintf(os.Stderr, "Error decoding response: %v\n", err)
+		os.Exit(0)
+	}
+
+	// Handle -deeplinks flag: discover deep links for an app
+	if *deeplinksApp != "" {
+		deeplinks, err := newClient(*server, srvKey, "").Deeplinks(context.Background(), *deeplinksApp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
-		fmt.Printf("Deep links for %s:\n", dlResult.App)
-		if len(dlResult.Deeplinks) == 0 {
+		fmt.Printf("Deep links for %s:\n", *deeplinksApp)
+		if len(deeplinks) == 0 {
 			fmt.Println("  (none found)")
 		}
-		for _, dl := range dlResult.Deeplinks {
+		for _, dl := range deeplinks {
 			fmt.Printf("  %s\n", dl)
 		}
 		os.Exit(0)
 	}
 
-	var goal, prov, mod, app, dl string
-	var reason, vis bool
+	// Handle -watch flag: stream progress of several tasks on one connection
+	if *watch != "" {
+		if !*quiet {
+			if line, err := fetchStatus(*server); err == nil {
+				fmt.Printf("Server:  %s\n", line)
+			}
+			if msg, err := fetchHealthMessage(*server); err == nil && msg != "" {
+				fmt.Printf("Notice:  %s\n", msg)
+			}
+		}
+		ok, err := watchTasks(*server, srvKey, strings.Split(*watch, ","), *quiet)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if ok {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	// Handle -batch flag: submit many tasks at once without waiting for them
+	if *batchFile != "" {
+		data, err := os.ReadFile(*batchFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		var reqs []json.RawMessage
+		if err := json.Unmarshal(data, &reqs); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: expected a JSON array of tasks: %v\n", *batchFile, err)
+			os.Exit(1)
+		}
+		prov := *provider
+		if prov == "" {
+			var first TaskRequest
+			if len(reqs) > 0 {
+				_ = json.Unmarshal(reqs[0], &first)
+			}
+			prov = first.Provider
+		}
+		if prov == "" {
+			prov, _ = defaultModel(os.Getenv("DROIDRUN_PROVIDER"), "")
+		}
+		key, err := resolveAPIKey(*apiKey, *apiKeyFile, prov)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		results, err := submitBatch(*server, srvKey, key, reqs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		failed := 0
+		for _, res := range results {
+			if res.Error != "" {
+				failed++
+			}
+		}
+		if *quiet {
+			output, _ := json.Marshal(results)
+			fmt.Println(string(output))
+		} else {
+			for _, res := range results {
+				if res.Error != "" {
+					fmt.Printf("#%-3d    error: %s\n", res.Index, res.Error)
+				} else {
+					fmt.Printf("#%-3d    %s (position: %d)\n", res.Index, res.TaskID, res.Position)
+				}
+			}
+			fmt.Printf("Queued %d of %d tasks\n", len(results)-failed, len(results))
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Handle -rerun flag: resubmit a task with the explicitly set flags as overrides
+	if *rerun != "" {
+		overrides := map[string]any{}
+		for name, field := range map[string]string{
+			"provider": "provider", "model": "model", "steps": "max_steps",
+			"reasoning": "reasoning", "vision": "vision", "app": "app",
+			"deeplink": "deeplink", "locale": "locale", "timezone": "timezone",
+			"cacheable": "cacheable", "base-url": "base_url", "label": "labels",
+		} {
+			if flagSet(name) {
+				overrides[field] = flag.Lookup(name).Value.(flag.Getter).Get()
+			}
+		}
+		prov := *provider
+		if prov == "" {
+			orig, err := fetchTask(*server, srvKey, *rerun)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			prov = orig.Request.Provider
+		}
+		key, err := resolveAPIKey(*apiKey, *apiKeyFile, prov)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.rerunOf = *rerun
+		os.Exit(submitAndWait(opts, func() (*SubmitResponse, error) {
+			return rerunTask(*server, srvKey, key, *rerun, overrides)
+		}))
+	}
+
+	var goal, prov, mod, base, app, dl, loc, tz string
+	var assertion AssertConfig
+	var reason, cache bool
+	var vis *bool
+	var taskLabels map[string]string
+	var setup []SetupStep
 	var steps int
 
 	if *taskFile != "" {
 		// Load from task file
 		var tf TaskFile
-		if _, err := toml.DecodeFile(*taskFile, &tf); err != nil {
+		md, err := toml.DecodeFile(*taskFile, &tf)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error loading task file: %v\n", err)
 			os.Exit(1)
 		}
+		if err := expandGoalVars(&tf.Task.Goal, taskVars.lookupVar); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", *taskFile, err)
+			os.Exit(1)
+		}
+		if problems := validateTaskConfig(tf.Task); len(problems) > 0 {
+			for _, p := range problems {
+				fmt.Fprintf(os.Stderr, "Error: %s: %s\n", *taskFile, p)
+			}
+			os.Exit(1)
+		}
 
 		goal = tf.Task.Goal.Prompt
 		app = tf.Task.Goal.App
 		dl = tf.Task.Goal.Deeplink
+		for _, s := range tf.Task.Goal.Setup {
+			setup = append(setup, SetupStep{App: s.App, Deeplink: s.Deeplink})
+		}
 		prov = tf.Task.Model.Provider
 		mod = tf.Task.Model.Model
+		base = tf.Task.Model.BaseURL
 		reason = tf.Task.Options.Reasoning
-		vis = tf.Task.Options.Vision
+		if md.IsDefined("task", "options", "vision") {
+			vis = &tf.Task.Options.Vision
+		}
 		steps = tf.Task.Options.MaxSteps
+		cache = tf.Task.Options.Cacheable
+		loc = tf.Task.Options.Locale
+		tz = tf.Task.Options.Timezone
+		assertion = tf.Task.Assert
+		taskLabels = tf.Task.Labels
 
 		if steps == 0 {
 			steps = 30
@@ -222,10 +574,11 @@ func main() {
 		}
 
 		goal = flag.Arg(0)
-		prov = "Google"
-		mod = "gemini-2.0-flash"
+		prov, mod = defaultModel(os.Getenv("DROIDRUN_PROVIDER"), os.Getenv("DROIDRUN_MODEL"))
 		reason = *reasoning
-		vis = *vision
+		if flagSet("vision") {
+			vis = vision
+		}
 		steps = *maxSteps
 	}
 
@@ -236,99 +589,157 @@ func main() {
 	if *model != "" {
 		mod = *model
 	}
+	if *baseURL != "" {
+		base = *baseURL
+	}
 	if *appPkg != "" {
 		app = *appPkg
 	}
 	if *deeplink != "" {
 		dl = *deeplink
 	}
-
-	// Get API key from flag or env
-	key := *apiKey
-	if key == "" {
-		switch prov {
-		case "Google", "GoogleGenAI":
-			key = os.Getenv("GOOGLE_API_KEY")
-		case "Anthropic":
-			key = os.Getenv("ANTHROPIC_API_KEY")
-		case "OpenAI":
-			key = os.Getenv("OPENAI_API_KEY")
-		case "DeepSeek":
-			key = os.Getenv("DEEPSEEK_API_KEY")
-		case "Ollama":
-			// Ollama doesn't need an API key
+	if *cacheable {
+		cache = true
+	}
+	if len(labels) > 0 {
+		if taskLabels == nil {
+			taskLabels = map[string]string{}
 		}
+		for k, v := range labels {
+			taskLabels[k] = v
+		}
+	}
+	if *locale != "" {
+		loc = *locale
+	}
+	if *timezone != "" {
+		tz = *timezone
 	}
 
-	if key == "" && prov != "Ollama" {
-		fmt.Fprintln(os.Stderr, "Error: API key required (-key flag or env var)")
+	// Get API key from flag, key file, or env
+	key, err := resolveAPIKey(*apiKey, *apiKeyFile, prov)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	if !*quiet {
+	if !*quiet && !*detach {
 		fmt.Printf("Server:  %s\n", *server)
-		fmt.Printf("Model:   %s/%s\n", prov, mod)
+		if msg, err := fetchHealthMessage(*server); err == nil && msg != "" {
+			fmt.Printf("Notice:  %s\n", msg)
+		}
+		if mod == "" {
+			fmt.Printf("Model:   %s (server default)\n", prov)
+		} else {
+			fmt.Printf("Model:   %s/%s\n", prov, mod)
+		}
+		if base != "" {
+			fmt.Printf("Base:    %s\n", base)
+		}
 		if app != "" {
 			fmt.Printf("App:     %s\n", app)
 		}
 		if dl != "" {
 			fmt.Printf("Link:    %s\n", dl)
 		}
+		for _, s := range setup {
+			if s.App != "" {
+				fmt.Printf("Setup:   %s\n", s.App)
+			} else {
+				fmt.Printf("Setup:   %s\n", s.Deeplink)
+			}
+		}
 		fmt.Printf("Goal:    %s\n\n", truncate(goal, 60))
 	}
 
 	// Submit task (without API key in body)
 	req := TaskRequest{
-		Goal:      goal,
-		App:       app,
-		Deeplink:  dl,
-		Provider:  prov,
-		Model:     mod,
-		Reasoning: reason,
-		Vision:    vis,
-		MaxSteps:  steps,
+		Goal:           goal,
+		App:            app,
+		Deeplink:       dl,
+		Setup:          setup,
+		Provider:       prov,
+		Model:          mod,
+		BaseURL:        base,
+		Reasoning:      reason,
+		Vision:         vis,
+		MaxSteps:       steps,
+		Cacheable:      cache,
+		AssertContains: assertion.Contains,
+		AssertRegex:    assertion.Regex,
+		Locale:         loc,
+		Timezone:       tz,
+		Labels:         taskLabels,
 	}
-
-	body, _ := json.Marshal(req)
-	httpReq, _ := http.NewRequest("POST", *server+"/run", bytes.NewBuffer(body))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-API-Key", key) // Send LLM API key via header
-	if srvKey != "" {
-		httpReq.Header.Set("X-Server-Key", srvKey) // Server authentication
+	if *runIf != "" {
+		id, cond, ok := strings.Cut(*runIf, ":")
+		if !ok {
+			cond = "success"
+		}
+		req.RunIf = &RunCondition{TaskID: id, Condition: cond}
 	}
 
-	resp, err := http.DefaultClient.Do(httpReq)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
-	}
-	defer func() { _ = resp.Body.Close() }()
+	os.Exit(submitAndWait(opts, func() (*SubmitResponse, error) {
+		return submitTask(*server, srvKey, key, req)
+	}))
+}
+
+// waitOptions are the flags that shape how a submitted task is waited on
+// and reported.
+type waitOptions struct {
+	server, srvKey string
+	quiet, detach  bool
+	stream         bool
+	showTiming     bool
+	format         string
+	reportPath     string
+	rerunOf        string // Task ID the submission reruns, for the progress output
+	pollInterval   time.Duration
+	pollJitter     float64
+	reconnectGrace time.Duration
+	retryFull      int
+	retryFullDelay time.Duration
+}
 
-	// Check for error response
-	if resp.StatusCode != http.StatusOK {
-		var errResp ErrorResponse
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		if json.Unmarshal(bodyBytes, &errResp) == nil && errResp.Error != "" {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", errResp.Error)
+// submitAndWait submits a task with submit (retrying while the server is
+// busy), waits for it to finish unless detached, and reports the outcome.
+// It returns the exit status.
+func submitAndWait(o waitOptions, submit func() (*SubmitResponse, error)) int {
+	submitStart := time.Now()
+	submitResp, err := submitRetrying(submit, o.retryFull, o.retryFullDelay, os.Stderr)
+	submitTook := time.Since(submitStart)
+	if err != nil {
+		var full *droidrunclient.QueueFullError
+		if errors.As(err, &full) {
+			fmt.Fprintf(os.Stderr, "Error: %v; try again later or use -retry-full\n", err)
 		} else {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", string(bodyBytes))
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		}
-		os.Exit(1)
-	}
-
-	var submitResp SubmitResponse
-	if err := json.NewDecoder(resp.Body).Decode(&submitResp); err != nil {
-		fmt.Fprintf(os.Stderr, "Error decoding response: %v\n", err)
-		os.Exit(1)
+		return submitExitCode(err)
 	}
 
 	if submitResp.TaskID == "" {
 		fmt.Fprintln(os.Stderr, "Error: no task ID received")
-		os.Exit(1)
+		return 1
 	}
 
-	if !*quiet {
-		fmt.Printf("Task:    %s (position: %d)\n", submitResp.TaskID, submitResp.Position)
+	// With -detach, nothing to wait on: report the ID and leave it running
+	if o.detach {
+		if o.quiet {
+			output, _ := json.Marshal(submitResp)
+			fmt.Println(string(output))
+		} else {
+			fmt.Println(submitResp.TaskID)
+		}
+		return 0
+	}
+
+	if !o.quiet {
+		if o.rerunOf != "" {
+			fmt.Printf("Task:    %s (rerun of %s, position: %d)\n", submitResp.TaskID, o.rerunOf, submitResp.Position)
+		} else {
+			fmt.Printf("Task:    %s (position: %d)\n", submitResp.TaskID, submitResp.Position)
+		}
 		fmt.Println("Waiting...")
 	}
 
@@ -337,51 +748,103 @@ func main() {
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigChan
-		if !*quiet {
+		if !o.quiet {
 			fmt.Println("\nCancelling task...")
 		}
-		cancelReq, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/task/%s", *server, submitResp.TaskID), nil)
-		if srvKey != "" {
-			cancelReq.Header.Set("X-Server-Key", srvKey)
-		}
-		_, _ = http.DefaultClient.Do(cancelReq) // Best effort cancel before exit
+		// Best effort cancel before exit
+		_ = serverClient(o.server, o.srvKey).Cancel(context.Background(), submitResp.TaskID)
 		os.Exit(130)
 	}()
 
+	// With -stream, wait on the event stream, then fetch the result below
+	if o.stream {
+		err := followTask(o.server, o.srvKey, submitResp.TaskID, func(ev TaskEvent) {
+			if o.quiet {
+				return
+			}
+			switch ev.Status {
+			case "waiting", "queued":
+				fmt.Print(".")
+			case "running":
+				fmt.Print("\r[running]   ")
+			}
+		})
+		if err != nil && !o.quiet {
+			fmt.Fprintf(os.Stderr, "\nStream unavailable (%v), polling instead\n", err)
+		}
+	}
+
 	// Poll for result
 	for {
-		pollReq, _ := http.NewRequest("GET", fmt.Sprintf("%s/task/%s", *server, submitResp.TaskID), nil)
-		if srvKey != "" {
-			pollReq.Header.Set("X-Server-Key", srvKey)
-		}
-		resp, err := http.DefaultClient.Do(pollReq)
+		// Jitter keeps many clients from polling in lockstep
+		interval := func() time.Duration { return jitter(o.pollInterval, o.pollJitter) }
+		status, err := pollStatus(o.server, o.srvKey, submitResp.TaskID, o.reconnectGrace, interval, os.Stderr)
 		if err != nil {
-			time.Sleep(2 * time.Second)
-			continue
+			if !o.quiet {
+				fmt.Println()
+			}
+			fmt.Fprintf(os.Stderr, "Error: %v (task %s may still be running)\n", err, submitResp.TaskID)
+			return 1
 		}
 
-		var status TaskStatus
-		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-			_ = resp.Body.Close()
-			time.Sleep(2 * time.Second)
-			continue
+		// With -timing, a table after the outcome, or a field in quiet JSON
+		timing := taskTimingOf(status, submitTook, time.Since(submitStart))
+		printTiming := func() {
+			if o.showTiming {
+				fmt.Println()
+				writeTiming(os.Stdout, timing)
+			}
+		}
+		addTiming := func(out map[string]any) {
+			if o.showTiming {
+				out["timing"] = timing
+			}
 		}
-		_ = resp.Body.Close()
 
 		switch status.Status {
-		case "queued":
-			if !*quiet {
+		case "completed", "failed", "cancelled", "skipped":
+			if o.reportPath != "" {
+				if err := writeReport(o.reportPath, status); err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+				} else if !o.quiet {
+					fmt.Print("\r            \r")
+					fmt.Printf("Report:  %s\n", o.reportPath)
+				}
+			}
+			if o.format != formatText {
+				out := statusOutput{TaskStatus: status}
+				if o.showTiming {
+					out.Timing = &timing
+				}
+				if err := writeStatus(os.Stdout, o.format, out); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				return exitCodeOf(status)
+			}
+		}
+
+		switch status.Status {
+		case "waiting", "queued":
+			if !o.quiet {
 				fmt.Print(".")
 			}
 		case "running":
-			if !*quiet {
+			if !o.quiet {
 				fmt.Print("\r[running]   ")
 			}
 		case "completed":
-			if !*quiet {
+			if !o.quiet {
 				fmt.Print("\r            \r")
 				fmt.Println("=== COMPLETED ===")
-				fmt.Printf("Success: %v\n\n", status.Success)
+				if status.FromCache != "" {
+					fmt.Printf("Cached:  result reused from task %s\n", status.FromCache)
+				}
+				fmt.Printf("Success: %v\n", status.Success)
+				if status.Error != "" {
+					fmt.Printf("Error:   %s\n", status.Error)
+				}
+				fmt.Println()
 				if status.Logs != "" {
 					fmt.Println("=== LOGS ===")
 					fmt.Printf("%s\n", status.Logs)
@@ -392,41 +855,548 @@ func main() {
 					fmt.Printf("%s\n\n", stepsJSON)
 				}
 				fmt.Printf("Result:\n%s\n", status.Result)
+				printTiming()
 			} else {
 				// Quiet mode: output JSON
-				output, _ := json.Marshal(map[string]any{
+				out := map[string]any{
 					"success": status.Success,
 					"result":  status.Result,
-				})
+				}
+				if status.Error != "" {
+					out["error"] = status.Error
+				}
+				addTiming(out)
+				output, _ := json.Marshal(out)
 				fmt.Println(string(output))
 			}
 			if status.Success {
-				os.Exit(0)
+				return 0
 			}
-			os.Exit(1)
+			return 1
 		case "failed":
-			if !*quiet {
+			if !o.quiet {
 				fmt.Print("\r            \r")
 				fmt.Println("=== FAILED ===")
 				fmt.Printf("Error: %s\n", status.Error)
+				printTiming()
 			} else {
-				output, _ := json.Marshal(map[string]any{
+				out := map[string]any{
 					"success": false,
 					"error":   status.Error,
-				})
+				}
+				addTiming(out)
+				output, _ := json.Marshal(out)
 				fmt.Println(string(output))
 			}
-			os.Exit(1)
+			return 1
 		case "cancelled":
-			if !*quiet {
+			if !o.quiet {
 				fmt.Print("\r            \r")
 				fmt.Println("=== CANCELLED ===")
+				printTiming()
+			}
+			return 130
+		case "skipped":
+			if !o.quiet {
+				fmt.Print("\r            \r")
+				fmt.Println("=== SKIPPED ===")
+				fmt.Printf("Reason: %s\n", status.SkipReason)
+				printTiming()
+			} else {
+				out := map[string]any{
+					"success": false,
+					"skipped": true,
+					"reason":  status.SkipReason,
+				}
+				addTiming(out)
+				output, _ := json.Marshal(out)
+				fmt.Println(string(output))
 			}
-			os.Exit(130)
+			return 1
 		}
 
-		time.Sleep(2 * time.Second)
+		time.Sleep(interval())
+	}
+}
+
+// taskTiming breaks down where a task's time went, in milliseconds.
+type taskTiming struct {
+	SubmitMs int64 `json:"submit_ms"` // POST /run round trip
+	WaitMs   int64 `json:"wait_ms"`   // Queued (or held by run_if) on the server
+	RunMs    int64 `json:"run_ms"`    // Worker execution
+	TotalMs  int64 `json:"total_ms"`  // From submitting until the final status arrived
+}
+
+// taskTimingOf derives the timing of a finished task from its server
+// timestamps, plus the client-side submit and total durations. A task that
+// never started (cancelled while queued, skipped, or cached) spent all its
+// server time waiting.
+func taskTimingOf(status TaskStatus, submit, total time.Duration) taskTiming {
+	parse := func(s string) time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, s)
+		return t
+	}
+	created, started, finished := parse(status.CreatedAt), parse(status.StartedAt), parse(status.FinishedAt)
+	timing := taskTiming{SubmitMs: submit.Milliseconds(), TotalMs: total.Milliseconds()}
+	switch {
+	case created.IsZero() || finished.IsZero():
+	case started.IsZero():
+		timing.WaitMs = finished.Sub(created).Milliseconds()
+	default:
+		timing.WaitMs = started.Sub(created).Milliseconds()
+		timing.RunMs = finished.Sub(started).Milliseconds()
+	}
+	return timing
+}
+
+// writeTiming prints a timing breakdown as a small table.
+func writeTiming(w io.Writer, t taskTiming) {
+	ms := func(n int64) time.Duration { return time.Duration(n) * time.Millisecond }
+	fmt.Fprintln(w, "=== TIMING ===")
+	fmt.Fprintf(w, "Submit:  %s\n", ms(t.SubmitMs))
+	fmt.Fprintf(w, "Queued:  %s\n", ms(t.WaitMs))
+	fmt.Fprintf(w, "Running: %s\n", ms(t.RunMs))
+	fmt.Fprintf(w, "Total:   %s\n", ms(t.TotalMs))
+}
+
+// clearQueue clears every task on the server, or with a filter (label and
+// provider query parameters) cancels only the matching unfinished ones.
+// Unless yes is set, it first asks the server what would go (refusing an
+// unconfirmed clear, it says), asks confirm with the number of unfinished
+// tasks and the running task IDs, then echoes the server's confirmation
+// value as X-Confirm, so the server refuses if tasks arrived meanwhile. It
+// returns the number cleared, or -1 if confirm declined.
+func clearQueue(server, srvKey string, filter url.Values, yes bool, confirm func(tasks int, running []string) bool) (int, error) {
+	c := newClient(server, srvKey, "")
+	ctx := context.Background()
+	if yes {
+		query := url.Values{}
+		maps.Copy(query, filter)
+		query.Set("confirm", "true")
+		return c.Clear(ctx, query, "")
+	}
+
+	cleared, err := c.Clear(ctx, filter, "")
+	var conflict *droidrunclient.ConfirmError
+	if !errors.As(err, &conflict) {
+		return cleared, err
+	}
+	// With nothing unfinished there's nothing to lose: a filtered cancel has
+	// nothing to do, and a full clear only drops finished tasks
+	if conflict.Tasks > 0 && !confirm(conflict.Tasks, conflict.Running) {
+		return -1, nil
+	}
+	if conflict.Tasks == 0 && len(filter) > 0 {
+		return 0, nil
+	}
+	cleared, err = c.Clear(ctx, filter, conflict.Confirm)
+	if errors.As(err, &conflict) {
+		return 0, fmt.Errorf("queue changed while confirming, nothing cleared; run -clear again")
+	}
+	return cleared, err
+}
+
+// setQueuePaused pauses or resumes the server's queue.
+func setQueuePaused(server, srvKey string, paused bool) (*droidrunclient.QueueState, error) {
+	c := newClient(server, srvKey, "")
+	if paused {
+		return c.Pause(context.Background())
+	}
+	return c.Resume(context.Background())
+}
+
+// listTasks fetches the tasks from GET /queue, optionally only those in the
+// comma-separated statuses and with all of labels, sorted by creation time.
+// Each task is kept as the server sent it so -quiet can pass it through
+// unchanged.
+func listTasks(server, srvKey, statuses string, labels map[string]string) ([]json.RawMessage, error) {
+	query := url.Values{}
+	if statuses != "" {
+		query.Set("status", statuses)
+	}
+	labelQuery(query, labels)
+	queue, err := serverClient(server, srvKey).Queue(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		raw     json.RawMessage
+		id      string
+		created time.Time
+	}
+	entries := make([]entry, 0, len(queue.Tasks))
+	for id, raw := range queue.Tasks {
+		var status TaskStatus
+		_ = json.Unmarshal(raw, &status)
+		created, _ := time.Parse(time.RFC3339, status.CreatedAt)
+		entries = append(entries, entry{raw, id, created})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].created.Equal(entries[j].created) {
+			return entries[i].created.Before(entries[j].created)
+		}
+		return entries[i].id < entries[j].id
+	})
+	tasks := make([]json.RawMessage, len(entries))
+	for i, e := range entries {
+		tasks[i] = e.raw
+	}
+	return tasks, nil
+}
+
+// writeTaskList prints tasks as a table of ID, status, provider, creation
+// time, and goal.
+func writeTaskList(w io.Writer, tasks []json.RawMessage) {
+	fmt.Fprintf(w, "%-10s %-10s %-12s %-19s %s\n", "ID", "STATUS", "PROVIDER", "CREATED", "GOAL")
+	for _, raw := range tasks {
+		var status TaskStatus
+		_ = json.Unmarshal(raw, &status)
+		created := status.CreatedAt
+		if t, err := time.Parse(time.RFC3339, created); err == nil {
+			created = t.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%-10s %-10s %-12s %-19s %s\n", status.ID, status.Status, status.Request.Provider, created, truncate(status.Request.Goal, 50))
+	}
+}
+
+// fetchStatus returns the server's compact status line from GET /status.
+func fetchStatus(server string) (string, error) {
+	return serverClient(server, "").Status(context.Background())
+}
+
+// fetchArtifacts downloads GET /task/{id}/artifacts.zip to path, removing
+// the partial file if the download fails.
+func fetchArtifacts(server, srvKey, id, path string) error {
+	zip, err := serverClient(server, srvKey).Artifacts(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = zip.Close() }()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, zip); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("downloading artifacts: %w", err)
+	}
+	return f.Close()
+}
+
+// fetchHealthMessage returns the operator message from GET /health, or "" if
+// none is set.
+func fetchHealthMessage(server string) (string, error) {
+	health, err := serverClient(server, "").Health(context.Background())
+	if err != nil {
+		return "", err
+	}
+	return health.Message, nil
+}
+
+// reconnectNoticeEvery is how often pollStatus reports that it is still
+// trying to reach the server.
+var reconnectNoticeEvery = 10 * time.Second
+
+// pollStatus fetches a task's status, retrying while the server can't be
+// reached (or answers with something other than JSON). It gives up once the
+// server has been unreachable for grace (0 = never), writing a notice to
+// notices every reconnectNoticeEvery in the meantime.
+func pollStatus(server, srvKey, id string, grace time.Duration, interval func() time.Duration, notices io.Writer) (TaskStatus, error) {
+	down := reconnecting{grace: grace, notices: notices}
+	for {
+		status, err := fetchTask(server, srvKey, id)
+		if err == nil {
+			return status, nil
+		}
+		if err := down.failed(err); err != nil {
+			return TaskStatus{}, err
+		}
+		time.Sleep(interval())
+	}
+}
+
+// reconnecting tracks how long the server has been unreachable while a
+// task is followed, for -reconnect-grace.
+type reconnecting struct {
+	grace   time.Duration // 0 = keep retrying
+	notices io.Writer
+
+	downSince, lastNotice time.Time
+}
+
+// failed records a failed request. It returns err when it isn't worth
+// retrying: the server answered with a 4xx (the task is gone, or the key is
+// wrong), or it has been unreachable for longer than grace.
+func (r *reconnecting) failed(err error) error {
+	var apiErr *droidrunclient.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+		return err
+	}
+	now := time.Now()
+	if r.downSince.IsZero() {
+		r.downSince = now
+	}
+	down := now.Sub(r.downSince).Round(time.Millisecond)
+	if r.grace > 0 && down >= r.grace {
+		return fmt.Errorf("server unreachable for %s (-reconnect-grace %s), giving up: %v", down, r.grace, err)
+	}
+	if r.lastNotice.IsZero() || now.Sub(r.lastNotice) >= reconnectNoticeEvery {
+		fmt.Fprintf(r.notices, "\nserver unreachable, retrying (%s so far): %v\n", down, err)
+		r.lastNotice = now
+	}
+	return nil
+}
+
+// reconnected resets the time the server has been unreachable.
+func (r *reconnecting) reconnected() {
+	r.downSince, r.lastNotice = time.Time{}, time.Time{}
+}
+
+// fetchTask makes a single GET /task/{id} request, without retrying.
+func fetchTask(server, srvKey, id string) (TaskStatus, error) {
+	status, err := serverClient(server, srvKey).Poll(context.Background(), id)
+	if err != nil {
+		return TaskStatus{}, err
+	}
+	return *status, nil
+}
+
+// fetchSummary makes a GET /task/{id}?format=summary request.
+func fetchSummary(server, srvKey, id string) (TaskSummary, error) {
+	summary, err := serverClient(server, srvKey).Summary(context.Background(), id)
+	if err != nil {
+		return TaskSummary{}, err
+	}
+	return *summary, nil
+}
+
+// fetchTimeline gets all of a task's steps from
+// GET /task/{id}/steps?format=timeline, a page at a time.
+func fetchTimeline(server, srvKey, id string) ([]TimelineStep, error) {
+	return serverClient(server, srvKey).Timeline(context.Background(), id)
+}
+
+// writeTimeline prints one line per step: its number, time, and action (or
+// the step's JSON if the server couldn't tell its action), then any
+// screenshot.
+func writeTimeline(w io.Writer, steps []TimelineStep) {
+	if len(steps) == 0 {
+		fmt.Fprintln(w, "No steps")
+		return
+	}
+	for _, step := range steps {
+		what := step.Action
+		if what == "" {
+			raw, _ := json.Marshal(step.Raw)
+			what = truncate(string(raw), 80)
+		}
+		fmt.Fprintf(w, "%3d  %-24s  %s\n", step.Index+1, step.Timestamp, what)
+		if step.Screenshot != "" {
+			fmt.Fprintf(w, "     %-24s  screenshot: %s\n", "", step.Screenshot)
+		}
+	}
+}
+
+// defaultModel picks the provider and model for a goal given on the command
+// line, from DROIDRUN_PROVIDER and DROIDRUN_MODEL when set. Only Google's
+// model is filled in here; for other providers the server picks.
+func defaultModel(envProvider, envModel string) (provider, model string) {
+	provider, model = envProvider, envModel
+	if provider == "" {
+		provider = "Google"
+	}
+	if model == "" && provider == "Google" {
+		model = "gemini-2.0-flash"
+	}
+	return provider, model
+}
+
+// resolveAPIKey returns the LLM API key from the -key flag, the -key-file, or
+// the provider's environment variable, in that order, or "" to use the
+// server's key.
+func resolveAPIKey(flagKey, keyFile, provider string) (string, error) {
+	key := flagKey
+	if key == "" && keyFile != "" {
+		var err error
+		key, err = readKeyFile(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("reading key file: %w", err)
+		}
+	}
+	if key == "" {
+		switch provider {
+		case "Google", "GoogleGenAI":
+			key = os.Getenv("GOOGLE_API_KEY")
+		case "Anthropic":
+			key = os.Getenv("ANTHROPIC_API_KEY")
+		case "OpenAI":
+			key = os.Getenv("OPENAI_API_KEY")
+		case "DeepSeek":
+			key = os.Getenv("DEEPSEEK_API_KEY")
+		case "Ollama":
+			// Ollama doesn't need an API key
+		}
+	}
+	// No key is fine: the server may have its own for the provider, and
+	// says so if it doesn't
+	return key, nil
+}
+
+// submitTask posts a task to the server. The LLM API key travels in the
+// X-API-Key header, never in the JSON body.
+func submitTask(server, srvKey, apiKey string, req TaskRequest) (*SubmitResponse, error) {
+	return newClient(server, srvKey, apiKey).Submit(context.Background(), req)
+}
+
+// rerunTask resubmits task id with overrides merged over its stored request.
+func rerunTask(server, srvKey, apiKey, id string, overrides map[string]any) (*SubmitResponse, error) {
+	return newClient(server, srvKey, apiKey).Rerun(context.Background(), id, overrides)
+}
+
+// submitBatch posts a JSON array of task requests to /batch, sharing apiKey
+// across them, and returns the per-task results. A 207 response (some tasks
+// rejected) is not an error; the rejected results carry their own Error.
+func submitBatch(server, srvKey, apiKey string, reqs []json.RawMessage) ([]BatchResult, error) {
+	return newClient(server, srvKey, apiKey).Batch(context.Background(), reqs)
+}
+
+// submitRetrying calls submit, retrying up to retries times while it fails
+// with a droidrunclient.QueueFullError. It waits as long as the server's
+// Retry-After asks, or delay without one, writing a notice to notices before
+// each retry.
+func submitRetrying(submit func() (*SubmitResponse, error), retries int, delay time.Duration, notices io.Writer) (*SubmitResponse, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := submit()
+		var full *droidrunclient.QueueFullError
+		if !errors.As(err, &full) || attempt > retries {
+			return resp, err
+		}
+		wait := delay
+		if full.RetryAfter > 0 {
+			wait = full.RetryAfter
+		}
+		fmt.Fprintf(notices, "Server busy (%s), retrying in %s (%d/%d)\n", full.Message, wait, attempt, retries)
+		time.Sleep(wait)
+	}
+}
+
+// Exit statuses for a rejected submission, after sysexits.h, so scripts can
+// tell a request that will never be accepted from one worth retrying.
+const (
+	exitInvalidRequest = 65 // EX_DATAERR: the server rejected the request as invalid
+	exitTryLater       = 75 // EX_TEMPFAIL: the server is busy or shutting down
+	exitNoPermission   = 77 // EX_NOPERM: the server key is missing, wrong, or not allowed this
+)
+
+// submitExitCode maps a failed submission to the client's exit status by the
+// server's error code. Errors without a code, such as the server being
+// unreachable, exit with 1.
+func submitExitCode(err error) int {
+	var full *droidrunclient.QueueFullError
+	if errors.As(err, &full) {
+		return exitTryLater
+	}
+	var apiErr *droidrunclient.Error
+	if !errors.As(err, &apiErr) {
+		return 1
+	}
+	switch apiErr.Code {
+	case "":
+		return 1
+	case "unauthorized", "forbidden":
+		return exitNoPermission
+	case "draining", "rate_limited", "queue_full", "service_unavailable":
+		return exitTryLater
+	case "internal_error":
+		return 1
+	}
+	if apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+		return exitInvalidRequest
+	}
+	return 1
+}
+
+// watchTasks follows several tasks over a single GET /events stream, printing
+// each status change. It returns true if every task completed successfully.
+func watchTasks(server, srvKey string, ids []string, quiet bool) (bool, error) {
+	allOK := true
+	err := serverClient(server, srvKey).Watch(context.Background(), ids, func(ev TaskEvent) {
+		if ev.Done() && !(ev.Status == "completed" && ev.Success) {
+			allOK = false
+		}
+
+		if quiet {
+			if ev.Done() {
+				output, _ := json.Marshal(ev)
+				fmt.Println(string(output))
+			}
+			return
+		}
+		switch ev.Status {
+		case "queued":
+			fmt.Printf("[%s] queued (position: %d)\n", ev.TaskID, ev.Position)
+		case "running":
+			fmt.Printf("[%s] running (steps: %d)\n", ev.TaskID, ev.Steps)
+		case "completed":
+			fmt.Printf("[%s] completed: success=%v %s\n", ev.TaskID, ev.Success, truncate(ev.Result, 60))
+		case "failed":
+			fmt.Printf("[%s] failed: %s\n", ev.TaskID, truncate(ev.Error, 60))
+		case "not_found":
+			fmt.Printf("[%s] not found\n", ev.TaskID)
+		default:
+			fmt.Printf("[%s] %s\n", ev.TaskID, ev.Status)
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	return allOK, nil
+}
+
+// followTask reads GET /task/{id}/events, calling fn for each event, until
+// the task finishes.
+func followTask(server, srvKey, id string, fn func(TaskEvent)) error {
+	return serverClient(server, srvKey).Follow(context.Background(), id, fn)
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// jitter returns d randomized uniformly within ±frac of its value.
+// frac is clamped to [0, 1].
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	delta := (rand.Float64()*2 - 1) * frac * float64(d)
+	return d + time.Duration(delta)
+}
+
+// readKeyFile reads an API key from a file, trimming surrounding whitespace.
+func readKeyFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
 	}
+	return key, nil
 }
 
 func truncate(s string, n int) string {
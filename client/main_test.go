@@ -0,0 +1,726 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"droidrun-client/droidrunclient"
+)
+
+func TestKeyFileSentViaHeader(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "google.key")
+	if err := os.WriteFile(keyPath, []byte("  file-secret-key\n"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+
+	key, err := readKeyFile(keyPath)
+	if err != nil {
+		t.Fatalf("readKeyFile: %v", err)
+	}
+	if key != "file-secret-key" {
+		t.Fatalf("expected trimmed key, got %q", key)
+	}
+
+	var gotKey string
+	var gotBody map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("X-API-Key")
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		_ = json.NewEncoder(w).Encode(SubmitResponse{TaskID: "abc", Status: "queued", Position: 1})
+	}))
+	defer srv.Close()
+
+	resp, err := submitTask(srv.URL, "", key, TaskRequest{Goal: "test", Provider: "Google"})
+	if err != nil {
+		t.Fatalf("submitTask: %v", err)
+	}
+	if resp.TaskID != "abc" {
+		t.Errorf("expected task ID 'abc', got %q", resp.TaskID)
+	}
+	if gotKey != "file-secret-key" {
+		t.Errorf("expected X-API-Key 'file-secret-key', got %q", gotKey)
+	}
+	if _, ok := gotBody["api_key"]; ok {
+		t.Error("API key should not be sent in the request body")
+	}
+}
+
+func TestRerunTaskPostsOverrides(t *testing.T) {
+	var gotPath, gotKey string
+	var gotBody map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotKey = r.URL.Path, r.Header.Get("X-API-Key")
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		_ = json.NewEncoder(w).Encode(SubmitResponse{TaskID: "new", Status: "queued"})
+	}))
+	defer srv.Close()
+
+	resp, err := rerunTask(srv.URL, "", "fresh", "abc", map[string]any{"max_steps": 50})
+	if err != nil {
+		t.Fatalf("rerunTask: %v", err)
+	}
+	if resp.TaskID != "new" || gotPath != "/task/abc/rerun" || gotKey != "fresh" {
+		t.Errorf("unexpected rerun: task %q, path %q, key %q", resp.TaskID, gotPath, gotKey)
+	}
+	if gotBody["max_steps"] != float64(50) || len(gotBody) != 1 {
+		t.Errorf("expected only the max_steps override, got %v", gotBody)
+	}
+}
+
+func TestSubmitRetriesWhenQueueFull(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: "queue is full"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(SubmitResponse{TaskID: "abc", Status: "queued"})
+	}))
+	defer srv.Close()
+	submit := func() (*SubmitResponse, error) {
+		return submitTask(srv.URL, "", "key", TaskRequest{Goal: "test"})
+	}
+
+	var notices strings.Builder
+	_, err := submitRetrying(submit, 1, time.Millisecond, &notices)
+	var full *droidrunclient.QueueFullError
+	if !errors.As(err, &full) || full.Message != "queue is full" {
+		t.Fatalf("expected a QueueFullError after running out of retries, got %v", err)
+	}
+	if attempts != 2 || strings.Count(notices.String(), "retrying") != 1 {
+		t.Errorf("expected 2 attempts and 1 notice, got %d: %q", attempts, notices.String())
+	}
+
+	resp, err := submitRetrying(submit, 5, time.Millisecond, io.Discard)
+	if err != nil || resp.TaskID != "abc" {
+		t.Fatalf("expected success on the third attempt, got %+v, %v", resp, err)
+	}
+
+	// Other errors aren't retried
+	attempts = 0
+	fail := func() (*SubmitResponse, error) { attempts++; return nil, fmt.Errorf("goal is required") }
+	if _, err := submitRetrying(fail, 5, time.Millisecond, io.Discard); err == nil || attempts != 1 {
+		t.Errorf("expected one attempt for a non-429 error, got %d: %v", attempts, err)
+	}
+}
+
+func TestSubmitBatchPartialSuccess(t *testing.T) {
+	var gotPath, gotKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotKey = r.URL.Path, r.Header.Get("X-API-Key")
+		w.WriteHeader(http.StatusMultiStatus)
+		_ = json.NewEncoder(w).Encode([]BatchResult{
+			{Index: 0, Status: http.StatusOK, TaskID: "abc", Position: 1},
+			{Index: 1, Status: http.StatusBadRequest, Error: "goal is required"},
+		})
+	}))
+	defer srv.Close()
+
+	results, err := submitBatch(srv.URL, "", "shared", []json.RawMessage{[]byte(`{"goal":"a"}`), []byte(`{"goal":""}`)})
+	if err != nil {
+		t.Fatalf("submitBatch: %v", err)
+	}
+	if gotPath != "/batch" || gotKey != "shared" {
+		t.Errorf("unexpected batch request: path %q, key %q", gotPath, gotKey)
+	}
+	if len(results) != 2 || results[0].TaskID != "abc" || results[1].Error != "goal is required" {
+		t.Errorf("expected per-task results from a 207, got %+v", results)
+	}
+}
+
+func TestFetchHealthMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"status": "ok", "message": "maintenance window 2-3am"}`)
+	}))
+	defer srv.Close()
+
+	msg, err := fetchHealthMessage(srv.URL)
+	if err != nil {
+		t.Fatalf("fetchHealthMessage: %v", err)
+	}
+	if msg != "maintenance window 2-3am" {
+		t.Errorf("expected the banner, got %q", msg)
+	}
+}
+
+func TestDefaultModelFromEnv(t *testing.T) {
+	tests := []struct {
+		envProvider, envModel string
+		provider, model       string
+	}{
+		{"", "", "Google", "gemini-2.0-flash"},
+		{"Ollama", "", "Ollama", ""},
+		{"Ollama", "qwen2.5", "Ollama", "qwen2.5"},
+		{"", "gemini-2.5-pro", "Google", "gemini-2.5-pro"},
+	}
+	for _, tt := range tests {
+		provider, model := defaultModel(tt.envProvider, tt.envModel)
+		if provider != tt.provider || model != tt.model {
+			t.Errorf("defaultModel(%q, %q) = %s/%s, want %s/%s", tt.envProvider, tt.envModel, provider, model, tt.provider, tt.model)
+		}
+	}
+}
+
+func TestFetchArtifacts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/task/abc/artifacts.zip" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"error": "task not found"}`)
+			return
+		}
+		_, _ = io.WriteString(w, "PK-zip-bytes")
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "out.zip")
+	if err := fetchArtifacts(srv.URL, "", "abc", path); err != nil {
+		t.Fatalf("fetchArtifacts: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "PK-zip-bytes" {
+		t.Errorf("unexpected download: %q", data)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.zip")
+	if err := fetchArtifacts(srv.URL, "", "nope", missing); err == nil || !strings.Contains(err.Error(), "task not found") {
+		t.Errorf("expected the server's error, got %v", err)
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Error("expected no file for a failed download")
+	}
+}
+
+func TestReadKeyFileEmpty(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "empty.key")
+	if err := os.WriteFile(keyPath, []byte("\n\t \n"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	if _, err := readKeyFile(keyPath); err == nil {
+		t.Error("expected error for empty key file")
+	}
+}
+
+func TestWatchTasksReadsMultiplexedEvents(t *testing.T) {
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("tasks")
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(strings.Join([]string{
+			`event: task`, `data: {"task_id":"a","status":"running"}`, ``,
+			`: keepalive`, ``,
+			`event: task`, `data: {"task_id":"b","status":"queued","position":1}`, ``,
+			`event: task`, `data: {"task_id":"a","status":"completed","success":true}`, ``,
+			`event: task`, `data: {"task_id":"b","status":"failed","error":"boom"}`, ``,
+			`event: done`, `data: {}`, ``,
+		}, "\n") + "\n"))
+	}))
+	defer srv.Close()
+
+	ok, err := watchTasks(srv.URL, "", []string{"a", "b"}, true)
+	if err != nil {
+		t.Fatalf("watchTasks: %v", err)
+	}
+	if gotQuery != "a,b" {
+		t.Errorf("expected tasks=a,b, got %q", gotQuery)
+	}
+	if ok {
+		t.Error("expected overall failure since task b failed")
+	}
+}
+
+func TestFollowTaskStopsAtTerminalEvent(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if r.URL.Path == "/task/gone/events" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(strings.Join([]string{
+			`event: task`, `data: {"task_id":"a","status":"queued","position":1}`, ``,
+			`event: task`, `data: {"task_id":"a","status":"running","steps":1}`, ``,
+			`event: task`, `data: {"task_id":"a","status":"completed","success":true}`, ``,
+			`event: done`, `data: {}`, ``,
+		}, "\n") + "\n"))
+	}))
+	defer srv.Close()
+
+	var statuses []string
+	if err := followTask(srv.URL, "", "a", func(ev TaskEvent) { statuses = append(statuses, ev.Status) }); err != nil {
+		t.Fatalf("followTask: %v", err)
+	}
+	if gotPath != "/task/a/events" {
+		t.Errorf("expected /task/a/events, got %q", gotPath)
+	}
+	if strings.Join(statuses, ",") != "queued,running,completed" {
+		t.Errorf("unexpected events %v", statuses)
+	}
+
+	// Older servers without the endpoint make the client fall back to polling
+	if err := followTask(srv.URL, "", "gone", func(TaskEvent) {}); err == nil {
+		t.Error("expected an error for a missing stream")
+	}
+}
+
+func TestClearQueueConfirms(t *testing.T) {
+	tasks, reported := 2, 2
+	var gotConfirm string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Query().Get("confirm") == "true" || r.Header.Get("X-Confirm") == strconv.Itoa(tasks):
+			gotConfirm = r.URL.RawQuery + r.Header.Get("X-Confirm")
+			_, _ = w.Write([]byte(`{"cleared": 3}`))
+		default:
+			w.WriteHeader(http.StatusConflict)
+			_, _ = fmt.Fprintf(w, `{"error": "confirm clearing", "tasks": %d, "confirm": %d, "running": ["a"]}`, reported, reported)
+		}
+	}))
+	defer srv.Close()
+
+	var asked string
+	cleared, err := clearQueue(srv.URL, "", nil, false, func(n int, running []string) bool {
+		asked = fmt.Sprintf("%d %v", n, running)
+		return false
+	})
+	if err != nil || cleared != -1 || asked != "2 [a]" {
+		t.Errorf("declined: got %d, %v after asking %q", cleared, err, asked)
+	}
+
+	yes := func(int, []string) bool { return true }
+	if cleared, err := clearQueue(srv.URL, "", nil, false, yes); err != nil || cleared != 3 || gotConfirm != "2" {
+		t.Errorf("confirmed: got %d, %v (confirm %q)", cleared, err, gotConfirm)
+	}
+	if cleared, err := clearQueue(srv.URL, "", nil, true, nil); err != nil || cleared != 3 || gotConfirm != "confirm=true" {
+		t.Errorf("-yes: got %d, %v (confirm %q)", cleared, err, gotConfirm)
+	}
+
+	// A task submitted after the prompt changes the count
+	tasks = 3
+	if _, err := clearQueue(srv.URL, "", nil, false, yes); err == nil || !strings.Contains(err.Error(), "queue changed") {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+
+	// With only finished tasks left there's nothing to ask about
+	tasks, reported = 0, 0
+	cleared, err = clearQueue(srv.URL, "", nil, false, func(int, []string) bool {
+		t.Error("asked to confirm clearing only finished tasks")
+		return false
+	})
+	if err != nil || cleared != 3 || gotConfirm != "0" {
+		t.Errorf("finished only: got %d, %v (confirm %q)", cleared, err, gotConfirm)
+	}
+}
+
+func TestClearQueueFiltered(t *testing.T) {
+	var gotQuery, gotConfirm string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		gotQuery = r.URL.Query().Encode()
+		if r.Header.Get("X-Confirm") == "1" {
+			gotConfirm = "1"
+			_, _ = w.Write([]byte(`{"cleared": 1, "task_ids": ["a"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"error": "confirm cancelling 1 tasks", "tasks": 1, "running": ["a"]}`))
+	}))
+	defer srv.Close()
+
+	filter := url.Values{}
+	labelQuery(filter, map[string]string{"project": "alpha"})
+	filter.Set("provider", "Ollama")
+	var asked string
+	cancelled, err := clearQueue(srv.URL, "", filter, false, func(n int, running []string) bool {
+		asked = fmt.Sprintf("%d %v", n, running)
+		return true
+	})
+	if err != nil || cancelled != 1 || asked != "1 [a]" || gotConfirm != "1" {
+		t.Errorf("got %d, %v after asking %q (confirm %q)", cancelled, err, asked, gotConfirm)
+	}
+	if gotQuery != "label=project%3Dalpha&provider=Ollama" {
+		t.Errorf("expected the filter sent, got %q", gotQuery)
+	}
+}
+
+func TestListTasksSortedByCreation(t *testing.T) {
+	var gotStatus string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotStatus = r.URL.Query().Get("status")
+		_, _ = io.WriteString(w, `{"queue_size": 0, "current_task": [], "tasks": {
+			"bbb": {"id": "bbb", "status": "failed", "created_at": "2025-01-28T10:00:00.5Z", "request": {"goal": "second", "provider": "Google"}},
+			"ccc": {"id": "ccc", "status": "running", "created_at": "2025-01-28T11:00:00Z", "request": {"goal": "third", "provider": "Anthropic"}},
+			"aaa": {"id": "aaa", "status": "failed", "created_at": "2025-01-28T09:00:00Z", "request": {"goal": "first", "provider": "Google"}}
+		}}`)
+	}))
+	defer srv.Close()
+
+	tasks, err := listTasks(srv.URL, "", "failed,running", nil)
+	if err != nil {
+		t.Fatalf("listTasks: %v", err)
+	}
+	if gotStatus != "failed,running" {
+		t.Errorf("expected the status filter passed to /queue, got %q", gotStatus)
+	}
+	var ids []string
+	for _, raw := range tasks {
+		var status TaskStatus
+		if err := json.Unmarshal(raw, &status); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		ids = append(ids, status.ID)
+	}
+	if strings.Join(ids, ",") != "aaa,bbb,ccc" {
+		t.Errorf("expected tasks oldest first, got %v", ids)
+	}
+
+	var out strings.Builder
+	writeTaskList(&out, tasks)
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 4 || !strings.Contains(lines[3], "Anthropic") || !strings.HasSuffix(lines[3], "third") {
+		t.Errorf("unexpected table:\n%s", out.String())
+	}
+}
+
+func TestListTasksLabels(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()["label"]
+		_, _ = io.WriteString(w, `{"tasks": {}}`)
+	}))
+	defer srv.Close()
+
+	labels := labelFlags{}
+	for _, s := range []string{"project=alpha", "env=a=b"} {
+		if err := labels.Set(s); err != nil {
+			t.Fatalf("Set(%q): %v", s, err)
+		}
+	}
+	if err := labels.Set("bad key=x"); err == nil {
+		t.Error("expected an invalid key to be rejected")
+	}
+	if _, err := listTasks(srv.URL, "", "", labels); err != nil {
+		t.Fatalf("listTasks: %v", err)
+	}
+	if strings.Join(got, " ") != "env=a=b project=alpha" {
+		t.Errorf("expected a label filter per label, got %q", got)
+	}
+}
+
+func TestSetQueuePaused(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		paused := r.URL.Path == "/queue/pause"
+		_, _ = fmt.Fprintf(w, `{"paused": %t, "queue_size": 3, "current_task": ["abc"]}`, paused)
+	}))
+	defer srv.Close()
+
+	state, err := setQueuePaused(srv.URL, "", true)
+	if err != nil || !state.Paused || state.QueueSize != 3 || len(state.Running) != 1 {
+		t.Errorf("unexpected pause result %+v, %v", state, err)
+	}
+	if state, err = setQueuePaused(srv.URL, "", false); err != nil || state.Paused {
+		t.Errorf("unexpected resume result %+v, %v", state, err)
+	}
+	if strings.Join(paths, ",") != "POST /queue/pause,POST /queue/resume" {
+		t.Errorf("unexpected requests %v", paths)
+	}
+}
+
+func TestFetchTimelinePages(t *testing.T) {
+	var offsets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "timeline" {
+			t.Errorf("expected format=timeline, got %q", r.URL.RawQuery)
+		}
+		offset := r.URL.Query().Get("offset")
+		offsets = append(offsets, offset)
+		if offset == "0" {
+			_, _ = io.WriteString(w, `{"total": 3, "steps": [
+				{"index": 0, "action": "tap", "timestamp": "10:00:01", "screenshot": "1.png"},
+				{"index": 1, "raw": {"thought": "hmm"}}]}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"total": 3, "steps": [{"index": 2, "action": "done"}]}`)
+	}))
+	defer srv.Close()
+
+	steps, err := fetchTimeline(srv.URL, "", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 || strings.Join(offsets, ",") != "0,2" {
+		t.Fatalf("expected 3 steps over 2 pages, got %d from offsets %v", len(steps), offsets)
+	}
+
+	var out strings.Builder
+	writeTimeline(&out, steps)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], "tap") || !strings.Contains(lines[1], "screenshot: 1.png") || !strings.Contains(lines[2], `{"thought":"hmm"}`) {
+		t.Errorf("unexpected timeline:\n%s", out.String())
+	}
+}
+
+func TestJitterWithinRange(t *testing.T) {
+	base := 2 * time.Second
+	lo, hi := base*3/4, base*5/4
+
+	var sawLow, sawHigh bool
+	for i := 0; i < 1000; i++ {
+		d := jitter(base, 0.25)
+		if d < lo || d > hi {
+			t.Fatalf("jitter(%v, 0.25) = %v, want within [%v, %v]", base, d, lo, hi)
+		}
+		sawLow = sawLow || d < base
+		sawHigh = sawHigh || d > base
+	}
+	if !sawLow || !sawHigh {
+		t.Error("expected jitter to spread both below and above the base interval")
+	}
+
+	if d := jitter(base, 0); d != base {
+		t.Errorf("expected no jitter with fraction 0, got %v", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := jitter(base, 5); d < 0 || d > 2*base {
+			t.Fatalf("fraction above 1 should clamp, got %v", d)
+		}
+	}
+}
+
+func TestWriteReportEscapesContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.html")
+	status := TaskStatus{
+		ID:      "abc123",
+		Request: TaskStatusRequest{Goal: "open WhatsApp & count <unread>", Provider: "Google", Model: "gemini-2.0-flash"},
+		Status:  "completed",
+		Success: true,
+		Result:  "Found 3 unread messages",
+		Steps:   []any{"open app", map[string]any{"action": "tap", "target": "<Chats>"}},
+	}
+	if err := writeReport(path, status); err != nil {
+		t.Fatalf("writeReport: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	html := string(b)
+	for _, want := range []string{
+		"open WhatsApp &amp; count &lt;unread&gt;",
+		"Found 3 unread messages",
+		"open app",
+		"&lt;Chats&gt;",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected report to contain %q", want)
+		}
+	}
+	if strings.Contains(html, "<unread>") {
+		t.Error("goal must be HTML-escaped")
+	}
+}
+
+func TestResolveServerKeyPrecedence(t *testing.T) {
+	oldGet := keyringGet
+	defer func() { keyringGet = oldGet }()
+
+	stored := map[string]string{"http://srv:8000": "from-keyring"}
+	keyringGet = func(server string) (string, error) {
+		if k, ok := stored[server]; ok {
+			return k, nil
+		}
+		return "", errors.New("secret not found in keyring")
+	}
+
+	tests := []struct {
+		flagKey, envKey, server, want string
+	}{
+		{"from-flag", "from-env", "http://srv:8000", "from-flag"},
+		{"", "from-env", "http://srv:8000", "from-env"},
+		{"", "", "http://srv:8000", "from-keyring"},
+		{"", "", "http://other:8000", ""},
+	}
+	for _, tt := range tests {
+		if got := resolveServerKey(tt.flagKey, tt.envKey, tt.server); got != tt.want {
+			t.Errorf("resolveServerKey(%q, %q, %q) = %q, want %q", tt.flagKey, tt.envKey, tt.server, got, tt.want)
+		}
+	}
+
+	// No keyring at all (e.g. headless Linux without a secret service)
+	keyringGet = func(string) (string, error) { return "", errors.New("no keyring provider") }
+	if got := resolveServerKey("", "", "http://srv:8000"); got != "" {
+		t.Errorf("expected empty key without a keyring, got %q", got)
+	}
+}
+
+func TestStoreServerKey(t *testing.T) {
+	oldSet := keyringSet
+	defer func() { keyringSet = oldSet }()
+
+	var gotServer, gotKey string
+	keyringSet = func(server, key string) error {
+		gotServer, gotKey = server, key
+		return nil
+	}
+	if err := storeServerKey("http://srv:8000", strings.NewReader("  secret-key\n")); err != nil {
+		t.Fatalf("storeServerKey: %v", err)
+	}
+	if gotServer != "http://srv:8000" || gotKey != "secret-key" {
+		t.Errorf("stored %q for %q", gotKey, gotServer)
+	}
+
+	if err := storeServerKey("http://srv:8000", strings.NewReader("\n")); err == nil {
+		t.Error("expected an error for an empty key")
+	}
+
+	keyringSet = func(string, string) error { return errors.New("no keyring provider") }
+	if err := storeServerKey("http://srv:8000", strings.NewReader("k")); err == nil {
+		t.Error("expected an error when the keyring is unavailable")
+	}
+}
+
+func TestPollStatusReconnectsWithinGrace(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(TaskStatus{ID: "abc123", Status: "running"})
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close() // Server is down until the goroutine below brings it back
+
+	up := make(chan *http.Server, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("relisten: %v", err)
+			up <- nil
+			return
+		}
+		srv := &http.Server{Handler: handler}
+		up <- srv
+		_ = srv.Serve(ln)
+	}()
+
+	var notices strings.Builder
+	interval := func() time.Duration { return 50 * time.Millisecond }
+	status, err := pollStatus("http://"+addr, "", "abc123", 5*time.Second, interval, &notices)
+	if srv := <-up; srv != nil {
+		defer func() { _ = srv.Close() }()
+	}
+	if err != nil {
+		t.Fatalf("pollStatus: %v", err)
+	}
+	if status.Status != "running" {
+		t.Errorf("expected running, got %q", status.Status)
+	}
+	if !strings.Contains(notices.String(), "server unreachable, retrying") {
+		t.Errorf("expected an unreachable notice, got %q", notices.String())
+	}
+}
+
+func TestPollStatusGivesUpAfterGrace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	interval := func() time.Duration { return 20 * time.Millisecond }
+	start := time.Now()
+	_, err = pollStatus("http://"+addr, "", "abc123", 200*time.Millisecond, interval, io.Discard)
+	if err == nil {
+		t.Fatal("expected an error once the grace ran out")
+	}
+	if !strings.Contains(err.Error(), "server unreachable for") {
+		t.Errorf("expected the error to say how long it tried, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, expected about 200ms", elapsed)
+	}
+}
+
+func TestTaskTiming(t *testing.T) {
+	status := TaskStatus{
+		Status:     "completed",
+		CreatedAt:  "2024-05-01T10:00:00Z",
+		StartedAt:  "2024-05-01T10:00:03.5Z",
+		FinishedAt: "2024-05-01T10:00:45Z",
+	}
+	timing := taskTimingOf(status, 120*time.Millisecond, 47*time.Second)
+	want := taskTiming{SubmitMs: 120, WaitMs: 3500, RunMs: 41500, TotalMs: 47000}
+	if timing != want {
+		t.Errorf("expected %+v, got %+v", want, timing)
+	}
+
+	var buf strings.Builder
+	writeTiming(&buf, timing)
+	for _, line := range []string{"Submit:  120ms", "Queued:  3.5s", "Running: 41.5s", "Total:   47s"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q in:\n%s", line, buf.String())
+		}
+	}
+
+	out, _ := json.Marshal(timing)
+	if string(out) != `{"submit_ms":120,"wait_ms":3500,"run_ms":41500,"total_ms":47000}` {
+		t.Errorf("unexpected JSON %s", out)
+	}
+
+	// Cancelled while queued: the server's zero StartedAt means it never ran
+	status.StartedAt = "0001-01-01T00:00:00Z"
+	if got := taskTimingOf(status, 0, 0); got.WaitMs != 45000 || got.RunMs != 0 {
+		t.Errorf("expected all server time spent waiting, got %+v", got)
+	}
+}
+
+func TestPollStatusStopsOnUnknownTask(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(ErrorResponse{Error: "task not found"})
+	}))
+	defer srv.Close()
+
+	interval := func() time.Duration { return time.Millisecond }
+	_, err := pollStatus(srv.URL, "", "gone", 0, interval, io.Discard)
+	if err == nil || err.Error() != "task not found" {
+		t.Errorf("expected the server's 404 without retrying, got %v", err)
+	}
+}
+
+func TestSubmitExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{&droidrunclient.Error{StatusCode: 400, Code: "goal_required", Message: "goal is required"}, exitInvalidRequest},
+		{&droidrunclient.Error{StatusCode: 401, Code: "unauthorized", Message: "unauthorized"}, exitNoPermission},
+		{&droidrunclient.Error{StatusCode: 503, Code: "draining", Message: "server is shutting down"}, exitTryLater},
+		{&droidrunclient.QueueFullError{Code: "queue_full", Message: "queue is full"}, exitTryLater},
+		{&droidrunclient.Error{StatusCode: 400, Message: "from an older server"}, 1},
+		{errors.New("connection refused"), 1},
+	} {
+		if got := submitExitCode(tc.err); got != tc.want {
+			t.Errorf("%v: expected exit status %d, got %d", tc.err, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+)
+
+// reportTemplate renders a self-contained HTML page (inline CSS, no external
+// assets) so it can be shared as a single file.
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>DroidRun task {{.ID}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Roboto, sans-serif; max-width: 860px; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.4em; }
+.status { display: inline-block; padding: 0.2em 0.6em; border-radius: 4px; color: #fff; }
+.ok { background: #2e7d32; }
+.fail { background: #c62828; }
+dl { display: grid; grid-template-columns: max-content 1fr; gap: 0.3em 1em; }
+dt { font-weight: bold; }
+pre { background: #f5f5f5; padding: 0.8em; overflow-x: auto; white-space: pre-wrap; }
+ol li { margin-bottom: 0.8em; }
+</style>
+</head>
+<body>
+<h1>{{.Goal}}</h1>
+<p><span class="status {{if .Success}}ok{{else}}fail{{end}}">{{.Status}}{{if eq .Status "completed"}}{{if .Success}} - success{{else}} - unsuccessful{{end}}{{end}}</span></p>
+<dl>
+<dt>Task</dt><dd>{{.ID}}</dd>
+{{- if .App}}<dt>App</dt><dd>{{.App}}</dd>{{end}}
+{{- if .Model}}<dt>Model</dt><dd>{{.Provider}} / {{.Model}}</dd>{{end}}
+{{- if .CreatedAt}}<dt>Created</dt><dd>{{.CreatedAt}}</dd>{{end}}
+{{- if .FinishedAt}}<dt>Finished</dt><dd>{{.FinishedAt}}</dd>{{end}}
+</dl>
+<h2>Result</h2>
+<pre>{{if .Result}}{{.Result}}{{else}}(none){{end}}</pre>
+{{- if .Error}}
+<h2>Error</h2>
+<pre>{{.Error}}</pre>
+{{- end}}
+{{- if .Steps}}
+<h2>Steps</h2>
+<ol>
+{{- range .Steps}}
+<li><pre>{{.}}</pre></li>
+{{- end}}
+</ol>
+{{- end}}
+</body>
+</html>
+`))
+
+// reportData is the view model for reportTemplate.
+type reportData struct {
+	TaskStatus
+	Goal, App, Provider, Model string
+	Steps                      []string
+}
+
+// writeReport renders a completed task as a standalone HTML file.
+func writeReport(path string, status TaskStatus) error {
+	data := reportData{
+		TaskStatus: status,
+		Goal:       status.Request.Goal,
+		App:        status.Request.App,
+		Provider:   status.Request.Provider,
+		Model:      status.Request.Model,
+		Steps:      formatSteps(status.Steps),
+	}
+	if data.Goal == "" {
+		data.Goal = "Task " + status.ID
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(f, data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("render report: %w", err)
+	}
+	return f.Close()
+}
+
+// formatSteps renders each step for display: strings as-is, anything else as
+// indented JSON.
+func formatSteps(steps any) []string {
+	list, ok := steps.([]any)
+	if !ok {
+		if steps == nil {
+			return nil
+		}
+		list = []any{steps}
+	}
+	out := make([]string, 0, len(list))
+	for _, step := range list {
+		if s, ok := step.(string); ok {
+			out = append(out, s)
+			continue
+		}
+		// The template escapes HTML, so the JSON itself needn't
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(step)
+		out = append(out, strings.TrimSuffix(b.String(), "\n"))
+	}
+	return out
+}
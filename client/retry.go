@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"droidrun-client/droidrunclient"
+)
+
+// Set by -retries and -retry-delay.
+var (
+	connectRetries    = 3
+	connectRetryDelay = time.Second
+)
+
+// retryNotices is where connection retries are reported.
+var retryNotices io.Writer = os.Stderr
+
+// newClient returns a droidrunclient.Client for server, retrying while it
+// can't be connected to as -retries and -retry-delay say.
+func newClient(server, srvKey, apiKey string) *droidrunclient.Client {
+	return droidrunclient.New(
+		droidrunclient.WithBaseURL(server),
+		droidrunclient.WithServerKey(srvKey),
+		droidrunclient.WithAPIKey(apiKey),
+		droidrunclient.WithConnectRetries(connectRetries, connectRetryDelay, retryNotices),
+	)
+}
+
+// serverClient returns a droidrunclient.Client for server that fails at once
+// when it can't be connected to, for requests that report or retry that
+// themselves.
+func serverClient(server, srvKey string) *droidrunclient.Client {
+	return droidrunclient.New(droidrunclient.WithBaseURL(server), droidrunclient.WithServerKey(srvKey))
+}
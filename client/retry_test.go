@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withConnectRetries sets the retry settings for one test, discarding the
+// notices unless out is given.
+func withConnectRetries(t *testing.T, n int, delay time.Duration, out io.Writer) {
+	t.Helper()
+	oldN, oldDelay, oldOut := connectRetries, connectRetryDelay, retryNotices
+	t.Cleanup(func() { connectRetries, connectRetryDelay, retryNotices = oldN, oldDelay, oldOut })
+	if out == nil {
+		out = io.Discard
+	}
+	connectRetries, connectRetryDelay, retryNotices = n, delay, out
+}
+
+// unusedAddr returns a local address nothing is listening on.
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func TestSubmitRetriesUntilServerIsUp(t *testing.T) {
+	var notices bytes.Buffer
+	withConnectRetries(t, 6, 20*time.Millisecond, &notices)
+	addr := unusedAddr(t)
+
+	// The server comes up after the first attempts have been refused
+	var gotGoal atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotGoal.Store(string(body))
+		_, _ = io.WriteString(w, `{"task_id": "abc123", "status": "queued", "position": 1}`)
+	}))
+	defer srv.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		srv.Listener = l
+		srv.Start()
+	}()
+
+	resp, err := submitTask("http://"+addr, "", "key", TaskRequest{Goal: "open settings"})
+	if err != nil {
+		t.Fatalf("expected the submission to succeed once the server was up, got %v", err)
+	}
+	if resp.TaskID != "abc123" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if body, _ := gotGoal.Load().(string); !strings.Contains(body, "open settings") {
+		t.Errorf("expected the body to be sent again on retry, got %q", body)
+	}
+	if !strings.Contains(notices.String(), "Server unreachable") {
+		t.Errorf("expected a retry notice, got %q", notices.String())
+	}
+}
+
+func TestSubmitGivesUpAfterRetries(t *testing.T) {
+	var notices bytes.Buffer
+	withConnectRetries(t, 2, time.Millisecond, &notices)
+
+	if _, err := submitTask("http://"+unusedAddr(t), "", "key", TaskRequest{Goal: "test"}); err == nil {
+		t.Fatal("expected an error with the server down")
+	}
+	if n := strings.Count(notices.String(), "retrying"); n != 2 {
+		t.Errorf("expected 2 retries, got %d:\n%s", n, notices.String())
+	}
+}
+
+func TestSubmitDoesNotRetryClientErrors(t *testing.T) {
+	withConnectRetries(t, 3, time.Millisecond, nil)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"error": "goal is required"}`)
+	}))
+	defer srv.Close()
+
+	_, err := submitTask(srv.URL, "", "key", TaskRequest{})
+	if err == nil || err.Error() != "goal is required" {
+		t.Errorf("expected the server's error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected a 4xx not to be retried, got %d calls", calls.Load())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// varRef matches a ${NAME} reference in a task file field. Bare $NAME is
+// left alone, as prompts may well contain prices like $5.
+var varRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// varFlags collects -var name=value flags.
+type varFlags map[string]string
+
+func (v varFlags) String() string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (v varFlags) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || !varRef.MatchString("${"+name+"}") {
+		return fmt.Errorf("expected name=value, got %q", s)
+	}
+	v[name] = value
+	return nil
+}
+
+// lookupVar resolves a name from the -var flags, then the environment.
+func (v varFlags) lookupVar(name string) (string, bool) {
+	if value, ok := v[name]; ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// expandGoalVars replaces ${NAME} references in the prompt, app, deeplink,
+// and setup steps of a task file. Every undefined name is reported rather than
+// expanded to "", which would quietly send a different task.
+func expandGoalVars(g *GoalConfig, lookup func(name string) (string, bool)) error {
+	undefined := map[string]bool{}
+	expand := func(s string) string {
+		return varRef.ReplaceAllStringFunc(s, func(ref string) string {
+			name := ref[2 : len(ref)-1]
+			value, ok := lookup(name)
+			if !ok {
+				undefined[name] = true
+			}
+			return value
+		})
+	}
+	prompt, app, deeplink := expand(g.Prompt), expand(g.App), expand(g.Deeplink)
+	setup := make([]SetupConfig, len(g.Setup))
+	for i, s := range g.Setup {
+		setup[i] = SetupConfig{App: expand(s.App), Deeplink: expand(s.Deeplink)}
+	}
+	if len(undefined) > 0 {
+		names := make([]string, 0, len(undefined))
+		for name := range undefined {
+			names = append(names, "${"+name+"}")
+		}
+		sort.Strings(names)
+		return fmt.Errorf("undefined variables %s (set them in the environment or with -var name=value)", strings.Join(names, ", "))
+	}
+	g.Prompt, g.App, g.Deeplink, g.Setup = prompt, app, deeplink, setup
+	return nil
+}
+
+// hasVarRef reports whether s references a variable, so it can't be
+// checked until expanded.
+func hasVarRef(s string) bool {
+	return varRef.MatchString(s)
+}
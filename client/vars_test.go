@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandGoalVars(t *testing.T) {
+	t.Setenv("CONTACT", "Alice")
+	t.Setenv("APP", "com.whatsapp")
+	vars := varFlags{}
+	if err := vars.Set("CONTACT=Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	g := GoalConfig{
+		Prompt:   "Reply to ${CONTACT} with a thumbs up; it costs $5",
+		App:      "${APP}",
+		Deeplink: "whatsapp://send",
+		Setup:    []SetupConfig{{App: "${APP}/.Main"}, {Deeplink: "whatsapp://chat?to=${CONTACT}"}},
+	}
+	if err := expandGoalVars(&g, vars.lookupVar); err != nil {
+		t.Fatal(err)
+	}
+	if g.Prompt != "Reply to Bob with a thumbs up; it costs $5" || g.App != "com.whatsapp" || g.Deeplink != "whatsapp://send" {
+		t.Errorf("expected -var to override the environment and other text to be kept, got %+v", g)
+	}
+	if g.Setup[0].App != "com.whatsapp/.Main" || g.Setup[1].Deeplink != "whatsapp://chat?to=Bob" {
+		t.Errorf("expected setup steps expanded, got %+v", g.Setup)
+	}
+}
+
+func TestExpandGoalVarsUndefined(t *testing.T) {
+	g := GoalConfig{Prompt: "Message ${NOBODY_SET_THIS} and ${ALSO_UNSET}", App: "com.whatsapp"}
+	err := expandGoalVars(&g, varFlags{}.lookupVar)
+	if err == nil || !strings.Contains(err.Error(), "${ALSO_UNSET}, ${NOBODY_SET_THIS}") {
+		t.Errorf("expected both undefined variables reported, got %v", err)
+	}
+	if g.Prompt != "Message ${NOBODY_SET_THIS} and ${ALSO_UNSET}" {
+		t.Errorf("expected the goal untouched on error, got %q", g.Prompt)
+	}
+
+	if err := (varFlags{}).Set("no-equals"); err == nil {
+		t.Error("expected -var without = to be rejected")
+	}
+}
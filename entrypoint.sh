@@ -83,4 +83,6 @@ echo "========================================"
 echo ""
 
 # Start the server
-exec droidrun-server "${PORT:-8000}" /app/worker.py
+# DROIDRUN_SERVER_FLAGS is intentionally unquoted so it splits into flags
+# shellcheck disable=SC2086
+exec droidrun-server $DROIDRUN_SERVER_FLAGS "${PORT:-8000}" /app/worker.py
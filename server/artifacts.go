@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// handleTaskArtifacts serves GET /task/{id}/artifacts.zip: the task's
+// metadata (task.json), worker logs (logs.txt), and steps (steps.jsonl, one
+// per line), streamed so a large step log is never held in memory.
+func (a *API) handleTaskArtifacts(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	task, ok := a.queue.Snapshot(id)
+	if !ok {
+		writeError(w, CodeNotFound, "task not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+"-artifacts.zip"))
+	zw := zip.NewWriter(w)
+	if err := a.queue.writeArtifacts(zw, task); err != nil {
+		// Headers are sent; all we can do is cut the archive short
+		taskLog(id).Errorf("Failed to write artifacts: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		taskLog(id).Errorf("Failed to finish artifacts: %v", err)
+	}
+}
+
+// writeArtifacts adds a task's artifacts to zw. Logs and steps get their own
+// entries, so they are left out of task.json.
+func (q *Queue) writeArtifacts(zw *zip.Writer, task Task) error {
+	logs, steps := q.fullLogs(task), task.Steps
+	meta := task
+	meta.Logs, meta.Steps = "", nil
+
+	f, err := zw.Create("task.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(meta); err != nil {
+		return err
+	}
+
+	if logs != "" {
+		if f, err = zw.Create("logs.txt"); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, logs); err != nil {
+			return err
+		}
+	}
+
+	if task.StepCount > 0 {
+		source := task.ID
+		if task.ServedFromCache != "" {
+			source = task.ServedFromCache
+		}
+		stepLog, err := os.Open(q.stepsPath(source))
+		if err != nil {
+			return err
+		}
+		defer func() { _ = stepLog.Close() }()
+		if f, err = zw.Create("steps.jsonl"); err != nil {
+			return err
+		}
+		_, err = io.Copy(f, stepLog)
+		return err
+	}
+	list, _ := steps.([]any)
+	if len(list) == 0 {
+		return nil
+	}
+	if f, err = zw.Create("steps.jsonl"); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, step := range list {
+		line, err := json.Marshal(step)
+		if err != nil {
+			continue
+		}
+		_, _ = bw.Write(append(line, '\n'))
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTaskArtifactsZip(t *testing.T) {
+	worker := writeWorker(t, `import json, sys
+json.load(sys.stdin)
+print("opening app", file=sys.stderr)
+print(json.dumps({"append_step": {"action": "open app"}}), flush=True)
+print(json.dumps({"ok": True, "success": True, "reason": "done", "steps": [{"action": "open app"}, {"action": "tap"}]}))
+`)
+	for _, stepsDir := range []string{"", t.TempDir()} {
+		q := NewQueue(worker, 1)
+		q.stepsDir = stepsDir
+		api := NewAPI(q)
+		go q.Run()
+
+		task := q.Submit(TaskRequest{Goal: "test"}, "key")
+		waitForStatus(t, q, task.ID, "completed", "failed")
+
+		req := httptest.NewRequest("GET", "/task/"+task.ID+"/artifacts.zip", nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("expected a zip, got %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatalf("invalid zip: %v", err)
+		}
+		entries := map[string]string{}
+		var names []string
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("open %s: %v", f.Name, err)
+			}
+			data, _ := io.ReadAll(rc)
+			_ = rc.Close()
+			entries[f.Name] = string(data)
+			names = append(names, f.Name)
+		}
+		if strings.Join(names, ",") != "task.json,logs.txt,steps.jsonl" {
+			t.Fatalf("steps-dir %q: unexpected entries %v", stepsDir, names)
+		}
+
+		var meta Task
+		if err := json.Unmarshal([]byte(entries["task.json"]), &meta); err != nil || meta.ID != task.ID || meta.Status != "completed" {
+			t.Errorf("unexpected task.json: %s", entries["task.json"])
+		}
+		if !strings.Contains(entries["logs.txt"], "opening app") {
+			t.Errorf("expected worker logs, got %q", entries["logs.txt"])
+		}
+		// The streamed step is kept; the final list only replaces in-memory steps
+		want := 2
+		if stepsDir != "" {
+			want = 1
+		}
+		if lines := strings.Count(entries["steps.jsonl"], "\n"); lines != want {
+			t.Errorf("steps-dir %q: expected %d step lines, got %q", stepsDir, want, entries["steps.jsonl"])
+		}
+	}
+
+	api := NewAPI(NewQueue("./worker.py", 1))
+	req := httptest.NewRequest("GET", "/task/missing/artifacts.zip", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown task, got %d", w.Code)
+	}
+}
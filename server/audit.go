@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Audit log actions
+const (
+	AuditSubmit = "submit" // A task was queued by /run, /batch, or a rerun
+	AuditCancel = "cancel" // DELETE /task/{id}
+	AuditClear  = "clear"  // DELETE /queue
+)
+
+// auditEntry is one line of the -audit-log. It identifies the goal and the
+// server key by their SHA-256 hashes only, and never holds the LLM API key.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	RequestID string    `json:"request_id,omitempty"`
+	KeyLabel  string    `json:"key_label,omitempty"`  // Label of the server key, with auth enabled
+	KeyHash   string    `json:"key_sha256,omitempty"` // Hash of the server key, with auth enabled
+	TaskID    string    `json:"task_id,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	GoalHash  string    `json:"goal_sha256,omitempty"`
+	Tasks     int       `json:"tasks,omitempty"` // Tasks removed by a clear
+}
+
+// taskAuditEntry describes an action on task id, with request req.
+func taskAuditEntry(action, id string, req TaskRequestSafe) auditEntry {
+	return auditEntry{
+		Action:   action,
+		TaskID:   id,
+		Provider: req.Provider,
+		Model:    req.Model,
+		GoalHash: sha256Hex(req.Goal),
+	}
+}
+
+// auditLog appends one JSON line per entry to w. Writes are serialized so
+// concurrent requests never interleave lines.
+type auditLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time // Replaced in tests
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{w: w, now: time.Now}
+}
+
+// record fills in the entry's time and who made request r, then writes it.
+// A nil auditLog records nothing.
+func (l *auditLog) record(r *http.Request, entry auditEntry) {
+	if l == nil {
+		return
+	}
+	entry.RequestID, _ = r.Context().Value(requestIDCtxKey{}).(string)
+	if serverAPIKey != "" || len(serverKeys) > 0 {
+		entry.KeyLabel = identityFrom(r.Context()).Label
+		entry.KeyHash = sha256Hex(r.Header.Get("X-Server-Key"))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Time = l.now().UTC()
+	line, _ := json.Marshal(entry)
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		requestLog(r.Context(), entry.TaskID).Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// sha256Hex returns the hex SHA-256 of s.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
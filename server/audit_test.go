@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe to read while the audit log writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// auditEntries parses the audit log, failing on any malformed line.
+func auditEntries(t *testing.T, log string) []auditEntry {
+	t.Helper()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("malformed audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	defer func(key string) { serverAPIKey = key }(serverAPIKey)
+	serverAPIKey = "server-secret"
+
+	var log lockedBuffer
+	api := NewAPI(NewQueue("./worker.py", 1))
+	api.SetAuditLog(&log)
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	api.audit.now = func() time.Time { return now }
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Server-Key", "server-secret")
+		req.Header.Set("X-API-Key", "llm-secret")
+		req.Header.Set("X-Request-ID", "req-"+method)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/run", `{"goal":"text Alice the door code","provider":"Anthropic"}`)
+	var resp struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the task queued, got %d: %s", w.Code, w.Body)
+	}
+	do("POST", "/run", `{"provider":"Anthropic"}`) // Rejected, not audited
+	if w := do("DELETE", "/task/"+resp.TaskID, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected the task cancelled, got %d", w.Code)
+	}
+	if w := do("DELETE", "/queue?confirm=true", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected the queue cleared, got %d", w.Code)
+	}
+
+	out := log.String()
+	for _, secret := range []string{"llm-secret", "server-secret", "door code"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("audit log contains %q:\n%s", secret, out)
+		}
+	}
+	entries := auditEntries(t, out)
+	if len(entries) != 3 {
+		t.Fatalf("expected submit, cancel, and clear entries, got:\n%s", out)
+	}
+	submit := entries[0]
+	want := auditEntry{
+		Time:      now,
+		Action:    AuditSubmit,
+		RequestID: "req-POST",
+		KeyLabel:  "default",
+		KeyHash:   sha256Hex("server-secret"),
+		TaskID:    resp.TaskID,
+		Provider:  "Anthropic",
+		Model:     defaultModel("Anthropic"),
+		GoalHash:  sha256Hex("text Alice the door code"),
+	}
+	if submit != want {
+		t.Errorf("submit entry:\n got %+v\nwant %+v", submit, want)
+	}
+	if cancel := entries[1]; cancel.Action != AuditCancel || cancel.TaskID != resp.TaskID || cancel.GoalHash != want.GoalHash || cancel.RequestID != "req-DELETE" {
+		t.Errorf("unexpected cancel entry %+v", cancel)
+	}
+	if clear := entries[2]; clear.Action != AuditClear || clear.Tasks != 1 || clear.KeyHash != want.KeyHash {
+		t.Errorf("unexpected clear entry %+v", clear)
+	}
+}
+
+func TestAuditLogConcurrentLines(t *testing.T) {
+	var log lockedBuffer
+	api := NewAPI(NewQueue("./worker.py", 1))
+	api.SetAuditLog(&log)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/run", strings.NewReader(`{"goal":"`+strings.Repeat("x", 4000)+`"}`))
+			req.Header.Set("X-API-Key", "key")
+			api.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	entries := auditEntries(t, log.String())
+	if len(entries) != 50 {
+		t.Fatalf("expected 50 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.KeyHash != "" || e.KeyLabel != "" {
+			t.Errorf("expected no key fields with auth off, got %+v", e)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// keyIdentity is the server key a request authenticated with.
+type keyIdentity struct {
+	Label     string
+	Providers map[string]bool // Allowed LLM providers (nil = any)
+}
+
+// Allows reports whether the key may run tasks with provider.
+func (k *keyIdentity) Allows(provider string) bool {
+	return k.Providers == nil || k.Providers[provider]
+}
+
+// jumpQueueLabels holds the server key labels set by -jump-queue-keys, whose
+// tasks may use jump_queue.
+var jumpQueueLabels = map[string]bool{}
+
+// MayJumpQueue reports whether the key may submit jump_queue tasks.
+func (k *keyIdentity) MayJumpQueue() bool {
+	return jumpQueueLabels[k.Label]
+}
+
+// defaultIdentity is used for DROIDRUN_SERVER_KEY, which is unrestricted.
+var defaultIdentity = &keyIdentity{Label: "default"}
+
+// serverKeys holds additional labelled server keys loaded with -server-keys,
+// keyed by the key itself.
+var serverKeys = map[string]*keyIdentity{}
+
+// authenticate resolves an X-Server-Key value to its identity.
+func authenticate(key string) (*keyIdentity, bool) {
+	if id, ok := serverKeys[key]; ok && key != "" {
+		return id, true
+	}
+	// An empty DROIDRUN_SERVER_KEY only matches when no other keys exist
+	if key == serverAPIKey && (serverAPIKey != "" || len(serverKeys) == 0) {
+		return defaultIdentity, true
+	}
+	return nil, false
+}
+
+// Values of -auth-mode.
+const (
+	AuthModeAll       = "all"        // every endpoint but /health and /status needs a key
+	AuthModeWriteOnly = "write-only" // GET and HEAD requests are public
+)
+
+// authMode is set by -auth-mode.
+var authMode = AuthModeAll
+
+// requiresAuth reports whether a request must carry a valid server key.
+func requiresAuth(r *http.Request) bool {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	if path == "/health" || path == "/status" {
+		return false
+	}
+	if authMode == AuthModeWriteOnly && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return false
+	}
+	return true
+}
+
+type identityCtxKey struct{}
+
+func withIdentity(ctx context.Context, id *keyIdentity) context.Context {
+	return context.WithValue(ctx, identityCtxKey{}, id)
+}
+
+// identityFrom returns the authenticated key identity of a request.
+func identityFrom(ctx context.Context) *keyIdentity {
+	if id, ok := ctx.Value(identityCtxKey{}).(*keyIdentity); ok {
+		return id
+	}
+	return defaultIdentity
+}
+
+// loadServerKeys reads a keys file with one key per line:
+//
+//	label key [Provider1,Provider2]
+//
+// Blank lines and lines starting with # are ignored. Without a provider list
+// the key may use any provider.
+func loadServerKeys(path string) (map[string]*keyIdentity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	keys := map[string]*keyIdentity{}
+	labels := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected \"label key [providers]\"", n)
+		}
+		label, key := fields[0], fields[1]
+		if labels[label] {
+			return nil, fmt.Errorf("line %d: duplicate label %q", n, label)
+		}
+		if _, dup := keys[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key", n)
+		}
+		id := &keyIdentity{Label: label}
+		if len(fields) == 3 {
+			id.Providers = map[string]bool{}
+			for _, p := range strings.Split(fields[2], ",") {
+				if !validProviders[p] {
+					return nil, fmt.Errorf("line %d: invalid provider %q", n, p)
+				}
+				id.Providers[p] = true
+			}
+		}
+		labels[label] = true
+		keys[key] = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadServerKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# tenants\nteam-a key-a\n\nteam-b key-b Ollama,Google\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write keys file: %v", err)
+	}
+
+	keys, err := loadServerKeys(path)
+	if err != nil {
+		t.Fatalf("loadServerKeys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if id := keys["key-a"]; id.Label != "team-a" || !id.Allows("OpenAI") {
+		t.Errorf("expected unrestricted team-a, got %+v", id)
+	}
+	if id := keys["key-b"]; id.Label != "team-b" || id.Allows("OpenAI") || !id.Allows("Ollama") {
+		t.Errorf("expected team-b limited to Ollama and Google, got %+v", id)
+	}
+
+	for _, bad := range []string{"lonely\n", "a k1\na k2\n", "a k\nb k\n", "a k Bogus\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatalf("failed to write keys file: %v", err)
+		}
+		if _, err := loadServerKeys(path); err == nil {
+			t.Errorf("expected error for keys file %q", bad)
+		}
+	}
+}
+
+func TestRestrictedKeyProviders(t *testing.T) {
+	origKey, origKeys := serverAPIKey, serverKeys
+	defer func() { serverAPIKey, serverKeys = origKey, origKeys }()
+
+	serverAPIKey = "admin-key"
+	serverKeys = map[string]*keyIdentity{
+		"cheap-key": {Label: "cheap", Providers: map[string]bool{"Ollama": true}},
+	}
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	run := func(serverKey, body string) int {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(body))
+		req.Header.Set("X-Server-Key", serverKey)
+		req.Header.Set("X-API-Key", "llm-key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := run("cheap-key", `{"goal":"test","provider":"OpenAI"}`); code != http.StatusForbidden {
+		t.Errorf("expected 403 for restricted key using OpenAI, got %d", code)
+	}
+	if code := run("cheap-key", `{"goal":"test"}`); code != http.StatusForbidden {
+		t.Errorf("expected 403 for restricted key using the default provider, got %d", code)
+	}
+	if code := run("cheap-key", `{"goal":"test","provider":"Ollama"}`); code != http.StatusOK {
+		t.Errorf("expected 200 for restricted key using Ollama, got %d", code)
+	}
+	if code := run("admin-key", `{"goal":"test","provider":"OpenAI"}`); code != http.StatusOK {
+		t.Errorf("expected DROIDRUN_SERVER_KEY to stay unrestricted, got %d", code)
+	}
+	if code := run("", `{"goal":"test","provider":"Ollama"}`); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a key, got %d", code)
+	}
+
+	// With only labelled keys configured, an empty key must not authenticate
+	serverAPIKey = ""
+	if code := run("", `{"goal":"test","provider":"Ollama"}`); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with empty key when only -server-keys is set, got %d", code)
+	}
+}
+
+func TestJumpQueuePermission(t *testing.T) {
+	origKey, origKeys, origLabels := serverAPIKey, serverKeys, jumpQueueLabels
+	defer func() { serverAPIKey, serverKeys, jumpQueueLabels = origKey, origKeys, origLabels }()
+
+	serverAPIKey = "admin-key"
+	serverKeys = map[string]*keyIdentity{"ops-key": {Label: "ops"}}
+	jumpQueueLabels = map[string]bool{"ops": true}
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	q.Submit(TaskRequest{Goal: "queued"}, "key")
+
+	run := func(serverKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"emergency","jump_queue":true}`))
+		req.Header.Set("X-Server-Key", serverKey)
+		req.Header.Set("X-API-Key", "llm-key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := run("admin-key"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a key not in -jump-queue-keys, got %d", w.Code)
+	}
+	w := run("ops-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for an allowed key, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Position int `json:"position"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Position != 1 {
+		t.Errorf("expected the jump_queue task at position 1, got %d", resp.Position)
+	}
+}
+
+func TestWriteOnlyAuthMode(t *testing.T) {
+	origKey, origMode := serverAPIKey, authMode
+	defer func() { serverAPIKey, authMode = origKey, origMode }()
+	serverAPIKey = "test-server-key"
+	authMode = AuthModeWriteOnly
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+
+	do := func(method, path, serverKey string) int {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(`{"goal":"test","provider":"Ollama"}`))
+		if serverKey != "" {
+			req.Header.Set("X-Server-Key", serverKey)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, path := range []string{"/queue", "/task/" + task.ID} {
+		if code := do("GET", path, ""); code != http.StatusOK {
+			t.Errorf("GET %s: expected 200 without a key, got %d", path, code)
+		}
+	}
+	if code := do("POST", "/run", ""); code != http.StatusUnauthorized {
+		t.Errorf("POST /run: expected 401 without a key, got %d", code)
+	}
+	if code := do("DELETE", "/task/"+task.ID, ""); code != http.StatusUnauthorized {
+		t.Errorf("DELETE /task: expected 401 without a key, got %d", code)
+	}
+	if code := do("POST", "/run", "test-server-key"); code != http.StatusOK {
+		t.Errorf("POST /run: expected 200 with the key, got %d", code)
+	}
+
+	authMode = AuthModeAll
+	if code := do("GET", "/queue", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET /queue: expected 401 without a key in all mode, got %d", code)
+	}
+}
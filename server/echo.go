@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Worker modes for -worker-mode
+const (
+	WorkerModePython = "python" // run worker.py
+	WorkerModeEcho   = "echo"   // no device or LLM: succeed with the goal after echoDelay
+)
+
+// runEcho stands in for the worker in echo mode, so queueing, cancellation,
+// and polling can be exercised without a device. After q.echoDelay it writes
+// a successful result echoing the goal to out, as worker.py would. It returns
+// early if the task is cancelled, or sets timedOut once timeout passes.
+func (q *Queue) runEcho(task *Task, out io.Writer, timeout time.Duration, timedOut *atomic.Bool) {
+	changed, unsubscribe := q.Subscribe()
+	defer unsubscribe()
+	done := time.NewTimer(q.echoDelay)
+	defer done.Stop()
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	for {
+		select {
+		case <-done.C:
+			q.mu.RLock()
+			goal := task.Request.Goal
+			q.mu.RUnlock()
+			line, _ := json.Marshal(map[string]any{
+				"ok":      true,
+				"success": true,
+				"reason":  goal,
+				"steps":   []map[string]string{{"action": "echo", "goal": goal}},
+			})
+			_, _ = out.Write(append(line, '\n'))
+			return
+		case <-deadline:
+			timedOut.Store(true)
+			return
+		case <-changed:
+			q.mu.RLock()
+			cancelled := task.Status == "cancelled"
+			q.mu.RUnlock()
+			if cancelled {
+				return
+			}
+		}
+	}
+}
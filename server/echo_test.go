@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newEchoQueue(delay time.Duration) *Queue {
+	q := NewQueue("/nonexistent/worker.py", 1)
+	q.workerMode = WorkerModeEcho
+	q.echoDelay = delay
+	go q.Run()
+	return q
+}
+
+func TestEchoWorkerEndToEnd(t *testing.T) {
+	api := NewAPI(newEchoQueue(50 * time.Millisecond))
+
+	var ids []string
+	for _, goal := range []string{"open settings", "check battery"} {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal": "`+goal+`", "provider": "Ollama"}`))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			TaskID string `json:"task_id"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode run response: %v", err)
+		}
+		ids = append(ids, resp.TaskID)
+	}
+
+	// Poll like a client until both finish
+	for i, goal := range []string{"open settings", "check battery"} {
+		deadline := time.Now().Add(5 * time.Second)
+		var task Task
+		for time.Now().Before(deadline) {
+			req := httptest.NewRequest("GET", "/task/"+ids[i], nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			task = Task{}
+			if err := json.NewDecoder(w.Body).Decode(&task); err != nil {
+				t.Fatalf("failed to decode task: %v", err)
+			}
+			if task.Status == "completed" || task.Status == "failed" {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if task.Status != "completed" || !task.Success || task.Result != goal {
+			t.Errorf("expected %q echoed back, got %s success=%v result=%q (%s)", goal, task.Status, task.Success, task.Result, task.Error)
+		}
+	}
+}
+
+func TestEchoWorkerCancel(t *testing.T) {
+	q := newEchoQueue(10 * time.Second)
+
+	task := q.Submit(TaskRequest{Goal: "slow"}, "key")
+	waitForStatus(t, q, task.ID, "running")
+	start := time.Now()
+	if !q.Cancel(task.ID) {
+		t.Fatal("expected Cancel to succeed")
+	}
+	waitForIdle(t, q)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("echo worker ignored the cancel for %s", elapsed)
+	}
+	if got := waitForStatus(t, q, task.ID, "cancelled"); got.Result != "" {
+		t.Errorf("expected no result for a cancelled task, got %q", got.Result)
+	}
+}
+
+func TestEchoWorkerTimeout(t *testing.T) {
+	q := newEchoQueue(10 * time.Second)
+
+	task := q.Submit(TaskRequest{Goal: "slow", TimeoutSeconds: 1}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "failed" || got.FailureKind != FailureTimeout {
+		t.Errorf("expected a timeout failure, got %s/%s: %q", got.Status, got.FailureKind, got.Error)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Error categories recorded on tasks that failed with a worker error, so
+// clients can tell account problems from problems with the task itself.
+const (
+	ErrorQuotaExceeded = "quota_exceeded" // Provider usage quota used up
+	ErrorBilling       = "billing"        // Provider account has no credit or payment method
+	ErrorAuthInvalid   = "auth_invalid"   // Provider API key missing, wrong, or revoked
+	ErrorRateLimited   = "rate_limited"   // Too many requests; retrying later may work
+	ErrorProvider      = "provider_error" // Provider outage or network trouble
+	ErrorTask          = "task_error"     // Anything else: the task, app, or device
+)
+
+var errorCategories = map[string]bool{
+	ErrorQuotaExceeded: true,
+	ErrorBilling:       true,
+	ErrorAuthInvalid:   true,
+	ErrorRateLimited:   true,
+	ErrorProvider:      true,
+	ErrorTask:          true,
+}
+
+// errorPattern assigns category to errors matching re.
+type errorPattern struct {
+	category string
+	re       *regexp.Regexp
+}
+
+// defaultErrorPatterns match the errors the providers' SDKs tend to print.
+// They're tried in order, so the more specific account errors come before
+// the generic HTTP statuses.
+var defaultErrorPatterns = []errorPattern{
+	{ErrorBilling, regexp.MustCompile(`(?i)billing|payment required|\b402\b|credit balance is too low|insufficient (credit|balance|funds)`)},
+	{ErrorQuotaExceeded, regexp.MustCompile(`(?i)quota|resource[_ ]exhausted|exceeded your current`)},
+	{ErrorAuthInvalid, regexp.MustCompile(`(?i)(invalid|incorrect|missing) (x-)?api[_ -]?key|api[_ ]key[_ ](not[_ ]valid|invalid)|authentication[_ ]error|unauthorized|\b401\b|permission[_ ]denied|\b403\b`)},
+	{ErrorRateLimited, regexp.MustCompile(`(?i)rate[_ ]?limit|too many requests|\b429\b`)},
+	{ErrorProvider, regexp.MustCompile(`(?i)internal server error|service unavailable|bad gateway|overloaded|\b50[0234]\b|connection (refused|reset|error)|deadline exceeded`)},
+}
+
+// parseErrorPattern parses an -error-pattern spec of the form
+// category=regex.
+func parseErrorPattern(spec string) (errorPattern, error) {
+	category, expr, ok := strings.Cut(spec, "=")
+	if !ok || expr == "" {
+		return errorPattern{}, fmt.Errorf("expected category=regex")
+	}
+	if !errorCategories[category] {
+		return errorPattern{}, fmt.Errorf("unknown category %q", category)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return errorPattern{}, err
+	}
+	return errorPattern{category: category, re: re}, nil
+}
+
+// classifyError returns the category of the first pattern matching msg, or
+// ErrorTask if none does.
+func classifyError(patterns []errorPattern, msg string) string {
+	for _, p := range patterns {
+		if p.re.MatchString(msg) {
+			return p.category
+		}
+	}
+	return ErrorTask
+}
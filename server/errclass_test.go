@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		msg, want string
+	}{
+		{"google.api_core.exceptions.ResourceExhausted: 429 Quota exceeded for quota metric 'Generate Content API requests per minute'", ErrorQuotaExceeded},
+		{"Error code: 429 - {'error': {'message': 'You exceeded your current quota, please check your plan', 'type': 'insufficient_quota'}}", ErrorQuotaExceeded},
+		{"anthropic.BadRequestError: Your credit balance is too low to access the Anthropic API", ErrorBilling},
+		{"Error code: 402 - Payment Required", ErrorBilling},
+		{"openai.AuthenticationError: Error code: 401 - Incorrect API key provided", ErrorAuthInvalid},
+		{"400 API key not valid. Please pass a valid API key. [reason: \"API_KEY_INVALID\"]", ErrorAuthInvalid},
+		{"anthropic.RateLimitError: Error code: 429 - rate_limit_error", ErrorRateLimited},
+		{"Too Many Requests", ErrorRateLimited},
+		{"anthropic.InternalServerError: Error code: 529 - overloaded_error", ErrorProvider},
+		{"503 Service Unavailable", ErrorProvider},
+		{"httpx.ConnectError: connection refused", ErrorProvider},
+		{"adb: device 'emulator-5554' not found", ErrorTask},
+		{"", ErrorTask},
+	} {
+		if got := classifyError(defaultErrorPatterns, tc.msg); got != tc.want {
+			t.Errorf("%q: expected %s, got %s", tc.msg, tc.want, got)
+		}
+	}
+}
+
+func TestParseErrorPattern(t *testing.T) {
+	p, err := parseErrorPattern(`billing=account suspended`)
+	if err != nil {
+		t.Fatalf("parseErrorPattern: %v", err)
+	}
+	patterns := append([]errorPattern{p}, defaultErrorPatterns...)
+	if got := classifyError(patterns, "account suspended"); got != ErrorBilling {
+		t.Errorf("expected the custom pattern to apply, got %s", got)
+	}
+	if got := classifyError(patterns, "429 Too Many Requests"); got != ErrorRateLimited {
+		t.Errorf("expected the built-in patterns to still apply, got %s", got)
+	}
+
+	for _, bad := range []string{"billing", "billing=", "bogus=x", "quota_exceeded=("} {
+		if _, err := parseErrorPattern(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestProcessRecordsErrorCategory(t *testing.T) {
+	q := NewQueue(writeWorker(t, `
+import json, sys
+task = json.load(sys.stdin)
+if task["goal"] == "stderr":
+    print("openai.RateLimitError: Error code: 429", file=sys.stderr)
+    sys.exit(1)
+if task["goal"] == "reported":
+    print(json.dumps({"ok": False, "error": "Your credit balance is too low"}))
+else:
+    print(json.dumps({"ok": True, "success": False, "reason": "gave up"}))
+`), 1)
+	go q.Run()
+
+	for goal, want := range map[string]string{"stderr": ErrorRateLimited, "reported": ErrorBilling, "unsuccessful": ""} {
+		task := q.Submit(TaskRequest{Goal: goal}, "key")
+		got := waitForStatus(t, q, task.ID, "completed", "failed")
+		if got.ErrorCategory != want {
+			t.Errorf("%s: expected error_category %q, got %q (error %q)", goal, want, got.ErrorCategory, got.Error)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error codes sent as "code" in error responses, so clients can tell errors
+// apart without matching their messages. Messages may change; codes don't.
+const (
+	CodeMethodNotAllowed   = "method_not_allowed"   // The endpoint doesn't take this method
+	CodeUnauthorized       = "unauthorized"         // X-Server-Key missing or wrong
+	CodeForbidden          = "forbidden"            // The server key doesn't allow this provider or jump_queue
+	CodeNotFound           = "not_found"            // No such task, schedule, or provider
+	CodeInvalidJSON        = "invalid_json"         // The body couldn't be read or decoded
+	CodeBodyTooLarge       = "body_too_large"       // The body is over -max-body
+	CodeInvalidParameter   = "invalid_parameter"    // A query or path parameter is missing or malformed
+	CodeInvalidRequest     = "invalid_request"      // A task field is out of range or malformed
+	CodeGoalRequired       = "goal_required"        // The task has no goal
+	CodeFieldTooLong       = "field_too_long"       // A task field is over its size limit
+	CodeInvalidProvider    = "invalid_provider"     // Not a provider the server knows
+	CodeProviderDisabled   = "provider_disabled"    // Disabled with PUT /providers/{name}
+	CodeAPIKeyRequired     = "api_key_required"     // No X-API-Key and no server key for the provider
+	CodeInvalidApp         = "invalid_app"          // Not a package name or package/activity
+	CodeInvalidDeeplink    = "invalid_deeplink"     // Not a scheme://something URI, or its scheme isn't allowed
+	CodeInvalidSetup       = "invalid_setup"        // A setup step is malformed
+	CodeDependencyNotFound = "dependency_not_found" // The run_if or replay_of task doesn't exist
+	CodeInvalidSchedule    = "invalid_schedule"     // A schedule's cron or task can't be used
+	CodeCannotCancel       = "cannot_cancel"        // The task is gone or has already finished
+	CodeConfirmRequired    = "confirm_required"     // DELETE /queue without a matching confirmation
+	CodeRateLimited        = "rate_limited"         // Over -rate or -max-concurrent-submits; see Retry-After
+	CodeQueueFull          = "queue_full"           // Over -max-queue; see Retry-After
+	CodeDraining           = "draining"             // The server is shutting down
+	CodeTooManyStreams     = "too_many_streams"     // Over -max-subscribers
+	CodeServiceUnavailable = "service_unavailable"  // The request gave up waiting, e.g. for room in the queue
+	CodeInternal           = "internal_error"       // Something went wrong on the server
+)
+
+// codedError is an error carrying the code to report it with.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// errorf formats an error to be reported with code.
+func errorf(code, format string, args ...any) error {
+	return &codedError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// errorCode returns the code err carries, or fallback if it has none.
+func errorCode(err error, fallback string) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return fallback
+}
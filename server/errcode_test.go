@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	err := fmt.Errorf("setup[0]: %w", errorf(CodeInvalidDeeplink, "invalid deeplink: %s", "x"))
+	if got := errorCode(err, CodeInvalidRequest); got != CodeInvalidDeeplink {
+		t.Errorf("expected the wrapped error's code, got %q", got)
+	}
+	if got := errorCode(fmt.Errorf("plain"), CodeInvalidRequest); got != CodeInvalidRequest {
+		t.Errorf("expected the fallback for an uncoded error, got %q", got)
+	}
+}
+
+func TestErrorResponseCodes(t *testing.T) {
+	defer func(key string) { serverAPIKey = key }(serverAPIKey)
+	serverAPIKey = "server-secret"
+
+	q := NewQueue("./worker.py", 1)
+	q.maxQueue = 1
+	api := NewAPI(q)
+	q.tasks["done"] = &Task{ID: "done", Status: "completed"}
+
+	do := func(method, target, body string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if auth {
+			req.Header.Set("X-Server-Key", "server-secret")
+		}
+		req.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("POST", "/run", `{"goal":"fills the queue"}`, true); w.Code != http.StatusOK {
+		t.Fatalf("expected the first task queued, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+		auth                 bool
+		status               int
+		code                 string
+	}{
+		{"GET", "/queue", "", false, http.StatusUnauthorized, CodeUnauthorized},
+		{"PUT", "/run", "", true, http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{"GET", "/task/missing", "", true, http.StatusNotFound, CodeNotFound},
+		{"POST", "/run", `{"goal":`, true, http.StatusBadRequest, CodeInvalidJSON},
+		{"POST", "/run", `{"goal":"x","deeplink":"nope"}`, true, http.StatusBadRequest, CodeInvalidDeeplink},
+		{"POST", "/run", `{"goal":"x","setup":[{}]}`, true, http.StatusBadRequest, CodeInvalidSetup},
+		{"POST", "/run", `{"goal":"one too many"}`, true, http.StatusTooManyRequests, CodeQueueFull},
+		{"GET", "/task/done/logs?tail=x", "", true, http.StatusBadRequest, CodeInvalidParameter},
+		{"DELETE", "/task/done", "", true, http.StatusBadRequest, CodeCannotCancel},
+		{"DELETE", "/queue", "", true, http.StatusConflict, CodeConfirmRequired},
+	} {
+		w := do(tc.method, tc.target, tc.body, tc.auth)
+		var resp ErrorResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%s %s: failed to decode error response: %v", tc.method, tc.target, err)
+		}
+		if w.Code != tc.status || resp.Code != tc.code || resp.Error == "" {
+			t.Errorf("%s %s: expected %d %s, got %d %+v", tc.method, tc.target, tc.status, tc.code, w.Code, resp)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sseKeepalive is how often idle event streams send a comment line, which
+// also re-checks watched tasks in case a change signal was coalesced.
+var sseKeepalive = 15 * time.Second
+
+// TaskEvent is a compact progress update for one task, sent over SSE.
+type TaskEvent struct {
+	TaskID   string `json:"task_id"`
+	Status   string `json:"status"` // task status, or not_found
+	Position int    `json:"position"`
+	Steps    int    `json:"steps"`
+	Success  bool   `json:"success,omitempty"`
+	Result   string `json:"result,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Events returns the current event for each of the given task IDs, or for
+// every task (oldest first) when ids is empty.
+func (q *Queue) Events(ids []string) []TaskEvent {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if len(ids) == 0 {
+		for id := range q.tasks {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return q.tasks[ids[i]].CreatedAt.Before(q.tasks[ids[j]].CreatedAt)
+		})
+	}
+
+	events := make([]TaskEvent, 0, len(ids))
+	for _, id := range ids {
+		task := q.tasks[id]
+		if task == nil {
+			events = append(events, TaskEvent{TaskID: id, Status: "not_found", Position: -1})
+			continue
+		}
+		events = append(events, TaskEvent{
+			TaskID:   id,
+			Status:   task.Status,
+			Position: q.position(id),
+			Steps:    stepCount(task),
+			Success:  task.Success,
+			Result:   task.Result,
+			Error:    task.Error,
+		})
+	}
+	return events
+}
+
+// stepCount returns the number of steps a worker reported.
+func stepCount(task *Task) int {
+	if task.StepCount > 0 {
+		return task.StepCount
+	}
+	if s, ok := task.Steps.([]any); ok {
+		return len(s)
+	}
+	return 0
+}
+
+// handleEvents streams task events as Server-Sent Events. With
+// ?tasks=id1,id2 it multiplexes just those tasks and closes the stream once
+// all of them have finished; without it, it streams every task until the
+// client disconnects.
+func (a *API) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(r.URL.Query().Get("tasks"), ",") {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	a.streamEvents(w, r, ids)
+}
+
+// handleTaskEvents serves GET /task/{id}/events: the /events stream for a
+// single task, which ends once the task finishes.
+func (a *API) handleTaskEvents(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.queue.Get(id) == nil {
+		writeError(w, CodeNotFound, "task not found", http.StatusNotFound)
+		return
+	}
+	a.streamEvents(w, r, []string{id})
+}
+
+// streamEvents sends an event whenever one of the tasks changes, until they
+// have all finished (or, with no ids, until the client disconnects). It
+// returns as soon as the client goes away, dropping its subscription.
+func (a *API) streamEvents(w http.ResponseWriter, r *http.Request, ids []string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, CodeInternal, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	all := len(ids) == 0
+
+	if !a.addSubscriber() {
+		writeError(w, CodeTooManyStreams, fmt.Sprintf("too many event streams open (limit %d)", a.maxSubscribers), http.StatusServiceUnavailable)
+		return
+	}
+	defer a.subscribers.Add(-1)
+
+	// Subscribe before the first snapshot so no change falls in between
+	changed, unsubscribe := a.queue.Subscribe()
+	defer unsubscribe()
+
+	// Streams outlive the server's WriteTimeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+
+	last := make(map[string]TaskEvent)
+	for {
+		for _, ev := range a.queue.Events(ids) {
+			if prev, seen := last[ev.TaskID]; seen && prev == ev {
+				continue
+			}
+			last[ev.TaskID] = ev
+			if err := writeSSE(w, "task", ev); err != nil {
+				return
+			}
+			if !all && (isTerminal(ev.Status) || ev.Status == "not_found") {
+				ids = removeID(ids, ev.TaskID)
+			}
+		}
+		if !all && len(ids) == 0 {
+			_ = writeSSE(w, "done", map[string]any{})
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// addSubscriber counts a new event stream, returning false instead if
+// -max-subscribers are already open.
+func (a *API) addSubscriber() bool {
+	for {
+		n := a.subscribers.Load()
+		if a.maxSubscribers > 0 && n >= int64(a.maxSubscribers) {
+			return false
+		}
+		if a.subscribers.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// writeSSE writes one Server-Sent Event with a JSON payload.
+func writeSSE(w http.ResponseWriter, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		serverLog.Errorf("Failed to encode %s event: %v", event, err)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
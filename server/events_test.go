@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one parsed Server-Sent Event.
+type sseEvent struct {
+	Event string
+	Data  string
+}
+
+// readSSE reads events from a stream until it ends.
+func readSSE(t *testing.T, resp *http.Response) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var cur sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if cur.Event != "" {
+				events = append(events, cur)
+			}
+			cur = sseEvent{}
+		case strings.HasPrefix(line, "event: "):
+			cur.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			cur.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return events
+}
+
+func TestEventsMultiplexesTasks(t *testing.T) {
+	q := NewQueue(writeWorker(t, `
+import json, sys, time
+task = json.load(sys.stdin)
+time.sleep(0.2)
+print(json.dumps({"ok": True, "success": True, "reason": task["goal"]}))
+`), 1)
+	srv := httptest.NewServer(NewAPI(q))
+	defer srv.Close()
+
+	first := q.Submit(TaskRequest{Goal: "first"}, "key")
+	second := q.Submit(TaskRequest{Goal: "second"}, "key")
+
+	resp, err := http.Get(srv.URL + "/events?tasks=" + first.ID + "," + second.ID + ",unknown")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", ct)
+	}
+
+	go q.Run()
+	events := readSSE(t, resp)
+
+	statuses := make(map[string][]string)
+	for _, ev := range events[:len(events)-1] {
+		if ev.Event != "task" {
+			t.Fatalf("unexpected event %q", ev.Event)
+		}
+		var te TaskEvent
+		if err := json.Unmarshal([]byte(ev.Data), &te); err != nil {
+			t.Fatalf("invalid event data %q: %v", ev.Data, err)
+		}
+		statuses[te.TaskID] = append(statuses[te.TaskID], te.Status)
+	}
+
+	for _, id := range []string{first.ID, second.ID} {
+		got := statuses[id]
+		if len(got) == 0 || got[0] != "queued" || got[len(got)-1] != "completed" {
+			t.Errorf("task %s: expected queued ... completed, got %v", id, got)
+		}
+	}
+	// Intermediate states arrive live, not just the final snapshot
+	if !containsString(statuses[second.ID], "running") {
+		t.Errorf("expected running event for second task, got %v", statuses[second.ID])
+	}
+	if got := statuses["unknown"]; len(got) != 1 || got[0] != "not_found" {
+		t.Errorf("expected a single not_found event for unknown task, got %v", got)
+	}
+	if last := events[len(events)-1]; last.Event != "done" {
+		t.Errorf("expected stream to end with done event, got %q", last.Event)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTaskEventsStreamsSteps(t *testing.T) {
+	q := NewQueue(writeWorker(t, `
+import json, sys, time
+json.load(sys.stdin)
+for action in ["open", "tap"]:
+    time.sleep(0.1)
+    print(json.dumps({"append_step": {"action": action}}), flush=True)
+print(json.dumps({"ok": True, "success": True, "reason": "done"}))
+`), 1)
+	srv := httptest.NewServer(NewAPI(q))
+	defer srv.Close()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	resp, err := http.Get(srv.URL + "/task/" + task.ID + "/events")
+	if err != nil {
+		t.Fatalf("GET /task/{id}/events: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	go q.Run()
+
+	// The stream ends by itself once the task finishes
+	var steps []int
+	var last TaskEvent
+	for _, ev := range readSSE(t, resp) {
+		if ev.Event != "task" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(ev.Data), &last); err != nil {
+			t.Fatalf("invalid event data %q: %v", ev.Data, err)
+		}
+		if len(steps) == 0 || steps[len(steps)-1] != last.Steps {
+			steps = append(steps, last.Steps)
+		}
+	}
+	if last.Status != "completed" || !last.Success {
+		t.Errorf("expected the stream to end with the completed task, got %+v", last)
+	}
+	if len(steps) != 3 || steps[0] != 0 || steps[1] != 1 || steps[2] != 2 {
+		t.Errorf("expected an event per step, got step counts %v", steps)
+	}
+
+	resp, err = http.Get(srv.URL + "/task/missing/events")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown task, got %d", resp.StatusCode)
+	}
+}
+
+func TestTaskEventsDisconnect(t *testing.T) {
+	q := NewQueue(writeWorker(t, "import time\ntime.sleep(30)\n"), 1)
+	srv := httptest.NewServer(NewAPI(q))
+	defer srv.Close()
+	go q.Run()
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	defer q.Cancel(task.ID)
+	waitForStatus(t, q, task.ID, "running")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/task/"+task.ID+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	cancel()
+
+	// The handler must notice and drop its subscription
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		q.mu.RLock()
+		subs := len(q.subs)
+		q.mu.RUnlock()
+		if subs == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("event stream still subscribed after the client disconnected")
+}
+
+func TestEventsMaxSubscribers(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	api.SetMaxSubscribers(2)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	open := func(ctx context.Context) *http.Response {
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /events: %v", err)
+		}
+		return resp
+	}
+	waitFor := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for api.Subscribers() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d subscribers, got %d", n, api.Subscribers())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := open(ctx)
+	defer func() { _ = first.Body.Close() }()
+	second := open(context.Background())
+	defer func() { _ = second.Body.Close() }()
+	waitFor(2)
+
+	rejected := open(context.Background())
+	_ = rejected.Body.Close()
+	if rejected.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 beyond -max-subscribers, got %d", rejected.StatusCode)
+	}
+
+	// A disconnected subscriber frees its slot
+	cancel()
+	waitFor(1)
+	third := open(context.Background())
+	defer func() { _ = third.Body.Close() }()
+	if third.StatusCode != http.StatusOK {
+		t.Errorf("expected a new stream once one closed, got %d", third.StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Values of -log-format.
+const (
+	LogFormatText = "text" // Human-readable, e.g. "2025/01/28 10:00:00 [id] Starting task: ..."
+	LogFormatJSON = "json" // One JSON object per line, for log aggregators
+)
+
+// logFormat is set by -log-format.
+var logFormat = LogFormatText
+
+// setLogFormat switches every logger to format.
+func setLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+		log.SetFlags(log.LstdFlags)
+	case LogFormatJSON:
+		log.SetFlags(0) // Lines carry their own time
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	logFormat = format
+	return nil
+}
+
+// Log levels, only shown in JSON lines.
+const (
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+	levelFatal = "fatal"
+)
+
+// logger logs lines about one task, schedule, or request (or none, for the
+// server as a whole). In text mode the task or schedule is a prefix, as in
+// "[id] Completed"; in JSON mode each is a field of its own.
+type logger struct {
+	taskID     string
+	scheduleID string
+	requestID  string
+}
+
+// serverLog logs lines that aren't about a task or request.
+var serverLog logger
+
+func taskLog(id string) logger     { return logger{taskID: id} }
+func scheduleLog(id string) logger { return logger{scheduleID: id} }
+
+// requestLog logs a line about the request with ctx, and the task it
+// queued if any.
+func requestLog(ctx context.Context, taskID string) logger {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return logger{taskID: taskID, requestID: id}
+}
+
+type requestIDCtxKey struct{}
+
+// withRequestID stores a request's X-Request-ID for requestLog.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey{}, id)
+}
+
+// logLine is a line in JSON mode.
+type logLine struct {
+	Time       string `json:"time"`
+	Level      string `json:"level"`
+	TaskID     string `json:"task_id,omitempty"`
+	ScheduleID string `json:"schedule_id,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	Msg        string `json:"msg"`
+}
+
+func (l logger) Infof(format string, args ...any)  { l.output(levelInfo, format, args...) }
+func (l logger) Warnf(format string, args ...any)  { l.output(levelWarn, format, args...) }
+func (l logger) Errorf(format string, args ...any) { l.output(levelError, format, args...) }
+
+// Fatalf logs and exits with status 1.
+func (l logger) Fatalf(format string, args ...any) {
+	l.output(levelFatal, format, args...)
+	os.Exit(1)
+}
+
+func (l logger) output(level, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if logFormat != LogFormatJSON {
+		switch {
+		case l.taskID != "":
+			msg = "[" + l.taskID + "] " + msg
+		case l.scheduleID != "":
+			msg = "[schedule " + l.scheduleID + "] " + msg
+		}
+		if l.requestID != "" {
+			msg += " (request " + l.requestID + ")"
+		}
+		log.Print(msg)
+		return
+	}
+	b, _ := json.Marshal(logLine{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		Level:      level,
+		TaskID:     l.taskID,
+		ScheduleID: l.scheduleID,
+		RequestID:  l.requestID,
+		Msg:        msg,
+	})
+	log.Print(string(b))
+}
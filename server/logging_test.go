@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog sends log output in format to the returned buffer until the
+// test ends.
+func captureLog(t *testing.T, format string) *syncBuffer {
+	t.Helper()
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	if err := setLogFormat(format); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		_ = setLogFormat(LogFormatText)
+	})
+	return &buf
+}
+
+func TestTextLogKeepsTaskPrefix(t *testing.T) {
+	buf := captureLog(t, LogFormatText)
+	taskLog("abc").Infof("Completed: success=%v", true)
+	scheduleLog("s1").Infof("Fired task %s", "abc")
+
+	out := buf.String()
+	if !strings.Contains(out, "[abc] Completed: success=true\n") || !strings.Contains(out, "[schedule s1] Fired task abc\n") {
+		t.Errorf("expected the usual text lines, got %q", out)
+	}
+}
+
+func TestJSONLogLines(t *testing.T) {
+	buf := captureLog(t, LogFormatJSON)
+	taskLog("abc").Errorf("Failed: %s", "boom")
+
+	var line logLine
+	if err := json.Unmarshal([]byte(buf.String()), &line); err != nil {
+		t.Fatalf("expected a JSON line, got %q: %v", buf.String(), err)
+	}
+	if line.Level != levelError || line.TaskID != "abc" || line.Msg != "Failed: boom" || line.Time == "" {
+		t.Errorf("unexpected line %+v", line)
+	}
+}
+
+func TestJSONLogRequestID(t *testing.T) {
+	buf := captureLog(t, LogFormatJSON)
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	req := httptest.NewRequest("POST", "/run", strings.NewReader(`{"goal": "open settings"}`))
+	req.Header.Set("X-API-Key", "test-key")
+	req.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var line logLine
+	if err := json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &line); err != nil {
+		t.Fatalf("expected one JSON line, got %q: %v", buf.String(), err)
+	}
+	if line.RequestID != "req-1" || line.TaskID == "" || !strings.HasPrefix(line.Msg, "Queued") {
+		t.Errorf("expected the queued line with request and task IDs, got %+v", line)
+	}
+}
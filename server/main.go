@@ -2,26 +2,37 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+	_ "time/tzdata" // Validate timezones even in images without zoneinfo
+	"unicode/utf8"
 )
 
 // Version is set at build time
 var Version = "dev"
 
+// startTime is when the server started, for uptime reporting
+var startTime = time.Now()
+
 // serverAPIKey is the optional authentication key for the server itself
 var serverAPIKey = os.Getenv("DROIDRUN_SERVER_KEY")
 
@@ -35,26 +46,417 @@ var validProviders = map[string]bool{
 	"Ollama":      true,
 }
 
+// maxTimeoutSeconds caps a request's timeout_seconds (one day).
+const maxTimeoutSeconds = 24 * 60 * 60
+
+// Length limits for request fields, in bytes.
+const (
+	maxGoalBytes     = 8 << 10
+	maxAppBytes      = 256
+	maxDeeplinkBytes = 2048
+	maxModelBytes    = 128
+	maxBaseURLBytes  = 2048
+)
+
+// maxSetupSteps caps how many steps a request's setup may have.
+const maxSetupSteps = 10
+
+// defaultMaxBody is the default -max-body.
+const defaultMaxBody = 1 << 20
+
+// defaultProvider is used when a request names no provider. Set with
+// -default-provider.
+var defaultProvider = "Google"
+
+// defaultModel returns the model used when a request names none.
+func defaultModel(provider string) string {
+	switch provider {
+	case "Google", "GoogleGenAI":
+		return "gemini-2.0-flash"
+	case "Anthropic":
+		return "claude-sonnet-4-20250514"
+	case "OpenAI":
+		return "gpt-4o"
+	case "DeepSeek":
+		return "deepseek-chat"
+	case "Ollama":
+		return "llama3.2"
+	}
+	return ""
+}
+
+// appPattern validates the app field: an Android package name, optionally
+// followed by an activity component (com.app/.MainActivity or
+// com.app/com.app.ui.MainActivity). Segments after the first may start with a
+// digit, as some published packages do. Overridable with -app-pattern.
+var appPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z0-9_]+)+(/\.?[a-zA-Z_][a-zA-Z0-9_$]*(\.[a-zA-Z_][a-zA-Z0-9_$]*)*)?$`)
+
+// packagePattern validates a bare package name, where no component is allowed.
+var packagePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z0-9_]+)+$`)
+
+// localePattern validates the locale field as a BCP-47 tag: a language,
+// then optional script, region, and variant subtags (en, en-US, zh-Hant-TW,
+// de-CH-1996).
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z]{4})?(-([a-zA-Z]{2}|[0-9]{3}))?(-([a-zA-Z0-9]{5,8}|[0-9][a-zA-Z0-9]{3}))*$`)
+
+// autoVisionPattern matches goals that need screen understanding, for which
+// vision is enabled unless the request set it explicitly. Nil disables it.
+// Set with -auto-vision-keywords.
+var autoVisionPattern *regexp.Regexp
+
+// compileKeywords builds a case-insensitive whole-word pattern from a
+// comma-separated keyword list, or returns nil for an empty list.
+func compileKeywords(list string) *regexp.Regexp {
+	var quoted []string
+	for _, kw := range strings.Split(list, ",") {
+		if kw = strings.TrimSpace(kw); kw != "" {
+			quoted = append(quoted, regexp.QuoteMeta(kw))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// allowedDeeplinkSchemes restricts which deeplink schemes tasks may open
+// (lowercase). Empty allows all. Set with -allowed-deeplink-schemes.
+var allowedDeeplinkSchemes = map[string]bool{}
+
+// serverProviderKeys holds LLM API keys loaded server-side, keyed by provider.
+// They are used when a request doesn't carry its own key and are never logged
+// or returned in API responses.
+var serverProviderKeys = map[string]string{}
+
+// stringList is a flag.Value that collects repeated flag occurrences.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 func main() {
+	keysFile := flag.String("keys", "", "File of server-side provider API keys as NAME=key lines (e.g. GOOGLE_API_KEY=...), used when a request has no X-API-Key; the environment's are used too")
+	var keyFiles stringList
+	flag.Var(&keyFiles, "key-file", "Load a provider API key from a file, as Provider=path (repeatable)")
+	providerConfigFile := flag.String("provider-config", "", "JSON file of per-provider gateway settings, {\"Provider\": {\"base_url\": ..., \"headers\": {...}}}, passed to the worker")
+	serverKeysFile := flag.String("server-keys", "", "File of additional server keys, one \"label key [Provider1,Provider2]\" per line")
+	authModeFlag := flag.String("auth-mode", AuthModeAll, "Which requests need a server key: all, or write-only to leave GET requests public")
+	var redactPatterns stringList
+	flag.Var(&redactPatterns, "redact", "Regex whose matches are masked in task logs and results, in addition to built-in token patterns (repeatable)")
+	var notifySinks stringList
+	var routeSpecs stringList
+	var errorPatternSpecs stringList
+	flag.Var(&errorPatternSpecs, "error-pattern", "Classify worker errors matching a regex: category=regex, tried before the built-in patterns (repeatable; categories: quota_exceeded, billing, auth_invalid, rate_limited, provider_error, task_error)")
+	flag.Var(&routeSpecs, "route", "Run tasks with a label on another worker: label:key=value=path (repeatable, first match wins)")
+	flag.Var(&notifySinks, "notify", "Send completion events to a sink: webhook=URL, file=PATH, exec=PATH, or nats=nats://host:port/subject (repeatable)")
+	webhookFormatFlag := flag.String("webhook-format", WebhookFormatEvent, "Body of -notify webhook posts: event (full completion event) or summary (one-line text plus key fields, e.g. for Slack)")
+	callbackWorkers := flag.Int("callback-workers", 4, "Number of goroutines delivering -notify events")
+	appPatternFlag := flag.String("app-pattern", "", "Regex that app package names must match (default: package name or package/activity)")
+	logFormatFlag := flag.String("log-format", LogFormatText, "Log format: text, or json for one JSON object per line (time, level, msg, and task_id, schedule_id, request_id where known)")
+	debug := flag.Bool("debug", false, "Log worker invocation details (command, working dir, env var names)")
+	stepExtension := flag.Int("allow-step-extension", 0, "Let workers request up to this many extra steps per task beyond max_steps (0 = never)")
+	statePath := flag.String("state", "", "Save tasks to this JSON file on every status change and restore them at startup")
+	stepsDir := flag.String("steps-dir", "", "Stream each task's steps to a file in this directory instead of keeping them in memory")
+	isolateHome := flag.Bool("isolate-home", false, "Run each worker with its own temporary HOME, removed when the task finishes")
+	workerCmd := flag.String("worker-cmd", "python3", "Interpreter (with any args, e.g. \"/opt/venv/bin/python -u\") that runs .py workers; other worker paths run as executables")
+	var workerArgs stringList
+	flag.Var(&workerArgs, "worker-arg", "Argument passed to the worker after its path (repeatable)")
+	workerMode := flag.String("worker-mode", WorkerModePython, "How tasks run: python (worker.py) or echo (no device or LLM; succeed with the goal after -echo-delay, for testing)")
+	echoDelay := flag.Duration("echo-delay", time.Second, "Simulated run time of each task with -worker-mode echo")
+	concurrency := flag.Int("concurrency", 1, "Number of workers that run tasks at the same time")
+	taskTTL := flag.Duration("task-ttl", 0, "Forget finished tasks this long after they finish (0 = keep forever)")
+	cacheTTL := flag.Duration("cache-ttl", 10*time.Minute, "How long successful results of cacheable tasks are reused")
+	maxQueue := flag.Int("max-queue", 0, "Maximum number of queued tasks (0 = unlimited)")
+	retryBudget := flag.Int("retry-budget", 0, "Maximum task retries per minute across the whole queue (0 = unlimited)")
+	retryCategories := flag.String("retry-categories", "", "Comma-separated error categories a worker error may be retried for, e.g. rate_limited,provider_error (empty = all)")
+	banner := flag.String("banner", "", "Operator message returned as \"message\" in /health (change at runtime with POST /health/message)")
+	cancelGrace := flag.Duration("cancel-grace", 5*time.Second, "On cancel, how long a worker gets to exit after SIGTERM before it is killed (0 = kill at once)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "On SIGTERM, how long to let in-flight HTTP requests finish")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "On SIGTERM, how long to let running workers finish before killing them, while still serving status requests and refusing new tasks with 503")
+	taskTimeout := flag.Duration("task-timeout", 0, "Default time limit for a task's worker, after which it is killed and the task fails; requests may override it with timeout_seconds (0 = no limit)")
+	autoVisionKeywords := flag.String("auto-vision-keywords", "", "Comma-separated words or phrases (e.g. \"tap the,button,icon,color\") that turn on vision for goals containing them, unless the request sets vision explicitly")
+	deeplinkSchemes := flag.String("allowed-deeplink-schemes", "", "Comma-separated deeplink schemes tasks may open, e.g. instagram,whatsapp,tel (empty = all)")
+	defaultProviderFlag := flag.String("default-provider", defaultProvider, "Provider used when a request names none")
+	onFull := flag.String("on-full", OnFullReject, "What to do when the queue is full: reject, block, or drop-oldest")
+	jumpQueueKeys := flag.String("jump-queue-keys", "", "Comma-separated server key labels (\"default\" for DROIDRUN_SERVER_KEY) whose tasks may set jump_queue to run next")
+	maxSubscribers := flag.Int("max-subscribers", 0, "Maximum event streams (/events, /task/{id}/events) open at once; more get 503 (0 = unlimited)")
+	maxOutput := flag.Int("max-output", defaultMaxOutput, "Maximum bytes of a task's result and logs to keep; longer ones keep their end after a truncation marker, and -steps-dir keeps the whole logs for /task/{id}/logs (0 = unlimited)")
+	maxBody := flag.Int64("max-body", defaultMaxBody, "Maximum request body in bytes; larger bodies get 413 (0 = unlimited)")
+	auditPath := flag.String("audit-log", "", "Append a JSON line to this file for every submission, cancellation, and queue clear: time, request ID, server key label and hash, task, provider/model, and goal hash (never the goal or API key)")
+	rate := flag.String("rate", "", "Maximum /run and /batch requests per client as N/min (or N/s), refilled gradually with bursts of up to N; more get 429 with Retry-After. Clients are server keys, or addresses when auth is off (empty = unlimited)")
+	maxConcurrentSubmits := flag.Int("max-concurrent-submits", 0, "Maximum /run and /batch requests one submitter (server key and client address) may have in flight at once; more get 429 (0 = unlimited)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: droidrun-server [flags] [port] [worker-path]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := setLogFormat(*logFormatFlag); err != nil {
+		serverLog.Fatalf("Invalid -log-format: %v", err)
+	}
+	if *serverKeysFile != "" {
+		keys, err := loadServerKeys(*serverKeysFile)
+		if err != nil {
+			serverLog.Fatalf("Failed to load -server-keys: %v", err)
+		}
+		serverKeys = keys
+		serverLog.Infof("Loaded %d server keys from %s", len(keys), *serverKeysFile)
+	}
+
+	switch *authModeFlag {
+	case AuthModeAll, AuthModeWriteOnly:
+		authMode = *authModeFlag
+	default:
+		serverLog.Fatalf("Invalid -auth-mode %q (expected all or write-only)", *authModeFlag)
+	}
+
+	for _, label := range strings.Split(*jumpQueueKeys, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			jumpQueueLabels[label] = true
+		}
+	}
+
 	// Server authentication is mandatory
-	if serverAPIKey == "" {
-		log.Fatal("DROIDRUN_SERVER_KEY environment variable is required")
+	if serverAPIKey == "" && len(serverKeys) == 0 {
+		serverLog.Fatalf("DROIDRUN_SERVER_KEY environment variable (or -server-keys) is required")
 	}
 
 	port := "8000"
-	if len(os.Args) > 1 {
-		port = os.Args[1]
+	if flag.NArg() > 0 {
+		port = flag.Arg(0)
 	}
 
 	workerPath := "./worker.py"
-	if len(os.Args) > 2 {
-		workerPath = os.Args[2]
+	if flag.NArg() > 1 {
+		workerPath = flag.Arg(1)
+	}
+
+	if *appPatternFlag != "" {
+		re, err := regexp.Compile(*appPatternFlag)
+		if err != nil {
+			serverLog.Fatalf("Invalid -app-pattern: %v", err)
+		}
+		appPattern = re
 	}
 
-	q := NewQueue(workerPath)
+	for _, scheme := range strings.Split(*deeplinkSchemes, ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			allowedDeeplinkSchemes[scheme] = true
+		}
+	}
+
+	autoVisionPattern = compileKeywords(*autoVisionKeywords)
+
+	if !validProviders[*defaultProviderFlag] {
+		serverLog.Fatalf("Invalid -default-provider %q (valid: Google, GoogleGenAI, Anthropic, OpenAI, DeepSeek, Ollama)", *defaultProviderFlag)
+	}
+	defaultProvider = *defaultProviderFlag
+
+	switch *onFull {
+	case OnFullReject, OnFullBlock, OnFullDropOldest:
+	default:
+		serverLog.Fatalf("Invalid -on-full %q (expected reject, block, or drop-oldest)", *onFull)
+	}
+	if *maxQueue < 0 {
+		serverLog.Fatalf("Invalid -max-queue %d (must be 0 or more)", *maxQueue)
+	}
+	if *maxSubscribers < 0 {
+		serverLog.Fatalf("Invalid -max-subscribers %d (must be 0 or more)", *maxSubscribers)
+	}
+	if *maxConcurrentSubmits < 0 {
+		serverLog.Fatalf("Invalid -max-concurrent-submits %d (must be 0 or more)", *maxConcurrentSubmits)
+	}
+	if *maxBody < 0 {
+		serverLog.Fatalf("Invalid -max-body %d (must be 0 or more)", *maxBody)
+	}
+	ratePerMinute, err := parseRate(*rate)
+	if err != nil {
+		serverLog.Fatalf("Invalid -rate: %v", err)
+	}
+
+	// Server-side provider keys: the environment, then -keys, then -key-file
+	sources := []func(string) string{os.Getenv}
+	if *keysFile != "" {
+		vars, err := loadKeysFile(*keysFile)
+		if err != nil {
+			serverLog.Fatalf("Invalid -keys file %s: %v", *keysFile, err)
+		}
+		sources = append(sources, func(name string) string { return vars[name] })
+	}
+	for _, lookup := range sources {
+		for provider, key := range providerKeysFrom(lookup) {
+			serverProviderKeys[provider] = key
+		}
+	}
+	for _, kf := range keyFiles {
+		provider, path, ok := strings.Cut(kf, "=")
+		if !ok || !validProviders[provider] {
+			serverLog.Fatalf("Invalid -key-file %q (expected Provider=path with a valid provider)", kf)
+		}
+		key, err := readKeyFile(path)
+		if err != nil {
+			serverLog.Fatalf("Failed to load %s API key: %v", provider, err)
+		}
+		serverProviderKeys[provider] = key
+		serverLog.Infof("Loaded %s API key from %s", provider, path)
+	}
+	if len(serverProviderKeys) > 0 {
+		// Provider names only, never the keys
+		names := make([]string, 0, len(serverProviderKeys))
+		for provider := range serverProviderKeys {
+			names = append(names, provider)
+		}
+		sort.Strings(names)
+		serverLog.Infof("Server-side API keys for: %s", strings.Join(names, ", "))
+	}
+
+	if *concurrency < 1 {
+		serverLog.Fatalf("Invalid -concurrency %d (must be 1 or more)", *concurrency)
+	}
+	q := NewQueue(workerPath, *concurrency)
+	q.workerCmd = strings.Fields(*workerCmd)
+	if len(q.workerCmd) == 0 {
+		serverLog.Fatalf("Invalid -worker-cmd (empty)")
+	}
+	q.workerArgs = workerArgs
+	switch *workerMode {
+	case WorkerModePython:
+	case WorkerModeEcho:
+		q.workerMode = WorkerModeEcho
+		q.echoDelay = *echoDelay
+		serverLog.Infof("Echo worker mode: tasks succeed with their goal after %s, nothing runs on a device", *echoDelay)
+	default:
+		serverLog.Fatalf("Invalid -worker-mode %q (expected python or echo)", *workerMode)
+	}
+	q.cacheTTL = *cacheTTL
+	q.debug = *debug
+	q.isolateHome = *isolateHome
+	if *stepExtension < 0 {
+		serverLog.Fatalf("Invalid -allow-step-extension %d (must be >= 0)", *stepExtension)
+	}
+	q.stepExtension = *stepExtension
+	if *stepsDir != "" {
+		if err := os.MkdirAll(*stepsDir, 0700); err != nil {
+			serverLog.Fatalf("Invalid -steps-dir: %v", err)
+		}
+		q.stepsDir = *stepsDir
+	}
+	if *maxOutput < 0 {
+		serverLog.Fatalf("Invalid -max-output %d (must be >= 0)", *maxOutput)
+	}
+	q.maxOutput = *maxOutput
+	q.maxQueue = *maxQueue
+	q.onFull = *onFull
+	q.retryBudget = *retryBudget
+	if *retryCategories != "" {
+		q.retryCategories = map[string]bool{}
+		for _, c := range strings.Split(*retryCategories, ",") {
+			c = strings.TrimSpace(c)
+			if !errorCategories[c] {
+				serverLog.Fatalf("Invalid -retry-categories %q: unknown category %q", *retryCategories, c)
+			}
+			q.retryCategories[c] = true
+		}
+	}
+	q.taskTimeout = *taskTimeout
+	q.cancelGrace = *cancelGrace
+	extra, err := compileRedactPatterns(redactPatterns)
+	if err != nil {
+		serverLog.Fatalf("Invalid -redact pattern: %v", err)
+	}
+	q.redactors = append(q.redactors, extra...)
+	if *providerConfigFile != "" {
+		configs, err := loadProviderConfigs(*providerConfigFile)
+		if err != nil {
+			serverLog.Fatalf("Invalid -provider-config: %v", err)
+		}
+		q.providerConfigs = configs
+		q.redactors = append(q.redactors, headerRedactors(configs)...)
+		for name, cfg := range configs {
+			// Header names only; their values are secrets
+			names := make([]string, 0, len(cfg.Headers))
+			for header := range cfg.Headers {
+				names = append(names, header)
+			}
+			sort.Strings(names)
+			serverLog.Infof("Provider %s: base_url=%q headers=%v", name, cfg.BaseURL, names)
+		}
+	}
+	for _, spec := range routeSpecs {
+		route, err := parseRoute(spec)
+		if err != nil {
+			serverLog.Fatalf("Invalid -route %q: %v", spec, err)
+		}
+		q.routes = append(q.routes, route)
+		serverLog.Infof("Route: label %s=%s -> %s", route.key, route.value, route.path)
+	}
+	var errorPatterns []errorPattern
+	for _, spec := range errorPatternSpecs {
+		p, err := parseErrorPattern(spec)
+		if err != nil {
+			serverLog.Fatalf("Invalid -error-pattern %q: %v", spec, err)
+		}
+		errorPatterns = append(errorPatterns, p)
+	}
+	q.errorPatterns = append(errorPatterns, defaultErrorPatterns...)
+	switch *webhookFormatFlag {
+	case WebhookFormatEvent, WebhookFormatSummary:
+		webhookFormat = *webhookFormatFlag
+	default:
+		serverLog.Fatalf("Invalid -webhook-format %q (expected event or summary)", *webhookFormatFlag)
+	}
+	var sinks multiNotifier
+	for _, spec := range notifySinks {
+		n, err := parseNotifier(spec)
+		if err != nil {
+			serverLog.Fatalf("Invalid -notify %q: %v", spec, err)
+		}
+		sinks = append(sinks, n)
+	}
+	if len(sinks) > 0 {
+		q.SetNotifier(sinks, *callbackWorkers)
+	}
+	if *statePath != "" {
+		if err := q.LoadState(*statePath); err != nil {
+			// Keep the bad file for inspection rather than overwriting it
+			serverLog.Warnf("Ignoring unreadable -state file, starting empty: %v", err)
+			if err := os.Rename(*statePath, *statePath+".corrupt"); err == nil {
+				serverLog.Warnf("Moved it to %s.corrupt", *statePath)
+			}
+		}
+		go q.PersistState(*statePath, nil)
+	}
+	if *taskTTL < 0 {
+		serverLog.Fatalf("Invalid -task-ttl %s (must be 0 or more)", *taskTTL)
+	}
+	if *taskTTL > 0 {
+		go q.ReapExpired(*taskTTL, nil)
+	}
+	if problem := q.ProbeWorkers(); problem != "" {
+		serverLog.Errorf("Worker unavailable, /health will report 503: %s", problem)
+	}
 	go q.Run()
 
 	api := NewAPI(q)
+	api.SetBanner(*banner)
+	api.SetMaxConcurrentSubmits(*maxConcurrentSubmits)
+	api.SetRateLimit(ratePerMinute)
+	api.SetMaxBody(*maxBody)
+	api.SetMaxSubscribers(*maxSubscribers)
+	if *auditPath != "" {
+		f, err := os.OpenFile(*auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			serverLog.Fatalf("Invalid -audit-log: %v", err)
+		}
+		defer func() { _ = f.Close() }()
+		api.SetAuditLog(f)
+		serverLog.Infof("Auditing submissions and cancellations to %s", *auditPath)
+	}
+	go api.schedules.Run()
 
 	srv := &http.Server{
 		Addr:         ":" + port,
@@ -70,48 +472,157 @@ func main() {
 
 	go func() {
 		<-quit
-		log.Println("Server shutting down...")
-
-		// Give outstanding requests 30 seconds to complete
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		srv.SetKeepAlivesEnabled(false)
-		if err := srv.Shutdown(ctx); err != nil {
-			log.Printf("Could not gracefully shutdown: %v", err)
+		serverLog.Infof("Server shutting down...")
+		gracefulShutdown(srv, q, *shutdownTimeout, *drainTimeout)
+		if *statePath != "" {
+			if err := q.SaveState(*statePath); err != nil {
+				serverLog.Errorf("Failed to save state to %s: %v", *statePath, err)
+			} else if n := q.Size(); n > 0 {
+				serverLog.Infof("Saved %d queued tasks to %s to run after restart", n, *statePath)
+			}
 		}
 		close(done)
 	}()
 
-	log.Printf("DroidRun server v%s starting on :%s", Version, port)
-	log.Printf("Worker: %s", workerPath)
-	log.Printf("Server authentication: enabled")
+	serverLog.Infof("DroidRun server v%s starting on :%s", Version, port)
+	serverLog.Infof("Worker: %s", workerPath)
+	serverLog.Infof("Server authentication: enabled")
 
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
+		serverLog.Fatalf("Server error: %v", err)
 	}
 
 	<-done
-	log.Println("Server stopped")
+	serverLog.Infof("Server stopped")
+}
+
+// gracefulShutdown first drains the queue: for up to drainTimeout the server
+// keeps answering requests, refusing new tasks with 503, while running
+// workers finish (they are killed after that). Then it lets in-flight HTTP
+// requests finish for up to httpTimeout. Queued tasks are left for
+// SaveState.
+func gracefulShutdown(srv *http.Server, q *Queue, httpTimeout, drainTimeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := q.Drain(ctx); err != nil {
+		serverLog.Warnf("Worker did not finish within %s: %v", drainTimeout, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), httpTimeout)
+	defer cancel()
+	srv.SetKeepAlivesEnabled(false)
+	if err := srv.Shutdown(ctx); err != nil {
+		serverLog.Errorf("Could not gracefully shutdown: %v", err)
+	}
 }
 
 // --- HTTP API (easy to replace) ---
 
+// apiVersion is the API's version. Every endpoint is served under apiPrefix
+// and, for clients from before versioning, without it. A breaking change
+// gets a new version and prefix, leaving these paths as they are.
+const (
+	apiVersion = "v1"
+	apiPrefix  = "/" + apiVersion
+)
+
 type API struct {
-	queue *Queue
-	mux   *http.ServeMux
+	queue     *Queue
+	schedules *Scheduler
+	mux       *http.ServeMux
+	banner    atomic.Pointer[string] // Operator message shown in /health (nil = none)
+	submits   *submitLimiter         // In-flight /run and /batch requests per submitter
+	maxBody   int64                  // Request body limit in bytes (0 = unlimited)
+	rate      *rateLimiter           // /run and /batch requests over time per client
+	audit     *auditLog              // Submissions and cancellations, from -audit-log (nil = off)
+
+	maxSubscribers int          // Cap on open event streams (0 = unlimited)
+	subscribers    atomic.Int64 // Open event streams
 }
 
 func NewAPI(q *Queue) *API {
-	a := &API{queue: q, mux: http.NewServeMux()}
-	a.mux.HandleFunc("/run", a.handleRun)
-	a.mux.HandleFunc("/task/", a.handleTask)
-	a.mux.HandleFunc("/queue", a.handleQueue)
-	a.mux.HandleFunc("/deeplinks", a.handleDeeplinks)
-	a.mux.HandleFunc("/health", a.handleHealth)
+	a := &API{queue: q, schedules: q.schedules, mux: http.NewServeMux(), submits: newSubmitLimiter(0), rate: newRateLimiter(0), maxBody: defaultMaxBody}
+	for _, route := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/run", a.handleRun},
+		{"/batch", a.handleBatch},
+		{"/task/", a.handleTask},
+		{"/tasks", a.handleTasks},
+		{"/queue", a.handleQueue},
+		{"/queue/order", a.handleQueueOrder},
+		{"/queue/pause", a.handleQueuePause},
+		{"/queue/resume", a.handleQueuePause},
+		{"/deeplinks", a.handleDeeplinks},
+		{"/health", a.handleHealth},
+		{"/health/message", a.handleHealthMessage},
+		{"/status", a.handleStatus},
+		{"/metrics", a.handleMetrics},
+		{"/events", a.handleEvents},
+		{"/schedules", a.handleSchedules},
+		{"/providers", a.handleProviders},
+		{"/providers/", a.handleProviders},
+		{"/schedules/", a.handleSchedules},
+	} {
+		// Unversioned paths are aliases for v1. Handlers see the path
+		// without the prefix either way.
+		a.mux.HandleFunc(route.path, route.handler)
+		a.mux.Handle(apiPrefix+route.path, http.StripPrefix(apiPrefix, route.handler))
+	}
 	return a
 }
 
+// SetMaxConcurrentSubmits caps the /run and /batch requests one submitter
+// may have in flight at once (0 = unlimited).
+func (a *API) SetMaxConcurrentSubmits(n int) {
+	a.submits = newSubmitLimiter(n)
+}
+
+// SetRateLimit allows each client perMinute /run and /batch requests a
+// minute (0 = unlimited).
+func (a *API) SetRateLimit(perMinute int) {
+	a.rate = newRateLimiter(perMinute)
+}
+
+// SetAuditLog records every submission, cancellation, and queue clear to w
+// as JSON lines.
+func (a *API) SetAuditLog(w io.Writer) {
+	a.audit = newAuditLog(w)
+}
+
+// SetMaxBody limits request bodies to n bytes (0 = unlimited).
+func (a *API) SetMaxBody(n int64) {
+	a.maxBody = n
+}
+
+// SetMaxSubscribers caps the event streams open at once (0 = unlimited).
+func (a *API) SetMaxSubscribers(n int) {
+	a.maxSubscribers = n
+}
+
+// Subscribers returns the number of open event streams.
+func (a *API) Subscribers() int {
+	return int(a.subscribers.Load())
+}
+
+// limitSubmits reserves an in-flight submission slot for r's submitter,
+// writing a 429 and returning nil if it has none left or is over -rate.
+// Otherwise the returned func releases the slot.
+func (a *API) limitSubmits(w http.ResponseWriter, r *http.Request) func() {
+	if ok, wait := a.rate.allow(rateClientOf(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(waitSeconds(wait)))
+		writeError(w, CodeRateLimited, "rate limit exceeded, try again later", http.StatusTooManyRequests)
+		return nil
+	}
+	submitter := submitterOf(r)
+	if !a.submits.acquire(submitter) {
+		writeError(w, CodeRateLimited, fmt.Sprintf("too many concurrent submissions (limit %d)", a.submits.max), http.StatusTooManyRequests)
+		return nil
+	}
+	return func() { a.submits.release(submitter) }
+}
+
 func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Add request ID for tracing
 	requestID := r.Header.Get("X-Request-ID")
@@ -119,13 +630,21 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		requestID = generateRequestID()
 	}
 	w.Header().Set("X-Request-ID", requestID)
-
-	// Server authentication (skip for health check)
-	if r.URL.Path != "/health" {
-		if r.Header.Get("X-Server-Key") != serverAPIKey {
-			writeError(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
+	r = r.WithContext(withRequestID(r.Context(), requestID))
+
+	// Server authentication (skip for health checks, and reads in
+	// write-only mode)
+	id, ok := authenticate(r.Header.Get("X-Server-Key"))
+	if !ok && requiresAuth(r) {
+		requestLog(r.Context(), "").Warnf("Unauthorized: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		writeError(w, CodeUnauthorized, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if ok {
+		r = r.WithContext(withIdentity(r.Context(), id))
+	}
+	if a.maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, a.maxBody)
 	}
 
 	a.mux.ServeHTTP(w, r)
@@ -134,46 +653,199 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // ErrorResponse represents a JSON error response
 type ErrorResponse struct {
 	Error     string `json:"error"`
+	Code      string `json:"code"` // One of the Code constants
 	RequestID string `json:"request_id,omitempty"`
 }
 
-func writeError(w http.ResponseWriter, msg string, code int) {
+// writeBodyError reports a request body that couldn't be read or decoded:
+// 413 if it was over -max-body, otherwise 400 with msg and err.
+func writeBodyError(w http.ResponseWriter, msg string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, CodeBodyTooLarge, fmt.Sprintf("request body too large (max %d bytes)", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeError(w, CodeInvalidJSON, msg+": "+err.Error(), http.StatusBadRequest)
+}
+
+// writeError writes an ErrorResponse with code and msg, and HTTP status.
+func writeError(w http.ResponseWriter, code, msg string, status int) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(ErrorResponse{
 		Error:     msg,
+		Code:      code,
 		RequestID: w.Header().Get("X-Request-ID"),
 	}); err != nil {
-		log.Printf("Failed to encode error response: %v", err)
+		serverLog.Errorf("Failed to encode error response: %v", err)
 	}
 }
 
 func (a *API) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		writeError(w, "GET only", http.StatusMethodNotAllowed)
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]any{
-		"status":       "ok",
+	status, code := "ok", http.StatusOK
+	problem := a.queue.WorkerProblem()
+	if problem != "" {
+		status, code = "worker_unavailable", http.StatusServiceUnavailable
+	}
+	if a.queue.Draining() {
+		status = "draining"
+	} else if a.queue.Paused() && problem == "" {
+		status = "paused"
+	}
+	health := map[string]any{
+		"status":       status,
+		"paused":       a.queue.Paused(),
+		"worker_ok":    problem == "",
 		"version":      Version,
+		"api_version":  apiVersion,
 		"queue_size":   a.queue.Size(),
-		"current_task": a.queue.Current(),
-	}); err != nil {
-		log.Printf("Failed to encode health response: %v", err)
+		"current_task": a.queue.Running(),
+		"timeouts":     a.queue.Timeouts(),
+	}
+	if remaining := a.queue.RetryBudgetRemaining(); remaining >= 0 {
+		health["retry_budget_remaining"] = remaining
+	}
+	if problem != "" {
+		health["reason"] = problem
+	}
+	health["subscribers"] = a.Subscribers()
+	if msg := a.Banner(); msg != "" {
+		health["message"] = msg
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		serverLog.Errorf("Failed to encode health response: %v", err)
+	}
+}
+
+// Banner returns the operator message, or "" if none is set.
+func (a *API) Banner() string {
+	if msg := a.banner.Load(); msg != nil {
+		return *msg
+	}
+	return ""
+}
+
+// SetBanner sets the operator message; "" clears it.
+func (a *API) SetBanner(msg string) {
+	msg = strings.TrimSpace(msg)
+	if msg == "" {
+		a.banner.Store(nil)
+		return
+	}
+	a.banner.Store(&msg)
+}
+
+// handleHealthMessage sets (POST {"message": "..."}) or clears (DELETE) the
+// operator message returned by /health. Unlike /health it requires the
+// server key.
+func (a *API) handleHealthMessage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeBodyError(w, "invalid JSON", err)
+			return
+		}
+		a.SetBanner(body.Message)
+	case "DELETE":
+		a.SetBanner("")
+	default:
+		writeError(w, CodeMethodNotAllowed, "POST or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+	serverLog.Infof("Health message set to %q", a.Banner())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": a.Banner()}); err != nil {
+		serverLog.Errorf("Failed to encode health message response: %v", err)
+	}
+}
+
+// handleStatus serves a one-line summary for shell use, e.g.
+// "ok vdev queue=3 running=a1b2c3d4 up=2h13m". Clients sending
+// Accept: application/json get the same fields as JSON.
+func (a *API) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	running := strings.Join(a.queue.Running(), ",")
+	up := formatUptime(time.Since(startTime))
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"status":  "ok",
+			"version": Version,
+			"queue":   a.queue.Size(),
+			"running": running,
+			"uptime":  up,
+		}); err != nil {
+			serverLog.Errorf("Failed to encode status response: %v", err)
+		}
+		return
+	}
+
+	if running == "" {
+		running = "-"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "ok v%s queue=%d running=%s up=%s\n", Version, a.queue.Size(), running, up)
+}
+
+// formatUptime renders a duration compactly: 45s, 13m, 2h13m.
+func formatUptime(d time.Duration) string {
+	if d < time.Minute {
+		return d.Truncate(time.Second).String()
+	}
+	return strings.TrimSuffix(d.Truncate(time.Minute).String(), "0s")
+}
+
+// handleMetrics serves counters in the Prometheus text exposition format.
+func (a *API) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
 	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP droidrun_queue_size Tasks waiting to run.\n")
+	fmt.Fprintf(w, "# TYPE droidrun_queue_size gauge\n")
+	fmt.Fprintf(w, "droidrun_queue_size %d\n", a.queue.Size())
+	fmt.Fprintf(w, "# HELP droidrun_task_timeouts_total Tasks failed by exceeding the task timeout.\n")
+	fmt.Fprintf(w, "# TYPE droidrun_task_timeouts_total counter\n")
+	fmt.Fprintf(w, "droidrun_task_timeouts_total %d\n", a.queue.Timeouts())
+	fmt.Fprintf(w, "# HELP droidrun_tasks_running Tasks with a worker running.\n")
+	fmt.Fprintf(w, "# TYPE droidrun_tasks_running gauge\n")
+	fmt.Fprintf(w, "droidrun_tasks_running %d\n", len(a.queue.Running()))
+	a.queue.Metrics().writeTo(w)
 }
 
 func (a *API) handleRun(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		writeError(w, "POST only", http.StatusMethodNotAllowed)
+		writeError(w, CodeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	release := a.limitSubmits(w, r)
+	if release == nil {
 		return
 	}
+	defer release()
 
 	var req TaskRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		writeBodyError(w, "invalid JSON", err)
 		return
 	}
 
@@ -183,54 +855,247 @@ func (a *API) handleRun(w http.ResponseWriter, r *http.Request) {
 		apiKey = req.APIKey
 	}
 	req.APIKey = "" // Clear from request struct (don't store)
+	if apiKey == "" {
+		apiKey = serverProviderKey(req.Provider)
+	}
+	a.submit(w, r, req, apiKey)
+}
+
+// submit validates req and queues it, writing the /run response.
+func (a *API) submit(w http.ResponseWriter, r *http.Request, req TaskRequest, apiKey string) {
+	task, status, err := a.accept(r, req, apiKey)
+	if err != nil {
+		if errors.Is(err, ErrQueueFull) {
+			if d := a.queue.RetryAfter(); d > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(waitSeconds(d)))
+			}
+		}
+		writeError(w, errorCode(err, CodeInvalidRequest), err.Error(), status)
+		return
+	}
 
-	// Validation
+	info := a.queue.Info(task.ID)
+	setQueueHeaders(w, info)
+	resp := map[string]any{
+		"task_id":    task.ID,
+		"status":     task.Status,
+		"position":   info.Position,
+		"queue_size": info.Size,
+	}
+	if info.EstimatedWait >= 0 {
+		resp["estimated_wait_seconds"] = waitSeconds(info.EstimatedWait)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		serverLog.Errorf("Failed to encode run response: %v", err)
+	}
+}
+
+// accept validates req and queues it. On failure it returns the HTTP status
+// to report with the error.
+func (a *API) accept(r *http.Request, req TaskRequest, apiKey string) (*Task, int, error) {
 	if err := validateRequest(&req, apiKey); err != nil {
-		writeError(w, err.Error(), http.StatusBadRequest)
+		return nil, http.StatusBadRequest, err
+	}
+	id := identityFrom(r.Context())
+	if !id.Allows(req.Provider) {
+		return nil, http.StatusForbidden, errorf(CodeForbidden, "provider %s not allowed for key %q", req.Provider, id.Label)
+	}
+	if req.JumpQueue && !id.MayJumpQueue() {
+		return nil, http.StatusForbidden, errorf(CodeForbidden, "jump_queue not allowed for key %q", id.Label)
+	}
+	if req.RunIf != nil && a.queue.Get(req.RunIf.TaskID) == nil {
+		return nil, http.StatusBadRequest, errorf(CodeDependencyNotFound, "run_if task not found: %s", req.RunIf.TaskID)
+	}
+	if req.Mode == ModeReplay {
+		if _, total, err := a.queue.Steps(req.ReplayOf, 0, 0); errors.Is(err, errTaskNotFound) {
+			return nil, http.StatusBadRequest, errorf(CodeDependencyNotFound, "replay_of task not found: %s", req.ReplayOf)
+		} else if err == nil && total == 0 {
+			return nil, http.StatusBadRequest, errorf(CodeInvalidRequest, "replay_of task has no recorded steps: %s", req.ReplayOf)
+		}
+	}
+
+	task, err := a.queue.TrySubmit(r.Context(), req, apiKey)
+	if errors.Is(err, ErrQueueFull) {
+		return nil, http.StatusTooManyRequests, &codedError{CodeQueueFull, err}
+	}
+	if errors.Is(err, ErrDraining) {
+		return nil, http.StatusServiceUnavailable, &codedError{CodeDraining, err}
+	}
+	if err != nil {
+		// Client went away while waiting for room
+		return nil, http.StatusServiceUnavailable, errorf(CodeServiceUnavailable, "submit aborted: %w", err)
+	}
+	requestLog(r.Context(), task.ID).Infof("Queued by %s: %s", id.Label, truncate(req.Goal, 50))
+	a.audit.record(r, taskAuditEntry(AuditSubmit, task.ID, task.Request))
+	return task, 0, nil
+}
+
+// maxBatchSize caps the tasks in one POST /batch.
+const maxBatchSize = 100
+
+// BatchResult is the outcome of one task in a POST /batch, in request order.
+type BatchResult struct {
+	Index    int    `json:"index"`
+	Status   int    `json:"status"` // HTTP status POST /run would have returned
+	TaskID   string `json:"task_id,omitempty"`
+	Position int    `json:"position,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"` // The error's code, as POST /run would have returned
+}
+
+// handleBatch serves POST /batch: an array of task requests, queued in order
+// as if each were sent to /run with the same headers. Invalid tasks are
+// reported and skipped without affecting the rest; the response is 200 if
+// every task was queued and 207 otherwise.
+func (a *API) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, CodeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
 		return
 	}
 
-	task := a.queue.Submit(req, apiKey)
+	release := a.limitSubmits(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	var reqs []TaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		writeBodyError(w, "invalid JSON", err)
+		return
+	}
+	if len(reqs) == 0 {
+		writeError(w, CodeInvalidRequest, "batch is empty", http.StatusBadRequest)
+		return
+	}
+	if len(reqs) > maxBatchSize {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("at most %d tasks per batch", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	code := http.StatusOK
+	results := make([]BatchResult, len(reqs))
+	for i, req := range reqs {
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" {
+			apiKey = req.APIKey
+		}
+		req.APIKey = ""
+		if apiKey == "" {
+			apiKey = serverProviderKey(req.Provider)
+		}
+
+		results[i] = BatchResult{Index: i, Status: http.StatusOK}
+		task, status, err := a.accept(r, req, apiKey)
+		if err != nil {
+			results[i].Status = status
+			results[i].Error = err.Error()
+			results[i].Code = errorCode(err, CodeInvalidRequest)
+			code = http.StatusMultiStatus
+			continue
+		}
+		results[i].TaskID = task.ID
+		results[i].Position = a.queue.Position(task.ID)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]any{
-		"task_id":  task.ID,
-		"status":   task.Status,
-		"position": a.queue.Position(task.ID),
-	}); err != nil {
-		log.Printf("Failed to encode run response: %v", err)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		serverLog.Errorf("Failed to encode batch response: %v", err)
 	}
 }
 
+// setQueueHeaders mirrors a task's queue info in X-Queue-Size,
+// X-Queue-Position, and X-Estimated-Wait (seconds; omitted when unknown), so
+// lightweight clients can back off without parsing JSON.
+func setQueueHeaders(w http.ResponseWriter, info QueueInfo) {
+	w.Header().Set("X-Queue-Size", strconv.Itoa(info.Size))
+	w.Header().Set("X-Queue-Position", strconv.Itoa(info.Position))
+	if info.EstimatedWait >= 0 {
+		w.Header().Set("X-Estimated-Wait", strconv.Itoa(waitSeconds(info.EstimatedWait)))
+	}
+}
+
+// waitSeconds rounds a wait estimate up to whole seconds.
+func waitSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
 func validateRequest(req *TaskRequest, apiKey string) error {
+	switch req.Mode {
+	case "", ModeAgent:
+		if req.ReplayOf != "" {
+			return errorf(CodeInvalidRequest, "replay_of needs mode %q", ModeReplay)
+		}
+	case ModeReplay:
+		if req.ReplayOf == "" {
+			return errorf(CodeInvalidRequest, "replay_of is required with mode %q", ModeReplay)
+		}
+		if strings.TrimSpace(req.Goal) == "" {
+			req.Goal = "Replay of task " + req.ReplayOf
+		}
+	default:
+		return errorf(CodeInvalidRequest, "invalid mode: %s (valid: %s, %s)", req.Mode, ModeAgent, ModeReplay)
+	}
+
 	// Goal is required
 	req.Goal = strings.TrimSpace(req.Goal)
 	if req.Goal == "" {
-		return fmt.Errorf("goal is required")
+		return errorf(CodeGoalRequired, "goal is required")
+	}
+	for _, field := range []struct {
+		name, value string
+		max         int
+	}{
+		{"goal", req.Goal, maxGoalBytes},
+		{"app", req.App, maxAppBytes},
+		{"deeplink", req.Deeplink, maxDeeplinkBytes},
+		{"model", req.Model, maxModelBytes},
+		{"base_url", req.BaseURL, maxBaseURLBytes},
+	} {
+		if len(field.value) > field.max {
+			return errorf(CodeFieldTooLong, "%s too long (%d bytes, max %d)", field.name, len(field.value), field.max)
+		}
 	}
 
 	// Provider validation
 	if req.Provider == "" {
-		req.Provider = "Google" // default
+		req.Provider = defaultProvider
+	}
+
+	if !req.Vision && !req.visionSet && autoVisionPattern != nil {
+		if kw := autoVisionPattern.FindString(req.Goal); kw != "" {
+			req.Vision = true
+			serverLog.Infof("Enabling vision for goal mentioning %q: %s", kw, truncate(req.Goal, 50))
+		}
 	}
 	if !validProviders[req.Provider] {
-		return fmt.Errorf("invalid provider: %s (valid: Google, Anthropic, OpenAI, DeepSeek, Ollama)", req.Provider)
+		return errorf(CodeInvalidProvider, "invalid provider: %s (valid: Google, Anthropic, OpenAI, DeepSeek, Ollama)", req.Provider)
+	}
+	if !providers.Enabled(req.Provider) {
+		return errorf(CodeProviderDisabled, "provider disabled: %s", req.Provider)
 	}
 
 	// Model defaults
 	if req.Model == "" {
-		switch req.Provider {
-		case "Google", "GoogleGenAI":
-			req.Model = "gemini-2.0-flash"
-		case "Anthropic":
-			req.Model = "claude-sonnet-4-20250514"
-		case "OpenAI":
-			req.Model = "gpt-4o"
-		case "DeepSeek":
-			req.Model = "deepseek-chat"
-		case "Ollama":
-			req.Model = "llama3.2"
-		}
+		req.Model = defaultModel(req.Provider)
+	}
+
+	if req.MaxRetries < 0 || req.MaxRetries > 10 {
+		return errorf(CodeInvalidRequest, "max_retries must be between 0 and 10")
+	}
+	if req.MaxOutputTokens < 0 {
+		return errorf(CodeInvalidRequest, "max_output_tokens must not be negative")
+	}
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > maxTimeoutSeconds {
+		return errorf(CodeInvalidRequest, "timeout_seconds must be between 0 and %d", maxTimeoutSeconds)
+	}
+	if req.Priority < -100 || req.Priority > 100 {
+		return errorf(CodeInvalidRequest, "priority must be between -100 and 100")
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		return err
 	}
 
 	// MaxSteps clamping (1-100)
@@ -240,107 +1105,702 @@ func validateRequest(req *TaskRequest, apiKey string) error {
 		req.MaxSteps = 100
 	}
 
-	// API key required (except for Ollama which runs locally)
-	if apiKey == "" && req.Provider != "Ollama" {
-		return fmt.Errorf("API key required (use X-API-Key header)")
+	// API key required (except for Ollama which runs locally, and replays,
+	// which don't use the LLM)
+	if apiKey == "" && serverProviderKey(req.Provider) == "" && req.Provider != "Ollama" && req.Mode != ModeReplay {
+		return errorf(CodeAPIKeyRequired, "API key required (use X-API-Key header; the server has none for %s)", req.Provider)
 	}
 
-	// App package validation (if provided)
-	if req.App != "" {
-		// Android package names: letters, digits, underscores, dots
-		matched, _ := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z][a-zA-Z0-9_]*)+$`, req.App)
-		if !matched {
-			return fmt.Errorf("invalid app package name: %s", req.App)
+	// Base URL validation (if provided): an http(s) URL with a host. Only
+	// with the caller's own key, so the server's keys never go to it.
+	if req.BaseURL != "" {
+		if !validBaseURL(req.BaseURL) {
+			return errorf(CodeInvalidRequest, "invalid base_url: %s (expected an http or https URL)", req.BaseURL)
+		}
+		if req.Provider != "Ollama" && req.Mode != ModeReplay && (apiKey == "" || apiKey == serverProviderKey(req.Provider)) {
+			return errorf(CodeAPIKeyRequired, "base_url needs your own API key for %s (use X-API-Key header)", req.Provider)
 		}
 	}
 
-	// Deeplink validation (if provided): must be a non-empty URI with a scheme
+	// App package validation (if provided): package name or package/activity
+	if req.App != "" && !appPattern.MatchString(req.App) {
+		return errorf(CodeInvalidApp, "invalid app package name: %s", req.App)
+	}
+
+	// Deeplink validation (if provided): must be a URI with a scheme
 	if req.Deeplink != "" {
-		if !strings.Contains(req.Deeplink, "://") {
-			return fmt.Errorf("invalid deeplink (must contain ://): %s", req.Deeplink)
+		link, err := checkDeeplink(req.Deeplink)
+		if err != nil {
+			return err
+		}
+		req.Deeplink = link
+	}
+
+	// Setup steps: each launches an app or opens a deeplink, checked as above
+	if len(req.Setup) > maxSetupSteps {
+		return errorf(CodeInvalidSetup, "setup has %d steps, max %d", len(req.Setup), maxSetupSteps)
+	}
+	for i, step := range req.Setup {
+		switch {
+		case (step.App == "") == (step.Deeplink == ""):
+			return errorf(CodeInvalidSetup, "setup[%d]: needs exactly one of app or deeplink", i)
+		case len(step.App) > maxAppBytes:
+			return errorf(CodeInvalidSetup, "setup[%d]: app too long (%d bytes, max %d)", i, len(step.App), maxAppBytes)
+		case len(step.Deeplink) > maxDeeplinkBytes:
+			return errorf(CodeInvalidSetup, "setup[%d]: deeplink too long (%d bytes, max %d)", i, len(step.Deeplink), maxDeeplinkBytes)
+		case step.App != "" && !appPattern.MatchString(step.App):
+			return errorf(CodeInvalidSetup, "setup[%d]: invalid app package name: %s", i, step.App)
+		case step.Deeplink != "":
+			link, err := checkDeeplink(step.Deeplink)
+			if err != nil {
+				return errorf(CodeInvalidSetup, "setup[%d]: %w", i, err)
+			}
+			req.Setup[i].Deeplink = link
+		}
+	}
+
+	if req.Locale != "" && !localePattern.MatchString(req.Locale) {
+		return errorf(CodeInvalidRequest, "invalid locale (want a BCP-47 tag like en-US): %s", req.Locale)
+	}
+	// IANA zone names only; LoadLocation also accepts "" and "Local"
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "Local" {
+			return errorf(CodeInvalidRequest, "invalid timezone (want an IANA name like Europe/Berlin): %s", req.Timezone)
+		}
+	}
+
+	// Result assertion regex must compile
+	if req.AssertRegex != "" {
+		if _, err := regexp.Compile(req.AssertRegex); err != nil {
+			return errorf(CodeInvalidRequest, "invalid assert_regex: %v", err)
+		}
+	}
+
+	// Conditional execution validation (if provided)
+	if req.RunIf != nil {
+		if req.RunIf.TaskID == "" {
+			return errorf(CodeInvalidRequest, "run_if.task_id is required")
+		}
+		switch req.RunIf.Condition {
+		case "success", "failure", "completed":
+		default:
+			return errorf(CodeInvalidRequest, "invalid run_if condition: %s (valid: success, failure, completed)", req.RunIf.Condition)
 		}
 	}
 
 	return nil
 }
 
+// checkDeeplink normalizes link and checks its scheme against
+// -allowed-deeplink-schemes.
+func checkDeeplink(link string) (string, error) {
+	link, err := normalizeDeeplink(link)
+	if err != nil {
+		return "", err
+	}
+	scheme, _, _ := strings.Cut(link, "://")
+	if len(allowedDeeplinkSchemes) > 0 && !allowedDeeplinkSchemes[scheme] {
+		return "", errorf(CodeInvalidDeeplink, "deeplink scheme not allowed: %s", scheme)
+	}
+	return link, nil
+}
+
+// normalizeDeeplink checks that link is a scheme://something URI and returns
+// it trimmed, with the scheme lowercased as Android matches it.
+func normalizeDeeplink(link string) (string, error) {
+	link = strings.TrimSpace(link)
+	scheme, rest, ok := strings.Cut(link, "://")
+	if !ok {
+		return "", errorf(CodeInvalidDeeplink, "invalid deeplink (must contain ://): %s", link)
+	}
+	if strings.Trim(rest, "/") == "" {
+		return "", errorf(CodeInvalidDeeplink, "invalid deeplink (nothing after %s://): %s", scheme, link)
+	}
+	if strings.ContainsAny(link, " \t\r\n") {
+		return "", errorf(CodeInvalidDeeplink, "invalid deeplink (contains whitespace): %s", link)
+	}
+	if u, err := url.Parse(link); err != nil || u.Scheme == "" || !strings.EqualFold(u.Scheme, scheme) {
+		return "", errorf(CodeInvalidDeeplink, "invalid deeplink (not a URI with a scheme): %s", link)
+	}
+	return strings.ToLower(scheme) + "://" + rest, nil
+}
+
+// serverProviderKey returns the server-side API key for a provider, if one
+// was loaded. An empty provider resolves to the default provider.
+func serverProviderKey(provider string) string {
+	if provider == "" {
+		provider = defaultProvider
+	}
+	return serverProviderKeys[provider]
+}
+
+// readKeyFile reads an API key from a file, trimming surrounding whitespace.
+func readKeyFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("key file %s is empty", path)
+	}
+	return key, nil
+}
+
 func (a *API) handleTask(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Path[len("/task/"):]
 	if id == "" {
-		writeError(w, "task ID required", http.StatusBadRequest)
+		writeError(w, CodeInvalidParameter, "task ID required", http.StatusBadRequest)
+		return
+	}
+	if id, ok := strings.CutSuffix(id, "/steps"); ok {
+		a.handleTaskSteps(w, r, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(id, "/artifacts.zip"); ok {
+		a.handleTaskArtifacts(w, r, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(id, "/events"); ok {
+		a.handleTaskEvents(w, r, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(id, "/rerun"); ok {
+		a.handleTaskRerun(w, r, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(id, "/logs"); ok {
+		a.handleTaskLogs(w, r, id)
 		return
 	}
 
 	if r.Method == "DELETE" {
 		if a.queue.Cancel(id) {
+			if task, ok := a.queue.Snapshot(id); ok {
+				a.audit.record(r, taskAuditEntry(AuditCancel, id, task.Request))
+			}
 			w.Header().Set("Content-Type", "application/json")
 			if err := json.NewEncoder(w).Encode(map[string]string{"status": "cancelled"}); err != nil {
-				log.Printf("Failed to encode cancel response: %v", err)
+				serverLog.Errorf("Failed to encode cancel response: %v", err)
 			}
 		} else {
-			writeError(w, "cannot cancel (task not found or already completed)", http.StatusBadRequest)
+			writeError(w, CodeCannotCancel, "cannot cancel (task not found or already completed)", http.StatusBadRequest)
 		}
 		return
 	}
 
 	if r.Method != "GET" {
-		writeError(w, "GET or DELETE only", http.StatusMethodNotAllowed)
+		writeError(w, CodeMethodNotAllowed, "GET or DELETE only", http.StatusMethodNotAllowed)
 		return
 	}
 
-	task := a.queue.Get(id)
-	if task == nil {
-		writeError(w, "task not found", http.StatusNotFound)
+	var limit int
+	if s := r.URL.Query().Get("max_result_bytes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, CodeInvalidParameter, "max_result_bytes must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "summary" {
+		writeError(w, CodeInvalidParameter, "invalid format (want summary): "+format, http.StatusBadRequest)
 		return
 	}
 
+	// A copy, as the worker may be updating the task while it's encoded
+	task, ok := a.queue.Snapshot(id)
+	if !ok {
+		writeError(w, CodeNotFound, "task not found", http.StatusNotFound)
+		return
+	}
+	if limit > 0 {
+		limitTaskSize(&task, limit)
+	}
+	info := a.queue.Info(id)
+	var resp any = task
+	switch {
+	case format == "summary":
+		resp = summarize(completionEvent(&task))
+	case task.Status == "queued" && info.EstimatedWait >= 0:
+		resp = queuedTaskJSON{taskJSON: task.toJSON(), EstimatedWaitSeconds: waitSeconds(info.EstimatedWait)}
+	}
+
+	setQueueHeaders(w, info)
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(task); err != nil {
-		log.Printf("Failed to encode task response: %v", err)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		serverLog.Errorf("Failed to encode task response: %v", err)
+	}
+}
+
+// handleTaskLogs serves GET /task/{id}/logs: the worker's stderr as plain
+// text, or with ?tail=N only its last N lines. While the worker runs the body
+// is the complete lines it has written so far; ?offset=N skips the first N
+// bytes, so a follower can fetch only what's new. X-Log-Size is the logs'
+// whole size, to pass as the next offset, and X-Task-Status the task's status
+// when they were read. Logs over -max-output are served whole when
+// -steps-dir kept them.
+func (a *API) handleTaskLogs(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	tail := 0
+	if s := query.Get("tail"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, CodeInvalidParameter, "tail must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		tail = n
+	}
+	offset := 0
+	if s := query.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, CodeInvalidParameter, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if tail > 0 && offset > 0 {
+		writeError(w, CodeInvalidParameter, "tail and offset can't be combined", http.StatusBadRequest)
+		return
+	}
+
+	logs, status, ok := a.queue.Logs(id)
+	if !ok {
+		writeError(w, CodeNotFound, "task not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Log-Size", strconv.Itoa(len(logs)))
+	w.Header().Set("X-Task-Status", status)
+	switch {
+	case tail > 0:
+		logs = tailLines(logs, tail)
+	case offset >= len(logs):
+		logs = "" // Nothing new, or the logs were cut short since
+	default:
+		logs = logs[offset:]
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, logs); err != nil {
+		taskLog(id).Errorf("Failed to write logs response: %v", err)
 	}
 }
 
+// tailLines returns the last n lines of s. A trailing newline doesn't count
+// as starting another line.
+func tailLines(s string, n int) string {
+	end := strings.TrimSuffix(s, "\n")
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] == '\n' {
+			if n--; n == 0 {
+				return s[i+1:]
+			}
+		}
+	}
+	return s
+}
+
+// handleTaskRerun serves POST /task/{id}/rerun: it submits a copy of the
+// task's request with the fields of an optional JSON body merged over it.
+// The stored API key is not reused; send a fresh one as for /run.
+func (a *API) handleTaskRerun(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		writeError(w, CodeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	orig := a.queue.Get(id)
+	if orig == nil {
+		writeError(w, CodeNotFound, "task not found", http.StatusNotFound)
+		return
+	}
+
+	release := a.limitSubmits(w, r)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	req := orig.Request.toRequest()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, "reading body", err)
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			writeError(w, CodeInvalidJSON, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, CodeInvalidJSON, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// A new provider gets its own default model unless one was given
+		_, modelSet := fields["model"]
+		if req.Provider != orig.Request.Provider && !modelSet {
+			req.Model = ""
+		}
+	}
+
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		apiKey = req.APIKey
+	}
+	req.APIKey = ""
+	if apiKey == "" {
+		apiKey = serverProviderKey(req.Provider)
+	}
+	a.submit(w, r, req, apiKey)
+}
+
+// handleTasks returns several tasks in one request: GET /tasks?ids=a,b,c.
+// Tasks come back in the order asked for, with null and an errors entry for
+// each unknown ID.
+func (a *API) handleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []string
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		writeError(w, CodeInvalidParameter, "ids required", http.StatusBadRequest)
+		return
+	}
+
+	tasks := a.queue.GetMany(ids)
+	errs := map[string]string{}
+	for i, task := range tasks {
+		if task == nil {
+			errs[ids[i]] = "task not found"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"tasks":  tasks,
+		"errors": errs,
+	}); err != nil {
+		serverLog.Errorf("Failed to encode tasks response: %v", err)
+	}
+}
+
+// limitTaskSize shortens a task copy's goal, result, logs, and steps to
+// about limit bytes each for ?max_result_bytes, marking what was cut and
+// listing the fields in Truncated. It must not be given a stored task, as
+// only the top-level fields are copies.
+func limitTaskSize(task *Task, limit int) {
+	for _, f := range []struct {
+		name string
+		s    *string
+	}{
+		{"goal", &task.Request.Goal},
+		{"result", &task.Result},
+		{"logs", &task.Logs},
+	} {
+		if len(*f.s) > limit {
+			*f.s = truncateBytes(*f.s, limit)
+			task.Truncated = append(task.Truncated, f.name)
+		}
+	}
+
+	steps, _ := task.Steps.([]any)
+	size := 0
+	for i, step := range steps {
+		data, _ := json.Marshal(step)
+		if size += len(data); size > limit {
+			// A fresh slice, so the stored steps are left alone
+			kept := append([]any(nil), steps[:i]...)
+			task.Steps = append(kept, map[string]int{"truncated_steps": len(steps) - i})
+			task.Truncated = append(task.Truncated, "steps")
+			break
+		}
+	}
+}
+
+// truncateBytes cuts s to at most n bytes on a UTF-8 boundary and notes how
+// much was dropped.
+func truncateBytes(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... [truncated %d bytes]", s[:n], len(s)-n)
+}
+
 func (a *API) handleQueue(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "DELETE" {
-		count := a.queue.Clear()
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(map[string]any{"cleared": count}); err != nil {
-			log.Printf("Failed to encode clear response: %v", err)
+		a.handleQueueDelete(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseTaskFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, CodeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]any{
+		"queue_size":   a.queue.Size(),
+		"current_task": a.queue.Running(),
+	}
+	query := r.URL.Query()
+	order := query.Get("sort")
+	switch {
+	case query.Has("limit") || query.Has("offset"):
+		// A page of tasks as a list, newest first
+		if order != "" {
+			writeError(w, CodeInvalidParameter, "sort can't be combined with limit or offset", http.StatusBadRequest)
+			return
 		}
+		limit, offset := defaultQueueLimit, 0
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > maxQueueLimit {
+				writeError(w, CodeInvalidParameter, fmt.Sprintf("invalid limit (want 1-%d): %s", maxQueueLimit, s), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		if s := query.Get("offset"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				writeError(w, CodeInvalidParameter, "invalid offset: "+s, http.StatusBadRequest)
+				return
+			}
+			offset = n
+		}
+		resp["tasks"], resp["total"] = a.queue.Page(filter, offset, limit)
+		resp["limit"], resp["offset"] = limit, offset
+	case order == "":
+		resp["tasks"] = a.queue.Query(filter)
+	case order == "eta":
+		// Only running and queued tasks, soonest to finish first
+		resp["tasks"] = a.queue.ByETA(time.Now(), filter)
+	default:
+		writeError(w, CodeInvalidParameter, "invalid sort (want eta): "+order, http.StatusBadRequest)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		serverLog.Errorf("Failed to encode queue response: %v", err)
+	}
+}
+
+// Page sizes for GET /queue?limit=N.
+const (
+	defaultQueueLimit = 50 // When only offset is given
+	maxQueueLimit     = 500
+)
+
+// handleQueueOrder lists queued tasks in dispatch order, so operators can see
+// what runs next.
+func (a *API) handleQueueOrder(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		writeError(w, "GET or DELETE only", http.StatusMethodNotAllowed)
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
 		return
 	}
 
+	queued, waiting := a.queue.Order()
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]any{
+		"current_task": a.queue.Running(),
+		"order":        queued,
+		"waiting":      waiting,
+	}); err != nil {
+		serverLog.Errorf("Failed to encode queue order response: %v", err)
+	}
+}
+
+// handleQueuePause serves POST /queue/pause and /queue/resume, which stop
+// and restart queued tasks from starting. Running tasks aren't affected.
+func (a *API) handleQueuePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, CodeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/queue/pause" {
+		if a.queue.Pause() {
+			requestLog(r.Context(), "").Infof("Queue paused with %d tasks queued", a.queue.Size())
+		}
+	} else if a.queue.Resume() {
+		requestLog(r.Context(), "").Infof("Queue resumed with %d tasks queued", a.queue.Size())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"paused":       a.queue.Paused(),
 		"queue_size":   a.queue.Size(),
-		"current_task": a.queue.Current(),
-		"tasks":        a.queue.All(),
+		"current_task": a.queue.Running(),
 	}); err != nil {
-		log.Printf("Failed to encode queue response: %v", err)
+		serverLog.Errorf("Failed to encode queue pause response: %v", err)
+	}
+}
+
+// handleQueueDelete serves DELETE /queue. Without a filter it clears every
+// task, killing running ones. With ?label=key=value (repeatable) or
+// ?provider=name it cancels only the matching unfinished tasks, as
+// DELETE /task/{id} would, and leaves the rest alone.
+func (a *API) handleQueueDelete(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	for name := range query {
+		if name != "confirm" && name != "label" && name != "provider" {
+			// A mistyped filter mustn't turn into clearing everything
+			writeError(w, CodeInvalidParameter, "unknown parameter for DELETE /queue: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+	filter, err := parseTaskFilter(query)
+	if err != nil {
+		writeError(w, CodeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filtered := len(filter.Labels) > 0 || filter.Provider != ""
+
+	// Clearing kills running tasks too, so it must be confirmed: with
+	// ?confirm=true, or X-Confirm set to the number of unfinished tasks it
+	// would clear (or cancel, with a filter), as the 409's confirm field says
+	want := -1
+	if query.Get("confirm") != "true" {
+		n, err := strconv.Atoi(r.Header.Get("X-Confirm"))
+		if err != nil {
+			n = -2 // Never matches
+		}
+		want = n
+	}
+
+	var count int
+	var ok bool
+	var ids []string
+	action := "clearing"
+	running := a.queue.Running()
+	if filtered {
+		action = "cancelling"
+		ids, ok = a.queue.CancelMatching(filter, want)
+		count = len(ids)
+		matched := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			matched[id] = true
+		}
+		matchedRunning := []string{}
+		for _, id := range running {
+			if matched[id] {
+				matchedRunning = append(matchedRunning, id)
+			}
+		}
+		running = matchedRunning
+	} else {
+		count, ok = a.queue.ClearExpecting(want)
+	}
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"error":      fmt.Sprintf("confirm %s %d tasks with ?confirm=true or X-Confirm: %d", action, count, count),
+			"code":       CodeConfirmRequired,
+			"request_id": w.Header().Get("X-Request-ID"),
+			"tasks":      count,
+			"confirm":    count, // The X-Confirm value that would go ahead
+			"running":    running,
+		}); err != nil {
+			serverLog.Errorf("Failed to encode clear confirmation: %v", err)
+		}
+		return
+	}
+
+	resp := map[string]any{"cleared": count}
+	if filtered {
+		for _, id := range ids {
+			if task, ok := a.queue.Snapshot(id); ok {
+				a.audit.record(r, taskAuditEntry(AuditCancel, id, task.Request))
+			}
+		}
+		requestLog(r.Context(), "").Infof("Cancelled %d matching tasks", count)
+		resp["task_ids"] = ids
+	} else {
+		a.audit.record(r, auditEntry{Action: AuditClear, Tasks: count})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		serverLog.Errorf("Failed to encode clear response: %v", err)
+	}
+}
+
+// parseTaskFilter reads /queue filters: status (comma-separated), label
+// (key=value, repeatable; all must match), and created_after,
+// created_before, finished_after, finished_before (RFC3339).
+func parseTaskFilter(v url.Values) (TaskFilter, error) {
+	var f TaskFilter
+	if s := v.Get("status"); s != "" {
+		f.Statuses = map[string]bool{}
+		for _, status := range strings.Split(s, ",") {
+			f.Statuses[strings.TrimSpace(status)] = true
+		}
+	}
+	for _, s := range v["label"] {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return f, fmt.Errorf("invalid label (want key=value): %s", s)
+		}
+		if f.Labels == nil {
+			f.Labels = map[string]string{}
+		}
+		f.Labels[key] = value
+	}
+	if p := v.Get("provider"); p != "" {
+		if !validProviders[p] {
+			return f, fmt.Errorf("invalid provider: %s", p)
+		}
+		f.Provider = p
+	}
+	for name, dst := range map[string]*time.Time{
+		"created_after":   &f.CreatedAfter,
+		"created_before":  &f.CreatedBefore,
+		"finished_after":  &f.FinishedAfter,
+		"finished_before": &f.FinishedBefore,
+	} {
+		if s := v.Get(name); s != "" {
+			ts, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s (want RFC3339): %s", name, s)
+			}
+			*dst = ts
+		}
 	}
+	return f, nil
 }
 
 func (a *API) handleDeeplinks(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		writeError(w, "GET only", http.StatusMethodNotAllowed)
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
 		return
 	}
 
 	app := r.URL.Query().Get("app")
 	if app == "" {
-		writeError(w, "app query parameter is required", http.StatusBadRequest)
+		writeError(w, CodeInvalidParameter, "app query parameter is required", http.StatusBadRequest)
 		return
 	}
 
 	// Validate package name
-	matched, _ := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z][a-zA-Z0-9_]*)+$`, app)
-	if !matched {
-		writeError(w, "invalid app package name: "+app, http.StatusBadRequest)
+	if !packagePattern.MatchString(app) {
+		writeError(w, CodeInvalidApp, "invalid app package name: "+app, http.StatusBadRequest)
 		return
 	}
 
@@ -348,7 +1808,7 @@ func (a *API) handleDeeplinks(w http.ResponseWriter, r *http.Request) {
 	cmd := exec.Command("adb", "shell", "dumpsys", "package", app)
 	out, err := cmd.Output()
 	if err != nil {
-		writeError(w, "adb error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, CodeInternal, "adb error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -359,7 +1819,7 @@ func (a *API) handleDeeplinks(w http.ResponseWriter, r *http.Request) {
 		"app":       app,
 		"deeplinks": deeplinks,
 	}); err != nil {
-		log.Printf("Failed to encode deeplinks response: %v", err)
+		serverLog.Errorf("Failed to encode deeplinks response: %v", err)
 	}
 }
 
@@ -451,7 +1911,7 @@ func parseDeeplinks(output string) []string {
 func generateRequestID() string {
 	b := make([]byte, 8)
 	if _, err := rand.Read(b); err != nil {
-		log.Printf("Failed to generate request ID: %v", err)
+		serverLog.Errorf("Failed to generate request ID: %v", err)
 	}
 	return hex.EncodeToString(b)
 }
@@ -473,7 +1933,7 @@ func (a *API) QueueSize() int {
 func (a *API) QueueStatus() map[string]any {
 	return map[string]any{
 		"queue_size":   a.queue.Size(),
-		"current_task": a.queue.Current(),
+		"current_task": a.queue.Running(),
 		"tasks":        a.queue.All(),
 	}
 }
@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHealthEndpoint(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	req := httptest.NewRequest("GET", "/health", nil)
@@ -36,8 +45,59 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
+func TestVersionedRoutes(t *testing.T) {
+	defer func(key string) { serverAPIKey = key }(serverAPIKey)
+	serverAPIKey = "server-secret"
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Server-Key", "server-secret")
+		req.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// /health stays public under the prefix, and reports the version
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/v1/health", nil))
+	var health map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected /v1/health without a key, got %d: %s", w.Code, w.Body)
+	}
+	if health["api_version"] != "v1" {
+		t.Errorf("expected api_version v1, got %v", health["api_version"])
+	}
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/v1/queue", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected other /v1 endpoints to need the key, got %d", w.Code)
+	}
+
+	// A task submitted on one path is the same task on the other
+	w = do("POST", "/v1/run", `{"goal":"test"}`)
+	var resp struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected /v1/run to queue the task, got %d: %s", w.Code, w.Body)
+	}
+	for _, target := range []string{"/task/" + resp.TaskID, "/v1/task/" + resp.TaskID, "/v1/task/" + resp.TaskID + "/logs"} {
+		if w := do("GET", target, ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d: %s", target, w.Code, w.Body)
+		}
+	}
+	if w := do("DELETE", "/v1/task/"+resp.TaskID, ""); w.Code != http.StatusOK {
+		t.Errorf("expected /v1 cancel to work, got %d: %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/v2/health", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected unknown versions to 404, got %d", w.Code)
+	}
+}
+
 func TestHealthEndpointWrongMethod(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	req := httptest.NewRequest("POST", "/health", nil)
@@ -50,7 +110,7 @@ func TestHealthEndpointWrongMethod(t *testing.T) {
 }
 
 func TestRunEndpointValidation(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	tests := []struct {
@@ -59,6 +119,7 @@ func TestRunEndpointValidation(t *testing.T) {
 		apiKey     string
 		wantStatus int
 		wantError  string
+		wantCode   string
 	}{
 		{
 			name:       "missing goal",
@@ -66,6 +127,7 @@ func TestRunEndpointValidation(t *testing.T) {
 			apiKey:     "test-key",
 			wantStatus: http.StatusBadRequest,
 			wantError:  "goal is required",
+			wantCode:   CodeGoalRequired,
 		},
 		{
 			name:       "empty goal",
@@ -73,6 +135,7 @@ func TestRunEndpointValidation(t *testing.T) {
 			apiKey:     "test-key",
 			wantStatus: http.StatusBadRequest,
 			wantError:  "goal is required",
+			wantCode:   CodeGoalRequired,
 		},
 		{
 			name:       "invalid provider",
@@ -80,6 +143,7 @@ func TestRunEndpointValidation(t *testing.T) {
 			apiKey:     "test-key",
 			wantStatus: http.StatusBadRequest,
 			wantError:  "invalid provider",
+			wantCode:   CodeInvalidProvider,
 		},
 		{
 			name:       "missing API key for non-Ollama",
@@ -87,6 +151,7 @@ func TestRunEndpointValidation(t *testing.T) {
 			apiKey:     "",
 			wantStatus: http.StatusBadRequest,
 			wantError:  "API key required",
+			wantCode:   CodeAPIKeyRequired,
 		},
 		{
 			name:       "Ollama without API key is OK",
@@ -108,6 +173,7 @@ func TestRunEndpointValidation(t *testing.T) {
 			apiKey:     "",
 			wantStatus: http.StatusBadRequest,
 			wantError:  "invalid app package",
+			wantCode:   CodeInvalidApp,
 		},
 		{
 			name:       "valid app package",
@@ -116,6 +182,93 @@ func TestRunEndpointValidation(t *testing.T) {
 			wantStatus: http.StatusOK,
 			wantError:  "",
 		},
+		{
+			name:       "max_retries out of range",
+			body:       `{"goal":"test","provider":"Ollama","max_retries":11}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "max_retries must be between 0 and 10",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "priority out of range",
+			body:       `{"goal":"test","provider":"Ollama","priority":101}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "priority must be between -100 and 100",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "negative timeout_seconds",
+			body:       `{"goal":"test","provider":"Ollama","timeout_seconds":-1}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "timeout_seconds must be between 0 and 86400",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "invalid label key",
+			body:       `{"goal":"test","provider":"Ollama","labels":{"bad key":"x"}}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid label key",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "invalid assert_regex",
+			body:       `{"goal":"test","provider":"Ollama","assert_regex":"("}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid assert_regex",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "valid timezone and locale",
+			body:       `{"goal":"test","provider":"Ollama","timezone":"Europe/Berlin","locale":"de-DE"}`,
+			apiKey:     "",
+			wantStatus: http.StatusOK,
+			wantError:  "",
+		},
+		{
+			name:       "invalid timezone",
+			body:       `{"goal":"test","provider":"Ollama","timezone":"Mars/Olympus_Mons"}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid timezone",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "Local is not a timezone",
+			body:       `{"goal":"test","provider":"Ollama","timezone":"Local"}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid timezone",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "invalid locale",
+			body:       `{"goal":"test","provider":"Ollama","locale":"en_US.UTF-8"}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid locale",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "invalid run_if condition",
+			body:       `{"goal":"test","provider":"Ollama","run_if":{"task_id":"abc","condition":"maybe"}}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid run_if condition",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "run_if unknown task",
+			body:       `{"goal":"test","provider":"Ollama","run_if":{"task_id":"nonexistent","condition":"success"}}`,
+			apiKey:     "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "run_if task not found",
+			wantCode:   CodeDependencyNotFound,
+		},
 	}
 
 	for _, tt := range tests {
@@ -140,13 +293,16 @@ func TestRunEndpointValidation(t *testing.T) {
 				if !strings.Contains(resp.Error, tt.wantError) {
 					t.Errorf("expected error containing %q, got %q", tt.wantError, resp.Error)
 				}
+				if resp.Code != tt.wantCode {
+					t.Errorf("expected code %q, got %q", tt.wantCode, resp.Code)
+				}
 			}
 		})
 	}
 }
 
 func TestRunEndpointWrongMethod(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	req := httptest.NewRequest("GET", "/run", nil)
@@ -159,7 +315,7 @@ func TestRunEndpointWrongMethod(t *testing.T) {
 }
 
 func TestRunEndpointInvalidJSON(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	req := httptest.NewRequest("POST", "/run", bytes.NewBufferString("not json"))
@@ -176,13 +332,13 @@ func TestRunEndpointInvalidJSON(t *testing.T) {
 	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if !strings.Contains(resp.Error, "invalid JSON") {
-		t.Errorf("expected 'invalid JSON' error, got %q", resp.Error)
+	if !strings.Contains(resp.Error, "invalid JSON") || resp.Code != CodeInvalidJSON {
+		t.Errorf("expected an invalid_json error, got %+v", resp)
 	}
 }
 
 func TestTaskEndpointNotFound(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	req := httptest.NewRequest("GET", "/task/nonexistent", nil)
@@ -195,7 +351,7 @@ func TestTaskEndpointNotFound(t *testing.T) {
 }
 
 func TestQueueEndpoint(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	req := httptest.NewRequest("GET", "/queue", nil)
@@ -217,7 +373,7 @@ func TestQueueEndpoint(t *testing.T) {
 }
 
 func TestRequestIDPropagation(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	// Test that provided X-Request-ID is echoed back
@@ -267,7 +423,7 @@ func TestServerAuthentication(t *testing.T) {
 	origKey := serverAPIKey
 	defer func() { serverAPIKey = origKey }()
 
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 	api := NewAPI(q)
 
 	// Test with auth enabled
@@ -350,3 +506,1414 @@ func TestModelDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultProviderApplied(t *testing.T) {
+	defer func() { defaultProvider = "Google" }()
+	defaultProvider = "Ollama"
+
+	req := &TaskRequest{Goal: "test"}
+	if err := validateRequest(req, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.Provider != "Ollama" || req.Model != "llama3.2" {
+		t.Errorf("expected Ollama/llama3.2, got %s/%s", req.Provider, req.Model)
+	}
+
+	task := NewQueue("./worker.py", 1).Submit(TaskRequest{Goal: "test"}, "")
+	if task.Request.Provider != "Ollama" || task.Request.Model != "llama3.2" {
+		t.Errorf("expected Submit to apply the default too, got %s/%s", task.Request.Provider, task.Request.Model)
+	}
+}
+
+func TestBatchSubmit(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+
+	post := func(body string) (int, []BatchResult) {
+		req := httptest.NewRequest("POST", "/batch", bytes.NewBufferString(body))
+		req.Header.Set("X-API-Key", "shared-key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		var results []BatchResult
+		if w.Code == http.StatusOK || w.Code == http.StatusMultiStatus {
+			if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return w.Code, results
+	}
+
+	code, results := post(`[{"goal":"first"},{"goal":""},{"goal":"third","max_retries":99},{"goal":"fourth"}]`)
+	if code != http.StatusMultiStatus {
+		t.Fatalf("expected 207 for a partly invalid batch, got %d", code)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %+v", results)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK} {
+		if results[i].Index != i || results[i].Status != want {
+			t.Errorf("result %d: expected status %d, got %+v", i, want, results[i])
+		}
+	}
+	if results[0].Position != 1 || results[3].Position != 2 {
+		t.Errorf("expected the valid tasks queued in order at 1 and 2, got %+v", results)
+	}
+	if results[1].TaskID != "" || results[1].Error == "" {
+		t.Errorf("expected the invalid task reported without an ID, got %+v", results[1])
+	}
+	if results[1].Code != CodeGoalRequired || results[2].Code != CodeInvalidRequest || results[0].Code != "" {
+		t.Errorf("expected each failure's code, got %+v", results)
+	}
+	if q.Size() != 2 {
+		t.Errorf("expected 2 tasks queued, got %d", q.Size())
+	}
+	if task := q.Get(results[3].TaskID); task == nil || task.apiKey != "shared-key" {
+		t.Errorf("expected the shared X-API-Key stored for each task, got %+v", task)
+	}
+
+	if code, _ := post(`[{"goal":"a"}]`); code != http.StatusOK {
+		t.Errorf("expected 200 when every task is queued, got %d", code)
+	}
+	for _, body := range []string{`[]`, `{"goal":"not an array"}`} {
+		if code, _ := post(body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, code)
+		}
+	}
+}
+
+func TestRunUsesServerProviderKey(t *testing.T) {
+	defer func() { serverProviderKeys = map[string]string{} }()
+
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+
+	// Without a server-side key, the request is rejected
+	req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test","provider":"Anthropic"}`))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without any key, got %d", w.Code)
+	}
+
+	serverProviderKeys["Anthropic"] = "server-side-key"
+	req = httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test","provider":"Anthropic"}`))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with server-side key, got %d (body: %s)", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "server-side-key") {
+		t.Error("server-side key must not appear in the response")
+	}
+
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	task := q.Get(resp["task_id"].(string))
+	if task.apiKey != "server-side-key" {
+		t.Errorf("expected task to use server-side key, got %q", task.apiKey)
+	}
+}
+
+func TestAppPackageValidation(t *testing.T) {
+	valid := []string{
+		"com.whatsapp",
+		"com.instagram.android",
+		"org.telegram.messenger",
+		"com.google.android.apps.maps",
+		"jp.naver.line.android",
+		"com.example.app2",
+		"com.vendor.3dscanner", // digit right after a dot
+		"com.foo_bar.baz",
+		"com.app/.MainActivity",
+		"com.spotify.music/com.spotify.music.MainActivity",
+		"com.android.settings/.Settings$WifiSettingsActivity",
+	}
+	invalid := []string{
+		"invalid",
+		"com.",
+		".com.app",
+		"com..app",
+		"1com.app",
+		"com.app/",
+		"com.app/.",
+		"com.app/.Main/Other",
+		"com.app;reboot",
+		"com.app .Main",
+	}
+
+	for _, app := range valid {
+		req := &TaskRequest{Goal: "test", Provider: "Ollama", App: app}
+		if err := validateRequest(req, ""); err != nil {
+			t.Errorf("expected %q to be valid, got %v", app, err)
+		}
+	}
+	for _, app := range invalid {
+		req := &TaskRequest{Goal: "test", Provider: "Ollama", App: app}
+		if err := validateRequest(req, ""); err == nil {
+			t.Errorf("expected %q to be rejected", app)
+		}
+	}
+}
+
+func TestAppPatternOverride(t *testing.T) {
+	orig := appPattern
+	defer func() { appPattern = orig }()
+
+	appPattern = regexp.MustCompile(`^com\.corp\.[a-z]+$`)
+
+	if err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", App: "com.corp.tool"}, ""); err != nil {
+		t.Errorf("expected configured pattern to accept, got %v", err)
+	}
+	if err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", App: "com.whatsapp"}, ""); err == nil {
+		t.Error("expected configured pattern to reject other packages")
+	}
+}
+
+func TestDeeplinksRejectsComponent(t *testing.T) {
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	req := httptest.NewRequest("GET", "/deeplinks?app=com.app/.MainActivity", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for component name, got %d", w.Code)
+	}
+}
+
+func TestRunRejectsWhenQueueFull(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.maxQueue = 1
+	api := NewAPI(q)
+
+	codes := make([]int, 2)
+	for i := range codes {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test"}`))
+		req.Header.Set("X-API-Key", "test-key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		codes[i] = w.Code
+	}
+	if codes[0] != http.StatusOK {
+		t.Errorf("expected first submit to succeed, got %d", codes[0])
+	}
+	if codes[1] != http.StatusTooManyRequests {
+		t.Errorf("expected 429 when queue is full, got %d", codes[1])
+	}
+
+	// Once run times are known, Retry-After says when a worker should be free
+	q.mu.Lock()
+	q.avgRun = 30 * time.Second
+	q.mu.Unlock()
+	req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test"}`))
+	req.Header.Set("X-API-Key", "test-key")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if got := w.Header().Get("Retry-After"); w.Code != http.StatusTooManyRequests || got != "30" {
+		t.Errorf("expected 429 with Retry-After 30, got %d with %q", w.Code, got)
+	}
+}
+
+func TestTaskRecordsPositionHistory(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test"}`))
+		req.Header.Set("X-API-Key", "test-key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		var resp map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode run response: %v", err)
+		}
+		ids = append(ids, resp["task_id"].(string))
+	}
+
+	// Moving up the queue is recorded as a new snapshot
+	q.Cancel(ids[0])
+
+	req := httptest.NewRequest("GET", "/task/"+ids[2], nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var task Task
+	if err := json.NewDecoder(w.Body).Decode(&task); err != nil {
+		t.Fatalf("failed to decode task: %v", err)
+	}
+	if task.SubmitPosition != 3 {
+		t.Errorf("expected submit_position 3, got %d", task.SubmitPosition)
+	}
+	var positions []int
+	for _, snap := range task.PositionHistory {
+		positions = append(positions, snap.Position)
+	}
+	if len(positions) != 2 || positions[0] != 3 || positions[1] != 2 {
+		t.Errorf("expected position history [3 2], got %v", positions)
+	}
+}
+
+func TestTimeoutsExposed(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.timeouts = 3
+	api := NewAPI(q)
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	var health map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatalf("failed to decode health: %v", err)
+	}
+	if health["timeouts"] != float64(3) {
+		t.Errorf("expected timeouts 3 in health, got %v", health["timeouts"])
+	}
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "droidrun_task_timeouts_total 3\n") {
+		t.Errorf("expected timeout counter in metrics, got:\n%s", w.Body.String())
+	}
+}
+
+func TestDeeplinkSchemeAllowlist(t *testing.T) {
+	defer func() { allowedDeeplinkSchemes = map[string]bool{} }()
+
+	// Empty allowlist accepts any scheme
+	if err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", Deeplink: "file:///sdcard/x"}, ""); err != nil {
+		t.Errorf("expected any scheme without an allowlist, got %v", err)
+	}
+
+	allowedDeeplinkSchemes = map[string]bool{"instagram": true, "tel": true}
+
+	for _, link := range []string{"instagram://mainfeed", "Instagram://user?username=x", "tel://5551234"} {
+		if err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", Deeplink: link}, ""); err != nil {
+			t.Errorf("expected %q to be allowed, got %v", link, err)
+		}
+	}
+	for _, link := range []string{"file:///sdcard/x", "intent://scan/#Intent;end", "whatsapp://send"} {
+		err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", Deeplink: link}, "")
+		if err == nil || !strings.Contains(err.Error(), "scheme not allowed") {
+			t.Errorf("expected %q to be rejected, got %v", link, err)
+		}
+	}
+}
+
+func TestDeeplinkValidation(t *testing.T) {
+	for link, want := range map[string]string{
+		"instagram://mainfeed":          "instagram://mainfeed",
+		"  Instagram://user?username=x": "instagram://user?username=x",
+		"file:///sdcard/x":              "file:///sdcard/x",
+		"intent://scan/#Intent;end":     "intent://scan/#Intent;end",
+	} {
+		req := TaskRequest{Goal: "test", Provider: "Ollama", Deeplink: link}
+		if err := validateRequest(&req, ""); err != nil {
+			t.Errorf("expected %q to be valid, got %v", link, err)
+		} else if req.Deeplink != want {
+			t.Errorf("expected %q normalized to %q, got %q", link, want, req.Deeplink)
+		}
+	}
+
+	for _, link := range []string{"instagram:", "instagram", "instagram://", "instagram:///", "://mainfeed", "insta gram://x", "instagram://main feed", "1nsta://x", "app://x/%zz"} {
+		err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", Deeplink: link}, "")
+		if err == nil || !strings.Contains(err.Error(), "invalid deeplink") {
+			t.Errorf("expected %q to be rejected, got %v", link, err)
+		}
+	}
+}
+
+func TestDeeplinkReachesWorker(t *testing.T) {
+	worker := writeWorker(t, `import json, sys
+task = json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": task.get("deeplink") or "none"}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+	api := NewAPI(q)
+
+	req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test","deeplink":"Instagram://mainfeed"}`))
+	req.Header.Set("X-API-Key", "test-key")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	var resp struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the task queued, got %d: %s", w.Code, w.Body)
+	}
+	got := waitForStatus(t, q, resp.TaskID, "completed", "failed")
+	if got.Result != "instagram://mainfeed" || got.Request.Deeplink != "instagram://mainfeed" {
+		t.Errorf("expected the normalized deeplink in the worker input and request, got %q / %q", got.Result, got.Request.Deeplink)
+	}
+}
+
+func TestSetupValidation(t *testing.T) {
+	req := TaskRequest{Goal: "test", Provider: "Ollama", Setup: []SetupStep{
+		{App: "com.whatsapp"},
+		{Deeplink: " Instagram://mainfeed"},
+		{App: "com.app/.MainActivity"},
+	}}
+	if err := validateRequest(&req, ""); err != nil {
+		t.Fatalf("expected a valid setup, got %v", err)
+	}
+	if req.Setup[1].Deeplink != "instagram://mainfeed" {
+		t.Errorf("expected the step's deeplink normalized, got %q", req.Setup[1].Deeplink)
+	}
+
+	for _, tc := range []struct {
+		setup []SetupStep
+		want  string
+	}{
+		{[]SetupStep{{}}, "setup[0]: needs exactly one of app or deeplink"},
+		{[]SetupStep{{App: "com.whatsapp"}, {App: "com.whatsapp", Deeplink: "whatsapp://send"}}, "setup[1]: needs exactly one"},
+		{[]SetupStep{{App: "invalid"}}, "setup[0]: invalid app package name"},
+		{[]SetupStep{{Deeplink: "instagram"}}, "setup[0]: invalid deeplink"},
+		{[]SetupStep{{App: "com." + strings.Repeat("a", maxAppBytes)}}, "setup[0]: app too long"},
+		{make([]SetupStep, maxSetupSteps+1), "setup has 11 steps, max 10"},
+	} {
+		err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", Setup: tc.setup}, "")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("setup %+v: expected %q, got %v", tc.setup, tc.want, err)
+		}
+	}
+
+	defer func() { allowedDeeplinkSchemes = map[string]bool{} }()
+	allowedDeeplinkSchemes = map[string]bool{"instagram": true}
+	err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", Setup: []SetupStep{{Deeplink: "whatsapp://send"}}}, "")
+	if err == nil || !strings.Contains(err.Error(), "setup[0]: deeplink scheme not allowed") {
+		t.Errorf("expected the scheme allowlist to apply to setup, got %v", err)
+	}
+}
+
+func TestSetupReachesWorker(t *testing.T) {
+	worker := writeWorker(t, `import json, sys
+task = json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": json.dumps(task["setup"])}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+	api := NewAPI(q)
+
+	body := `{"goal":"test","app":"com.whatsapp","setup":[{"deeplink":"Instagram://mainfeed"},{"app":"com.android.chrome"}]}`
+	req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(body))
+	req.Header.Set("X-API-Key", "test-key")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	var resp struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the task queued, got %d: %s", w.Code, w.Body)
+	}
+	got := waitForStatus(t, q, resp.TaskID, "completed", "failed")
+	want := `[{"app": "com.whatsapp"}, {"deeplink": "instagram://mainfeed"}, {"app": "com.android.chrome"}]`
+	if got.Result != want {
+		t.Errorf("expected the shorthand app first, then the setup, got %s", got.Result)
+	}
+	if len(got.Request.Setup) != 2 || got.Request.App != "com.whatsapp" {
+		t.Errorf("expected the request to keep app and setup apart, got %+v", got.Request)
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	q.Submit(TaskRequest{Goal: "one"}, "key")
+	q.Submit(TaskRequest{Goal: "two"}, "key")
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	line := w.Body.String()
+	pattern := regexp.MustCompile(`^ok v\S+ queue=2 running=- up=\S+\n$`)
+	if !pattern.MatchString(line) {
+		t.Errorf("unexpected status line %q", line)
+	}
+
+	req = httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode JSON status: %v", err)
+	}
+	if resp["queue"] != float64(2) {
+		t.Errorf("expected queue 2 in JSON status, got %v", resp["queue"])
+	}
+}
+
+func TestFormatUptime(t *testing.T) {
+	tests := map[time.Duration]string{
+		45*time.Second + 300*time.Millisecond: "45s",
+		13*time.Minute + 5*time.Second:        "13m",
+		2*time.Hour + 13*time.Minute:          "2h13m",
+		50 * time.Hour:                        "50h0m",
+	}
+	for d, want := range tests {
+		if got := formatUptime(d); got != want {
+			t.Errorf("formatUptime(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestQueueEndpointFilters(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	old := q.Submit(TaskRequest{Goal: "old"}, "key")
+	q.mu.Lock()
+	q.tasks[old.ID].CreatedAt = time.Now().Add(-48 * time.Hour)
+	q.mu.Unlock()
+	recent := q.Submit(TaskRequest{Goal: "recent"}, "key")
+
+	since := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	req := httptest.NewRequest("GET", "/queue?status=queued&created_after="+since, nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Tasks map[string]Task `json:"tasks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if _, ok := resp.Tasks[recent.ID]; !ok || len(resp.Tasks) != 1 {
+		t.Errorf("expected only the recent task, got %v", resp.Tasks)
+	}
+
+	req = httptest.NewRequest("GET", "/queue?finished_before=yesterday", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad timestamp, got %d", w.Code)
+	}
+}
+
+func TestRequestSizeLimits(t *testing.T) {
+	api := NewAPI(NewQueue("./worker.py", 1))
+	run := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("POST", "/run", strings.NewReader(body)))
+		return w
+	}
+
+	w := run(fmt.Sprintf(`{"goal": %q, "provider": "Ollama"}`, strings.Repeat("a", maxGoalBytes+1)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "goal too long") {
+		t.Errorf("expected 400 for an over-long goal, got %d: %s", w.Code, w.Body)
+	}
+	if w := run(fmt.Sprintf(`{"goal": %q, "provider": "Ollama"}`, strings.Repeat("a", maxGoalBytes))); w.Code != http.StatusOK {
+		t.Errorf("expected a goal at the limit to be accepted, got %d: %s", w.Code, w.Body)
+	}
+	for field, n := range map[string]int{"app": maxAppBytes, "deeplink": maxDeeplinkBytes, "model": maxModelBytes} {
+		w := run(fmt.Sprintf(`{"goal": "test", "provider": "Ollama", %q: %q}`, field, strings.Repeat("a", n+1)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), field+" too long") {
+			t.Errorf("expected 400 for an over-long %s, got %d: %s", field, w.Code, w.Body)
+		}
+	}
+
+	// Bodies past -max-body aren't read at all
+	api.SetMaxBody(1024)
+	w = run(fmt.Sprintf(`{"goal": "test", "provider": "Ollama", "labels": {"pad": %q}}`, strings.Repeat("a", 2048)))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "max 1024 bytes") {
+		t.Errorf("expected 413 for an over-limit body, got %d: %s", w.Code, w.Body)
+	}
+	if w := run(`{"goal": "test", "provider": "Ollama"}`); w.Code != http.StatusOK {
+		t.Errorf("expected a small body to be accepted, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestQueueEndpointLabelFilter(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	labels := map[string]string{"project": "alpha", "env": "staging"}
+	alpha := q.Submit(TaskRequest{Goal: "alpha", Labels: labels}, "key")
+	q.Submit(TaskRequest{Goal: "beta", Labels: map[string]string{"project": "beta", "env": "staging"}}, "key")
+	q.Submit(TaskRequest{Goal: "unlabelled"}, "key")
+
+	get := func(query string) (int, map[string]Task) {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/queue?"+query, nil))
+		var resp struct {
+			Tasks map[string]Task `json:"tasks"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Tasks
+	}
+
+	for _, query := range []string{"label=project=alpha", "label=project=alpha&label=env=staging"} {
+		code, tasks := get(query)
+		if code != http.StatusOK || len(tasks) != 1 {
+			t.Fatalf("%s: expected only the alpha task, got %d %v", query, code, tasks)
+		}
+		if got := tasks[alpha.ID].Request.Labels; !reflect.DeepEqual(got, labels) {
+			t.Errorf("%s: expected the labels unchanged, got %v", query, got)
+		}
+	}
+	if _, tasks := get("label=env=staging"); len(tasks) != 2 {
+		t.Errorf("expected both staging tasks, got %v", tasks)
+	}
+	if _, tasks := get("label=project=alpha&label=env=prod"); len(tasks) != 0 {
+		t.Errorf("expected every label to have to match, got %v", tasks)
+	}
+	if code, _ := get("label=project"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a label without a value, got %d", code)
+	}
+}
+
+func TestQueueEndpointPagination(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	var ids []string
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		task := q.Submit(TaskRequest{Goal: fmt.Sprintf("task %d", i)}, "key")
+		q.mu.Lock()
+		q.tasks[task.ID].CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		q.mu.Unlock()
+		ids = append(ids, task.ID)
+	}
+	q.Cancel(ids[3])
+
+	get := func(query string) (int, []Task, int) {
+		req := httptest.NewRequest("GET", "/queue?"+query, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		var resp struct {
+			Tasks []Task `json:"tasks"`
+			Total int    `json:"total"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("%s: failed to decode response: %v", query, err)
+			}
+		}
+		return w.Code, resp.Tasks, resp.Total
+	}
+
+	code, tasks, total := get("limit=2&offset=1")
+	if code != http.StatusOK || total != 5 || len(tasks) != 2 {
+		t.Fatalf("expected 2 of 5 tasks, got %d: %d tasks, total %d", code, len(tasks), total)
+	}
+	if tasks[0].ID != ids[3] || tasks[1].ID != ids[2] {
+		t.Errorf("expected the 2nd and 3rd newest tasks, got %s, %s", tasks[0].ID, tasks[1].ID)
+	}
+
+	if _, tasks, total := get("status=queued&limit=10"); total != 4 || len(tasks) != 4 || tasks[0].ID != ids[4] {
+		t.Errorf("expected 4 queued tasks newest first, got total %d: %+v", total, tasks)
+	}
+	if _, tasks, total := get("offset=10"); total != 5 || tasks == nil || len(tasks) != 0 {
+		t.Errorf("expected an empty page past the end, got total %d: %+v", total, tasks)
+	}
+	for _, query := range []string{"limit=0", "limit=abc", "offset=-1", "limit=2&sort=eta"} {
+		if code, _, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestTasksEndpointBatch(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	first := q.Submit(TaskRequest{Goal: "first"}, "key")
+	second := q.Submit(TaskRequest{Goal: "second"}, "key")
+
+	req := httptest.NewRequest("GET", "/tasks?ids="+second.ID+",missing,"+first.ID, nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Tasks  []*Task           `json:"tasks"`
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Tasks) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(resp.Tasks))
+	}
+	if resp.Tasks[0] == nil || resp.Tasks[0].ID != second.ID {
+		t.Errorf("expected %s first, got %+v", second.ID, resp.Tasks[0])
+	}
+	if resp.Tasks[1] != nil {
+		t.Errorf("expected null for an unknown ID, got %+v", resp.Tasks[1])
+	}
+	if resp.Tasks[2] == nil || resp.Tasks[2].ID != first.ID {
+		t.Errorf("expected %s last, got %+v", first.ID, resp.Tasks[2])
+	}
+	if len(resp.Errors) != 1 || resp.Errors["missing"] == "" {
+		t.Errorf("expected an error for the unknown ID only, got %v", resp.Errors)
+	}
+
+	req = httptest.NewRequest("GET", "/tasks", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without ids, got %d", w.Code)
+	}
+}
+
+func TestAutoVisionKeywords(t *testing.T) {
+	autoVisionPattern = compileKeywords("button, tap the")
+	defer func() { autoVisionPattern = nil }()
+
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"matching goal", `{"goal":"press the blue Button","provider":"Ollama"}`, true},
+		{"phrase match", `{"goal":"Tap the settings gear","provider":"Ollama"}`, true},
+		{"non-matching goal", `{"goal":"open settings","provider":"Ollama"}`, false},
+		{"partial word", `{"goal":"open buttonsapp","provider":"Ollama"}`, false},
+		{"explicit vision=false wins", `{"goal":"press the blue button","provider":"Ollama","vision":false}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req TaskRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if err := validateRequest(&req, ""); err != nil {
+				t.Fatalf("validateRequest: %v", err)
+			}
+			if req.Vision != tt.want {
+				t.Errorf("vision = %v, want %v", req.Vision, tt.want)
+			}
+		})
+	}
+
+	autoVisionPattern = nil
+	req := TaskRequest{Goal: "press the blue button", Provider: "Ollama"}
+	if err := validateRequest(&req, ""); err != nil || req.Vision {
+		t.Errorf("expected vision to stay off when the feature is disabled (err %v)", err)
+	}
+}
+
+func TestRunSetsQueueHeaders(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.avgRun = 30 * time.Second
+	api := NewAPI(q)
+	q.Submit(TaskRequest{Goal: "ahead"}, "key")
+
+	req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test","provider":"Ollama"}`))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", w.Code, w.Body.String())
+	}
+	var resp struct {
+		TaskID        string `json:"task_id"`
+		Position      int    `json:"position"`
+		QueueSize     int    `json:"queue_size"`
+		EstimatedWait int    `json:"estimated_wait_seconds"`
+	}
+	body := w.Body.String()
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Position != 2 || resp.QueueSize != 2 || resp.EstimatedWait != 60 || strings.Contains(body, `"estimated_wait"`) {
+		t.Errorf("unexpected body %s", body)
+	}
+	for header, want := range map[string]int{
+		"X-Queue-Size":     resp.QueueSize,
+		"X-Queue-Position": resp.Position,
+		"X-Estimated-Wait": resp.EstimatedWait,
+	} {
+		if got := w.Header().Get(header); got != strconv.Itoa(want) {
+			t.Errorf("%s = %q, want %d to match the body", header, got, want)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/task/"+resp.TaskID, nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Queue-Position"); got != "2" {
+		t.Errorf("expected X-Queue-Position 2 on poll, got %q", got)
+	}
+	var polled map[string]any
+	_ = json.Unmarshal(w.Body.Bytes(), &polled)
+	if polled["estimated_wait_seconds"] != float64(60) || polled["id"] != resp.TaskID {
+		t.Errorf("expected the queued task with estimated_wait_seconds 60, got %v", polled)
+	}
+
+	// No finished runs yet: the wait is unknown and left out
+	q.avgRun = 0
+	req = httptest.NewRequest("GET", "/task/"+resp.TaskID, nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Estimated-Wait"); got != "" {
+		t.Errorf("expected no X-Estimated-Wait without history, got %q", got)
+	}
+	if strings.Contains(w.Body.String(), "estimated_wait") {
+		t.Errorf("expected no estimated wait without history, got %s", w.Body)
+	}
+
+	// A task held back by run_if isn't in the queue, so it gets no estimate
+	q.avgRun = 30 * time.Second
+	body = `{"goal":"later","provider":"Ollama","run_if":{"task_id":"` + resp.TaskID + `","condition":"success"}}`
+	req = httptest.NewRequest("POST", "/run", bytes.NewBufferString(body))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Estimated-Wait"); got != "" {
+		t.Errorf("expected no X-Estimated-Wait for a waiting task, got %q", got)
+	}
+	if strings.Contains(w.Body.String(), "estimated_wait") {
+		t.Errorf("expected no estimated wait for a waiting task, got %s", w.Body)
+	}
+}
+
+func TestTaskRerunAppliesOverrides(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	orig := q.Submit(TaskRequest{Goal: "open settings", App: "com.android.settings", Provider: "Google", Model: "gemini-2.0-flash", MaxSteps: 30}, "key")
+
+	req := httptest.NewRequest("POST", "/task/"+orig.ID+"/rerun", bytes.NewBufferString(`{"max_steps": 50, "provider": "Anthropic"}`))
+	req.Header.Set("X-API-Key", "fresh-key")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	id, _ := resp["task_id"].(string)
+	rerun := q.Get(id)
+	if rerun == nil || id == orig.ID {
+		t.Fatalf("expected a new task, got %q", id)
+	}
+	got := rerun.Request
+	if got.Goal != "open settings" || got.App != "com.android.settings" {
+		t.Errorf("expected goal and app carried over, got %+v", got)
+	}
+	if got.MaxSteps != 50 || got.Provider != "Anthropic" {
+		t.Errorf("expected overrides applied, got %+v", got)
+	}
+	if got.Model != "claude-sonnet-4-20250514" {
+		t.Errorf("expected the new provider's default model, got %q", got.Model)
+	}
+	if rerun.apiKey != "fresh-key" {
+		t.Errorf("expected the fresh API key, got %q", rerun.apiKey)
+	}
+
+	// The merged request is validated like a new one
+	req = httptest.NewRequest("POST", "/task/"+orig.ID+"/rerun", bytes.NewBufferString(`{"max_retries": 20}`))
+	req.Header.Set("X-API-Key", "fresh-key")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid override, got %d", w.Code)
+	}
+
+	// Overriding labels and run_if leaves the source task's own alone
+	dep := q.Submit(TaskRequest{Goal: "dependency"}, "key")
+	labelled := q.Submit(TaskRequest{Goal: "labelled", Labels: map[string]string{"team": "a"}, RunIf: &RunCondition{TaskID: dep.ID, Condition: "success"}}, "key")
+	body := `{"labels": {"team": "b", "env": "prod"}, "run_if": {"task_id": "` + dep.ID + `", "condition": "failure"}}`
+	req = httptest.NewRequest("POST", "/task/"+labelled.ID+"/rerun", bytes.NewBufferString(body))
+	req.Header.Set("X-API-Key", "fresh-key")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	src := q.Get(labelled.ID).Request
+	if len(src.Labels) != 1 || src.Labels["team"] != "a" {
+		t.Errorf("expected the source task's labels unchanged, got %v", src.Labels)
+	}
+	if src.RunIf == nil || src.RunIf.Condition != "success" {
+		t.Errorf("expected the source task's run_if unchanged, got %+v", src.RunIf)
+	}
+
+	req = httptest.NewRequest("POST", "/task/missing/rerun", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown task, got %d", w.Code)
+	}
+}
+
+func TestQueueOrderMatchesDispatch(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	api := NewAPI(q)
+	first := q.Submit(TaskRequest{Goal: "first"}, "key")
+	held := q.Submit(TaskRequest{Goal: "held", RunIf: &RunCondition{TaskID: first.ID, Condition: "success"}}, "key")
+	second := q.Submit(TaskRequest{Goal: "second"}, "key")
+	third := q.Submit(TaskRequest{Goal: "third"}, "key")
+
+	req := httptest.NewRequest("GET", "/queue/order", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Order   []*Task `json:"order"`
+		Waiting []*Task `json:"waiting"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	var reported []string
+	for _, task := range resp.Order {
+		reported = append(reported, task.ID)
+	}
+	if len(resp.Waiting) != 1 || resp.Waiting[0].ID != held.ID {
+		t.Errorf("expected %s waiting, got %+v", held.ID, resp.Waiting)
+	}
+
+	go q.Run()
+	tasks := []*Task{first, second, third, held}
+	for _, task := range tasks {
+		waitForStatus(t, q, task.ID, "completed", "failed")
+	}
+	sort.Slice(tasks, func(i, j int) bool { return q.Get(tasks[i].ID).StartedAt.Before(q.Get(tasks[j].ID).StartedAt) })
+	var dispatched []string
+	for _, task := range tasks[:3] {
+		dispatched = append(dispatched, task.ID)
+	}
+	if strings.Join(reported, ",") != strings.Join(dispatched, ",") {
+		t.Errorf("reported order %v, dispatched %v", reported, dispatched)
+	}
+	if tasks[3].ID != held.ID {
+		t.Errorf("expected the run_if task to start last, got %s", tasks[3].ID)
+	}
+}
+
+func TestQueueSortByETA(t *testing.T) {
+	q := NewQueue("./worker.py", 2)
+	api := NewAPI(q)
+	now := time.Now()
+	q.avgRun = 10 * time.Second
+	for _, task := range []*Task{
+		{ID: "just-started", Status: "running", StartedAt: now.Add(-time.Second)},
+		{ID: "nearly-done", Status: "running", StartedAt: now.Add(-9 * time.Second)},
+		{ID: "next", Status: "queued"},
+		{ID: "finished", Status: "completed"},
+	} {
+		q.tasks[task.ID] = task
+	}
+	q.running["just-started"] = nil
+	q.running["nearly-done"] = nil
+	q.pendingOrder = []string{"next"}
+
+	req := httptest.NewRequest("GET", "/queue?sort=eta", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Tasks []TaskETA `json:"tasks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	var ids []string
+	for _, task := range resp.Tasks {
+		ids = append(ids, task.ID)
+	}
+	if strings.Join(ids, ",") != "nearly-done,just-started,next" {
+		t.Fatalf("unexpected order %v", ids)
+	}
+	// The queued task gets the first worker to free up, after nearly-done
+	want := []time.Duration{time.Second, 9 * time.Second, 11 * time.Second}
+	for i, task := range resp.Tasks {
+		if task.EstimatedCompletion == nil {
+			t.Fatalf("%s: missing estimated_completion", task.ID)
+		}
+		if got := task.EstimatedCompletion.Sub(now); got < want[i]-time.Second || got > want[i]+time.Second {
+			t.Errorf("%s: expected completion in about %s, got %s", task.ID, want[i], got)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/queue?sort=size", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown sort, got %d", w.Code)
+	}
+}
+
+func TestClearQueueRequiresConfirmation(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	q.Submit(TaskRequest{Goal: "one"}, "key")
+	q.Submit(TaskRequest{Goal: "two"}, "key")
+	// Finished tasks aren't counted in the confirmation, only cleared
+	q.tasks["done"] = &Task{ID: "done", Status: "completed"}
+
+	clear := func(target, confirm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", target, nil)
+		if confirm != "" {
+			req.Header.Set("X-Confirm", confirm)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, confirm := range []string{"", "1", "yes"} {
+		w := clear("/queue", confirm)
+		if w.Code != http.StatusConflict {
+			t.Fatalf("X-Confirm %q: expected 409, got %d", confirm, w.Code)
+		}
+		var resp struct {
+			Error   string `json:"error"`
+			Tasks   int    `json:"tasks"`
+			Confirm int    `json:"confirm"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Tasks != 2 || resp.Confirm != 2 || !strings.Contains(resp.Error, "X-Confirm: 2") {
+			t.Errorf("expected the confirmation details, got %+v", resp)
+		}
+	}
+	if len(q.All()) != 3 {
+		t.Fatal("unconfirmed clear removed tasks")
+	}
+
+	if w := clear("/queue", "3"); w.Code != http.StatusConflict {
+		t.Errorf("expected X-Confirm counting finished tasks to be refused, got %d", w.Code)
+	}
+	if w := clear("/queue", "2"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"cleared":3`) {
+		t.Errorf("expected X-Confirm: 2 to clear, got %d: %s", w.Code, w.Body.String())
+	}
+	q.Submit(TaskRequest{Goal: "three"}, "key")
+	if w := clear("/queue?confirm=true", ""); w.Code != http.StatusOK || len(q.All()) != 0 {
+		t.Errorf("expected ?confirm=true to clear, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCancelMatchingTasks(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(30)
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+	api := NewAPI(q)
+	alpha := map[string]string{"project": "alpha"}
+	running := q.Submit(TaskRequest{Goal: "running", Provider: "Google", Labels: alpha}, "key")
+	waitForStatus(t, q, running.ID, "running")
+	queued := q.Submit(TaskRequest{Goal: "queued", Provider: "Google", Labels: alpha}, "key")
+	other := q.Submit(TaskRequest{Goal: "other", Provider: "Ollama", Labels: map[string]string{"project": "beta"}}, "key")
+	q.tasks["done"] = &Task{ID: "done", Status: "completed", Request: TaskRequestSafe{Labels: alpha}}
+
+	cancel := func(target, confirm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", target, nil)
+		if confirm != "" {
+			req.Header.Set("X-Confirm", confirm)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// Unknown parameters and providers are refused rather than clearing all
+	for _, target := range []string{"/queue?labels=project=alpha&confirm=true", "/queue?provider=Nope&confirm=true", "/queue?label=alpha&confirm=true"} {
+		if w := cancel(target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", target, w.Code)
+		}
+	}
+
+	// Confirmation counts only the matching unfinished tasks
+	w := cancel("/queue?label=project=alpha", "")
+	var conflict struct {
+		Tasks   int      `json:"tasks"`
+		Running []string `json:"running"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&conflict); err != nil || w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d (%v)", w.Code, err)
+	}
+	if conflict.Tasks != 2 || len(conflict.Running) != 1 || conflict.Running[0] != running.ID {
+		t.Errorf("expected the 2 matching tasks, 1 running, got %+v", conflict)
+	}
+
+	w = cancel("/queue?label=project=alpha", "2")
+	var resp struct {
+		Cleared int      `json:"cleared"`
+		TaskIDs []string `json:"task_ids"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK || resp.Cleared != 2 || len(resp.TaskIDs) != 2 {
+		t.Fatalf("expected the alpha tasks cancelled, got %d: %+v", w.Code, resp)
+	}
+	waitForStatus(t, q, running.ID, "cancelled")
+	waitForStatus(t, q, queued.ID, "cancelled")
+	if got := q.Get(other.ID); got.Status != "queued" {
+		t.Errorf("expected the beta task left queued, got %s", got.Status)
+	}
+	if got := q.Get("done"); got.Status != "completed" || len(q.All()) != 4 {
+		t.Errorf("expected finished tasks kept, got %s of %d tasks", got.Status, len(q.All()))
+	}
+
+	if w := cancel("/queue?provider=Ollama&confirm=true", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"cleared":1`) {
+		t.Errorf("expected the Ollama task cancelled, got %d: %s", w.Code, w.Body)
+	}
+	waitForStatus(t, q, other.ID, "cancelled")
+}
+
+func TestTaskLogs(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	q.tasks["done"] = &Task{ID: "done", Status: "completed", Logs: "one\ntwo\nthree\n"}
+	q.tasks["new"] = &Task{ID: "new", Status: "queued"}
+
+	get := func(target string) (int, string) {
+		req := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	for _, tc := range []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/task/done/logs", http.StatusOK, "one\ntwo\nthree\n"},
+		{"/task/done/logs?tail=2", http.StatusOK, "two\nthree\n"},
+		{"/task/done/logs?tail=10", http.StatusOK, "one\ntwo\nthree\n"},
+		{"/task/new/logs", http.StatusOK, ""},
+		{"/task/done/logs?offset=4", http.StatusOK, "two\nthree\n"},
+		{"/task/done/logs?offset=100", http.StatusOK, ""},
+	} {
+		code, body := get(tc.target)
+		if code != tc.code || body != tc.body {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.target, tc.code, tc.body, code, body)
+		}
+	}
+	if code, _ := get("/task/missing/logs"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown task, got %d", code)
+	}
+	if code, _ := get("/task/done/logs?tail=0"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for tail=0, got %d", code)
+	}
+	for _, target := range []string{"/task/done/logs?offset=-1", "/task/done/logs?tail=1&offset=1"} {
+		if code, _ := get(target); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", target, code)
+		}
+	}
+}
+
+func TestTaskMaxResultBytes(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	result := strings.Repeat("é", 200) // 400 bytes
+	var steps []any
+	for i := 0; i < 10; i++ {
+		steps = append(steps, json.RawMessage(`{"action":"tap","n":`+strconv.Itoa(i)+`}`))
+	}
+	q.tasks["big"] = &Task{ID: "big", Status: "completed", Request: TaskRequestSafe{Goal: "short"}, Result: result, Logs: strings.Repeat("x", 50), Steps: steps}
+
+	get := func(target string) (int, Task) {
+		req := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		var task Task
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&task); err != nil {
+				t.Fatalf("failed to decode task: %v", err)
+			}
+		}
+		return w.Code, task
+	}
+
+	code, task := get("/task/big?max_result_bytes=101")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if !strings.HasPrefix(task.Result, strings.Repeat("é", 50)+"... [truncated 300 bytes]") {
+		t.Errorf("expected the result cut on a rune boundary, got %q", task.Result)
+	}
+	if task.Logs != strings.Repeat("x", 50) || task.Request.Goal != "short" {
+		t.Error("fields under the limit must be left alone")
+	}
+	list, _ := task.Steps.([]any)
+	// Each step encodes to 22 bytes, so 4 fit
+	if n := len(list); n != 5 || !strings.Contains(fmt.Sprint(list[n-1]), "truncated_steps:6") {
+		t.Errorf("expected 4 steps and a marker, got %v", task.Steps)
+	}
+	if strings.Join(task.Truncated, ",") != "result,steps" {
+		t.Errorf("expected truncated [result steps], got %v", task.Truncated)
+	}
+
+	// Only that response was shaped
+	if _, task := get("/task/big"); task.Result != result || len(task.Steps.([]any)) != 10 || task.Truncated != nil {
+		t.Errorf("expected the full task without the param, got %d steps, truncated %v", len(task.Steps.([]any)), task.Truncated)
+	}
+	if stored := q.Get("big"); stored.Result != result || len(stored.Steps.([]any)) != 10 {
+		t.Error("stored task was modified")
+	}
+	if code, _ := get("/task/big?max_result_bytes=0"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for max_result_bytes=0, got %d", code)
+	}
+}
+
+func TestReplayForwardsSteps(t *testing.T) {
+	q := NewQueue(writeWorker(t, `import json, sys
+task = json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": task.get("mode", "") + " " + json.dumps(task.get("replay_steps"))}))
+`), 1)
+	api := NewAPI(q)
+	q.tasks["src"] = &Task{ID: "src", Status: "completed", Steps: []any{
+		json.RawMessage(`{"action":"tap","x":10,"y":20}`),
+		json.RawMessage(`{"action":"back"}`),
+	}}
+	q.tasks["nosteps"] = &Task{ID: "nosteps", Status: "completed"}
+	go q.Run()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// No goal or API key needed, as the LLM isn't used
+	w := post(`{"mode": "replay", "replay_of": "src"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode run response: %v", err)
+	}
+	got := waitForStatus(t, q, resp.TaskID, "completed", "failed")
+	if want := `replay [{"action": "tap", "x": 10, "y": 20}, {"action": "back"}]`; got.Result != want {
+		t.Errorf("expected the worker to get the source steps, got %q (%s)", got.Result, got.Error)
+	}
+	if got.Request.Goal != "Replay of task src" {
+		t.Errorf("expected a default goal, got %q", got.Request.Goal)
+	}
+
+	for body, wantErr := range map[string]string{
+		`{"mode": "replay"}`:                                    "replay_of is required",
+		`{"mode": "replay", "replay_of": "missing"}`:            "replay_of task not found",
+		`{"mode": "replay", "replay_of": "nosteps"}`:            "replay_of task has no recorded steps",
+		`{"goal": "x", "replay_of": "src"}`:                     "replay_of needs mode",
+		`{"goal": "x", "mode": "record", "provider": "Ollama"}`: "invalid mode",
+	} {
+		if w := post(body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), wantErr) {
+			t.Errorf("%s: expected 400 %q, got %d: %s", body, wantErr, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHealthMessage(t *testing.T) {
+	origKey := serverAPIKey
+	defer func() { serverAPIKey = origKey }()
+	serverAPIKey = "test-server-key"
+
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	health := func() map[string]any {
+		req := httptest.NewRequest("GET", "/health", nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		var resp map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode health: %v", err)
+		}
+		return resp
+	}
+	if _, ok := health()["message"]; ok {
+		t.Error("expected no message by default")
+	}
+
+	req := httptest.NewRequest("POST", "/health/message", bytes.NewBufferString(`{"message": "maintenance window 2-3am"}`))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without server key, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/health/message", bytes.NewBufferString(`{"message": "maintenance window 2-3am"}`))
+	req.Header.Set("X-Server-Key", "test-server-key")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if msg := health()["message"]; msg != "maintenance window 2-3am" {
+		t.Errorf("expected the banner in /health, got %v", msg)
+	}
+
+	req = httptest.NewRequest("DELETE", "/health/message", nil)
+	req.Header.Set("X-Server-Key", "test-server-key")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if _, ok := health()["message"]; ok || w.Code != http.StatusOK {
+		t.Errorf("expected DELETE to clear the message, got %d", w.Code)
+	}
+}
+
+func TestQueuePauseResume(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+task = json.load(sys.stdin)
+time.sleep(0.2 if task["goal"] == "slow" else 0)
+print(json.dumps({"ok": True, "success": True, "reason": "done"}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+	api := NewAPI(q)
+	post := func(path string) map[string]any {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", path, w.Code, w.Body)
+		}
+		var resp map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+	health := func() map[string]any {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		var resp map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// Pausing leaves the running task to finish
+	slow := q.Submit(TaskRequest{Goal: "slow"}, "key")
+	waitForStatus(t, q, slow.ID, "running")
+	if resp := post("/queue/pause"); resp["paused"] != true {
+		t.Fatalf("expected paused, got %v", resp)
+	}
+	queued := q.Submit(TaskRequest{Goal: "fast"}, "key")
+	waitForStatus(t, q, slow.ID, "completed")
+	time.Sleep(100 * time.Millisecond)
+	if got, _ := q.Snapshot(queued.ID); got.Status != "queued" {
+		t.Errorf("expected the task to stay queued while paused, got %s", got.Status)
+	}
+	if h := health(); h["status"] != "paused" || h["paused"] != true {
+		t.Errorf("expected /health to report the pause, got %v", h)
+	}
+
+	if resp := post("/queue/resume"); resp["paused"] != false {
+		t.Fatalf("expected resumed, got %v", resp)
+	}
+	waitForStatus(t, q, queued.ID, "completed")
+	if h := health(); h["status"] != "ok" || h["paused"] != false {
+		t.Errorf("expected /health back to ok, got %v", h)
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/queue/pause", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", w.Code)
+	}
+}
+
+func TestDrainRefusesNewTasks(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(0.5)
+print(json.dumps({"ok": True, "success": True, "reason": "done"}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+	api := NewAPI(q)
+
+	running := q.Submit(TaskRequest{Goal: "slow"}, "key")
+	waitForStatus(t, q, running.ID, "running")
+	queued := q.Submit(TaskRequest{Goal: "next"}, "key")
+
+	drained := make(chan error, 1)
+	go func() { drained <- q.Drain(context.Background()) }()
+	for !q.Draining() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test"}`))
+	req.Header.Set("X-API-Key", "test-key")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while draining, got %d: %s", w.Code, w.Body)
+	}
+
+	// Status requests are still answered
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/"+running.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected task status while draining, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if !strings.Contains(w.Body.String(), `"status":"draining"`) {
+		t.Errorf("expected /health to report draining, got %s", w.Body)
+	}
+
+	if err := <-drained; err != nil {
+		t.Fatalf("expected the running task to finish, got %v", err)
+	}
+	if got := q.Get(running.ID); got.Status != "completed" {
+		t.Errorf("expected the running task to complete, got %s", got.Status)
+	}
+	if got := q.Get(queued.ID); got.Status != "queued" {
+		t.Errorf("expected the queued task left for the state file, got %s", got.Status)
+	}
+}
+
+func TestHealthReportsWorkerAvailability(t *testing.T) {
+	dir := t.TempDir()
+	q := NewQueue(filepath.Join(dir, "worker.py"), 1)
+	q.workerCmd = []string{"sh"}
+	api := NewAPI(q)
+
+	health := func() (int, map[string]any) {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	if problem := q.ProbeWorkers(); !strings.Contains(problem, "worker.py not found") {
+		t.Errorf("expected the missing script reported, got %q", problem)
+	}
+	if code, body := health(); code != http.StatusServiceUnavailable || body["worker_ok"] != false || body["status"] != "worker_unavailable" || body["reason"] == nil {
+		t.Errorf("expected 503 with worker_ok false and a reason, got %d %v", code, body)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "worker.py"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	q.workerCmd = []string{"no-such-python-here"}
+	if problem := q.ProbeWorkers(); !strings.Contains(problem, "interpreter no-such-python-here not found") {
+		t.Errorf("expected the missing interpreter reported, got %q", problem)
+	}
+
+	q.workerCmd = []string{"sh"}
+	if problem := q.ProbeWorkers(); problem != "" {
+		t.Errorf("expected no problem, got %q", problem)
+	}
+	if code, body := health(); code != http.StatusOK || body["worker_ok"] != true || body["reason"] != nil {
+		t.Errorf("expected 200 with worker_ok true, got %d %v", code, body)
+	}
+}
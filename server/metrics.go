@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the task duration
+// histogram.
+var durationBuckets = []float64{10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// taskMetrics counts tasks for GET /metrics. Guarded by Queue.mu.
+type taskMetrics struct {
+	submitted map[string]int // By provider
+	completed map[string]int // By provider; includes unsuccessful and cached results
+	failed    map[string]int // By provider; counted once retries are used up
+	skipped   map[string]int // By provider; run_if wasn't met
+
+	// Worker run time of completed and failed tasks, from StartedAt to FinishedAt
+	durationCounts []int // Per bucket, not cumulative
+	durationCount  int
+	durationSum    float64
+}
+
+func newTaskMetrics() taskMetrics {
+	return taskMetrics{
+		submitted:      map[string]int{},
+		completed:      map[string]int{},
+		failed:         map[string]int{},
+		skipped:        map[string]int{},
+		durationCounts: make([]int, len(durationBuckets)),
+	}
+}
+
+// finish counts a task that reached completed, failed, or skipped. Tasks
+// served from the cache or skipped never ran, so they add no duration.
+func (m *taskMetrics) finish(task *Task) {
+	switch task.Status {
+	case "completed":
+		m.completed[task.Request.Provider]++
+	case "failed":
+		m.failed[task.Request.Provider]++
+	case "skipped":
+		m.skipped[task.Request.Provider]++
+	default:
+		return
+	}
+	if task.ServedFromCache != "" || task.StartedAt.IsZero() {
+		return
+	}
+	secs := task.FinishedAt.Sub(task.StartedAt).Seconds()
+	m.durationCount++
+	m.durationSum += secs
+	for i, le := range durationBuckets {
+		if secs <= le {
+			m.durationCounts[i]++
+			break
+		}
+	}
+}
+
+// Metrics returns a copy of the task counters.
+func (q *Queue) Metrics() taskMetrics {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	m := q.metrics
+	m.submitted = copyCounts(m.submitted)
+	m.completed = copyCounts(m.completed)
+	m.failed = copyCounts(m.failed)
+	m.skipped = copyCounts(m.skipped)
+	m.durationCounts = append([]int(nil), m.durationCounts...)
+	return m
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	cp := make(map[string]int, len(counts))
+	for k, n := range counts {
+		cp[k] = n
+	}
+	return cp
+}
+
+// writeTo writes the counters in the Prometheus text exposition format.
+func (m taskMetrics) writeTo(w io.Writer) {
+	for _, c := range []struct {
+		name, help string
+		counts     map[string]int
+	}{
+		{"droidrun_tasks_submitted_total", "Tasks submitted.", m.submitted},
+		{"droidrun_tasks_completed_total", "Tasks the worker finished, successfully or not.", m.completed},
+		{"droidrun_tasks_failed_total", "Tasks that failed after any retries.", m.failed},
+		{"droidrun_tasks_skipped_total", "Tasks skipped because their run_if wasn't met.", m.skipped},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		providers := make([]string, 0, len(c.counts))
+		for provider := range c.counts {
+			providers = append(providers, provider)
+		}
+		sort.Strings(providers)
+		for _, provider := range providers {
+			fmt.Fprintf(w, "%s{provider=%q} %d\n", c.name, provider, c.counts[provider])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP droidrun_task_duration_seconds Worker run time of finished tasks.\n")
+	fmt.Fprintf(w, "# TYPE droidrun_task_duration_seconds histogram\n")
+	cumulative := 0
+	for i, le := range durationBuckets {
+		cumulative += m.durationCounts[i]
+		fmt.Fprintf(w, "droidrun_task_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "droidrun_task_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "droidrun_task_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "droidrun_task_duration_seconds_count %d\n", m.durationCount)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCountTasks(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	api := NewAPI(q)
+	go q.Run()
+
+	ok := q.Submit(TaskRequest{Goal: "ok", Provider: "Google"}, "key")
+	failed := q.Submit(TaskRequest{Goal: "fail", Provider: "Anthropic"}, "key")
+	waitForStatus(t, q, ok.ID, "completed")
+	waitForStatus(t, q, failed.ID, "failed")
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`droidrun_tasks_submitted_total{provider="Anthropic"} 1`,
+		`droidrun_tasks_submitted_total{provider="Google"} 1`,
+		`droidrun_tasks_completed_total{provider="Google"} 1`,
+		`droidrun_tasks_failed_total{provider="Anthropic"} 1`,
+		`droidrun_task_duration_seconds_bucket{le="10"} 2`,
+		`droidrun_task_duration_seconds_bucket{le="+Inf"} 2`,
+		`droidrun_task_duration_seconds_count 2`,
+		"droidrun_queue_size 0",
+		"droidrun_tasks_running 0",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `droidrun_tasks_completed_total{provider="Anthropic"}`) {
+		t.Error("failed task counted as completed")
+	}
+}
+
+func TestMetricsRequireServerKey(t *testing.T) {
+	origKey := serverAPIKey
+	defer func() { serverAPIKey = origKey }()
+	serverAPIKey = "test-server-key"
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a key, got %d", w.Code)
+	}
+	req.Header.Set("X-Server-Key", "test-server-key")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 with the key, got %d", w.Code)
+	}
+}
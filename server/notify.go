@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyTimeout bounds how long a single sink may take to deliver an event.
+var notifyTimeout = 10 * time.Second
+
+// CompletionEvent is sent to every configured sink when a task finishes.
+type CompletionEvent struct {
+	TaskID     string    `json:"task_id"`
+	Status     string    `json:"status"`
+	Success    bool      `json:"success"`
+	Goal       string    `json:"goal"`
+	Result     string    `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	runTime time.Duration // Worker run time, for summaries (0 if it never ran)
+}
+
+func completionEvent(task *Task) CompletionEvent {
+	ev := CompletionEvent{
+		TaskID:     task.ID,
+		Status:     task.Status,
+		Success:    task.Success,
+		Goal:       task.Request.Goal,
+		Result:     task.Result,
+		Error:      task.Error,
+		FinishedAt: task.FinishedAt,
+	}
+	if !task.StartedAt.IsZero() && !task.FinishedAt.IsZero() {
+		ev.runTime = task.FinishedAt.Sub(task.StartedAt)
+	}
+	return ev
+}
+
+// Notifier delivers completion events to one destination.
+type Notifier interface {
+	Notify(ctx context.Context, ev CompletionEvent) error
+}
+
+// multiNotifier fans an event out to several sinks concurrently, so a slow or
+// failing sink doesn't hold up the others.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(ctx context.Context, ev CompletionEvent) error {
+	errs := make([]error, len(m))
+	var wg sync.WaitGroup
+	for i, n := range m {
+		wg.Add(1)
+		go func(i int, n Notifier) {
+			defer wg.Done()
+			errs[i] = n.Notify(ctx, ev)
+		}(i, n)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Values of -webhook-format.
+const (
+	WebhookFormatEvent   = "event"   // The CompletionEvent
+	WebhookFormatSummary = "summary" // A TaskSummary, e.g. for chat webhooks
+)
+
+// webhookFormat is set by -webhook-format.
+var webhookFormat = WebhookFormatEvent
+
+// webhookNotifier POSTs the event as JSON, or its summary.
+type webhookNotifier struct {
+	url     string
+	summary bool
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, ev CompletionEvent) error {
+	var body []byte
+	if n.summary {
+		body, _ = json.Marshal(summarize(ev))
+	} else {
+		body, _ = json.Marshal(ev)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s returned %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// fileNotifier appends the event as a JSON line.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (n *fileNotifier) Notify(_ context.Context, ev CompletionEvent) error {
+	line, _ := json.Marshal(ev)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("file: %w", err)
+	}
+	return f.Close()
+}
+
+// execNotifier runs a post-hook command with the event JSON on stdin.
+type execNotifier struct {
+	path string
+}
+
+func (n execNotifier) Notify(ctx context.Context, ev CompletionEvent) error {
+	body, _ := json.Marshal(ev)
+	cmd := exec.CommandContext(ctx, n.path)
+	cmd.Stdin = bytes.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("exec %s: %w: %s", n.path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// natsNotifier publishes the event to a NATS subject using the core text
+// protocol, connecting once per event.
+type natsNotifier struct {
+	addr    string
+	subject string
+}
+
+func (n natsNotifier) Notify(ctx context.Context, ev CompletionEvent) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return fmt.Errorf("nats: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		return fmt.Errorf("nats: unexpected greeting %q: %v", strings.TrimSpace(line), err)
+	}
+	body, _ := json.Marshal(ev)
+	// PING after PUB: the PONG confirms the server processed the publish
+	msg := fmt.Sprintf("CONNECT {\"verbose\":false}\r\nPUB %s %d\r\n%s\r\nPING\r\n", n.subject, len(body), body)
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("nats: %w", err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("nats: %w", err)
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// parseNotifier builds a sink from a -notify value: webhook=URL, file=PATH,
+// exec=PATH, or nats=nats://host:port/subject.
+func parseNotifier(spec string) (Notifier, error) {
+	kind, target, ok := strings.Cut(spec, "=")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("expected kind=target")
+	}
+	switch kind {
+	case "webhook":
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("webhook needs an http(s) URL")
+		}
+		return webhookNotifier{url: target, summary: webhookFormat == WebhookFormatSummary}, nil
+	case "file":
+		return &fileNotifier{path: target}, nil
+	case "exec":
+		return execNotifier{path: target}, nil
+	case "nats":
+		u, err := url.Parse(target)
+		subject := strings.Trim(u.Path, "/")
+		if err != nil || u.Scheme != "nats" || u.Host == "" || subject == "" {
+			return nil, fmt.Errorf("nats needs nats://host:port/subject")
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "4222")
+		}
+		return natsNotifier{addr: addr, subject: subject}, nil
+	}
+	return nil, fmt.Errorf("unknown sink %q (expected webhook, file, exec, or nats)", kind)
+}
+
+// deliveryQueueSize is how many completion events may wait for a free
+// callback worker before new ones are dropped.
+var deliveryQueueSize = 100
+
+// SetNotifier configures the completion sinks and starts that many goroutines
+// that deliver events from a bounded queue, so slow sinks never hold up task
+// processing.
+func (q *Queue) SetNotifier(n Notifier, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	q.notifier = n
+	q.deliveries = make(chan CompletionEvent, deliveryQueueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for ev := range q.deliveries {
+				q.deliverNow(ev)
+			}
+		}()
+	}
+}
+
+// deliver hands a completion event to the callback workers without blocking,
+// dropping it if their queue is full.
+func (q *Queue) deliver(ev CompletionEvent) {
+	if q.notifier == nil {
+		return
+	}
+	select {
+	case q.deliveries <- ev:
+	default:
+		taskLog(ev.TaskID).Warnf("Notification dropped: delivery queue full")
+	}
+}
+
+func (q *Queue) deliverNow(ev CompletionEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if err := q.notifier.Notify(ctx, ev); err != nil {
+		taskLog(ev.TaskID).Errorf("Notification failed: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events []CompletionEvent
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, ev CompletionEvent) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, ev)
+	return nil
+}
+
+func (n *recordingNotifier) received() []CompletionEvent {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]CompletionEvent(nil), n.events...)
+}
+
+type failingNotifier struct{}
+
+func (failingNotifier) Notify(context.Context, CompletionEvent) error {
+	return errors.New("sink down")
+}
+
+func TestMultiNotifierIsolatesFailingSink(t *testing.T) {
+	rec := &recordingNotifier{}
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	q.SetNotifier(multiNotifier{failingNotifier{}, rec}, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "hello"}, "key")
+	waitForStatus(t, q, task.ID, "completed")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(rec.received()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := rec.received()
+	if len(events) != 1 {
+		t.Fatalf("expected the healthy sink to get 1 event, got %d", len(events))
+	}
+	if events[0].TaskID != task.ID || events[0].Status != "completed" || events[0].Result != "hello" {
+		t.Errorf("unexpected event %+v", events[0])
+	}
+
+	err := multiNotifier{failingNotifier{}, rec}.Notify(context.Background(), events[0])
+	if err == nil || !strings.Contains(err.Error(), "sink down") {
+		t.Errorf("expected the failing sink's error to be reported, got %v", err)
+	}
+}
+
+func TestSkippedTaskNotifies(t *testing.T) {
+	rec := &recordingNotifier{}
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	q.SetNotifier(rec, 1)
+	go q.Run()
+
+	first := q.Submit(TaskRequest{Goal: "fail", Provider: "Google"}, "key")
+	skipped := q.Submit(TaskRequest{Goal: "ok", Provider: "Google", RunIf: &RunCondition{TaskID: first.ID, Condition: "success"}}, "key")
+	waitForStatus(t, q, skipped.ID, "skipped")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(rec.received()) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := rec.received()
+	if len(events) != 2 || events[0].TaskID != first.ID || events[1].TaskID != skipped.ID || events[1].Status != "skipped" {
+		t.Fatalf("expected notifications for the failed task, then the skipped one, got %+v", events)
+	}
+	if n := q.Metrics().skipped["Google"]; n != 1 {
+		t.Errorf("expected 1 skipped task counted, got %d", n)
+	}
+}
+
+func TestWebhookAndFileNotifiers(t *testing.T) {
+	var got CompletionEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	ev := CompletionEvent{TaskID: "abc", Status: "completed", Success: true}
+	for _, spec := range []string{"webhook=" + srv.URL, "file=" + path} {
+		n, err := parseNotifier(spec)
+		if err != nil {
+			t.Fatalf("parseNotifier(%q): %v", spec, err)
+		}
+		if err := n.Notify(context.Background(), ev); err != nil {
+			t.Errorf("%s: %v", spec, err)
+		}
+	}
+
+	if got.TaskID != "abc" {
+		t.Errorf("expected webhook to receive the event, got %+v", got)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read event file: %v", err)
+	}
+	if !strings.Contains(string(b), `"task_id":"abc"`) {
+		t.Errorf("expected event in file, got %q", b)
+	}
+}
+
+func TestNATSNotifierPublishes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	published := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = conn.Write([]byte("INFO {}\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := r.ReadString('\n')
+				published <- line + payload
+			case strings.HasPrefix(line, "PING"):
+				_, _ = conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+
+	n, err := parseNotifier("nats=nats://" + ln.Addr().String() + "/droidrun.done")
+	if err != nil {
+		t.Fatalf("parseNotifier: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Notify(ctx, CompletionEvent{TaskID: "abc"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	msg := <-published
+	if !strings.HasPrefix(msg, "PUB droidrun.done ") || !strings.Contains(msg, `"task_id":"abc"`) {
+		t.Errorf("unexpected publish %q", msg)
+	}
+}
+
+func TestParseNotifierRejectsInvalid(t *testing.T) {
+	for _, spec := range []string{"", "webhook", "webhook=ftp://x", "nats=nats://host", "smtp=me@example.com"} {
+		if _, err := parseNotifier(spec); err == nil {
+			t.Errorf("expected parseNotifier(%q) to fail", spec)
+		}
+	}
+}
+
+func TestSlowCallbackDoesNotDelayTasks(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	q.SetNotifier(webhookNotifier{url: srv.URL}, 1)
+	go q.Run()
+
+	start := time.Now()
+	var last *Task
+	for i := 0; i < 3; i++ {
+		last = q.Submit(TaskRequest{Goal: "hello"}, "key")
+	}
+	waitForStatus(t, q, last.ID, "completed")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("tasks took %v to complete behind a stuck callback", elapsed)
+	}
+}
+
+func TestDeliveryQueueFullDrops(t *testing.T) {
+	orig := deliveryQueueSize
+	deliveryQueueSize = 1
+	defer func() { deliveryQueueSize = orig }()
+
+	block := make(chan struct{})
+	defer close(block)
+	q := NewQueue("./worker.py", 1)
+	q.SetNotifier(blockingNotifier(block), 1)
+
+	// One event is picked up by the worker, one waits, the rest are dropped
+	for i := 0; i < 5; i++ {
+		q.deliver(CompletionEvent{TaskID: "t"})
+	}
+	if n := len(q.deliveries); n > 1 {
+		t.Errorf("expected at most 1 queued delivery, got %d", n)
+	}
+}
+
+type blockingNotifier chan struct{}
+
+func (b blockingNotifier) Notify(ctx context.Context, _ CompletionEvent) error {
+	select {
+	case <-b:
+	case <-ctx.Done():
+	}
+	return nil
+}
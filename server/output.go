@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// defaultMaxOutput is the default -max-output.
+const defaultMaxOutput = 256 << 10
+
+// truncatedMarker starts a result or logs that -max-output cut short.
+const truncatedMarker = "...[truncated "
+
+// keepTail cuts s to its last n bytes or so, on a UTF-8 boundary, after a
+// marker saying how much was dropped. The end is kept as it's the most
+// recent output, where a failure shows.
+func keepTail(s string, n int) string {
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	start := len(s) - n
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return fmt.Sprintf("%s%d bytes]...%s", truncatedMarker, start, s[start:])
+}
+
+// logsPath is where a task's whole logs are kept, with -steps-dir set, when
+// -max-output cut the stored ones short.
+func (q *Queue) logsPath(id string) string {
+	return filepath.Join(q.stepsDir, id+".log")
+}
+
+// capLogs returns logs cut to -max-output. With -steps-dir the whole logs
+// are written to the task's log file first, for GET /task/{id}/logs; a
+// leftover file from an earlier attempt is removed.
+func (q *Queue) capLogs(id, logs string) string {
+	if q.maxOutput <= 0 || len(logs) <= q.maxOutput {
+		if q.stepsDir != "" {
+			_ = os.Remove(q.logsPath(id))
+		}
+		return logs
+	}
+	if q.stepsDir != "" {
+		if err := os.WriteFile(q.logsPath(id), []byte(logs), 0600); err != nil {
+			taskLog(id).Errorf("Failed to save full logs: %v", err)
+		}
+	}
+	return keepTail(logs, q.maxOutput)
+}
+
+// fullLogs returns a task's logs as the worker wrote them when they were cut
+// short and the whole are on disk, otherwise the stored logs.
+func (q *Queue) fullLogs(task Task) string {
+	if q.stepsDir == "" || !strings.HasPrefix(task.Logs, truncatedMarker) {
+		return task.Logs
+	}
+	data, err := os.ReadFile(q.logsPath(task.ID))
+	if err != nil {
+		return task.Logs
+	}
+	return string(data)
+}
+
+// removeTaskFiles deletes a forgotten task's step log and full logs.
+func (q *Queue) removeTaskFiles(id string) {
+	if q.stepsDir != "" {
+		_ = os.Remove(q.stepsPath(id))
+		_ = os.Remove(q.logsPath(id))
+	}
+}
+
+// liveLog is a worker's stderr, readable while the worker is writing it.
+type liveLog struct {
+	apiKey string // Redacted from what's read
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *liveLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *liveLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// lines returns the complete lines written so far. A partial line is held
+// back, as half a secret wouldn't be recognized to redact.
+func (l *liveLog) lines() string {
+	s := l.String()
+	return s[:strings.LastIndexByte(s, '\n')+1]
+}
+
+// Logs returns a task's logs and its status when they were read. While the
+// worker runs they are the complete lines it has written so far; once it
+// has exited, the recorded logs (in full if they were kept on disk).
+func (q *Queue) Logs(id string) (logs, status string, ok bool) {
+	q.mu.RLock()
+	task, ok := q.tasks[id]
+	if !ok {
+		q.mu.RUnlock()
+		return "", "", false
+	}
+	recorded := Task{ID: task.ID, Logs: task.Logs}
+	status = task.Status
+	live := q.liveLogs[id]
+	q.mu.RUnlock()
+
+	if live != nil {
+		return redact(live.lines(), q.redactors, live.apiKey), status, true
+	}
+	return q.fullLogs(recorded), status, true
+}
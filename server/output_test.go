@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepTail(t *testing.T) {
+	if got := keepTail("short", 10); got != "short" {
+		t.Errorf("expected output under the limit untouched, got %q", got)
+	}
+	if got := keepTail("0123456789", 4); got != "...[truncated 6 bytes]...6789" {
+		t.Errorf("expected the last 4 bytes after a marker, got %q", got)
+	}
+	// Never starts mid-rune: "é" is two bytes
+	if got := keepTail("aaaaé", 1); got != "...[truncated 6 bytes]..." {
+		t.Errorf("expected the cut moved past the split rune, got %q", got)
+	}
+	if got := keepTail(strings.Repeat("x", 100), 0); len(got) != 100 {
+		t.Errorf("expected 0 to mean unlimited, got %d bytes", len(got))
+	}
+}
+
+func TestOutputCap(t *testing.T) {
+	worker := writeWorker(t, `import json, sys
+json.load(sys.stdin)
+sys.stderr.write("early line\n" + "x" * 5000 + "\nlast line\n")
+print(json.dumps({"ok": True, "success": True, "reason": "r" * 5000 + " done"}))
+`)
+	q := NewQueue(worker, 1)
+	q.maxOutput = 100
+	q.stepsDir = t.TempDir()
+	go q.Run()
+	api := NewAPI(q)
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if !strings.HasPrefix(got.Result, "...[truncated ") || !strings.HasSuffix(got.Result, " done") || len(got.Result) > 130 {
+		t.Errorf("expected the result's tail after a marker, got %d bytes: %q", len(got.Result), got.Result)
+	}
+	if !strings.HasPrefix(got.Logs, "...[truncated ") || !strings.HasSuffix(got.Logs, "last line\n") || strings.Contains(got.Logs, "early line") {
+		t.Errorf("expected the logs' tail after a marker, got %q", got.Logs)
+	}
+
+	// The whole logs are still there from /logs
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/"+task.ID+"/logs", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "early line\n") || w.Body.Len() < 5000 {
+		t.Errorf("expected the untruncated logs, got %d: %.40q", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/"+task.ID+"/logs?tail=1", nil))
+	if w.Body.String() != "last line\n" {
+		t.Errorf("expected tail to apply to the whole logs, got %q", w.Body)
+	}
+
+	// Forgetting the task removes its log file
+	q.Clear()
+	if _, err := os.Stat(q.logsPath(task.ID)); !os.IsNotExist(err) {
+		t.Errorf("expected the log file removed with the task, got %v", err)
+	}
+}
+
+func TestLiveLogs(t *testing.T) {
+	release := filepath.Join(t.TempDir(), "release")
+	worker := writeWorker(t, `import json, os, sys, time
+json.load(sys.stdin)
+sys.stderr.write("step one\nusing key-1234\nhalf a li")
+sys.stderr.flush()
+while not os.path.exists(`+strconv.Quote(release)+`):
+    time.sleep(0.01)
+sys.stderr.write("ne\n")
+print(json.dumps({"ok": True, "success": True, "reason": "done"}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+	api := NewAPI(q)
+	task := q.Submit(TaskRequest{Goal: "test"}, "key-1234")
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	// The complete lines are served while the worker runs, redacted
+	want := "step one\nusing ***\n"
+	var w *httptest.ResponseRecorder
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if w = get("/task/" + task.ID + "/logs"); w.Body.String() == want {
+			break
+		}
+	}
+	if w.Body.String() != want {
+		t.Fatalf("expected the running worker's complete lines, got %q", w.Body)
+	}
+	if w.Header().Get("X-Task-Status") != "running" || w.Header().Get("X-Log-Size") != strconv.Itoa(len(want)) {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+
+	if err := os.WriteFile(release, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, q, task.ID, "completed")
+	w = get("/task/" + task.ID + "/logs?offset=" + strconv.Itoa(len(want)))
+	if w.Body.String() != "half a line\n" || w.Header().Get("X-Task-Status") != "completed" {
+		t.Errorf("expected the rest of the logs from the offset, got %q (%s)", w.Body, w.Header().Get("X-Task-Status"))
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// providerState tracks which of the validProviders are enabled. Updates copy
+// the state under mu and publish a new snapshot; reads just load the current
+// snapshot, so frequent polling of /providers never contends with updates.
+type providerState struct {
+	mu      sync.Mutex // Serializes updates
+	current atomic.Pointer[providerSnapshot]
+}
+
+// providerSnapshot is an immutable view of the enabled providers, with the
+// /providers response encoded once per change.
+type providerSnapshot struct {
+	enabled map[string]bool
+	body    []byte
+}
+
+// ProviderInfo is one entry of the GET /providers list.
+type ProviderInfo struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// providers holds the runtime enabled state; every valid provider starts
+// enabled.
+var providers = newProviderState()
+
+func newProviderState() *providerState {
+	p := &providerState{}
+	enabled := make(map[string]bool, len(validProviders))
+	for name := range validProviders {
+		enabled[name] = true
+	}
+	p.publish(enabled)
+	return p
+}
+
+// publish stores a new snapshot. Must be called with mu held (or before p is
+// shared).
+func (p *providerState) publish(enabled map[string]bool) {
+	list := make([]ProviderInfo, 0, len(enabled))
+	for name, on := range enabled {
+		list = append(list, ProviderInfo{Name: name, Enabled: on})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	body, _ := json.Marshal(map[string]any{"providers": list})
+	p.current.Store(&providerSnapshot{enabled: enabled, body: append(body, '\n')})
+}
+
+// Enabled reports whether tasks may currently use provider.
+func (p *providerState) Enabled(provider string) bool {
+	return p.current.Load().enabled[provider]
+}
+
+// SetEnabled enables or disables a valid provider. It reports false for
+// unknown providers.
+func (p *providerState) SetEnabled(provider string, on bool) bool {
+	if !validProviders[provider] {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.current.Load().enabled
+	if old[provider] == on {
+		return true
+	}
+	enabled := make(map[string]bool, len(old))
+	for name, v := range old {
+		enabled[name] = v
+	}
+	enabled[provider] = on
+	p.publish(enabled)
+	return true
+}
+
+// handleProviders serves GET /providers (the cached list) and
+// PUT /providers/{name} with {"enabled": bool}.
+func (a *API) handleProviders(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/providers"), "/")
+	if name == "" {
+		if r.Method != "GET" {
+			writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(providers.current.Load().body); err != nil {
+			serverLog.Errorf("Failed to write providers response: %v", err)
+		}
+		return
+	}
+
+	if r.Method != "PUT" {
+		writeError(w, CodeMethodNotAllowed, "PUT only", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+		writeError(w, CodeInvalidJSON, `expected {"enabled": true|false}`, http.StatusBadRequest)
+		return
+	}
+	if !providers.SetEnabled(name, *body.Enabled) {
+		writeError(w, CodeNotFound, "unknown provider: "+name, http.StatusNotFound)
+		return
+	}
+	serverLog.Infof("Provider %s enabled=%v", name, *body.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ProviderInfo{Name: name, Enabled: *body.Enabled}); err != nil {
+		serverLog.Errorf("Failed to encode provider response: %v", err)
+	}
+}
+
+// ProviderConfig points a provider's SDK at an API gateway. It is passed to
+// the worker as base_url and headers.
+type ProviderConfig struct {
+	BaseURL string            `json:"base_url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// loadProviderConfigs reads a -provider-config file: a JSON object mapping
+// provider names to their ProviderConfig, e.g.
+//
+//	{"OpenAI": {"base_url": "https://gw.internal/openai/v1", "headers": {"X-Gateway-Key": "..."}}}
+func loadProviderConfigs(path string) (map[string]ProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]ProviderConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	for name, cfg := range configs {
+		if !validProviders[name] {
+			return nil, fmt.Errorf("invalid provider %q", name)
+		}
+		if cfg.BaseURL != "" {
+			if !validBaseURL(cfg.BaseURL) {
+				return nil, fmt.Errorf("%s: base_url must be an http(s) URL", name)
+			}
+		}
+		for header := range cfg.Headers {
+			if header == "" || strings.ContainsAny(header, " :\r\n") {
+				return nil, fmt.Errorf("%s: invalid header name %q", name, header)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// headerRedactors masks the configured header values, which are usually
+// gateway credentials, wherever redaction applies.
+func headerRedactors(configs map[string]ProviderConfig) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, cfg := range configs {
+		for _, value := range cfg.Headers {
+			if value != "" {
+				res = append(res, regexp.MustCompile(regexp.QuoteMeta(value)))
+			}
+		}
+	}
+	return res
+}
+
+// providerKeyVars names the variable holding each provider's API key, both
+// in the environment and in a -keys file. Ollama runs locally and has none.
+var providerKeyVars = map[string]string{
+	"Google":      "GOOGLE_API_KEY",
+	"GoogleGenAI": "GOOGLE_API_KEY",
+	"Anthropic":   "ANTHROPIC_API_KEY",
+	"OpenAI":      "OPENAI_API_KEY",
+	"DeepSeek":    "DEEPSEEK_API_KEY",
+}
+
+// providerKeysFrom returns the API key of each provider whose variable
+// lookup finds, such as os.Getenv or a loadKeysFile map.
+func providerKeysFrom(lookup func(name string) string) map[string]string {
+	keys := map[string]string{}
+	for provider, name := range providerKeyVars {
+		if key := strings.TrimSpace(lookup(name)); key != "" {
+			keys[provider] = key
+		}
+	}
+	return keys
+}
+
+// loadKeysFile reads a -keys file of NAME=value lines, such as
+// GOOGLE_API_KEY=..., skipping blank lines and # comments. Only the names in
+// providerKeyVars are accepted, so a typo doesn't go unnoticed.
+func loadKeysFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, name := range providerKeyVars {
+		known[name] = true
+	}
+	vars := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !known[name] {
+			// Not the line itself: it may hold a key
+			return nil, fmt.Errorf("line %d: expected NAME=key with a provider key variable such as GOOGLE_API_KEY", i+1)
+		}
+		vars[name] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return vars, nil
+}
+
+// validBaseURL reports whether s is an http(s) URL with a host, as a
+// provider base_url must be.
+func validBaseURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
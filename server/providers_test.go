@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProvidersConcurrentToggle(t *testing.T) {
+	defer func() { providers = newProviderState() }()
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				api.ServeHTTP(w, httptest.NewRequest("GET", "/providers", nil))
+				var resp struct {
+					Providers []ProviderInfo `json:"providers"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.Providers) != len(validProviders) {
+					t.Errorf("bad /providers response (err %v): %+v", err, resp)
+					return
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				body := fmt.Sprintf(`{"enabled":%v}`, (i+j)%2 == 0)
+				w := httptest.NewRecorder()
+				api.ServeHTTP(w, httptest.NewRequest("PUT", "/providers/DeepSeek", strings.NewReader(body)))
+				if w.Code != http.StatusOK {
+					t.Errorf("expected 200 toggling DeepSeek, got %d", w.Code)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDisabledProviderRejected(t *testing.T) {
+	defer func() { providers = newProviderState() }()
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	put := func(path, body string) int {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("PUT", path, strings.NewReader(body)))
+		return w.Code
+	}
+	if code := put("/providers/Ollama", `{"enabled":false}`); code != http.StatusOK {
+		t.Fatalf("expected 200 disabling Ollama, got %d", code)
+	}
+	if code := put("/providers/Nope", `{"enabled":false}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown provider, got %d", code)
+	}
+	if code := put("/providers/Ollama", `{}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without enabled, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test","provider":"Ollama"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "provider disabled") {
+		t.Errorf("expected 400 provider disabled, got %d: %s", w.Code, w.Body.String())
+	}
+
+	put("/providers/Ollama", `{"enabled":true}`)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test","provider":"Ollama"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 once re-enabled, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProviderConfigReachesWorker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	if err := os.WriteFile(path, []byte(`{
+		"OpenAI": {"base_url": "https://gw.internal/openai/v1", "headers": {"X-Gateway-Key": "gw-secret-123"}},
+		"Anthropic": {"base_url": "https://gw.internal/anthropic"}
+	}`), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	configs, err := loadProviderConfigs(path)
+	if err != nil {
+		t.Fatalf("loadProviderConfigs: %v", err)
+	}
+
+	// The worker reports what it was given; printing the header to stderr
+	// checks that its value is redacted from the logs
+	worker := writeWorker(t, `import json, sys
+task = json.load(sys.stdin)
+print("gateway key", (task.get("headers") or {}).get("X-Gateway-Key"), file=sys.stderr)
+print(json.dumps({"ok": True, "success": True, "reason": json.dumps([task.get("base_url"), task.get("headers")])}))
+`)
+	q := NewQueue(worker, 1)
+	q.providerConfigs = configs
+	q.redactors = append(q.redactors, headerRedactors(configs)...)
+	go q.Run()
+
+	openai := q.Submit(TaskRequest{Goal: "test", Provider: "OpenAI"}, "key")
+	ollama := q.Submit(TaskRequest{Goal: "test", Provider: "Ollama"}, "key")
+
+	got := waitForStatus(t, q, openai.ID, "completed", "failed")
+	var reported []any
+	if err := json.Unmarshal([]byte(got.Result), &reported); err != nil {
+		t.Fatalf("unexpected worker result %q (%s): %v", got.Result, got.Error, err)
+	}
+	if reported[0] != "https://gw.internal/openai/v1" {
+		t.Errorf("expected the OpenAI base_url, got %v", reported[0])
+	}
+	if strings.Contains(got.Logs, "gw-secret-123") || !strings.Contains(got.Logs, "***") {
+		t.Errorf("expected the header value redacted from logs, got %q", got.Logs)
+	}
+
+	got = waitForStatus(t, q, ollama.ID, "completed", "failed")
+	if got.Result != "[null, null]" {
+		t.Errorf("expected no gateway settings for an unconfigured provider, got %q", got.Result)
+	}
+}
+
+func TestRequestBaseURL(t *testing.T) {
+	defer func(keys map[string]string) { serverProviderKeys = keys }(serverProviderKeys)
+	serverProviderKeys = map[string]string{"OpenAI": "server-secret"}
+
+	for _, base := range []string{"localhost:11434", "ftp://host/v1", "http://", "not a url"} {
+		if err := validateRequest(&TaskRequest{Goal: "test", Provider: "Ollama", BaseURL: base}, ""); err == nil {
+			t.Errorf("%s: expected an error", base)
+		}
+	}
+	// The server's own key must never be sent to a caller's endpoint
+	for _, key := range []string{"", "server-secret"} {
+		err := validateRequest(&TaskRequest{Goal: "test", Provider: "OpenAI", BaseURL: "https://gw.example/v1"}, key)
+		if err == nil || !strings.Contains(err.Error(), "own API key") {
+			t.Errorf("key %q: expected base_url to need the caller's key, got %v", key, err)
+		}
+	}
+
+	worker := writeWorker(t, `import json, sys
+task = json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": json.dumps([task.get("base_url"), task.get("headers")])}))
+`)
+	q := NewQueue(worker, 1)
+	q.providerConfigs = map[string]ProviderConfig{
+		"OpenAI": {BaseURL: "https://gw.internal/openai/v1", Headers: map[string]string{"X-Gateway-Key": "gw-secret"}},
+	}
+	go q.Run()
+	api := NewAPI(q)
+
+	body := `{"goal": "open settings", "provider": "OpenAI", "base_url": "http://10.0.0.5:8080/v1"}`
+	req := httptest.NewRequest("POST", "/run", strings.NewReader(body))
+	req.Header.Set("X-API-Key", "caller-key")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		TaskID string `json:"task_id"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+	got := waitForStatus(t, q, resp.TaskID, "completed", "failed")
+	if got.Result != `["http://10.0.0.5:8080/v1", null]` {
+		t.Errorf("expected the request's base_url without the gateway headers, got %q (%s)", got.Result, got.Error)
+	}
+	data, _ := json.Marshal(got)
+	if !strings.Contains(string(data), `"base_url":"http://10.0.0.5:8080/v1"`) {
+		t.Errorf("expected base_url in the task JSON, got %s", data)
+	}
+}
+
+func TestLoadProviderConfigsRejectsBadEntries(t *testing.T) {
+	for _, body := range []string{
+		`{"Bogus": {"base_url": "https://gw"}}`,
+		`{"OpenAI": {"base_url": "gw.internal"}}`,
+		`{"OpenAI": {"headers": {"Bad Header": "x"}}}`,
+		`not json`,
+	} {
+		path := filepath.Join(t.TempDir(), "providers.json")
+		if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if _, err := loadProviderConfigs(path); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+func TestLoadKeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# provider keys\nGOOGLE_API_KEY=g-secret\n\nANTHROPIC_API_KEY = \"a-secret\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	vars, err := loadKeysFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := providerKeysFrom(func(name string) string { return vars[name] })
+	if keys["Google"] != "g-secret" || keys["GoogleGenAI"] != "g-secret" || keys["Anthropic"] != "a-secret" || len(keys) != 3 {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	if err := os.WriteFile(path, []byte("GOOGLE_APIKEY=g-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadKeysFile(path)
+	if err == nil || strings.Contains(err.Error(), "g-secret") {
+		t.Errorf("expected an error without the line's value for an unknown name, got %v", err)
+	}
+}
+
+func TestServerProviderKeyFallback(t *testing.T) {
+	defer func(keys map[string]string) { serverProviderKeys = keys }(serverProviderKeys)
+	serverProviderKeys = map[string]string{"Anthropic": "server-secret"}
+
+	worker := writeWorker(t, `import json, sys
+task = json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": "used " + task["api_key"]}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+	api := NewAPI(q)
+
+	submit := func(provider string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"goal": "open settings", "provider": %q}`, provider)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("POST", "/run", strings.NewReader(body)))
+		return w
+	}
+
+	// No server key for OpenAI, so the request still needs one
+	if w := submit("OpenAI"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "API key required") {
+		t.Errorf("expected 400 without any key, got %d: %s", w.Code, w.Body)
+	}
+
+	w := submit("Anthropic")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the server's key to be used, got %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		TaskID string `json:"task_id"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	waitForStatus(t, q, resp.TaskID, "completed", "failed")
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/"+resp.TaskID, nil))
+	if strings.Contains(w.Body.String(), "server-secret") || !strings.Contains(w.Body.String(), "used ***") {
+		t.Errorf("expected the worker to get the key and the task JSON to hide it, got %s", w.Body)
+	}
+}
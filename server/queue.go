@@ -2,84 +2,452 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // TaskRequest represents an incoming task request.
 // Note: APIKey is accepted but never stored or included in JSON output.
 type TaskRequest struct {
-	Goal      string `json:"goal"`
-	App       string `json:"app,omitempty"`
-	Deeplink  string `json:"deeplink,omitempty"`
-	Provider  string `json:"provider"`
-	Model     string `json:"model"`
-	Reasoning bool   `json:"reasoning"`
-	Vision    bool   `json:"vision"`
-	MaxSteps  int    `json:"max_steps"`
-	APIKey    string `json:"api_key,omitempty"` // Only used for backwards-compat parsing, never stored
+	Goal            string            `json:"goal"`
+	App             string            `json:"app,omitempty"`
+	Deeplink        string            `json:"deeplink,omitempty"`
+	Setup           []SetupStep       `json:"setup,omitempty"` // Run in order before the goal, after app and deeplink
+	Provider        string            `json:"provider"`
+	Model           string            `json:"model"`
+	BaseURL         string            `json:"base_url,omitempty"` // Endpoint for the provider's API, e.g. a remote Ollama or an OpenAI-compatible gateway
+	Reasoning       bool              `json:"reasoning"`
+	Vision          bool              `json:"vision"`
+	MaxSteps        int               `json:"max_steps"`
+	Priority        int               `json:"priority,omitempty"`   // Higher runs first; ties go to the task queued first
+	JumpQueue       bool              `json:"jump_queue,omitempty"` // Run next, ahead of every queued task whatever its priority
+	RunIf           *RunCondition     `json:"run_if,omitempty"`
+	Cacheable       bool              `json:"cacheable,omitempty"`
+	AssertContains  string            `json:"assert_contains,omitempty"`
+	AssertRegex     string            `json:"assert_regex,omitempty"`
+	MaxRetries      int               `json:"max_retries,omitempty"`
+	MaxOutputTokens int               `json:"max_output_tokens,omitempty"`
+	TimeoutSeconds  int               `json:"timeout_seconds,omitempty"` // Overrides -task-timeout for this task
+	Locale          string            `json:"locale,omitempty"`          // BCP-47 tag, e.g. en-US
+	Timezone        string            `json:"timezone,omitempty"`        // IANA zone, e.g. Europe/Berlin
+	Labels          map[string]string `json:"labels,omitempty"`          // Free-form key/values, matched by -route
+	Mode            string            `json:"mode,omitempty"`            // ModeAgent (default) or ModeReplay
+	ReplayOf        string            `json:"replay_of,omitempty"`       // Task whose steps a replay repeats
+	APIKey          string            `json:"api_key,omitempty"`         // Only used for backwards-compat parsing, never stored
+
+	visionSet bool // Vision was given explicitly, so -auto-vision-keywords leaves it alone
+}
+
+// UnmarshalJSON records whether vision was set explicitly, which a plain
+// bool can't distinguish from omitted.
+func (r *TaskRequest) UnmarshalJSON(data []byte) error {
+	type plain TaskRequest
+	// Start from r so fields missing from data keep their current values
+	aux := struct {
+		plain
+		Vision *bool `json:"vision"`
+	}{plain: plain(*r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*r = TaskRequest(aux.plain)
+	if aux.Vision != nil {
+		r.Vision, r.visionSet = *aux.Vision, true
+	}
+	return nil
+}
+
+// RunCondition holds a task until an earlier task finishes, then runs it only
+// if that task's outcome matches Condition (success, failure, or completed).
+type RunCondition struct {
+	TaskID    string `json:"task_id"`
+	Condition string `json:"condition"`
+}
+
+// SetupStep is one step the worker takes to set the device up before the
+// goal: launching App or opening Deeplink (exactly one of them).
+type SetupStep struct {
+	App      string `json:"app,omitempty"`
+	Deeplink string `json:"deeplink,omitempty"`
+}
+
+// setupSteps returns every setup step in the order the worker takes them:
+// the app and deeplink shorthands first, then setup.
+func (s TaskRequestSafe) setupSteps() []SetupStep {
+	steps := make([]SetupStep, 0, len(s.Setup)+2)
+	if s.App != "" {
+		steps = append(steps, SetupStep{App: s.App})
+	}
+	if s.Deeplink != "" {
+		steps = append(steps, SetupStep{Deeplink: s.Deeplink})
+	}
+	return append(steps, s.Setup...)
 }
 
+// Task modes
+const (
+	ModeAgent  = "agent"  // The LLM agent works towards the goal
+	ModeReplay = "replay" // The worker repeats replay_of's recorded steps, without the LLM
+)
+
 // TaskRequestSafe is the sanitized version without sensitive fields.
 // This is what gets stored and returned in API responses.
 type TaskRequestSafe struct {
-	Goal      string `json:"goal"`
-	App       string `json:"app,omitempty"`
-	Deeplink  string `json:"deeplink,omitempty"`
-	Provider  string `json:"provider"`
-	Model     string `json:"model"`
-	Reasoning bool   `json:"reasoning"`
-	Vision    bool   `json:"vision"`
-	MaxSteps  int    `json:"max_steps"`
+	Goal            string            `json:"goal"`
+	App             string            `json:"app,omitempty"`
+	Deeplink        string            `json:"deeplink,omitempty"`
+	Setup           []SetupStep       `json:"setup,omitempty"`
+	Provider        string            `json:"provider"`
+	Model           string            `json:"model"`
+	BaseURL         string            `json:"base_url,omitempty"`
+	Reasoning       bool              `json:"reasoning"`
+	Vision          bool              `json:"vision"`
+	MaxSteps        int               `json:"max_steps"`
+	Priority        int               `json:"priority,omitempty"`
+	JumpQueue       bool              `json:"jump_queue,omitempty"`
+	RunIf           *RunCondition     `json:"run_if,omitempty"`
+	Cacheable       bool              `json:"cacheable,omitempty"`
+	AssertContains  string            `json:"assert_contains,omitempty"`
+	AssertRegex     string            `json:"assert_regex,omitempty"`
+	MaxRetries      int               `json:"max_retries,omitempty"`
+	MaxOutputTokens int               `json:"max_output_tokens,omitempty"`
+	TimeoutSeconds  int               `json:"timeout_seconds,omitempty"`
+	Locale          string            `json:"locale,omitempty"`
+	Timezone        string            `json:"timezone,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Mode            string            `json:"mode,omitempty"`
+	ReplayOf        string            `json:"replay_of,omitempty"`
+}
+
+// toRequest turns a stored request back into a submittable one. Vision counts
+// as explicitly set so -auto-vision-keywords doesn't change it. JumpQueue is
+// left out: a rerun has to ask to jump the queue again. Setup, RunIf, and
+// Labels are copied, so decoding overrides into the result leaves the stored
+// request alone.
+func (s TaskRequestSafe) toRequest() TaskRequest {
+	var runIf *RunCondition
+	if s.RunIf != nil {
+		cond := *s.RunIf
+		runIf = &cond
+	}
+	return TaskRequest{
+		Goal:            s.Goal,
+		App:             s.App,
+		Deeplink:        s.Deeplink,
+		Setup:           append([]SetupStep(nil), s.Setup...), // validateRequest normalizes it in place
+		Provider:        s.Provider,
+		Model:           s.Model,
+		BaseURL:         s.BaseURL,
+		Reasoning:       s.Reasoning,
+		Vision:          s.Vision,
+		MaxSteps:        s.MaxSteps,
+		Priority:        s.Priority,
+		RunIf:           runIf,
+		Cacheable:       s.Cacheable,
+		AssertContains:  s.AssertContains,
+		AssertRegex:     s.AssertRegex,
+		MaxRetries:      s.MaxRetries,
+		MaxOutputTokens: s.MaxOutputTokens,
+		TimeoutSeconds:  s.TimeoutSeconds,
+		Locale:          s.Locale,
+		Timezone:        s.Timezone,
+		Labels:          maps.Clone(s.Labels),
+		Mode:            s.Mode,
+		ReplayOf:        s.ReplayOf,
+		visionSet:       true,
+	}
 }
 
 type Task struct {
-	ID         string          `json:"id"`
-	Request    TaskRequestSafe `json:"request"`
-	Status     string          `json:"status"` // queued, running, completed, failed, cancelled
-	Success    bool            `json:"success,omitempty"`
-	Result     string          `json:"result,omitempty"`
-	Error      string          `json:"error,omitempty"`
-	Logs       string          `json:"logs,omitempty"`
-	Steps      any             `json:"steps,omitempty"`
-	CreatedAt  time.Time       `json:"created_at"`
-	StartedAt  time.Time       `json:"started_at,omitempty"`
-	FinishedAt time.Time       `json:"finished_at,omitempty"`
+	ID              string             `json:"id"`
+	Request         TaskRequestSafe    `json:"request"`
+	Status          string             `json:"status"` // waiting, queued, running, completed, failed, cancelled, skipped
+	Success         bool               `json:"success,omitempty"`
+	Result          string             `json:"result,omitempty"`
+	Error           string             `json:"error,omitempty"`
+	ParseError      string             `json:"parse_error,omitempty"`      // Why the worker's stdout wasn't a valid result
+	RawOutput       string             `json:"raw_output,omitempty"`       // The unparseable stdout, capped at maxRawOutput bytes
+	OutputTokens    int                `json:"output_tokens,omitempty"`    // Cumulative output tokens reported by the worker
+	Retries         int                `json:"retries,omitempty"`          // Times the worker was re-run after failing
+	FailureKind     string             `json:"failure_kind,omitempty"`     // Why the task didn't succeed; see failureHint
+	HTTPStatusHint  int                `json:"http_status_hint,omitempty"` // HTTP status equivalent of FailureKind, for dashboards
+	ErrorCategory   string             `json:"error_category,omitempty"`   // For worker errors: account problem or task problem; see classifyError
+	SkipReason      string             `json:"skip_reason,omitempty"`
+	ServedFromCache string             `json:"served_from_cache,omitempty"` // ID of the task whose cached result was reused
+	SubmitPosition  int                `json:"submit_position,omitempty"`   // Queue position when submitted
+	PositionHistory []PositionSnapshot `json:"position_history,omitempty"`  // Position changes while queued, ending with 0 when started
+	WaitMs          int64              `json:"wait_ms,omitempty"`           // Time from CreatedAt to StartedAt
+	Logs            string             `json:"logs,omitempty"`
+	Steps           any                `json:"steps,omitempty"`
+	StepCount       int                `json:"step_count,omitempty"` // Steps stored in the -steps-dir log (Steps is then empty)
+	LastStep        any                `json:"last_step,omitempty"`  // Most recent step in the -steps-dir log
+	StepExtensions  []StepExtension    `json:"step_extensions,omitempty"`
+	Truncated       []string           `json:"truncated,omitempty"` // Fields shortened for this response by ?max_result_bytes
+	CreatedAt       time.Time          `json:"created_at"`
+	StartedAt       time.Time          `json:"started_at,omitempty"`
+	FinishedAt      time.Time          `json:"finished_at,omitempty"`
 
 	// apiKey is stored internally but never serialized to JSON
 	apiKey string
 }
 
+// taskJSON is how a Task is encoded: its fields plus the computed
+// run_duration_ms (StartedAt to FinishedAt), omitted until both timestamps
+// exist. The time queued is already WaitMs.
+type taskJSON struct {
+	plainTask
+	RunDurationMs int64 `json:"run_duration_ms,omitempty"`
+}
+
+type plainTask Task // Task without its MarshalJSON
+
+func (t Task) toJSON() taskJSON {
+	out := taskJSON{plainTask: plainTask(t)}
+	if !t.StartedAt.IsZero() && !t.FinishedAt.IsZero() {
+		out.RunDurationMs = t.FinishedAt.Sub(t.StartedAt).Milliseconds()
+	}
+	return out
+}
+
+func (t Task) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.toJSON())
+}
+
+// Failure kinds recorded on tasks that didn't succeed
+const (
+	FailureWorker       = "worker_error" // Worker crashed, exited non-zero, or reported an error
+	FailureTimeout      = "timeout"      // Killed by the task timeout
+	FailureOutputLimit  = "output_limit" // Killed for exceeding max_output_tokens
+	FailureAssertion    = "assertion"    // Result didn't match assert_contains/assert_regex
+	FailureUnsuccessful = "unsuccessful" // Agent finished without achieving the goal
+	FailureSkipped      = "skipped"      // run_if condition not met
+)
+
+// failureHint maps a failure kind to an HTTP status, so dashboards can tell
+// problems the submitter can fix (4xx) from server or worker trouble (5xx).
+func failureHint(kind string) int {
+	switch kind {
+	case FailureWorker:
+		return http.StatusBadGateway
+	case FailureTimeout:
+		return http.StatusGatewayTimeout
+	case FailureOutputLimit, FailureAssertion, FailureUnsuccessful:
+		return http.StatusUnprocessableEntity
+	case FailureSkipped:
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+func (t *Task) setFailure(kind string) {
+	t.FailureKind = kind
+	t.HTTPStatusHint = failureHint(kind)
+}
+
+// maxRawOutput caps the unparseable worker output kept in Task.RawOutput.
+const maxRawOutput = 4096
+
+// rawOutput makes worker output safe to return as RawOutput: invalid UTF-8
+// (e.g. binary junk) is replaced and anything past maxRawOutput is cut.
+func rawOutput(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if len(s) > maxRawOutput {
+		s = truncateBytes(s, maxRawOutput)
+	}
+	return s
+}
+
+// StepExtension records a worker's request to go past max_steps.
+type StepExtension struct {
+	Requested int       `json:"requested"`
+	Granted   int       `json:"granted"`
+	Reason    string    `json:"reason,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// grantSteps answers a worker's request for n more steps, granting at most
+// what remains of the task's -allow-step-extension allowance.
+func (q *Queue) grantSteps(task *Task, n int, reason string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := 0
+	for _, ext := range task.StepExtensions {
+		used += ext.Granted
+	}
+	granted := max(0, min(n, q.stepExtension-used))
+	task.StepExtensions = append(task.StepExtensions, StepExtension{Requested: n, Granted: granted, Reason: reason, At: time.Now()})
+	taskLog(task.ID).Infof("Step extension: requested %d, granted %d (%s)", n, granted, truncate(reason, 50))
+	q.notify()
+	return granted
+}
+
+// workerStdin is a worker's stdin held open to answer it mid-run. Each
+// message is one JSON line.
+type workerStdin struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func (s *workerStdin) send(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// PositionSnapshot records a task's queue position at a point in time.
+type PositionSnapshot struct {
+	Position int       `json:"position"`
+	At       time.Time `json:"at"`
+}
+
 type Queue struct {
-	mu           sync.RWMutex
-	tasks        map[string]*Task
-	pending      chan string
-	pendingOrder []string // Track order of pending tasks for Position()
-	current      string
-	currentCmd   *exec.Cmd
-	workerPath   string
+	mu              sync.RWMutex
+	tasks           map[string]*Task
+	pendingOrder    []string             // Queued tasks in dispatch order: by priority, then time queued
+	ready           *sync.Cond           // Signalled when a task joins pendingOrder
+	space           *sync.Cond           // Signalled when pendingOrder shrinks
+	maxQueue        int                  // Max queued tasks for TrySubmit (0 = unlimited)
+	onFull          string               // Queue-full policy for TrySubmit
+	retryBudget     int                  // Max retries across all tasks per minute (0 = unlimited)
+	retryWindow     time.Time            // Start of the current retry budget window
+	retriesUsed     int                  // Retries taken in the current window
+	retryCategories map[string]bool      // Error categories worker errors may be retried for (nil = all)
+	taskTimeout     time.Duration        // Kill the worker after this long (0 = no limit)
+	timeouts        int                  // Tasks failed by a timeout since start
+	metrics         taskMetrics          // Counters for GET /metrics
+	avgRun          time.Duration        // Moving average of worker run time, for wait estimates
+	notifier        Notifier             // Completion event sinks (nil = none)
+	deliveries      chan CompletionEvent // Pending notifications for the callback workers
+	waiting         []string             // Tasks held until their run_if dependency finishes
+	concurrency     int                  // Workers run at once
+	running         map[string]*exec.Cmd // Running tasks; the command is nil until started
+	liveLogs        map[string]*liveLog  // Stderr of running workers, as it's written
+	workerPath      string
+	workerCmd       []string         // Interpreter and its args for .py workers, from -worker-cmd
+	workerArgs      []string         // Passed to every worker after its path, from -worker-arg
+	workerProblem   string           // Why the workers can't run, from ProbeWorkers ("" = fine)
+	routes          []workerRoute    // Label routes to other workers, first match wins
+	errorPatterns   []errorPattern   // Classify worker errors into ErrorCategory, first match wins
+	workerMode      string           // WorkerModePython (default) or WorkerModeEcho
+	echoDelay       time.Duration    // Simulated run time in echo mode
+	redactors       []*regexp.Regexp // Applied to logs and results before storing
+	debug           bool             // Log worker invocation details
+	isolateHome     bool             // Give each worker its own temporary HOME
+	stepsDir        string           // Stream steps to per-task files here instead of memory ("" = memory)
+	maxOutput       int              // Keep only the tail of results and logs longer than this (0 = unlimited)
+	stepExtension   int              // Max extra steps a worker may be granted per task (0 = none)
+	closing         bool             // Set by Shutdown; no new tasks start
+	draining        bool             // Set by Drain; TrySubmit fails with ErrDraining
+	paused          bool             // Set by Pause; queued tasks wait until Resume
+	saveMu          sync.Mutex       // Serializes SaveState
+	schedules       *Scheduler       // Saved and restored with the tasks by -state
+	cancelGrace     time.Duration    // Time between SIGTERM and SIGKILL on cancel (0 = kill at once)
+
+	// Gateway base URL and headers per provider, from -provider-config
+	providerConfigs map[string]ProviderConfig
+
+	// Subscribers signalled on every task state change (see Subscribe)
+	subs map[chan struct{}]struct{}
+
+	// Result cache for cacheable tasks, keyed by request hash
+	cache    map[string]cacheEntry
+	cacheTTL time.Duration
+}
+
+// cacheEntry is a successful result kept for reuse by identical cacheable requests.
+type cacheEntry struct {
+	taskID    string
+	result    string
+	steps     any
+	stepCount int // Steps in the source task's step log
+	lastStep  any
+	expires   time.Time
 }
 
-func NewQueue(workerPath string) *Queue {
-	return &Queue{
-		tasks:      make(map[string]*Task),
-		pending:    make(chan string, 100),
-		workerPath: workerPath,
+// NewQueue creates a queue that runs up to concurrency workers at once
+// (at least 1).
+func NewQueue(workerPath string, concurrency int) *Queue {
+	redactors, _ := compileRedactPatterns(defaultRedactPatterns)
+	q := &Queue{
+		tasks:         make(map[string]*Task),
+		concurrency:   max(concurrency, 1),
+		running:       make(map[string]*exec.Cmd),
+		liveLogs:      make(map[string]*liveLog),
+		workerPath:    workerPath,
+		workerCmd:     []string{"python3"},
+		subs:          make(map[chan struct{}]struct{}),
+		cache:         make(map[string]cacheEntry),
+		cacheTTL:      10 * time.Minute,
+		redactors:     redactors,
+		onFull:        OnFullReject,
+		metrics:       newTaskMetrics(),
+		errorPatterns: defaultErrorPatterns,
+		maxOutput:     defaultMaxOutput,
 	}
+	q.space = sync.NewCond(&q.mu)
+	q.ready = sync.NewCond(&q.mu)
+	q.schedules = NewScheduler(q)
+	return q
 }
 
+// ErrQueueFull is returned by TrySubmit when the queue is at -max-queue
+// capacity under the reject policy.
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrDraining is returned by TrySubmit once Drain has begun.
+var ErrDraining = errors.New("server is shutting down")
+
+// Queue-full policies for TrySubmit
+const (
+	OnFullReject     = "reject"      // refuse the new task
+	OnFullBlock      = "block"       // wait for room
+	OnFullDropOldest = "drop-oldest" // cancel the oldest queued task to make room
+)
+
+// Submit enqueues a task regardless of the max queue setting.
 func (q *Queue) Submit(req TaskRequest, apiKey string) *Task {
+	task, _ := q.submit(context.Background(), req, apiKey, false)
+	return task
+}
+
+// TrySubmit enqueues a task, applying the queue-full policy when maxQueue
+// tasks are already queued. Under the block policy it waits until there is
+// room or ctx is done.
+func (q *Queue) TrySubmit(ctx context.Context, req TaskRequest, apiKey string) (*Task, error) {
+	return q.submit(ctx, req, apiKey, true)
+}
+
+func (q *Queue) submit(ctx context.Context, req TaskRequest, apiKey string, limit bool) (*Task, error) {
 	// Apply defaults
 	if req.Provider == "" {
-		req.Provider = "Google"
+		req.Provider = defaultProvider
 	}
 	if req.Model == "" {
-		req.Model = "gemini-2.0-flash"
+		req.Model = defaultModel(req.Provider)
 	}
 	if req.MaxSteps == 0 {
 		req.MaxSteps = 30
@@ -89,14 +457,30 @@ func (q *Queue) Submit(req TaskRequest, apiKey string) *Task {
 	task := &Task{
 		ID: id,
 		Request: TaskRequestSafe{
-			Goal:      req.Goal,
-			App:       req.App,
-			Deeplink:  req.Deeplink,
-			Provider:  req.Provider,
-			Model:     req.Model,
-			Reasoning: req.Reasoning,
-			Vision:    req.Vision,
-			MaxSteps:  req.MaxSteps,
+			Goal:            req.Goal,
+			App:             req.App,
+			Deeplink:        req.Deeplink,
+			Setup:           req.Setup,
+			Provider:        req.Provider,
+			Model:           req.Model,
+			BaseURL:         req.BaseURL,
+			Reasoning:       req.Reasoning,
+			Vision:          req.Vision,
+			MaxSteps:        req.MaxSteps,
+			Priority:        req.Priority,
+			JumpQueue:       req.JumpQueue,
+			RunIf:           req.RunIf,
+			Cacheable:       req.Cacheable,
+			AssertContains:  req.AssertContains,
+			AssertRegex:     req.AssertRegex,
+			MaxRetries:      req.MaxRetries,
+			MaxOutputTokens: req.MaxOutputTokens,
+			TimeoutSeconds:  req.TimeoutSeconds,
+			Locale:          req.Locale,
+			Timezone:        req.Timezone,
+			Labels:          req.Labels,
+			Mode:            req.Mode,
+			ReplayOf:        req.ReplayOf,
 		},
 		Status:    "queued",
 		CreatedAt: time.Now(),
@@ -104,12 +488,92 @@ func (q *Queue) Submit(req TaskRequest, apiKey string) *Task {
 	}
 
 	q.mu.Lock()
+	if limit && q.draining {
+		q.mu.Unlock()
+		return nil, ErrDraining
+	}
+	if entry, ok := q.cachedResult(task.Request); ok {
+		q.tasks[id] = task
+		task.Status = "completed"
+		task.Success = true
+		task.Result = entry.result
+		task.Steps = entry.steps
+		task.StepCount = entry.stepCount
+		task.LastStep = entry.lastStep
+		task.StartedAt = task.CreatedAt
+		task.FinishedAt = task.CreatedAt
+		task.ServedFromCache = entry.taskID
+		task.apiKey = ""
+		q.metrics.submitted[task.Request.Provider]++
+		q.metrics.finish(task)
+		q.notify()
+		q.mu.Unlock()
+		taskLog(id).Infof("Served from cache (task %s)", entry.taskID)
+		return task, nil
+	}
+	if req.RunIf != nil {
+		// Hold until the referenced task finishes (it may already have)
+		q.tasks[id] = task
+		task.Status = "waiting"
+		q.waiting = append(q.waiting, id)
+		q.metrics.submitted[task.Request.Provider]++
+		q.releaseWaiting()
+		q.notify()
+		q.mu.Unlock()
+		return task, nil
+	}
+	if limit {
+		if err := q.makeRoom(ctx); err != nil {
+			q.mu.Unlock()
+			return nil, err
+		}
+	}
 	q.tasks[id] = task
-	q.pendingOrder = append(q.pendingOrder, id)
+	q.push(id)
+	task.SubmitPosition = q.position(id)
+	q.metrics.submitted[task.Request.Provider]++
+	q.notify()
 	q.mu.Unlock()
+	return task, nil
+}
 
-	q.pending <- id
-	return task
+// makeRoom applies the queue-full policy until a new task fits under
+// maxQueue. Must be called with mu held; the block policy releases it while
+// waiting.
+func (q *Queue) makeRoom(ctx context.Context) error {
+	if q.maxQueue <= 0 || len(q.pendingOrder) < q.maxQueue {
+		return nil
+	}
+
+	switch q.onFull {
+	case OnFullDropOldest:
+		for len(q.pendingOrder) >= q.maxQueue {
+			oldest := q.oldestLowPriority()
+			q.cancel(oldest, "dropped to make room in a full queue")
+			taskLog(oldest).Warnf("Dropped: queue full")
+		}
+		return nil
+	case OnFullBlock:
+		// Wake the wait below if the submitter goes away
+		stop := context.AfterFunc(ctx, func() {
+			q.mu.Lock()
+			q.space.Broadcast()
+			q.mu.Unlock()
+		})
+		defer stop()
+		for len(q.pendingOrder) >= q.maxQueue {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if q.draining {
+				return ErrDraining
+			}
+			q.space.Wait()
+		}
+		return nil
+	default:
+		return ErrQueueFull
+	}
 }
 
 func (q *Queue) Get(id string) *Task {
@@ -118,36 +582,193 @@ func (q *Queue) Get(id string) *Task {
 	return q.tasks[id]
 }
 
+// GetMany looks up several tasks under one lock. The result lines up with
+// ids, with nil for unknown IDs; like Snapshot, it holds copies that are safe
+// to read while the queue keeps updating the originals.
+func (q *Queue) GetMany(ids []string) []*Task {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	tasks := make([]*Task, len(ids))
+	for i, id := range ids {
+		if task := q.tasks[id]; task != nil {
+			snapshot := *task
+			tasks[i] = &snapshot
+		}
+	}
+	return tasks
+}
+
+// Snapshot returns a copy of a task that is safe to read while the queue
+// keeps updating the original.
+func (q *Queue) Snapshot(id string) (Task, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	task := q.tasks[id]
+	if task == nil {
+		return Task{}, false
+	}
+	return *task, true
+}
+
 func (q *Queue) All() map[string]*Task {
+	return q.Query(TaskFilter{})
+}
+
+// TaskFilter selects tasks for Query. Zero fields match everything. Time
+// windows are half-open: After is inclusive and Before is exclusive, so
+// consecutive daily windows never count a task twice. A Finished window only
+// matches tasks that have finished.
+type TaskFilter struct {
+	Statuses       map[string]bool
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	FinishedAfter  time.Time
+	FinishedBefore time.Time
+	Labels         map[string]string // Every one must be on the task
+	Provider       string
+}
+
+func (f TaskFilter) matches(t *Task) bool {
+	if len(f.Statuses) > 0 && !f.Statuses[t.Status] {
+		return false
+	}
+	if !inWindow(t.CreatedAt, f.CreatedAfter, f.CreatedBefore) {
+		return false
+	}
+	if !f.FinishedAfter.IsZero() || !f.FinishedBefore.IsZero() {
+		if t.FinishedAt.IsZero() || !inWindow(t.FinishedAt, f.FinishedAfter, f.FinishedBefore) {
+			return false
+		}
+	}
+	for k, v := range f.Labels {
+		if value, ok := t.Request.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	if f.Provider != "" && t.Request.Provider != f.Provider {
+		return false
+	}
+	return true
+}
+
+func inWindow(ts, after, before time.Time) bool {
+	if !after.IsZero() && ts.Before(after) {
+		return false
+	}
+	if !before.IsZero() && !ts.Before(before) {
+		return false
+	}
+	return true
+}
+
+// Order returns the queued tasks in the order they will be dispatched, and
+// the tasks held by run_if (which join the end of it once released).
+func (q *Queue) Order() (queued, waiting []*Task) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	queued = make([]*Task, 0, len(q.pendingOrder))
+	for _, id := range q.pendingOrder {
+		if task := q.tasks[id]; task != nil {
+			queued = append(queued, task)
+		}
+	}
+	waiting = make([]*Task, 0, len(q.waiting))
+	for _, id := range q.waiting {
+		if task := q.tasks[id]; task != nil {
+			waiting = append(waiting, task)
+		}
+	}
+	return queued, waiting
+}
+
+// Query returns the tasks matching f, keyed by ID.
+func (q *Queue) Query(f TaskFilter) map[string]*Task {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
 	cp := make(map[string]*Task)
 	for k, v := range q.tasks {
-		cp[k] = v
+		if f.matches(v) {
+			cp[k] = v
+		}
 	}
 	return cp
 }
 
+// Page returns up to limit tasks matching f, newest first (ties by ID),
+// after skipping offset of them, along with how many matched in all.
+func (q *Queue) Page(f TaskFilter, offset, limit int) ([]*Task, int) {
+	q.mu.RLock()
+	matched := make([]*Task, 0, len(q.tasks))
+	for _, task := range q.tasks {
+		if f.matches(task) {
+			matched = append(matched, task)
+		}
+	}
+	q.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+	total := len(matched)
+	if offset >= total {
+		return []*Task{}, total
+	}
+	matched = matched[offset:]
+	if limit < len(matched) {
+		matched = matched[:limit]
+	}
+	return matched, total
+}
+
+// Size returns the number of queued tasks: those waiting for a worker, not
+// counting running tasks or run_if tasks still held back.
 func (q *Queue) Size() int {
-	return len(q.pending)
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.queuedCount()
 }
 
-func (q *Queue) Current() string {
+// queuedCount is Size without locking: pendingOrder holds exactly the
+// queued tasks, as position relies on. Must be called with mu held.
+func (q *Queue) queuedCount() int {
+	return len(q.pendingOrder)
+}
+
+// Running returns the IDs of the running tasks, oldest first.
+func (q *Queue) Running() []string {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
-	return q.current
+	ids := make([]string, 0, len(q.running))
+	started := make(map[string]time.Time, len(q.running))
+	for id := range q.running {
+		ids = append(ids, id)
+		if task := q.tasks[id]; task != nil { // Gone if cleared while running
+			started[id] = task.StartedAt
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return started[ids[i]].Before(started[ids[j]]) })
+	return ids
 }
 
 func (q *Queue) Position(id string) int {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
+	return q.position(id)
+}
 
+// position is Position without locking. Must be called with mu held.
+func (q *Queue) position(id string) int {
 	// If currently running, position is 0
-	if q.current == id {
+	if _, ok := q.running[id]; ok {
 		return 0
 	}
 
-	// Find position in pending order
+	// pendingOrder holds exactly the queued tasks, so the last position
+	// matches Size
 	for i, taskID := range q.pendingOrder {
 		if taskID == id {
 			return i + 1 // 1-based position (0 means running)
@@ -157,165 +778,1412 @@ func (q *Queue) Position(id string) int {
 	return -1 // Not found in queue
 }
 
+// recordRunTime folds a finished worker run into avgRun. Must be called with
+// mu held.
+func (q *Queue) recordRunTime(d time.Duration) {
+	if q.avgRun == 0 {
+		q.avgRun = d
+		return
+	}
+	// Weight recent runs so the estimate follows changes in load
+	q.avgRun += (d - q.avgRun) / 5
+}
+
+// QueueInfo is a task's place in the queue, reported alongside submit and
+// poll responses so clients can back off without extra calls.
+type QueueInfo struct {
+	Size          int           // Tasks waiting to run
+	Position      int           // 0 = running, -1 = not queued
+	EstimatedWait time.Duration // Until the task starts; -1 = unknown (not queued, or no runs yet)
+}
+
+// queuedTaskJSON is how GET /task/{id} reports a queued task once there is
+// a run time to estimate its wait from.
+type queuedTaskJSON struct {
+	taskJSON
+	EstimatedWaitSeconds int `json:"estimated_wait_seconds"`
+}
+
+// RetryAfter estimates how soon a full queue has room again: the time for
+// one of the workers to finish a task, or 0 before any task has finished.
+func (q *Queue) RetryAfter() time.Duration {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.avgRun / time.Duration(q.concurrency)
+}
+
+// Info reports the queue size and the task's position and estimated wait.
+func (q *Queue) Info(id string) QueueInfo {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	info := QueueInfo{Size: q.queuedCount(), Position: q.position(id)}
+	switch {
+	case info.Position == 0:
+		info.EstimatedWait = 0
+	case info.Position < 0:
+		// Not in the queue, e.g. waiting on run_if: it may never start
+		info.EstimatedWait = -1
+	case q.avgRun == 0:
+		info.EstimatedWait = -1
+	default:
+		// The running tasks plus those ahead, spread over the workers, each
+		// taking about avgRun
+		rounds := (info.Position + q.concurrency - 1) / q.concurrency
+		info.EstimatedWait = time.Duration(rounds) * q.avgRun
+	}
+	return info
+}
+
+// TaskETA is a running or queued task with its estimated completion time.
+type TaskETA struct {
+	Task
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"` // Unset until a run has finished to estimate from
+}
+
+// MarshalJSON encodes the task as usual plus EstimatedCompletion, which the
+// MarshalJSON promoted from Task would leave out.
+func (e TaskETA) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		taskJSON
+		EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+	}{e.Task.toJSON(), e.EstimatedCompletion})
+}
+
+// ByETA returns the running and queued tasks matching f in order of
+// estimated completion: running tasks first, soonest to finish first, then
+// queued ones in dispatch order. Each task is assumed to take avgRun; queued
+// tasks go to whichever worker frees up first.
+func (q *Queue) ByETA(now time.Time, f TaskFilter) []TaskETA {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var running []*Task
+	for id := range q.running {
+		if task := q.tasks[id]; task != nil {
+			running = append(running, task)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].StartedAt.Before(running[j].StartedAt) })
+
+	// When each worker will be free, starting with the running tasks
+	free := make([]time.Time, max(q.concurrency, len(running)))
+	for i := range free {
+		free[i] = now
+	}
+	list := make([]TaskETA, 0, len(running)+len(q.pendingOrder))
+	for i, task := range running {
+		entry := TaskETA{Task: *task}
+		if q.avgRun > 0 {
+			eta := task.StartedAt.Add(q.avgRun)
+			if eta.Before(now) {
+				eta = now // Overdue; could finish any moment
+			}
+			free[i] = eta
+			entry.EstimatedCompletion = &eta
+		}
+		list = append(list, entry)
+	}
+	if q.avgRun > 0 {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].EstimatedCompletion.Before(*list[j].EstimatedCompletion) })
+	}
+	for _, id := range q.pendingOrder {
+		task := q.tasks[id]
+		if task == nil {
+			continue
+		}
+		entry := TaskETA{Task: *task}
+		if q.avgRun > 0 {
+			next := 0
+			for i := range free {
+				if free[i].Before(free[next]) {
+					next = i
+				}
+			}
+			eta := free[next].Add(q.avgRun)
+			free[next] = eta
+			entry.EstimatedCompletion = &eta
+		}
+		list = append(list, entry)
+	}
+
+	filtered := list[:0]
+	for _, entry := range list {
+		if f.matches(&entry.Task) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
 func (q *Queue) Cancel(id string) bool {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	return q.cancel(id, "")
+}
 
+// cancel marks a waiting, queued, or running task as cancelled, killing its
+// worker if running. reason, if set, is recorded as the task's error.
+// Must be called with mu held.
+func (q *Queue) cancel(id, reason string) bool {
 	task := q.tasks[id]
 	if task == nil {
 		return false
 	}
 
-	// If running, kill the process
-	if task.Status == "running" && q.currentCmd != nil && q.current == id {
-		if err := q.currentCmd.Process.Kill(); err != nil {
-			log.Printf("[%s] Failed to kill process: %v", id, err)
-		}
+	// If running, stop the process
+	if cmd := q.running[id]; task.Status == "running" && cmd != nil {
+		stopWorker(cmd, id, q.cancelGrace)
 	}
 
-	// If queued or running, mark as cancelled
-	if task.Status == "queued" || task.Status == "running" {
+	// If waiting, queued or running, mark as cancelled
+	if task.Status == "waiting" || task.Status == "queued" || task.Status == "running" {
 		task.Status = "cancelled"
 		task.FinishedAt = time.Now()
+		if reason != "" {
+			task.Error = reason
+		}
 		q.removePendingOrder(id)
+		q.waiting = removeID(q.waiting, id)
+		q.releaseWaiting()
+		q.notify()
 		return true
 	}
 	return false
 }
 
+// stopWorker sends SIGTERM so the worker can back out cleanly (e.g. close a
+// half-launched app), then kills it if it's still running after grace. The
+// caller's cmd.Wait returns once the worker exits either way.
+func stopWorker(cmd *exec.Cmd, id string, grace time.Duration) {
+	if grace > 0 {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err == nil {
+			time.AfterFunc(grace, func() {
+				if err := cmd.Process.Kill(); err == nil {
+					taskLog(id).Warnf("Worker ignored SIGTERM for %s, killed", grace)
+				}
+			})
+			return
+		}
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		taskLog(id).Errorf("Failed to kill process: %v", err)
+	}
+}
+
 func (q *Queue) Clear() int {
+	count, _ := q.ClearExpecting(-1)
+	return count
+}
+
+// ClearExpecting clears the queue if it holds exactly want unfinished
+// (waiting, queued, or running) tasks, any number when want is -1, so a
+// confirmation given for an earlier count can't wipe tasks submitted since.
+// Finished tasks aren't counted: clearing them loses nothing but history.
+// It returns the number of tasks cleared, or the number of unfinished ones
+// when it refuses.
+func (q *Queue) ClearExpecting(want int) (int, bool) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	if want != -1 {
+		unfinished := 0
+		for _, task := range q.tasks {
+			if !isTerminal(task.Status) {
+				unfinished++
+			}
+		}
+		if want != unfinished {
+			return unfinished, false
+		}
+	}
 
-	// Kill current task if running
-	if q.currentCmd != nil {
-		if err := q.currentCmd.Process.Kill(); err != nil {
-			log.Printf("Failed to kill current process: %v", err)
+	// Stop running tasks, marked cancelled so they aren't retried
+	now := time.Now()
+	for id, cmd := range q.running {
+		if task := q.tasks[id]; task != nil {
+			task.Status = "cancelled"
+			task.FinishedAt = now
+		}
+		if cmd != nil {
+			stopWorker(cmd, id, q.cancelGrace)
 		}
 	}
 
 	count := len(q.tasks)
+	for id := range q.tasks {
+		q.removeTaskFiles(id)
+	}
 	q.tasks = make(map[string]*Task)
-	q.current = ""
 	q.pendingOrder = nil
+	q.waiting = nil
+	q.cache = make(map[string]cacheEntry)
+	q.space.Broadcast()
+	q.notify()
+	return count, true
+}
 
-	// Drain pending queue
-	for len(q.pending) > 0 {
-		<-q.pending
+// CancelMatching cancels the waiting, queued, and running tasks f matches,
+// like Cancel, if there are exactly want of them (any number when want is
+// -1). It returns their IDs, cancelled or not. Finished tasks are left as
+// they are.
+func (q *Queue) CancelMatching(f TaskFilter, want int) ([]string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := []string{}
+	for id, task := range q.tasks {
+		if !isTerminal(task.Status) && f.matches(task) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if want != -1 && want != len(ids) {
+		return ids, false
 	}
+	for _, id := range ids {
+		q.cancel(id, "")
+	}
+	return ids, true
+}
 
-	return count
+// Reap removes finished tasks (completed, failed, cancelled, or skipped)
+// whose FinishedAt is older than ttl, returning how many it removed. Queued,
+// waiting, and running tasks are never touched.
+func (q *Queue) Reap(now time.Time, ttl time.Duration) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	removed := 0
+	for id, task := range q.tasks {
+		if !isTerminal(task.Status) || task.FinishedAt.IsZero() || now.Sub(task.FinishedAt) < ttl {
+			continue
+		}
+		delete(q.tasks, id)
+		q.removeTaskFiles(id)
+		removed++
+	}
+	if removed > 0 {
+		q.notify()
+	}
+	return removed
+}
+
+// ReapExpired calls Reap every ttl/10 (at least every second) until stop is
+// closed, so finished tasks don't accumulate forever under -task-ttl.
+func (q *Queue) ReapExpired(ttl time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(max(ttl/10, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if n := q.Reap(now, ttl); n > 0 {
+				serverLog.Infof("Removed %d tasks finished more than %s ago", n, ttl)
+			}
+		}
+	}
+}
+
+// Drain prepares the queue for shutdown: submissions through TrySubmit are
+// refused with ErrDraining, including any blocked waiting for room, and then
+// it shuts down as Shutdown does. Queued tasks stay queued, to be saved with
+// SaveState.
+func (q *Queue) Drain(ctx context.Context) error {
+	q.mu.Lock()
+	q.draining = true
+	q.space.Broadcast()
+	q.mu.Unlock()
+	return q.Shutdown(ctx)
+}
+
+// Pause stops queued tasks from starting until Resume. Running tasks carry
+// on, and submissions are still queued. It reports whether the queue was
+// running before.
+func (q *Queue) Pause() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	was := q.paused
+	q.paused = true
+	return !was
+}
+
+// Resume lets queued tasks start again after Pause. It reports whether the
+// queue was paused before.
+func (q *Queue) Resume() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	was := q.paused
+	q.paused = false
+	q.ready.Broadcast()
+	return was
+}
+
+// Paused reports whether the queue is paused.
+func (q *Queue) Paused() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.paused
+}
+
+// Draining reports whether Drain has begun.
+func (q *Queue) Draining() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.draining
+}
+
+// Shutdown stops new tasks from starting and waits for the running workers to
+// finish. If ctx ends first, they are killed and ctx's error returned.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	changed, unsubscribe := q.Subscribe()
+	defer unsubscribe()
+	q.mu.Lock()
+	q.closing = true
+	q.mu.Unlock()
+
+	for {
+		q.mu.Lock()
+		if len(q.running) == 0 {
+			q.mu.Unlock()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for id, cmd := range q.running {
+				if cmd == nil {
+					continue
+				}
+				taskLog(id).Warnf("Killing worker at shutdown")
+				if err := cmd.Process.Kill(); err != nil {
+					taskLog(id).Errorf("Failed to kill worker: %v", err)
+				}
+			}
+			q.mu.Unlock()
+			return ctx.Err()
+		default:
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+	}
 }
 
+// Run starts the queue's workers, each taking the first task in
+// pendingOrder whenever it is free. It never returns.
 func (q *Queue) Run() {
-	for id := range q.pending {
-		q.process(id)
+	var wg sync.WaitGroup
+	for i := 0; i < q.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				q.process(q.next())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// next waits until a task is queued, and the queue isn't paused or shutting
+// down, and returns the first in dispatch order. It stays queued until
+// process starts it, so two idle workers may get the same ID; process runs
+// it only once.
+func (q *Queue) next() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pendingOrder) == 0 || q.closing || q.paused {
+		q.ready.Wait()
 	}
+	return q.pendingOrder[0]
 }
 
 func (q *Queue) process(id string) {
 	q.mu.Lock()
 	task := q.tasks[id]
-	if task == nil {
+	if task == nil || task.Status != "queued" || q.closing {
+		// Started by another worker, cancelled, or cleared since next
+		// returned it, or shutting down
 		q.mu.Unlock()
 		return
 	}
 	task.Status = "running"
 	task.StartedAt = time.Now()
-	q.current = id
+	task.WaitMs = task.StartedAt.Sub(task.CreatedAt).Milliseconds()
+	task.PositionHistory = append(task.PositionHistory, PositionSnapshot{Position: 0, At: task.StartedAt})
+	q.running[id] = nil
 	q.removePendingOrder(id)
 	apiKey := task.apiKey // Get the stored API key
+	q.notify()
 	q.mu.Unlock()
 
-	log.Printf("[%s] Starting task: %s", id, truncate(task.Request.Goal, 50))
+	taskLog(id).Infof("Starting task: %s", truncate(task.Request.Goal, 50))
 
 	// Build input for worker - include API key here (passed via stdin, not stored)
-	input, _ := json.Marshal(map[string]any{
-		"goal":      task.Request.Goal,
-		"app":       task.Request.App,
-		"deeplink":  task.Request.Deeplink,
-		"provider":  task.Request.Provider,
-		"model":     task.Request.Model,
-		"reasoning": task.Request.Reasoning,
-		"vision":    task.Request.Vision,
-		"max_steps": task.Request.MaxSteps,
-		"api_key":   apiKey,
-	})
+	workerInput := map[string]any{
+		"goal":              task.Request.Goal,
+		"app":               task.Request.App,
+		"deeplink":          task.Request.Deeplink,
+		"setup":             task.Request.setupSteps(),
+		"provider":          task.Request.Provider,
+		"model":             task.Request.Model,
+		"reasoning":         task.Request.Reasoning,
+		"vision":            task.Request.Vision,
+		"max_steps":         task.Request.MaxSteps,
+		"max_output_tokens": task.Request.MaxOutputTokens,
+		"locale":            task.Request.Locale,
+		"timezone":          task.Request.Timezone,
+		"labels":            task.Request.Labels,
+		"api_key":           apiKey,
+	}
+	// Tells the worker its stdin stays open to answer request_more_steps
+	if q.stepExtension > 0 && q.workerMode != WorkerModeEcho {
+		workerInput["step_extension"] = q.stepExtension
+	}
+	if cfg, ok := q.providerConfigs[task.Request.Provider]; ok {
+		workerInput["base_url"] = cfg.BaseURL
+		workerInput["headers"] = cfg.Headers
+	}
+	// The request's own endpoint wins. The gateway's headers are meant for
+	// the gateway only, so they aren't sent along to it.
+	if task.Request.BaseURL != "" {
+		workerInput["base_url"] = task.Request.BaseURL
+		delete(workerInput, "headers")
+	}
+	// A replay hands the worker the source task's steps to repeat
+	var replayErr error
+	if task.Request.Mode == ModeReplay {
+		steps, _, err := q.Steps(task.Request.ReplayOf, 0, math.MaxInt)
+		if err == nil && len(steps) == 0 {
+			err = errors.New("no recorded steps")
+		}
+		if err != nil {
+			replayErr = fmt.Errorf("replay of task %s: %w", task.Request.ReplayOf, err)
+		}
+		workerInput["mode"] = ModeReplay
+		workerInput["replay_steps"] = steps
+	}
+	input, _ := json.Marshal(workerInput)
 
 	// Run worker
-	cmd := exec.Command("python3", q.workerPath)
-	cmd.Stdin = bytes.NewReader(input)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
+	workerPath, route := q.routeWorker(task.Request.Labels)
+	if route != nil {
+		taskLog(id).Infof("Routed to worker %s (label %s=%s)", workerPath, route.key, route.value)
+	}
+	cmd := q.workerCommand(workerPath)
+	cleanupHome, err := q.isolateWorkerHome(cmd, id)
+	if err == nil {
+		err = replayErr
+	}
+	if q.debug {
+		taskLog(id).Infof("Worker command: %s", describeCmd(cmd))
+	}
+	// With step extensions, stdin stays open so the worker can be answered
+	var stdin *workerStdin
+	if q.stepExtension > 0 && err == nil && q.workerMode != WorkerModeEcho {
+		var pipe io.WriteCloser
+		if pipe, err = cmd.StdinPipe(); err == nil {
+			stdin = &workerStdin{w: pipe}
+		}
+	} else {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	stderr := &liveLog{apiKey: apiKey}
 	q.mu.Lock()
-	q.currentCmd = cmd
+	q.liveLogs[id] = stderr
 	q.mu.Unlock()
+	var timedOut, overTokens atomic.Bool
+	maxTokens := task.Request.MaxOutputTokens
+	timeout := q.taskTimeout
+	if task.Request.TimeoutSeconds > 0 {
+		timeout = time.Duration(task.Request.TimeoutSeconds) * time.Second
+	}
+	stepLog := q.openStepLog(id)
+	if stepLog != nil {
+		defer func() { _ = stepLog.Close() }()
+	}
+	stdout := &lineWriter{onLine: func(line []byte) bool {
+		// Progress lines stream a step as it happens, ask for more steps,
+		// or report the cumulative output tokens used so far. Any other
+		// object without "ok" is a step too; "ok" marks the result.
+		var progress struct {
+			Step         json.RawMessage `json:"append_step"`
+			MoreSteps    *int            `json:"request_more_steps"`
+			Reason       string          `json:"reason"`
+			OutputTokens *int            `json:"output_tokens"`
+		}
+		if json.Unmarshal(line, &progress) != nil {
+			return false
+		}
+		if progress.Step != nil {
+			q.recordStep(task, stepLog, progress.Step)
+			return true
+		}
+		if progress.MoreSteps != nil {
+			granted := q.grantSteps(task, *progress.MoreSteps, redact(progress.Reason, q.redactors, apiKey))
+			if stdin != nil {
+				if err := stdin.send(map[string]int{"granted_steps": granted}); err != nil {
+					taskLog(id).Errorf("Failed to answer step extension request: %v", err)
+				}
+			}
+			return true
+		}
+		if progress.OutputTokens == nil {
+			if isStepLine(line) {
+				q.recordStep(task, stepLog, line)
+				return true
+			}
+			return false
+		}
+		q.mu.Lock()
+		task.OutputTokens = *progress.OutputTokens
+		running := q.running[id]
+		q.notify()
+		q.mu.Unlock()
+		if maxTokens > 0 && *progress.OutputTokens > maxTokens && !overTokens.Swap(true) && running != nil {
+			if err := running.Process.Kill(); err != nil {
+				taskLog(id).Errorf("Failed to kill process over token limit: %v", err)
+			}
+		}
+		return false
+	}}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if q.workerMode == WorkerModeEcho {
+		if err == nil {
+			q.runEcho(task, stdout, timeout, &timedOut)
+		}
+	} else if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil && q.workerMode != WorkerModeEcho {
+		// Publish the command only once started, so Cancel can kill it
+		q.mu.Lock()
+		q.running[id] = cmd
+		if task.Status == "cancelled" || overTokens.Load() {
+			_ = cmd.Process.Kill()
+		}
+		q.mu.Unlock()
+		if stdin != nil {
+			if err := stdin.send(json.RawMessage(input)); err != nil {
+				taskLog(id).Errorf("Failed to write worker input: %v", err)
+			}
+		}
 
-	err := cmd.Run()
+		var timer *time.Timer
+		if timeout > 0 {
+			timer = time.AfterFunc(timeout, func() {
+				timedOut.Store(true)
+				taskLog(id).Warnf("Timeout: killing worker after %s", formatTimeout(timeout))
+				if err := cmd.Process.Kill(); err != nil {
+					taskLog(id).Errorf("Failed to kill timed out process: %v", err)
+				}
+			})
+		}
+		err = cmd.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	cleanupHome()
+	_ = stdout.Close()
 	output := stdout.Bytes()
+	logs := q.capLogs(id, redact(stderr.String(), q.redactors, apiKey))
 
 	q.mu.Lock()
-	q.currentCmd = nil
+	delete(q.running, id)
+	delete(q.liveLogs, id)
+	if q.tasks[id] != task {
+		// Cleared while running: there's nothing left to finish or retry
+		q.removeTaskFiles(id)
+		q.notify()
+		q.mu.Unlock()
+		return
+	}
 	task.FinishedAt = time.Now()
-	task.Logs = stderr.String()
-	q.current = ""
+	task.Logs = logs
 
-	// Check if cancelled while running
+	// Check if cancelled while running (Cancel already released dependents)
 	if task.Status == "cancelled" {
-		log.Printf("[%s] Cancelled", id)
+		if steps := partialSteps(output); len(steps) > 0 {
+			q.keepSteps(task, stepLog, steps)
+		}
+		taskLog(id).Infof("Cancelled")
+		ev := completionEvent(task)
+		q.notify()
 		q.mu.Unlock()
+		q.deliver(ev)
 		return
 	}
 
-	if err != nil {
+	q.recordRunTime(task.FinishedAt.Sub(task.StartedAt))
+
+	if timedOut.Load() {
+		task.Status = "failed"
+		task.Error = fmt.Sprintf("task exceeded timeout of %s", formatTimeout(timeout))
+		task.setFailure(FailureTimeout)
+		if steps := partialSteps(output); len(steps) > 0 {
+			q.keepSteps(task, stepLog, steps)
+		}
+		q.timeouts++
+		taskLog(id).Errorf("Failed: %s", task.Error)
+	} else if overTokens.Load() {
+		task.Status = "failed"
+		task.Error = fmt.Sprintf("output token limit exceeded (%d > %d)", task.OutputTokens, maxTokens)
+		task.setFailure(FailureOutputLimit)
+		if steps := partialSteps(output); len(steps) > 0 {
+			q.keepSteps(task, stepLog, steps)
+		}
+		taskLog(id).Errorf("Failed: %s", task.Error)
+	} else if err != nil {
 		task.Status = "failed"
 		task.Error = err.Error()
-		if stderr.Len() > 0 {
-			task.Error = stderr.String()
+		if logs != "" {
+			task.Error = logs
 		}
-		log.Printf("[%s] Failed: %s", id, task.Error)
+		task.setFailure(FailureWorker)
+		taskLog(id).Errorf("Failed: %s", task.Error)
 	} else {
-		var result struct {
-			OK      bool   `json:"ok"`
-			Success bool   `json:"success"`
-			Reason  string `json:"reason"`
-			Error   string `json:"error"`
-			Steps   any    `json:"steps"`
-		}
-		if err := json.Unmarshal(output, &result); err != nil {
+		result, err := stdout.Result()
+		if err != nil {
 			task.Status = "failed"
-			task.Error = "invalid worker output: " + string(output)
+			task.Error = "invalid worker output"
+			task.ParseError = redact(err.Error(), q.redactors, apiKey)
+			task.RawOutput = rawOutput(redact(string(output), q.redactors, apiKey))
+			task.setFailure(FailureWorker)
 		} else if !result.OK {
 			task.Status = "failed"
-			task.Error = result.Error
+			task.Error = redact(result.Error, q.redactors, apiKey)
+			task.setFailure(FailureWorker)
 		} else {
 			task.Status = "completed"
 			task.Success = result.Success
-			task.Result = result.Reason
-			task.Steps = result.Steps
+			task.Result = keepTail(redact(result.Reason, q.redactors, apiKey), q.maxOutput)
+			q.keepSteps(task, stepLog, result.Steps)
+			if !task.Success {
+				task.setFailure(FailureUnsuccessful)
+			} else if err := checkAssertions(task.Request, task.Result); err != nil {
+				task.Success = false
+				task.Error = err.Error()
+				task.setFailure(FailureAssertion)
+				taskLog(id).Warnf("%s", task.Error)
+			}
+			if task.Request.Cacheable && task.Success {
+				q.cache[requestHash(task.Request)] = cacheEntry{
+					taskID:    id,
+					result:    task.Result,
+					steps:     task.Steps,
+					stepCount: task.StepCount,
+					lastStep:  task.LastStep,
+					expires:   time.Now().Add(q.cacheTTL),
+				}
+			}
 		}
-		log.Printf("[%s] Completed: success=%v", id, task.Success)
+		taskLog(id).Infof("Completed: success=%v", task.Success)
 	}
+	if task.FailureKind == FailureWorker {
+		task.ErrorCategory = classifyError(q.errorPatterns, task.Error)
+	}
+
+	if task.Status == "failed" && task.Retries < task.Request.MaxRetries && !q.retryableCategory(task) {
+		taskLog(id).Warnf("Not retrying: error category %s isn't in -retry-categories", task.ErrorCategory)
+	} else if task.Status == "failed" && task.Retries < task.Request.MaxRetries {
+		if q.takeRetry(time.Now()) {
+			task.Retries++
+			task.Status = "queued"
+			task.Error = ""
+			task.ParseError, task.RawOutput = "", ""
+			task.setFailure("")
+			task.ErrorCategory = ""
+			task.OutputTokens = 0
+			task.Steps, task.StepCount, task.LastStep = nil, 0, nil
+			task.StepExtensions = nil
+			task.FinishedAt = time.Time{}
+			q.push(id)
+			taskLog(id).Infof("Retrying (%d/%d)", task.Retries, task.Request.MaxRetries)
+			q.notify()
+			q.mu.Unlock()
+			return
+		}
+		task.Error += " (retry skipped: retry budget exhausted)"
+		taskLog(id).Warnf("Retry skipped: retry budget exhausted")
+	}
+
+	q.metrics.finish(task)
+	// Delivered before releaseWaiting, so tasks it skips are notified after
+	// the task they depended on
+	q.deliver(completionEvent(task))
+	q.releaseWaiting()
+	q.notify()
 	q.mu.Unlock()
 }
 
+// Timeouts returns how many tasks have failed by exceeding the task timeout.
+func (q *Queue) Timeouts() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.timeouts
+}
+
+// retryableCategory reports whether -retry-categories lets a failed task be
+// retried. It only restricts worker errors; other failures, such as
+// timeouts, have no error category and retry as usual. Must be called with mu
+// held.
+func (q *Queue) retryableCategory(task *Task) bool {
+	return q.retryCategories == nil || task.ErrorCategory == "" || q.retryCategories[task.ErrorCategory]
+}
+
+// takeRetry consumes one retry from the per-minute budget, reporting whether
+// one was available. Must be called with mu held.
+func (q *Queue) takeRetry(now time.Time) bool {
+	if q.retryBudget <= 0 {
+		return true
+	}
+	if now.Sub(q.retryWindow) >= time.Minute {
+		q.retryWindow = now
+		q.retriesUsed = 0
+	}
+	if q.retriesUsed >= q.retryBudget {
+		return false
+	}
+	q.retriesUsed++
+	return true
+}
+
+// RetryBudgetRemaining returns the retries left in the current window, or -1
+// if there is no budget.
+func (q *Queue) RetryBudgetRemaining() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.retryBudget <= 0 {
+		return -1
+	}
+	if time.Since(q.retryWindow) >= time.Minute {
+		return q.retryBudget
+	}
+	return q.retryBudget - q.retriesUsed
+}
+
+// Subscribe returns a channel that is signalled whenever any task changes
+// state, and a function that unsubscribes. Signals coalesce, so a slow
+// subscriber sees at most one pending signal and should re-read the tasks it
+// cares about on every wake-up.
+func (q *Queue) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	q.mu.Lock()
+	q.subs[ch] = struct{}{}
+	q.mu.Unlock()
+	return ch, func() {
+		q.mu.Lock()
+		delete(q.subs, ch)
+		q.mu.Unlock()
+	}
+}
+
+// notify signals all subscribers without blocking.
+// Must be called with mu held.
+func (q *Queue) notify() {
+	for ch := range q.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// changed signals subscribers for a change outside the tasks, such as a
+// schedule added or deleted, so PersistState saves it.
+func (q *Queue) changed() {
+	q.mu.Lock()
+	q.notify()
+	q.mu.Unlock()
+}
+
+// workerCommand builds the command that runs the worker at path: a .py
+// script through the -worker-cmd interpreter, anything else as an executable
+// of its own. The task input, including the API key, is written to its stdin
+// separately.
+func (q *Queue) workerCommand(path string) *exec.Cmd {
+	if !strings.HasSuffix(path, ".py") {
+		return exec.Command(path, q.workerArgs...)
+	}
+	args := append(append(append([]string{}, q.workerCmd[1:]...), path), q.workerArgs...)
+	return exec.Command(q.workerCmd[0], args...)
+}
+
+// ProbeWorkers checks that the worker, and any routed workers, can be run,
+// remembering the first problem found for WorkerProblem. It doesn't run
+// them; it only checks that each file (and the interpreter for .py workers)
+// exists and is executable. Echo mode needs no worker.
+func (q *Queue) ProbeWorkers() string {
+	problem := ""
+	if q.workerMode != WorkerModeEcho {
+		paths := []string{q.workerPath}
+		for _, route := range q.routes {
+			paths = append(paths, route.path)
+		}
+		for _, path := range paths {
+			if err := q.checkWorker(path); err != nil {
+				problem = err.Error()
+				break
+			}
+		}
+	}
+	q.mu.Lock()
+	q.workerProblem = problem
+	q.mu.Unlock()
+	return problem
+}
+
+// WorkerProblem returns why the workers can't run, as last found by
+// ProbeWorkers, or "" if they can (or were never probed).
+func (q *Queue) WorkerProblem() string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.workerProblem
+}
+
+// checkWorker reports why the command workerCommand builds for path can't
+// be started.
+func (q *Queue) checkWorker(path string) error {
+	if strings.HasSuffix(path, ".py") {
+		if _, err := exec.LookPath(q.workerCmd[0]); err != nil {
+			return fmt.Errorf("worker interpreter %s not found", q.workerCmd[0])
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("worker %s not found", path)
+		}
+		return nil
+	}
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf("worker %s is missing or not executable", path)
+	}
+	return nil
+}
+
+// isolateWorkerHome points the worker's HOME at a fresh temporary directory
+// when -isolate-home is set, so concurrent workers don't share SDK caches or
+// credentials. The returned cleanup removes the directory.
+func (q *Queue) isolateWorkerHome(cmd *exec.Cmd, id string) (func(), error) {
+	if !q.isolateHome {
+		return func() {}, nil
+	}
+	home, err := os.MkdirTemp("", "droidrun-home-"+id+"-")
+	if err != nil {
+		return func() {}, fmt.Errorf("create worker home: %w", err)
+	}
+	// The last HOME wins when the environment has duplicates
+	cmd.Env = append(os.Environ(), "HOME="+home)
+	return func() {
+		if err := os.RemoveAll(home); err != nil {
+			taskLog(id).Errorf("Failed to remove worker home %s: %v", home, err)
+		}
+	}, nil
+}
+
+// describeCmd renders a command for debug logs: the resolved program, its
+// arguments, working directory, and the names (never values) of any
+// environment variables set on it.
+func describeCmd(cmd *exec.Cmd) string {
+	args := make([]string, len(cmd.Args))
+	for i, a := range cmd.Args {
+		if a == "" || strings.ContainsAny(a, " \t\"'") {
+			a = strconv.Quote(a)
+		}
+		args[i] = a
+	}
+	if len(args) > 0 && cmd.Path != "" {
+		args[0] = cmd.Path
+	}
+
+	dir := cmd.Dir
+	if dir == "" {
+		dir = "."
+	}
+	env := "inherited"
+	if cmd.Env != nil {
+		keys := make([]string, 0, len(cmd.Env))
+		for _, kv := range cmd.Env {
+			k, _, _ := strings.Cut(kv, "=")
+			keys = append(keys, k)
+		}
+		env = "[" + strings.Join(keys, " ") + "]"
+	}
+	return fmt.Sprintf("%s (dir: %s, env: %s)", strings.Join(args, " "), dir, env)
+}
+
+// formatTimeout shows whole-second timeouts in seconds ("120s" rather than
+// "2m0s"), matching timeout_seconds.
+func formatTimeout(d time.Duration) string {
+	if d%time.Second == 0 {
+		return strconv.Itoa(int(d/time.Second)) + "s"
+	}
+	return d.String()
+}
+
+// partialSteps extracts the complete JSON objects, one per line, from the
+// stdout of a worker that was killed before finishing. A line cut off
+// mid-write, or any other non-JSON line, is skipped.
+func partialSteps(output []byte) []any {
+	var steps []any
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var obj map[string]any
+		if err := json.Unmarshal(line, &obj); err != nil {
+			continue
+		}
+		steps = append(steps, obj)
+	}
+	return steps
+}
+
+// workerResult is the final JSON object a worker prints.
+type workerResult struct {
+	OK      bool
+	Success bool
+	Reason  string
+	Error   string
+	Steps   any // []any of json.RawMessage when the worker sent an array
+}
+
+// decodeResult reads a worker result with a streaming decoder. A steps array
+// is decoded one element at a time into json.RawMessage rather than unmarshaled
+// into generic maps, which for long runs with screenshots took several times
+// the size of the output itself.
+func decodeResult(r io.Reader) (workerResult, error) {
+	var res workerResult
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return res, err
+	} else if tok != json.Delim('{') {
+		return res, fmt.Errorf("worker result is not an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return res, err
+		}
+		switch key, _ := tok.(string); key {
+		case "ok":
+			err = dec.Decode(&res.OK)
+		case "success":
+			err = dec.Decode(&res.Success)
+		case "reason":
+			err = dec.Decode(&res.Reason)
+		case "error":
+			err = dec.Decode(&res.Error)
+		case "steps":
+			res.Steps, err = decodeSteps(dec)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	_, err := dec.Token() // Closing brace
+	return res, err
+}
+
+// decodeSteps decodes the steps value at dec's position. Workers that report
+// something other than an array (e.g. a step count) get it stored as is.
+func decodeSteps(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('['):
+		steps := []any{}
+		for dec.More() {
+			var step json.RawMessage
+			if err := dec.Decode(&step); err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		}
+		_, err := dec.Token()
+		return steps, err
+	case json.Delim('{'):
+		obj := map[string]any{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			var v any
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			obj[key.(string)] = v
+		}
+		_, err := dec.Token()
+		return obj, err
+	default:
+		return tok, nil // Scalar, or nil for null
+	}
+}
+
+// finalOutput returns the worker's result object: its last non-empty line if
+// that is JSON (earlier lines are progress updates), otherwise the whole
+// stdout, for a result printed over several lines.
+func finalOutput(output []byte) []byte {
+	output = bytes.TrimSpace(output)
+	if i := bytes.LastIndexByte(output, '\n'); i >= 0 {
+		if last := bytes.TrimSpace(output[i+1:]); json.Valid(last) {
+			return last
+		}
+	}
+	return output
+}
+
+// isStepLine reports whether a worker output line is a step: a JSON object
+// without the "ok" that marks the final result.
+func isStepLine(line []byte) bool {
+	var obj map[string]json.RawMessage
+	if line[0] != '{' || json.Unmarshal(line, &obj) != nil {
+		return false
+	}
+	_, ok := obj["ok"]
+	return !ok
+}
+
+// maxBufferedOutput caps the worker output lineWriter buffers besides the
+// last line, so a worker printing endless noise can't exhaust memory.
+var maxBufferedOutput = 64 << 20
+
+// resultStart matches the start of a result line: worker.py always puts
+// "ok" first, so the line can be decoded as it arrives.
+var resultStart = regexp.MustCompile(`^\s*\{\s*"ok"\s*:`)
+
+// lineWriter calls onLine with each complete line as it arrives, letting
+// process react to worker progress while the worker runs. Lines onLine
+// reports as consumed are dropped; everything else is buffered for Bytes,
+// up to maxBufferedOutput, after which only the last line is kept.
+//
+// A line starting with "ok" is the result instead: it goes straight to a
+// streaming decoder, so a huge steps array is never held as text, and only
+// its first maxRawOutput bytes are buffered.
+type lineWriter struct {
+	buf       bytes.Buffer
+	pending   []byte
+	last      []byte // Last non-empty unconsumed line
+	truncated bool   // buf passed maxBufferedOutput and was dropped
+	onLine    func(line []byte) (consumed bool)
+
+	stream *resultStream // Decoding the result line now being written
+	result *resultStream // The decoded result, while it's the last line
+	head   int           // Bytes of the result line buffered so far
+}
+
+// resultStream decodes a result line fed to it through a pipe.
+type resultStream struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	res  workerResult
+	err  error
+}
+
+func newResultStream() *resultStream {
+	pr, pw := io.Pipe()
+	s := &resultStream{pw: pw, done: make(chan struct{})}
+	go func() {
+		s.res, s.err = decodeResult(pr)
+		// Anything after the object is ignored, and this unblocks writes
+		// once decoding stopped early on an error
+		_ = pr.Close()
+		close(s.done)
+	}()
+	return s
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		if w.stream != nil {
+			w.feedResult(chunk)
+		} else {
+			w.pending = append(w.pending, chunk...)
+			if resultStart.Match(w.pending) {
+				w.stream = newResultStream()
+				w.head = 0
+				w.feedResult(w.pending)
+				w.pending = w.pending[:0]
+			}
+		}
+		if i < 0 {
+			break
+		}
+		if w.stream != nil {
+			w.endResult()
+		} else {
+			w.endLine()
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// endLine hands the complete line in pending to onLine, buffering it unless
+// consumed.
+func (w *lineWriter) endLine() {
+	line := bytes.TrimSpace(w.pending)
+	if len(line) == 0 || !w.onLine(line) {
+		if len(line) > 0 {
+			w.last = append(w.last[:0], line...)
+			w.result = nil
+		}
+		w.buffer(append(w.pending, '\n'))
+	}
+	w.pending = w.pending[:0]
+}
+
+// feedResult passes part of the result line to its decoder.
+func (w *lineWriter) feedResult(p []byte) {
+	if keep := min(len(p), maxRawOutput-w.head); keep > 0 {
+		w.buffer(p[:keep])
+		w.last = append(w.last[:w.head], p[:keep]...)
+		w.head += keep
+	}
+	// Fails only once the decoder has stopped, which then needs no more
+	_, _ = w.stream.pw.Write(p)
+}
+
+// endResult finishes the result line, waiting for its decoder.
+func (w *lineWriter) endResult() {
+	_ = w.stream.pw.Close()
+	<-w.stream.done
+	w.buffer([]byte{'\n'})
+	w.result, w.stream = w.stream, nil
+}
+
+// buffer keeps p for Bytes, unless the output has passed maxBufferedOutput.
+func (w *lineWriter) buffer(p []byte) {
+	if !w.truncated && w.buf.Len()+len(p) > maxBufferedOutput {
+		w.truncated = true
+		w.buf = bytes.Buffer{}
+	}
+	if !w.truncated {
+		w.buf.Write(p)
+	}
+}
+
+// Close finishes a result line the worker left unterminated. Call it once
+// the worker has exited.
+func (w *lineWriter) Close() error {
+	if w.stream != nil {
+		w.endResult()
+	}
+	return nil
+}
+
+// Result returns the worker's result: the streamed result line if nothing
+// but consumed lines followed it, otherwise whatever finalOutput finds in
+// the buffered output.
+func (w *lineWriter) Result() (workerResult, error) {
+	if w.result != nil {
+		return w.result.res, w.result.err
+	}
+	return decodeResult(bytes.NewReader(finalOutput(w.Bytes())))
+}
+
+// Bytes returns the unconsumed output, including any unterminated last line.
+// Once the output has passed maxBufferedOutput, that's just the last line.
+func (w *lineWriter) Bytes() []byte {
+	if w.truncated {
+		if len(bytes.TrimSpace(w.pending)) > 0 {
+			return w.pending
+		}
+		return w.last
+	}
+	return append(w.buf.Bytes(), w.pending...)
+}
+
+// checkAssertions verifies a successful result against the task's expected-
+// result assertions. The regex was validated at submit time.
+func checkAssertions(req TaskRequestSafe, result string) error {
+	if req.AssertContains != "" && !strings.Contains(result, req.AssertContains) {
+		return fmt.Errorf("assertion failed: result does not contain %q", req.AssertContains)
+	}
+	if req.AssertRegex != "" {
+		re, err := regexp.Compile(req.AssertRegex)
+		if err != nil {
+			return fmt.Errorf("assertion failed: invalid assert_regex: %v", err)
+		}
+		if !re.MatchString(result) {
+			return fmt.Errorf("assertion failed: result does not match %q", req.AssertRegex)
+		}
+	}
+	return nil
+}
+
+// cachedResult returns an unexpired cached result for a cacheable request.
+// Conditional tasks always run. Must be called with mu held.
+func (q *Queue) cachedResult(req TaskRequestSafe) (cacheEntry, bool) {
+	if !req.Cacheable || req.RunIf != nil {
+		return cacheEntry{}, false
+	}
+	key := requestHash(req)
+	entry, ok := q.cache[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(q.cache, key)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// requestHash identifies requests that would do the same work.
+func requestHash(req TaskRequestSafe) string {
+	req.RunIf = nil
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 // removePendingOrder removes an id from pendingOrder slice.
 // Must be called with mu held.
 func (q *Queue) removePendingOrder(id string) {
-	for i, taskID := range q.pendingOrder {
-		if taskID == id {
-			q.pendingOrder = append(q.pendingOrder[:i], q.pendingOrder[i+1:]...)
-			return
+	q.pendingOrder = removeID(q.pendingOrder, id)
+	q.recordPositions()
+	q.space.Broadcast()
+}
+
+// recordPositions appends a snapshot for every queued task whose position
+// changed since its last snapshot. Must be called with mu held.
+func (q *Queue) recordPositions() {
+	now := time.Now()
+	for i, id := range q.pendingOrder {
+		task := q.tasks[id]
+		if task == nil {
+			continue
+		}
+		pos := i + 1
+		if n := len(task.PositionHistory); n > 0 && task.PositionHistory[n-1].Position == pos {
+			continue
+		}
+		task.PositionHistory = append(task.PositionHistory, PositionSnapshot{Position: pos, At: now})
+	}
+}
+
+// releaseWaiting resolves waiting tasks whose run_if dependency has finished:
+// matching tasks move to queued, the rest are skipped, counted and notified
+// like any other finished task. Skipping can finish another task's
+// dependency, so it repeats until nothing changes.
+// Must be called with mu held.
+func (q *Queue) releaseWaiting() {
+	for changed := true; changed; {
+		changed = false
+		for _, id := range q.waiting {
+			task := q.tasks[id]
+			dep := q.tasks[task.Request.RunIf.TaskID]
+			if dep != nil && !isTerminal(dep.Status) {
+				continue
+			}
+			q.waiting = removeID(q.waiting, id)
+			changed = true
+			if dep != nil && conditionMet(task.Request.RunIf.Condition, dep) {
+				task.Status = "queued"
+				q.push(id)
+			} else {
+				task.Status = "skipped"
+				task.FinishedAt = time.Now()
+				task.setFailure(FailureSkipped)
+				if dep == nil {
+					task.SkipReason = "run_if task " + task.Request.RunIf.TaskID + " no longer exists"
+				} else {
+					task.SkipReason = "run_if " + task.Request.RunIf.Condition + " not met: task " + dep.ID + " finished as " + dep.Status
+				}
+				taskLog(id).Infof("Skipped: %s", task.SkipReason)
+				q.metrics.finish(task)
+				q.deliver(completionEvent(task)) // Doesn't block, so mu may be held
+			}
+			break // q.waiting changed; restart the scan
+		}
+	}
+}
+
+// push queues a task behind those of equal or higher priority and ahead of
+// the rest, then wakes a worker. A jump_queue task goes to the very front,
+// and other tasks stay behind every jump_queue task. Must be called with mu
+// held.
+func (q *Queue) push(id string) {
+	i := 0
+	if req := q.tasks[id].Request; !req.JumpQueue {
+		i = sort.Search(len(q.pendingOrder), func(i int) bool {
+			other := q.tasks[q.pendingOrder[i]].Request
+			return !other.JumpQueue && other.Priority < req.Priority
+		})
+	}
+	q.pendingOrder = append(q.pendingOrder, "")
+	copy(q.pendingOrder[i+1:], q.pendingOrder[i:])
+	q.pendingOrder[i] = id
+	q.recordPositions()
+	q.ready.Signal()
+}
+
+// oldestLowPriority returns the queued task the drop-oldest policy gives up:
+// the oldest of those with the lowest priority. Must be called with mu held
+// and pendingOrder non-empty.
+func (q *Queue) oldestLowPriority() string {
+	lowest := q.tasks[q.pendingOrder[len(q.pendingOrder)-1]].Request.Priority
+	for _, id := range q.pendingOrder {
+		if q.tasks[id].Request.Priority == lowest {
+			return id
+		}
+	}
+	return q.pendingOrder[0]
+}
+
+func isTerminal(status string) bool {
+	switch status {
+	case "completed", "failed", "cancelled", "skipped":
+		return true
+	}
+	return false
+}
+
+// conditionMet reports whether a finished task satisfies a run_if condition.
+// "success" needs a completed, successful task; "failure" matches a failed
+// task or a completed but unsuccessful one; "completed" matches any outcome.
+func conditionMet(condition string, dep *Task) bool {
+	succeeded := dep.Status == "completed" && dep.Success
+	switch condition {
+	case "success":
+		return succeeded
+	case "failure":
+		return dep.Status == "failed" || (dep.Status == "completed" && !dep.Success)
+	case "completed":
+		return true
+	}
+	return false
+}
+
+func removeID(ids []string, id string) []string {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i], ids[i+1:]...)
 		}
 	}
+	return ids
 }
 
 func randomID() string {
 	b := make([]byte, 4)
 	if _, err := rand.Read(b); err != nil {
-		log.Printf("Failed to generate random ID: %v", err)
+		serverLog.Errorf("Failed to generate random ID: %v", err)
 	}
 	return hex.EncodeToString(b)
 }
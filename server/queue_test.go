@@ -1,13 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
 
 func TestQueueSubmit(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	req := TaskRequest{
 		Goal:     "test goal",
@@ -36,7 +49,7 @@ func TestQueueSubmit(t *testing.T) {
 }
 
 func TestQueueSubmitDefaults(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	req := TaskRequest{
 		Goal: "test",
@@ -58,7 +71,7 @@ func TestQueueSubmitDefaults(t *testing.T) {
 }
 
 func TestQueueGet(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	req := TaskRequest{Goal: "test"}
 	task := q.Submit(req, "key")
@@ -74,7 +87,7 @@ func TestQueueGet(t *testing.T) {
 }
 
 func TestQueueGetNotFound(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	got := q.Get("nonexistent")
 	if got != nil {
@@ -82,8 +95,28 @@ func TestQueueGetNotFound(t *testing.T) {
 	}
 }
 
+func TestQueueGetManyReturnsCopies(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+
+	got := q.GetMany([]string{task.ID, "nonexistent"})
+	if got[0] == nil || got[0].ID != task.ID {
+		t.Fatalf("expected %s first, got %+v", task.ID, got[0])
+	}
+	if got[1] != nil {
+		t.Errorf("expected nil for an unknown ID, got %+v", got[1])
+	}
+	if got[0] == q.Get(task.ID) {
+		t.Fatal("expected a copy, got the stored task")
+	}
+	got[0].Status = "completed"
+	if status := q.Get(task.ID).Status; status != "queued" {
+		t.Errorf("expected the stored task untouched, got status %q", status)
+	}
+}
+
 func TestQueueAll(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	q.Submit(TaskRequest{Goal: "test1"}, "key1")
 	q.Submit(TaskRequest{Goal: "test2"}, "key2")
@@ -96,21 +129,43 @@ func TestQueueAll(t *testing.T) {
 }
 
 func TestQueueSize(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	if q.Size() != 0 {
 		t.Errorf("expected size 0, got %d", q.Size())
 	}
 
 	q.Submit(TaskRequest{Goal: "test"}, "key")
-	// Size reflects pending channel
+	// Size counts queued tasks
 	if q.Size() != 1 {
 		t.Errorf("expected size 1, got %d", q.Size())
 	}
 }
 
+func TestQueueSizeCountsQueuedOnly(t *testing.T) {
+	q := NewQueue(writeWorker(t, "import time\ntime.sleep(30)\n"), 1)
+	running := q.Submit(TaskRequest{Goal: "running"}, "key")
+	go q.Run()
+	defer q.Clear()
+	waitForStatus(t, q, running.ID, "running")
+	first := q.Submit(TaskRequest{Goal: "first"}, "key")
+	second := q.Submit(TaskRequest{Goal: "second"}, "key")
+
+	if got := q.Size(); got != 2 {
+		t.Errorf("expected size 2 with one running and two queued, got %d", got)
+	}
+	for want, id := range []string{running.ID, first.ID, second.ID} {
+		if got := q.Position(id); got != want {
+			t.Errorf("expected position %d for %s, got %d", want, id, got)
+		}
+	}
+	if info := q.Info(second.ID); info.Size != 2 || info.Position != 2 {
+		t.Errorf("expected size 2 and position 2, got %+v", info)
+	}
+}
+
 func TestQueueCancelQueued(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	task := q.Submit(TaskRequest{Goal: "test"}, "key")
 
@@ -129,7 +184,7 @@ func TestQueueCancelQueued(t *testing.T) {
 }
 
 func TestQueueCancelNotFound(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	if q.Cancel("nonexistent") {
 		t.Error("expected Cancel to fail for nonexistent task")
@@ -137,7 +192,7 @@ func TestQueueCancelNotFound(t *testing.T) {
 }
 
 func TestQueueClear(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	q.Submit(TaskRequest{Goal: "test1"}, "key1")
 	q.Submit(TaskRequest{Goal: "test2"}, "key2")
@@ -152,28 +207,61 @@ func TestQueueClear(t *testing.T) {
 	}
 }
 
-func TestQueueCurrent(t *testing.T) {
-	q := NewQueue("./worker.py")
+func TestQueueRunning(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+
+	if running := q.Running(); len(running) != 0 {
+		t.Errorf("expected no running tasks initially, got %v", running)
+	}
+}
+
+func TestQueueConcurrency(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(1)
+print(json.dumps({"ok": True, "success": True, "reason": "done"}))
+`)
+	q := NewQueue(worker, 2)
+	go q.Run()
+
+	first := q.Submit(TaskRequest{Goal: "first"}, "key")
+	second := q.Submit(TaskRequest{Goal: "second"}, "key")
+	third := q.Submit(TaskRequest{Goal: "third"}, "key")
+	waitForStatus(t, q, first.ID, "running")
+	waitForStatus(t, q, second.ID, "running")
+
+	if running := q.Running(); len(running) != 2 {
+		t.Fatalf("expected 2 running tasks, got %v", running)
+	}
+	if pos := q.Position(third.ID); pos != 1 {
+		t.Errorf("expected the waiting task at position 1, got %d", pos)
+	}
 
-	if q.Current() != "" {
-		t.Error("expected Current to be empty initially")
+	// Cancelling one running task must leave the other alone
+	if !q.Cancel(second.ID) {
+		t.Fatal("expected Cancel to succeed")
 	}
+	waitForStatus(t, q, third.ID, "running")
+	if got := waitForStatus(t, q, first.ID, "completed", "failed"); got.Status != "completed" {
+		t.Errorf("expected the other running task to complete, got %s", got.Status)
+	}
+	waitForStatus(t, q, third.ID, "completed")
 }
 
 func TestQueuePosition(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	task := q.Submit(TaskRequest{Goal: "test"}, "key")
 	pos := q.Position(task.ID)
 
-	// Position returns Size(), so with 1 pending task it should be 1
+	// The only queued task is first in line
 	if pos != 1 {
 		t.Errorf("expected position 1, got %d", pos)
 	}
 }
 
 func TestTaskJSONDoesNotIncludeAPIKey(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	task := q.Submit(TaskRequest{
 		Goal:     "test",
@@ -196,8 +284,46 @@ func TestTaskJSONDoesNotIncludeAPIKey(t *testing.T) {
 	}
 }
 
+func TestTaskJSONDurations(t *testing.T) {
+	created := time.Date(2025, 1, 28, 10, 0, 0, 0, time.UTC)
+	task := Task{ID: "t1", Status: "queued", CreatedAt: created}
+
+	durations := func() map[string]any {
+		t.Helper()
+		data, err := json.Marshal(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]any
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["id"] != "t1" {
+			t.Errorf("expected the task's own fields too, got %v", got)
+		}
+		return map[string]any{"wait": got["wait_ms"], "run": got["run_duration_ms"]}
+	}
+
+	if got := durations(); got["wait"] != nil || got["run"] != nil {
+		t.Errorf("expected no durations while queued, got %v", got)
+	}
+
+	task.Status = "running"
+	task.StartedAt = created.Add(1500 * time.Millisecond)
+	task.WaitMs = 1500
+	if got := durations(); got["wait"] != 1500.0 || got["run"] != nil {
+		t.Errorf("expected only the wait while running, got %v", got)
+	}
+
+	task.Status = "completed"
+	task.FinishedAt = task.StartedAt.Add(42*time.Second + 250*time.Millisecond)
+	if got := durations(); got["wait"] != 1500.0 || got["run"] != 42250.0 {
+		t.Errorf("expected wait 1500 and run 42250, got %v", got)
+	}
+}
+
 func TestTaskRequestSafeFields(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	task := q.Submit(TaskRequest{
 		Goal:      "test goal",
@@ -272,7 +398,7 @@ func TestTruncate(t *testing.T) {
 }
 
 func TestTaskTimestamps(t *testing.T) {
-	q := NewQueue("./worker.py")
+	q := NewQueue("./worker.py", 1)
 
 	before := time.Now()
 	task := q.Submit(TaskRequest{Goal: "test"}, "key")
@@ -291,6 +417,304 @@ func TestTaskTimestamps(t *testing.T) {
 	}
 }
 
+func TestRunIfSkipOnFailure(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	go q.Run()
+
+	first := q.Submit(TaskRequest{Goal: "fail"}, "key")
+	onSuccess := q.Submit(TaskRequest{Goal: "ok", RunIf: &RunCondition{TaskID: first.ID, Condition: "success"}}, "key")
+	onFailure := q.Submit(TaskRequest{Goal: "ok", RunIf: &RunCondition{TaskID: first.ID, Condition: "failure"}}, "key")
+	// Depends on a task that will be skipped
+	chained := q.Submit(TaskRequest{Goal: "ok", RunIf: &RunCondition{TaskID: onSuccess.ID, Condition: "completed"}}, "key")
+
+	waitForStatus(t, q, first.ID, "failed")
+
+	got := waitForStatus(t, q, onSuccess.ID, "skipped")
+	if got.SkipReason == "" {
+		t.Error("expected skip reason to be set")
+	}
+	if got.FinishedAt.IsZero() {
+		t.Error("expected FinishedAt to be set for skipped task")
+	}
+
+	if got := waitForStatus(t, q, onFailure.ID, "completed"); !got.Success {
+		t.Errorf("expected run_if failure task to run successfully, got %+v", got)
+	}
+
+	// "completed" matches any outcome, including skipped
+	waitForStatus(t, q, chained.ID, "completed")
+}
+
+func TestRunIfHeldUntilDependencyFinishes(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+
+	first := q.Submit(TaskRequest{Goal: "first"}, "key")
+	second := q.Submit(TaskRequest{Goal: "second", RunIf: &RunCondition{TaskID: first.ID, Condition: "completed"}}, "key")
+
+	if second.Status != "waiting" {
+		t.Errorf("expected status 'waiting', got %q", second.Status)
+	}
+	if q.Position(second.ID) != -1 {
+		t.Errorf("waiting task should not have a queue position, got %d", q.Position(second.ID))
+	}
+
+	// Cancelling the dependency releases the waiting task
+	q.Cancel(first.ID)
+	if second.Status != "queued" {
+		t.Errorf("expected status 'queued' after dependency finished, got %q", second.Status)
+	}
+}
+
+func TestCacheableResultReused(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	go q.Run()
+
+	req := TaskRequest{Goal: "check if logged in", Cacheable: true}
+	first := q.Submit(req, "key")
+	waitForStatus(t, q, first.ID, "completed")
+
+	second := q.Submit(req, "key")
+	if second.Status != "completed" || !second.Success {
+		t.Fatalf("expected cached task to complete immediately, got status %q", second.Status)
+	}
+	if second.ServedFromCache != first.ID {
+		t.Errorf("expected served_from_cache %q, got %q", first.ID, second.ServedFromCache)
+	}
+	if second.Result != "check if logged in" {
+		t.Errorf("expected cached result, got %q", second.Result)
+	}
+
+	// Non-cacheable and differing requests run normally
+	if got := q.Submit(TaskRequest{Goal: "check if logged in"}, "key"); got.ServedFromCache != "" {
+		t.Error("non-cacheable request should not be served from cache")
+	}
+	if got := q.Submit(TaskRequest{Goal: "something else", Cacheable: true}, "key"); got.ServedFromCache != "" {
+		t.Error("different request should not be served from cache")
+	}
+}
+
+func TestCacheableFailureNotCached(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	go q.Run()
+
+	first := q.Submit(TaskRequest{Goal: "fail", Cacheable: true}, "key")
+	waitForStatus(t, q, first.ID, "failed")
+
+	if second := q.Submit(TaskRequest{Goal: "fail", Cacheable: true}, "key"); second.ServedFromCache != "" {
+		t.Error("failed results should not be cached")
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.cacheTTL = time.Millisecond
+
+	req := TaskRequestSafe{Goal: "test", Cacheable: true}
+	q.cache[requestHash(req)] = cacheEntry{taskID: "old", expires: time.Now().Add(-time.Second)}
+
+	if _, ok := q.cachedResult(req); ok {
+		t.Error("expected expired cache entry to be ignored")
+	}
+	if len(q.cache) != 0 {
+		t.Error("expected expired cache entry to be removed")
+	}
+}
+
+func TestWorkerOutputRedacted(t *testing.T) {
+	worker := writeWorker(t, `
+import json, sys
+print("calling API with Bearer abcdefghijklmnop123 and key my-literal-key", file=sys.stderr)
+print("custom secret: ZZZ-9999", file=sys.stderr)
+print(json.dumps({"ok": True, "success": True, "reason": "got token sk-abcdefghijklmnopqrstuvwx"}))
+`)
+	q := NewQueue(worker, 1)
+	extra, err := compileRedactPatterns([]string{`ZZZ-\d+`})
+	if err != nil {
+		t.Fatalf("compileRedactPatterns: %v", err)
+	}
+	q.redactors = append(q.redactors, extra...)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "my-literal-key")
+	got := waitForStatus(t, q, task.ID, "completed")
+
+	for _, secret := range []string{"abcdefghijklmnop123", "my-literal-key", "ZZZ-9999", "sk-abcdefghijklmnopqrstuvwx"} {
+		if contains(got.Logs, secret) || contains(got.Result, secret) {
+			t.Errorf("secret %q was not redacted (logs: %q, result: %q)", secret, got.Logs, got.Result)
+		}
+	}
+	if !contains(got.Logs, "calling API with") || !contains(got.Result, "got token ***") {
+		t.Errorf("expected surrounding text to be kept (logs: %q, result: %q)", got.Logs, got.Result)
+	}
+}
+
+func TestDebugLogsWorkerCommand(t *testing.T) {
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	q.debug = true
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "secret-api-key")
+	waitForStatus(t, q, task.ID, "completed")
+
+	want := describeCmd(q.workerCommand(q.workerPath))
+	if !contains(buf.String(), "["+task.ID+"] Worker command: "+want) {
+		t.Errorf("expected log to contain worker command %q, got:\n%s", want, buf.String())
+	}
+	if contains(buf.String(), "secret-api-key") {
+		t.Error("API key must not be logged")
+	}
+}
+
+func TestWorkerCommandConfigurable(t *testing.T) {
+	dir := t.TempDir()
+	// A stub that answers with the arguments it was run with
+	stub := filepath.Join(dir, "stub.sh")
+	script := `#!/bin/sh
+cat > /dev/null
+printf '{"ok": true, "success": true, "reason": "%s"}\n' "$*"
+`
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// An executable worker runs directly, with -worker-arg after its path
+	q := NewQueue(stub, 1)
+	q.workerArgs = []string{"--device", "emulator-5554"}
+	if got := q.workerCommand(stub).Args; strings.Join(got, " ") != stub+" --device emulator-5554" {
+		t.Errorf("unexpected command for an executable worker: %q", got)
+	}
+	go q.Run()
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	if got := waitForStatus(t, q, task.ID, "completed", "failed"); got.Result != "--device emulator-5554" {
+		t.Errorf("expected the stub to get the extra args, got %s %q (%s)", got.Status, got.Result, got.Error)
+	}
+
+	// A .py worker goes through -worker-cmd, whose own args come first
+	q = NewQueue(filepath.Join(dir, "worker.py"), 1)
+	q.workerCmd = []string{stub, "-u"}
+	q.workerArgs = []string{"--verbose"}
+	go q.Run()
+	task = q.Submit(TaskRequest{Goal: "test"}, "key")
+	want := "-u " + filepath.Join(dir, "worker.py") + " --verbose"
+	if got := waitForStatus(t, q, task.ID, "completed", "failed"); got.Result != want {
+		t.Errorf("expected interpreter args %q, got %s %q (%s)", want, got.Status, got.Result, got.Error)
+	}
+}
+
+func TestDescribeCmd(t *testing.T) {
+	cmd := exec.Command("python3", "/opt/my worker/worker.py", "--flag")
+	cmd.Dir = "/srv"
+	cmd.Env = []string{"HOME=/tmp/home", "GOOGLE_API_KEY=secret"}
+
+	got := describeCmd(cmd)
+	want := cmd.Path + ` "/opt/my worker/worker.py" --flag (dir: /srv, env: [HOME GOOGLE_API_KEY])`
+	if got != want {
+		t.Errorf("describeCmd = %q, want %q", got, want)
+	}
+	if contains(got, "secret") {
+		t.Error("env values must not be included")
+	}
+}
+
+func TestResultAssertions(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	go q.Run()
+
+	tests := []struct {
+		name        string
+		req         TaskRequest
+		wantSuccess bool
+		wantError   string
+	}{
+		{"contains passes", TaskRequest{Goal: "logged in as alice", AssertContains: "alice"}, true, ""},
+		{"contains fails", TaskRequest{Goal: "logged out", AssertContains: "alice"}, false, "does not contain"},
+		{"regex passes", TaskRequest{Goal: "3 unread messages", AssertRegex: `^\d+ unread`}, true, ""},
+		{"regex fails", TaskRequest{Goal: "no messages", AssertRegex: `^\d+ unread`}, false, "does not match"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := q.Submit(tt.req, "key")
+			got := waitForStatus(t, q, task.ID, "completed", "failed")
+			if got.Status != "completed" {
+				t.Fatalf("expected status 'completed', got %q", got.Status)
+			}
+			if got.Success != tt.wantSuccess {
+				t.Errorf("expected success=%v, got %v", tt.wantSuccess, got.Success)
+			}
+			if tt.wantError == "" && got.Error != "" {
+				t.Errorf("expected no error, got %q", got.Error)
+			}
+			if tt.wantError != "" && !contains(got.Error, tt.wantError) {
+				t.Errorf("expected error containing %q, got %q", tt.wantError, got.Error)
+			}
+		})
+	}
+}
+
+// goalWorker is a fake worker that fails when the goal is "fail" and
+// otherwise succeeds, echoing the goal back as the result.
+const goalWorker = `
+import json, sys
+task = json.load(sys.stdin)
+if task["goal"] == "fail":
+    print("worker failed", file=sys.stderr)
+    sys.exit(1)
+print(json.dumps({"ok": True, "success": True, "reason": task["goal"]}))
+`
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes and reads.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// writeWorker writes a fake Python worker script and returns its path.
+func writeWorker(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "worker.py")
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatalf("failed to write worker: %v", err)
+	}
+	return path
+}
+
+// waitForStatus waits until a task reaches one of the given statuses and
+// returns a snapshot of it.
+func waitForStatus(t *testing.T, q *Queue, id string, statuses ...string) Task {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		q.mu.RLock()
+		task := *q.tasks[id]
+		q.mu.RUnlock()
+		for _, s := range statuses {
+			if task.Status == s {
+				return task
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("task %s did not reach status %v", id, statuses)
+	return Task{}
+}
+
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(s) > 0 && containsHelper(s, substr))
 }
@@ -303,3 +727,1110 @@ func containsHelper(s, substr string) bool {
 	}
 	return false
 }
+
+func TestTrySubmitRejectWhenFull(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.maxQueue = 2
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.TrySubmit(context.Background(), TaskRequest{Goal: "test"}, "key"); err != nil {
+			t.Fatalf("submit %d: unexpected error %v", i, err)
+		}
+	}
+	if _, err := q.TrySubmit(context.Background(), TaskRequest{Goal: "test"}, "key"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	if n := len(q.All()); n != 2 {
+		t.Errorf("rejected task should not be stored, got %d tasks", n)
+	}
+
+	// Submit itself stays unlimited
+	q.Submit(TaskRequest{Goal: "test"}, "key")
+	if n := q.Size(); n != 3 {
+		t.Errorf("expected Submit to bypass the limit, got size %d", n)
+	}
+}
+
+func TestTrySubmitBlockWaitsForRoom(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.maxQueue = 1
+	q.onFull = OnFullBlock
+
+	first, err := q.TrySubmit(context.Background(), TaskRequest{Goal: "first"}, "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan *Task)
+	go func() {
+		task, err := q.TrySubmit(context.Background(), TaskRequest{Goal: "second"}, "key")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		done <- task
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected TrySubmit to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Cancel(first.ID)
+	select {
+	case task := <-done:
+		if task == nil || task.Request.Goal != "second" {
+			t.Fatalf("expected the blocked task to be queued, got %+v", task)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TrySubmit did not unblock after room was made")
+	}
+}
+
+func TestTrySubmitBlockHonorsContext(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.maxQueue = 1
+	q.onFull = OnFullBlock
+	q.Submit(TaskRequest{Goal: "first"}, "key")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := q.TrySubmit(ctx, TaskRequest{Goal: "second"}, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if n := len(q.All()); n != 1 {
+		t.Errorf("abandoned task should not be stored, got %d tasks", n)
+	}
+}
+
+func TestTrySubmitDropOldest(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	q.maxQueue = 2
+	q.onFull = OnFullDropOldest
+
+	oldest := q.Submit(TaskRequest{Goal: "oldest"}, "key")
+	second := q.Submit(TaskRequest{Goal: "second"}, "key")
+	newest, err := q.TrySubmit(context.Background(), TaskRequest{Goal: "newest"}, "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := q.Get(oldest.ID)
+	if got.Status != "cancelled" {
+		t.Errorf("expected oldest task to be cancelled, got %q", got.Status)
+	}
+	if !contains(got.Error, "full queue") {
+		t.Errorf("expected drop reason in error, got %q", got.Error)
+	}
+	if pos := q.Position(second.ID); pos != 1 {
+		t.Errorf("expected second task at position 1, got %d", pos)
+	}
+	if pos := q.Position(newest.ID); pos != 2 {
+		t.Errorf("expected newest task at position 2, got %d", pos)
+	}
+}
+
+func TestTaskWaitRecordedWhenStarted(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "ok"}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+
+	if got.WaitMs != got.StartedAt.Sub(got.CreatedAt).Milliseconds() {
+		t.Errorf("expected wait_ms to match StartedAt-CreatedAt, got %d", got.WaitMs)
+	}
+	n := len(got.PositionHistory)
+	if got.SubmitPosition != 1 || n != 2 || got.PositionHistory[n-1].Position != 0 {
+		t.Errorf("expected submit position 1 and history ending at 0, got %d %+v", got.SubmitPosition, got.PositionHistory)
+	}
+}
+
+func TestRetryBudgetExhausted(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	q.retryBudget = 2
+	go q.Run()
+
+	// Each failing task is allowed 3 retries, but only 2 fit in the budget
+	first := q.Submit(TaskRequest{Goal: "fail", MaxRetries: 3}, "key")
+	got := waitForStatus(t, q, first.ID, "failed")
+	if got.Retries != 2 {
+		t.Errorf("expected 2 retries before the budget ran out, got %d", got.Retries)
+	}
+	if !contains(got.Error, "retry budget exhausted") {
+		t.Errorf("expected budget error, got %q", got.Error)
+	}
+	if n := q.RetryBudgetRemaining(); n != 0 {
+		t.Errorf("expected no budget remaining, got %d", n)
+	}
+
+	second := q.Submit(TaskRequest{Goal: "fail", MaxRetries: 3}, "key")
+	got = waitForStatus(t, q, second.ID, "failed")
+	if got.Retries != 0 {
+		t.Errorf("expected retries to be skipped once the budget is exhausted, got %d", got.Retries)
+	}
+
+	// A new window restores the budget
+	q.mu.Lock()
+	q.retryWindow = time.Now().Add(-time.Minute)
+	q.mu.Unlock()
+	if n := q.RetryBudgetRemaining(); n != 2 {
+		t.Errorf("expected budget to reset after the window, got %d", n)
+	}
+}
+
+func TestRetryCategories(t *testing.T) {
+	q := NewQueue(writeWorker(t, `
+import json, sys
+task = json.load(sys.stdin)
+print(json.dumps({"ok": False, "error": task["goal"]}))
+`), 1)
+	q.retryCategories = map[string]bool{ErrorRateLimited: true, ErrorProvider: true}
+	go q.Run()
+
+	limited := q.Submit(TaskRequest{Goal: "429 Too Many Requests", MaxRetries: 2}, "key")
+	if got := waitForStatus(t, q, limited.ID, "failed"); got.Retries != 2 || got.ErrorCategory != ErrorRateLimited {
+		t.Errorf("expected a rate-limited failure to use its retries, got %d retries (%s)", got.Retries, got.ErrorCategory)
+	}
+	// Not "key", which would be masked in the error as the task's own API key
+	denied := q.Submit(TaskRequest{Goal: "Incorrect API key provided", MaxRetries: 2}, "llm-secret")
+	if got := waitForStatus(t, q, denied.ID, "failed"); got.Retries != 0 || got.ErrorCategory != ErrorAuthInvalid {
+		t.Errorf("expected an auth failure to fail at once, got %d retries (%s)", got.Retries, got.ErrorCategory)
+	}
+}
+
+func TestRetrySucceedsWithinMaxRetries(t *testing.T) {
+	// Fails on the first attempt, succeeds on the next
+	worker := writeWorker(t, `import json, os, sys
+json.load(sys.stdin)
+marker = os.path.join(os.path.dirname(os.path.abspath(__file__)), "attempted")
+if not os.path.exists(marker):
+    open(marker, "w").close()
+    print(json.dumps({"ok": False, "error": "flaky"}))
+else:
+    print(json.dumps({"ok": True, "success": True, "reason": "done", "steps": 1}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test", MaxRetries: 1}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "completed" || got.Retries != 1 {
+		t.Errorf("expected completion after 1 retry, got %s with %d retries", got.Status, got.Retries)
+	}
+	if got.Error != "" {
+		t.Errorf("expected error from the failed attempt to be cleared, got %q", got.Error)
+	}
+}
+
+func TestClearWhileRetryableTaskRuns(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(30)
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test", MaxRetries: 2}, "key")
+	waitForStatus(t, q, task.ID, "running")
+	q.Clear()
+
+	// The killed worker must neither crash the queue nor come back as a retry
+	deadline := time.Now().Add(10 * time.Second)
+	for len(q.Running()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if len(q.running) != 0 || len(q.pendingOrder) != 0 || len(q.tasks) != 0 {
+		t.Errorf("expected nothing left after the clear, got %d running, %d queued, %d tasks", len(q.running), len(q.pendingOrder), len(q.tasks))
+	}
+}
+
+func TestRetrySkipsReplacedTask(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(30)
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test", MaxRetries: 2}, "key")
+	waitForStatus(t, q, task.ID, "running")
+	var cmd *exec.Cmd
+	for deadline := time.Now().Add(10 * time.Second); cmd == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		q.mu.RLock()
+		cmd = q.running[task.ID]
+		q.mu.RUnlock()
+	}
+	if cmd == nil {
+		t.Fatal("worker never started")
+	}
+
+	// Another task takes the ID while the worker runs, then the worker fails:
+	// process must leave it alone rather than retry it
+	q.mu.Lock()
+	q.tasks[task.ID] = &Task{ID: task.ID, Status: "completed"}
+	q.mu.Unlock()
+	_ = cmd.Process.Kill()
+
+	for deadline := time.Now().Add(10 * time.Second); len(q.Running()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if len(q.pendingOrder) != 0 || q.tasks[task.ID].Status != "completed" {
+		t.Errorf("expected the failed worker's task not to be retried, got queue %v and status %s", q.pendingOrder, q.tasks[task.ID].Status)
+	}
+}
+
+func TestTaskTimeoutCounted(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(10)
+print(json.dumps({"ok": True, "success": True, "reason": "too late"}))
+`)
+	q := NewQueue(worker, 1)
+	q.taskTimeout = 200 * time.Millisecond
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "slow"}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "failed" || got.Error != "task exceeded timeout of 200ms" {
+		t.Errorf("expected timeout failure, got %s: %q", got.Status, got.Error)
+	}
+	if n := q.Timeouts(); n != 1 {
+		t.Errorf("expected 1 timeout, got %d", n)
+	}
+}
+
+func TestPerTaskTimeout(t *testing.T) {
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(10)
+print(json.dumps({"ok": True, "success": True, "reason": "too late"}))
+`)
+	q := NewQueue(worker, 1)
+	q.taskTimeout = time.Hour // The request's own timeout wins
+	go q.Run()
+
+	start := time.Now()
+	task := q.Submit(TaskRequest{Goal: "slow", TimeoutSeconds: 1}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "failed" || got.Error != "task exceeded timeout of 1s" || got.FailureKind != FailureTimeout {
+		t.Errorf("expected timeout failure, got %s/%s: %q", got.Status, got.FailureKind, got.Error)
+	}
+	if got.FinishedAt.IsZero() || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the worker killed after about 1s, finished at %v", got.FinishedAt)
+	}
+
+	// A timeout kill is logged as such, not as a cancellation
+	logs := buf.String()
+	if !contains(logs, "Timeout: killing worker after 1s") || contains(logs, "Cancelled") {
+		t.Errorf("expected a timeout log line, got:\n%s", logs)
+	}
+}
+
+func TestShutdownWaitsForWorker(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(0.5)
+print(json.dumps({"ok": True, "success": True, "reason": "done"}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "slow"}, "key")
+	waitForStatus(t, q, task.ID, "running")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+	if got := q.Get(task.ID); got.Status != "completed" {
+		t.Errorf("expected in-flight task to complete, got %s", got.Status)
+	}
+}
+
+func TestShutdownKillsSlowWorker(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+time.sleep(10)
+print(json.dumps({"ok": True, "success": True, "reason": "too late"}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	slow := q.Submit(TaskRequest{Goal: "slow"}, "key")
+	waitForStatus(t, q, slow.ID, "running")
+	next := q.Submit(TaskRequest{Goal: "next"}, "key")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := q.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s, expected it to stop at the deadline", elapsed)
+	}
+
+	got := waitForStatus(t, q, slow.ID, "completed", "failed")
+	if got.Status != "failed" {
+		t.Errorf("expected killed task to fail, got %s", got.Status)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := q.Get(next.ID); got.Status != "queued" {
+		t.Errorf("expected queued task not to start after shutdown, got %s", got.Status)
+	}
+}
+
+func TestPartialStepsKeptOnCancel(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+print(json.dumps({"step": 1, "action": "open app"}), flush=True)
+print(json.dumps({"step": 2, "action": "tap"}), flush=True)
+sys.stdout.write('{"step": 3, "act')
+sys.stdout.flush()
+time.sleep(10)
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	waitForStatus(t, q, task.ID, "running")
+	time.Sleep(500 * time.Millisecond) // Let the worker write its output
+	if !q.Cancel(task.ID) {
+		t.Fatal("expected Cancel to succeed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var steps []any
+	for time.Now().Before(deadline) && steps == nil {
+		time.Sleep(10 * time.Millisecond)
+		if got, _ := q.Snapshot(task.ID); got.Steps != nil {
+			steps, _ = got.Steps.([]any)
+		}
+	}
+	if len(steps) != 2 {
+		t.Fatalf("expected the 2 complete objects as partial steps, got %v", steps)
+	}
+	if step := steps[1].(map[string]any); step["action"] != "tap" {
+		t.Errorf("unexpected second step %v", step)
+	}
+	if got, _ := q.Snapshot(task.ID); got.Status != "cancelled" {
+		t.Errorf("expected task to stay cancelled, got %q", got.Status)
+	}
+}
+
+func TestStepLinesRecordedLive(t *testing.T) {
+	// Steps arrive one per line; the worker then crashes before its result
+	worker := writeWorker(t, `import json, sys, time
+json.load(sys.stdin)
+print(json.dumps({"step": 1, "action": "open app"}), flush=True)
+print(json.dumps({"output_tokens": 10}), flush=True)
+print(json.dumps({"step": 2, "action": "tap"}), flush=True)
+time.sleep(0.3)
+sys.exit(1)
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := q.Snapshot(task.ID)
+		if steps, _ := got.Steps.([]any); len(steps) == 2 {
+			if got.Status != "running" {
+				t.Fatalf("expected the steps while running, got them with status %s", got.Status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("steps never appeared while running, got %v (%s)", got.Steps, got.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := waitForStatus(t, q, task.ID, "failed")
+	steps, _ := got.Steps.([]any)
+	if len(steps) != 2 || steps[1].(map[string]any)["action"] != "tap" {
+		t.Errorf("expected the streamed steps kept after the crash, got %v", got.Steps)
+	}
+	if got.OutputTokens != 10 {
+		t.Errorf("expected the token count still tracked, got %d", got.OutputTokens)
+	}
+}
+
+func TestLineWriterBoundsOutput(t *testing.T) {
+	defer func(n int) { maxBufferedOutput = n }(maxBufferedOutput)
+	maxBufferedOutput = 64
+
+	w := &lineWriter{onLine: func([]byte) bool { return false }}
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(w, "noise line %d\n", i)
+	}
+	fmt.Fprintln(w, `{"ok": true, "success": true}`)
+	if got := string(w.Bytes()); got != `{"ok": true, "success": true}` {
+		t.Errorf("expected only the last line once over the cap, got %q", got)
+	}
+	if w.buf.Len() != 0 {
+		t.Errorf("expected the buffer dropped, still %d bytes", w.buf.Len())
+	}
+
+	// Under the cap everything is kept, as before
+	w = &lineWriter{onLine: func([]byte) bool { return false }}
+	fmt.Fprint(w, "{\n  \"ok\": true\n}")
+	if got := string(w.Bytes()); got != "{\n  \"ok\": true\n}" {
+		t.Errorf("expected the whole output, got %q", got)
+	}
+}
+
+func TestLineWriterStreamsResult(t *testing.T) {
+	var steps []string
+	for i := 0; i < 1000; i++ {
+		steps = append(steps, fmt.Sprintf(`{"action": "tap", "index": %d}`, i))
+	}
+	output := `{"ok": true, "success": true, "reason": "done", "steps": [` + strings.Join(steps, ", ") + "]}\n"
+
+	w := &lineWriter{onLine: func(line []byte) bool { return bytes.Contains(line, []byte("output_tokens")) }}
+	fmt.Fprintln(w, `{"output_tokens": 10}`)
+	for rest := output; rest != ""; {
+		n := min(len(rest), 100)
+		fmt.Fprint(w, rest[:n])
+		rest = rest[n:]
+	}
+	fmt.Fprintln(w, `{"output_tokens": 20}`)
+	res, err := w.Result()
+	if err != nil {
+		t.Fatalf("Result: %v", err)
+	}
+	if got, _ := res.Steps.([]any); !res.OK || !res.Success || res.Reason != "done" || len(got) != 1000 {
+		t.Errorf("unexpected result: ok=%v success=%v reason=%q steps=%d", res.OK, res.Success, res.Reason, len(got))
+	}
+	if got := len(w.Bytes()); got > maxRawOutput+1 {
+		t.Errorf("expected only the start of the result buffered, got %d bytes", got)
+	}
+
+	// A line after the result takes its place, as the last line always has
+	fmt.Fprintln(w, `{"ok": false, "error": "second thoughts"}`)
+	fmt.Fprintln(w, "done")
+	if _, err := w.Result(); err == nil {
+		t.Error("expected the trailing line to be decoded instead")
+	}
+
+	// An unterminated result is finished by Close
+	w = &lineWriter{onLine: func([]byte) bool { return false }}
+	fmt.Fprint(w, `{"ok": false, "error": "boom"}`)
+	w.Close()
+	if res, err := w.Result(); err != nil || res.OK || res.Error != "boom" {
+		t.Errorf("expected the unterminated result, got %+v (%v)", res, err)
+	}
+
+	// A truncated one is an error, with its start kept for raw_output
+	w = &lineWriter{onLine: func([]byte) bool { return false }}
+	fmt.Fprint(w, `{"ok": true, "steps": [{"a": `)
+	w.Close()
+	if _, err := w.Result(); err == nil {
+		t.Error("expected an error for a truncated result")
+	}
+	if got := string(w.Bytes()); !strings.HasPrefix(got, `{"ok": true`) {
+		t.Errorf("expected the result's start kept, got %q", got)
+	}
+}
+
+func TestCancelDuringLaunchAbortsCleanly(t *testing.T) {
+	// Mimics worker.py: SIGTERM while launching the app closes it first
+	worker := writeWorker(t, `import json, signal, sys, time
+json.load(sys.stdin)
+def abort(signum, frame):
+    print("closing app", file=sys.stderr, flush=True)
+    time.sleep(0.3)
+    print("app closed", file=sys.stderr, flush=True)
+    sys.exit(0)
+signal.signal(signal.SIGTERM, abort)
+print(json.dumps({"append_step": {"phase": "launch"}}), flush=True)
+time.sleep(10)
+`)
+	q := NewQueue(worker, 1)
+	q.cancelGrace = 5 * time.Second
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test", App: "com.example"}, "key")
+	waitForLaunch(t, q, task.ID)
+	if !q.Cancel(task.ID) {
+		t.Fatal("expected Cancel to succeed")
+	}
+	waitForIdle(t, q)
+	if got := waitForStatus(t, q, task.ID, "cancelled"); !contains(got.Logs, "app closed") {
+		t.Errorf("expected the worker to finish closing the app, logs: %q", got.Logs)
+	}
+}
+
+func TestRealWorkerAbortsLaunchOnSIGTERM(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not available")
+	}
+	worker, err := filepath.Abs("../worker.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake adb that logs its arguments and hangs on the app launch
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	adb := "#!/bin/sh\necho \"$*\" >> " + calls + "\ncase \"$*\" in *monkey*) sleep 10;; esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "adb"), []byte(adb), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(python, "-u", worker)
+	cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	cmd.Stdin = strings.NewReader(`{"goal": "test", "app": "com.example"}` + "\n")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if data, _ := os.ReadFile(calls); strings.Contains(string(data), "monkey") {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatal("worker never started launching the app")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+
+	if !strings.Contains(stdout.String(), "cancelled during app launch") {
+		t.Errorf("expected the launch to be aborted, got %q", stdout.String())
+	}
+	if data, _ := os.ReadFile(calls); !strings.Contains(string(data), "force-stop com.example") {
+		t.Errorf("expected the app to be closed, adb calls: %q", data)
+	}
+}
+
+func TestCancelKillsWorkerIgnoringSIGTERM(t *testing.T) {
+	worker := writeWorker(t, `import json, signal, sys, time
+json.load(sys.stdin)
+signal.signal(signal.SIGTERM, signal.SIG_IGN)
+print(json.dumps({"append_step": {"phase": "launch"}}), flush=True)
+time.sleep(10)
+`)
+	q := NewQueue(worker, 1)
+	q.cancelGrace = 200 * time.Millisecond
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	waitForLaunch(t, q, task.ID)
+	start := time.Now()
+	q.Cancel(task.ID)
+	waitForIdle(t, q)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("worker outlived the cancel grace: %s", elapsed)
+	}
+}
+
+// waitForLaunch waits until the worker has streamed its first step.
+func waitForLaunch(t *testing.T, q *Queue, id string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		q.mu.RLock()
+		steps := q.tasks[id].Steps
+		q.mu.RUnlock()
+		if steps != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("task %s never started launching", id)
+}
+
+// waitForIdle waits until no worker is running.
+func waitForIdle(t *testing.T, q *Queue) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(q.Running()) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("worker still running")
+}
+
+func TestPartialSteps(t *testing.T) {
+	out := []byte("{\"step\":1}\nnot json\n\n{\"step\":2}\n{\"step\":3,\"trunc")
+	if n := len(partialSteps(out)); n != 2 {
+		t.Errorf("expected 2 complete objects, got %d", n)
+	}
+	if steps := partialSteps(nil); steps != nil {
+		t.Errorf("expected no steps for empty output, got %v", steps)
+	}
+}
+
+func TestDecodeResult(t *testing.T) {
+	res, err := decodeResult(strings.NewReader(`{"ok": true, "success": true, "reason": "done", "extra": {"x": [1]}, "steps": [{"action": "tap"}, "b"]}`))
+	if err != nil {
+		t.Fatalf("decodeResult: %v", err)
+	}
+	steps, _ := res.Steps.([]any)
+	if !res.OK || !res.Success || res.Reason != "done" || len(steps) != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if out, _ := json.Marshal(steps); string(out) != `[{"action":"tap"},"b"]` {
+		t.Errorf("steps changed in decoding: %s", out)
+	}
+
+	// Not every worker sends an array
+	if res, err := decodeResult(strings.NewReader(`{"ok": true, "steps": 12}`)); err != nil || res.Steps != float64(12) {
+		t.Errorf("expected a scalar steps value kept, got %v (%v)", res.Steps, err)
+	}
+	if _, err := decodeResult(strings.NewReader(`{"ok": true, "steps": [{"a": `)); err == nil {
+		t.Error("expected an error for truncated output")
+	}
+	if _, err := decodeResult(strings.NewReader(`[1, 2]`)); err == nil {
+		t.Error("expected an error for a non-object result")
+	}
+}
+
+// BenchmarkDecodeResult compares decoding a large steps array with the
+// streaming decoder, directly and fed through lineWriter as the worker writes
+// it, against unmarshaling it into generic values. retained-B/op is the heap
+// still held by the decoded result.
+func BenchmarkDecodeResult(b *testing.B) {
+	// Steps carry the UI tree: many small objects, the worst case for
+	// generic maps
+	element := `{"class": "android.widget.TextView", "text": "Chats", "bounds": [0, 120, 540, 260], "clickable": true, "index": 3}`
+	elements := make([]string, 40)
+	for i := range elements {
+		elements[i] = element
+	}
+	step := `{"action": "tap", "target": "Send", "ui": [` + strings.Join(elements, ",") + `]}`
+	steps := make([]string, 2000)
+	for i := range steps {
+		steps[i] = step
+	}
+	output := []byte(`{"ok": true, "success": true, "reason": "done", "steps": [` + strings.Join(steps, ",") + `]}`)
+
+	run := func(b *testing.B, decode func() any) {
+		b.ReportAllocs()
+		var retained uint64
+		var keep any
+		for i := 0; i < b.N; i++ {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			keep = decode()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			if after.HeapAlloc > before.HeapAlloc {
+				retained += after.HeapAlloc - before.HeapAlloc
+			}
+		}
+		runtime.KeepAlive(keep)
+		b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+	}
+	b.Run("stream", func(b *testing.B) {
+		run(b, func() any {
+			res, err := decodeResult(bytes.NewReader(output))
+			if err != nil {
+				b.Fatal(err)
+			}
+			return res
+		})
+	})
+	b.Run("line writer", func(b *testing.B) {
+		run(b, func() any {
+			w := &lineWriter{onLine: func([]byte) bool { return false }}
+			for rest := output; len(rest) > 0; {
+				n := min(len(rest), 64<<10) // A pipe's worth at a time
+				_, _ = w.Write(rest[:n])
+				rest = rest[n:]
+			}
+			_ = w.Close()
+			res, err := w.Result()
+			if err != nil {
+				b.Fatal(err)
+			}
+			return res
+		})
+	})
+	b.Run("unmarshal", func(b *testing.B) {
+		run(b, func() any {
+			var res struct {
+				Steps any `json:"steps"`
+			}
+			if err := json.Unmarshal(output, &res); err != nil {
+				b.Fatal(err)
+			}
+			return res
+		})
+	})
+}
+
+func TestOutputTokenLimit(t *testing.T) {
+	worker := writeWorker(t, `import json, sys, time
+task = json.load(sys.stdin)
+assert task["max_output_tokens"] > 0
+for used in (100, 200, 300, 400):
+    print(json.dumps({"output_tokens": used}), flush=True)
+    time.sleep(0.1)
+print(json.dumps({"ok": True, "success": True, "reason": "ran away"}))
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test", MaxOutputTokens: 250}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "failed" || !contains(got.Error, "output token limit exceeded") {
+		t.Fatalf("expected token limit failure, got %s: %q", got.Status, got.Error)
+	}
+	if got.OutputTokens != 300 {
+		t.Errorf("expected the count that crossed the limit (300), got %d", got.OutputTokens)
+	}
+
+	// Under the limit, progress lines don't get in the way of the final result
+	task = q.Submit(TaskRequest{Goal: "test", MaxOutputTokens: 1000}, "key")
+	got = waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "completed" || got.Result != "ran away" || got.OutputTokens != 400 {
+		t.Errorf("expected completion with 400 tokens, got %s %q %d (%s)", got.Status, got.Result, got.OutputTokens, got.Error)
+	}
+}
+
+func TestQueueQueryTimeRange(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	day := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	next := day.Add(24 * time.Hour)
+
+	add := func(id, status string, created, finished time.Time) {
+		q.tasks[id] = &Task{ID: id, Status: status, CreatedAt: created, FinishedAt: finished}
+	}
+	add("before", "completed", day.Add(-time.Hour), day.Add(-30*time.Minute))
+	add("at-start", "completed", day, day.Add(time.Minute))
+	add("inside", "failed", day.Add(12*time.Hour), day.Add(13*time.Hour))
+	add("straddle", "completed", day.Add(23*time.Hour), next.Add(time.Hour)) // created today, finished tomorrow
+	add("at-end", "completed", next, next.Add(time.Minute))
+	add("running", "running", day.Add(20*time.Hour), time.Time{})
+
+	ids := func(m map[string]*Task) map[string]bool {
+		out := map[string]bool{}
+		for id := range m {
+			out[id] = true
+		}
+		return out
+	}
+	check := func(name string, f TaskFilter, want ...string) {
+		t.Helper()
+		got := ids(q.Query(f))
+		if len(got) != len(want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+			return
+		}
+		for _, id := range want {
+			if !got[id] {
+				t.Errorf("%s: got %v, want %v", name, got, want)
+				return
+			}
+		}
+	}
+
+	// After is inclusive, Before is exclusive
+	check("created today", TaskFilter{CreatedAfter: day, CreatedBefore: next},
+		"at-start", "inside", "straddle", "running")
+	check("finished today", TaskFilter{FinishedAfter: day, FinishedBefore: next},
+		"at-start", "inside")
+	check("finished tomorrow", TaskFilter{FinishedAfter: next},
+		"straddle", "at-end")
+	check("created today and completed",
+		TaskFilter{CreatedAfter: day, CreatedBefore: next, Statuses: map[string]bool{"completed": true}},
+		"at-start", "straddle")
+	check("no filter", TaskFilter{},
+		"before", "at-start", "inside", "straddle", "at-end", "running")
+}
+
+func TestFailureHints(t *testing.T) {
+	tests := map[string]int{
+		FailureWorker:       http.StatusBadGateway,
+		FailureTimeout:      http.StatusGatewayTimeout,
+		FailureOutputLimit:  http.StatusUnprocessableEntity,
+		FailureAssertion:    http.StatusUnprocessableEntity,
+		FailureUnsuccessful: http.StatusUnprocessableEntity,
+		FailureSkipped:      http.StatusPreconditionFailed,
+		"":                  0,
+	}
+	for kind, want := range tests {
+		if got := failureHint(kind); got != want {
+			t.Errorf("failureHint(%q) = %d, want %d", kind, got, want)
+		}
+	}
+}
+
+func TestFailureKindRecorded(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	go q.Run()
+
+	failed := q.Submit(TaskRequest{Goal: "fail"}, "key")
+	asserted := q.Submit(TaskRequest{Goal: "hello", AssertContains: "bye"}, "key")
+	ok := q.Submit(TaskRequest{Goal: "hello"}, "key")
+
+	got := waitForStatus(t, q, failed.ID, "failed")
+	if got.FailureKind != FailureWorker || got.HTTPStatusHint != http.StatusBadGateway {
+		t.Errorf("expected worker_error/502, got %q/%d", got.FailureKind, got.HTTPStatusHint)
+	}
+	got = waitForStatus(t, q, asserted.ID, "completed")
+	if got.FailureKind != FailureAssertion || got.HTTPStatusHint != http.StatusUnprocessableEntity {
+		t.Errorf("expected assertion/422, got %q/%d", got.FailureKind, got.HTTPStatusHint)
+	}
+	got = waitForStatus(t, q, ok.ID, "completed")
+	if got.FailureKind != "" || got.HTTPStatusHint != 0 {
+		t.Errorf("expected no failure kind on success, got %q/%d", got.FailureKind, got.HTTPStatusHint)
+	}
+}
+
+func TestIsolateHomePerTask(t *testing.T) {
+	worker := writeWorker(t, `
+import json, os, sys
+json.load(sys.stdin)
+home = os.environ["HOME"]
+open(os.path.join(home, ".credentials"), "w").write("cached")
+print(json.dumps({"ok": True, "success": True, "reason": home}))
+`)
+	q := NewQueue(worker, 1)
+	q.isolateHome = true
+	go q.Run()
+
+	first := q.Submit(TaskRequest{Goal: "one"}, "key")
+	second := q.Submit(TaskRequest{Goal: "two"}, "key")
+	home1 := waitForStatus(t, q, first.ID, "completed", "failed").Result
+	home2 := waitForStatus(t, q, second.ID, "completed", "failed").Result
+
+	if home1 == "" || home1 == os.Getenv("HOME") {
+		t.Fatalf("expected a temporary HOME, got %q", home1)
+	}
+	if home1 == home2 {
+		t.Errorf("expected a unique HOME per task, both got %q", home1)
+	}
+	for _, home := range []string{home1, home2} {
+		if _, err := os.Stat(home); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed after the task, stat err = %v", home, err)
+		}
+	}
+}
+
+func TestStepExtensionGranted(t *testing.T) {
+	worker := writeWorker(t, `import json, sys
+task = json.loads(sys.stdin.readline())
+granted = 0
+for ask in (5, 5):
+    print(json.dumps({"request_more_steps": ask, "reason": "almost done"}), flush=True)
+    granted += json.loads(sys.stdin.readline())["granted_steps"]
+print(json.dumps({"ok": True, "success": True, "reason": "%d+%d" % (task["max_steps"], granted)}))
+`)
+	q := NewQueue(worker, 1)
+	q.stepExtension = 8
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test", MaxSteps: 10}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "completed" {
+		t.Fatalf("expected completed, got %q (%s)", got.Status, got.Error)
+	}
+	if got.Result != "10+8" {
+		t.Errorf("expected the worker to receive 8 extra steps in total, got %q", got.Result)
+	}
+	if len(got.StepExtensions) != 2 {
+		t.Fatalf("expected 2 recorded extensions, got %+v", got.StepExtensions)
+	}
+	first, second := got.StepExtensions[0], got.StepExtensions[1]
+	if first.Requested != 5 || first.Granted != 5 || first.Reason != "almost done" {
+		t.Errorf("unexpected first extension %+v", first)
+	}
+	if second.Granted != 3 {
+		t.Errorf("expected the second grant capped at 3, got %+v", second)
+	}
+}
+
+func TestRealWorkerRequestsMoreSteps(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	worker, err := filepath.Abs("../worker.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stand-ins for droidrun and the LLM: the first run uses up its steps,
+	// the one after the extension finishes the goal
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"droidrun/__init__.py": `import types
+class AgentConfig:
+    def __init__(self, max_steps, **kwargs):
+        self.max_steps = max_steps
+class DroidrunConfig:
+    def __init__(self, agent):
+        self.agent = agent
+class DroidAgent:
+    runs = 0
+    def __init__(self, goal, config, llms):
+        self.max_steps = config.agent.max_steps
+    async def run(self):
+        DroidAgent.runs += 1
+        steps = [{"run": DroidAgent.runs}] * self.max_steps
+        if DroidAgent.runs == 1:
+            return types.SimpleNamespace(success=False, reason="Reached max steps", steps=steps)
+        return types.SimpleNamespace(success=True, reason="done", steps=steps[:2])
+`,
+		"llama_index/__init__.py":      "",
+		"llama_index/llms/__init__.py": "",
+		"llama_index/llms/ollama.py":   "class Ollama:\n    def __init__(self, **kwargs):\n        pass\n",
+		"adb":                          "#!/bin/sh\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PYTHONPATH", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	q := NewQueue(worker, 1)
+	q.stepExtension = 8
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test", Provider: "Ollama", Model: "llama3", MaxSteps: 10}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "completed" || !got.Success {
+		t.Fatalf("expected the extended run to succeed, got %q (%s) logs: %s", got.Status, got.Error, got.Logs)
+	}
+	if len(got.StepExtensions) != 1 {
+		t.Fatalf("expected 1 recorded extension, got %+v", got.StepExtensions)
+	}
+	if ext := got.StepExtensions[0]; ext.Requested != 5 || ext.Granted != 5 || !strings.Contains(ext.Reason, "Reached max steps") {
+		t.Errorf("unexpected extension %+v", ext)
+	}
+	if steps, _ := got.Steps.([]any); len(steps) != 12 {
+		t.Errorf("expected the steps of both runs, got %d", len(steps))
+	}
+}
+
+func TestQueuePriorityOrder(t *testing.T) {
+	q := NewQueue(writeWorker(t, goalWorker), 1)
+	low := q.Submit(TaskRequest{Goal: "low", Priority: -5}, "key")
+	first := q.Submit(TaskRequest{Goal: "first"}, "key")
+	urgent := q.Submit(TaskRequest{Goal: "urgent", Priority: 10}, "key")
+	second := q.Submit(TaskRequest{Goal: "second"}, "key")
+
+	if urgent.SubmitPosition != 1 {
+		t.Errorf("expected the urgent task to jump to position 1, got %d", urgent.SubmitPosition)
+	}
+	want := []*Task{urgent, first, second, low}
+	for i, task := range want {
+		if pos := q.Position(task.ID); pos != i+1 {
+			t.Errorf("%s: expected position %d, got %d", task.Request.Goal, i+1, pos)
+		}
+	}
+
+	go q.Run()
+	for _, task := range want {
+		waitForStatus(t, q, task.ID, "completed", "failed")
+	}
+	for i := 1; i < len(want); i++ {
+		prev, cur := q.Get(want[i-1].ID), q.Get(want[i].ID)
+		if cur.StartedAt.Before(prev.StartedAt) {
+			t.Errorf("%s started before %s", cur.Request.Goal, prev.Request.Goal)
+		}
+	}
+}
+
+func TestQueueJumpQueue(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	urgent := q.Submit(TaskRequest{Goal: "urgent", Priority: 10}, "key")
+	normal := q.Submit(TaskRequest{Goal: "normal"}, "key")
+	jumper := q.Submit(TaskRequest{Goal: "jumper", JumpQueue: true}, "key")
+	if jumper.SubmitPosition != 1 {
+		t.Errorf("expected the jump_queue task at position 1, got %d", jumper.SubmitPosition)
+	}
+
+	// A later jumper goes ahead of the earlier one; other tasks stay behind both
+	next := q.Submit(TaskRequest{Goal: "next", JumpQueue: true}, "key")
+	higher := q.Submit(TaskRequest{Goal: "higher", Priority: 50}, "key")
+	want := []*Task{next, jumper, higher, urgent, normal}
+	for i, task := range want {
+		if pos := q.Position(task.ID); pos != i+1 {
+			t.Errorf("%s: expected position %d, got %d", task.Request.Goal, i+1, pos)
+		}
+	}
+	if req := q.Get(jumper.ID).Request.toRequest(); req.JumpQueue {
+		t.Error("expected a rerun not to inherit jump_queue")
+	}
+}
+
+func TestInvalidWorkerOutputKeptApart(t *testing.T) {
+	worker := writeWorker(t, `import json, sys
+json.load(sys.stdin)
+sys.stdout.buffer.write(b"not json \xff\xfe " + b"x" * 10000 + b"\n")
+`)
+	q := NewQueue(worker, 1)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "failed" || got.Error != "invalid worker output" {
+		t.Fatalf("expected a concise error, got %q: %q", got.Status, got.Error)
+	}
+	if got.ParseError == "" {
+		t.Error("expected the parse error to be recorded")
+	}
+	if !strings.HasPrefix(got.RawOutput, "not json � x") {
+		t.Errorf("expected raw output with invalid UTF-8 replaced, got %.40q", got.RawOutput)
+	}
+	if len(got.RawOutput) > maxRawOutput+64 || !strings.Contains(got.RawOutput, "[truncated") {
+		t.Errorf("expected raw output capped near %d bytes, got %d", maxRawOutput, len(got.RawOutput))
+	}
+}
+
+func TestReapRemovesOnlyExpiredFinishedTasks(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	now := time.Now()
+	old := q.Submit(TaskRequest{Goal: "old"}, "key")
+	recent := q.Submit(TaskRequest{Goal: "recent"}, "key")
+	queued := q.Submit(TaskRequest{Goal: "queued"}, "key")
+	running := q.Submit(TaskRequest{Goal: "running"}, "key")
+	q.Cancel(old.ID)
+	q.Cancel(recent.ID)
+	q.mu.Lock()
+	q.tasks[old.ID].FinishedAt = now.Add(-2 * time.Hour)
+	q.tasks[recent.ID].FinishedAt = now.Add(-time.Minute)
+	q.tasks[queued.ID].CreatedAt = now.Add(-3 * time.Hour)
+	q.tasks[running.ID].Status = "running"
+	q.tasks[running.ID].StartedAt = now.Add(-3 * time.Hour)
+	q.mu.Unlock()
+
+	if n := q.Reap(now, time.Hour); n != 1 {
+		t.Errorf("expected 1 task reaped, got %d", n)
+	}
+	if q.Get(old.ID) != nil {
+		t.Error("expected the task finished 2h ago to be removed")
+	}
+	for _, task := range []*Task{recent, queued, running} {
+		if q.Get(task.ID) == nil {
+			t.Errorf("%s: expected the task to be kept", task.Request.Goal)
+		}
+	}
+}
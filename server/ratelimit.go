@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client: each holds up to burst tokens,
+// refilled at rate per second, and a submission takes one. Unlike
+// submitLimiter it limits submissions over time.
+type rateLimiter struct {
+	rate  float64 // Tokens added per second (0 = unlimited)
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time // Replaced in tests
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // When tokens was last brought up to date
+}
+
+// newRateLimiter allows perMinute submissions a minute per client, in bursts
+// of up to perMinute (0 = unlimited).
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from client's bucket. If it's empty it returns false
+// and how long until a token is available.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	l.prune(now)
+	return true, 0
+}
+
+// prune drops buckets that have refilled completely, as they're the same as
+// no bucket at all. Called with mu held.
+func (l *rateLimiter) prune(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// parseRate parses -rate, "N/min" (or "N/s"), as submissions a minute. ""
+// and "0" mean unlimited.
+func parseRate(s string) (int, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q (expected N/min, e.g. 30/min)", s)
+	}
+	switch unit {
+	case "s", "sec":
+		return n * 60, nil
+	case "m", "min":
+		return n, nil
+	}
+	return 0, fmt.Errorf("invalid rate %q (unit must be min or s)", s)
+}
+
+// rateClientOf identifies whose bucket a request draws from: its server
+// key's label when auth is enabled, otherwise the client's address.
+func rateClientOf(r *http.Request) string {
+	if serverAPIKey != "" || len(serverKeys) > 0 {
+		return "key:" + identityFrom(r.Context()).Label
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	api.SetRateLimit(2)
+	now := time.Now()
+	api.rate.now = func() time.Time { return now }
+
+	post := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test"}`))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := post("10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("submission %d: expected 200 within the burst, got %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	w := post("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the bucket is empty, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("expected Retry-After 30 (one token at 2/min), got %q", got)
+	}
+
+	// Health checks and other clients aren't affected
+	health := httptest.NewRecorder()
+	api.ServeHTTP(health, httptest.NewRequest("GET", "/health", nil))
+	if health.Code != http.StatusOK {
+		t.Errorf("expected /health to be exempt, got %d", health.Code)
+	}
+	if w := post("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected another client to have its own bucket, got %d", w.Code)
+	}
+
+	// Tokens come back gradually: one after 30s, not two
+	now = now.Add(30 * time.Second)
+	if w := post("10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected a refilled token after 30s, got %d", w.Code)
+	}
+	if w := post("10.0.0.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the refilled token to be used up, got %d", w.Code)
+	}
+
+	// A full minute refills the whole burst, and no more
+	now = now.Add(10 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if w := post("10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Errorf("submission %d after refilling: expected 200, got %d", i+1, w.Code)
+		}
+	}
+	if w := post("10.0.0.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the bucket to hold no more than the burst, got %d", w.Code)
+	}
+}
+
+func TestRateLimitPerServerKey(t *testing.T) {
+	defer func(key string) { serverAPIKey = key }(serverAPIKey)
+	serverAPIKey = "server-secret"
+
+	api := NewAPI(NewQueue("./worker.py", 1))
+	api.SetRateLimit(1)
+	api.rate.now = func() time.Time { return time.Unix(0, 0) }
+
+	// With auth on, a key's clients share one bucket whatever their address
+	for i, addr := range []string{"10.0.0.1:1234", "10.0.0.2:1234"} {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test"}`))
+		req.RemoteAddr = addr
+		req.Header.Set("X-Server-Key", "server-secret")
+		req.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if want := []int{http.StatusOK, http.StatusTooManyRequests}[i]; w.Code != want {
+			t.Errorf("%s: expected %d, got %d", addr, want, w.Code)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for in, want := range map[string]int{"": 0, "0": 0, "30/min": 30, "1/m": 1, "2/s": 120} {
+		got, err := parseRate(in)
+		if err != nil || got != want {
+			t.Errorf("parseRate(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"30", "-1/min", "x/min", "30/day", "0/min"} {
+		if _, err := parseRate(in); err == nil {
+			t.Errorf("parseRate(%q): expected an error", in)
+		}
+	}
+}
+
+func TestRateLimitAppliesToRerun(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	api := NewAPI(q)
+	api.SetRateLimit(1)
+	api.rate.now = func() time.Time { return time.Unix(0, 0) }
+	orig := q.Submit(TaskRequest{Goal: "test"}, "key")
+
+	// Reruns submit tasks too, so they draw from the same bucket as /run
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/task/"+orig.ID+"/rerun", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("rerun %d: expected %d, got %d: %s", i+1, want, w.Code, w.Body)
+		}
+	}
+	if got := len(q.All()); got != 2 {
+		t.Errorf("expected one rerun queued besides the original, got %d tasks", got)
+	}
+}
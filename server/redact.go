@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// redactedText replaces secrets matched by redaction patterns.
+const redactedText = "***"
+
+// defaultRedactPatterns match common secret shapes that workers and the
+// libraries they call tend to print.
+var defaultRedactPatterns = []string{
+	`sk-[A-Za-z0-9_-]{16,}`,                                   // OpenAI / Anthropic style keys
+	`AIza[0-9A-Za-z_-]{35}`,                                   // Google API keys
+	`gh[pousr]_[A-Za-z0-9]{36,}`,                              // GitHub tokens
+	`AKIA[0-9A-Z]{16}`,                                        // AWS access key IDs
+	`eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`, // JWTs
+	`(?i)bearer\s+[A-Za-z0-9._~+/-]{8,}=*`,                    // Authorization headers
+	`(?i)\b(otp|passcode|code)(\s+is)?\W{0,3}\d{4,8}\b`,       // One-time codes
+}
+
+// compileRedactPatterns compiles redaction regexes, failing on the first bad one.
+func compileRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// redact masks every pattern match in s, plus any literal secrets given
+// (e.g. the task's own API key, which may not match a known shape).
+func redact(s string, patterns []*regexp.Regexp, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redactedText)
+		}
+	}
+	for _, re := range patterns {
+		s = re.ReplaceAllString(s, redactedText)
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// labelKeyPattern restricts label keys to simple identifiers like env or team.name.
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// maxLabels caps the labels on one task.
+const maxLabels = 16
+
+// validateLabels checks a request's labels.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels allowed", maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key: %q", k)
+		}
+		if len(v) > 256 {
+			return fmt.Errorf("label %s value too long (max 256)", k)
+		}
+	}
+	return nil
+}
+
+// workerRoute sends tasks whose label key has value to a different worker.
+type workerRoute struct {
+	key, value string
+	path       string
+}
+
+// parseRoute parses a -route spec of the form label:key=value=path and
+// checks that the worker exists.
+func parseRoute(spec string) (workerRoute, error) {
+	rule, ok := strings.CutPrefix(spec, "label:")
+	if !ok {
+		return workerRoute{}, fmt.Errorf("expected label:key=value=path")
+	}
+	parts := strings.SplitN(rule, "=", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return workerRoute{}, fmt.Errorf("expected label:key=value=path")
+	}
+	if !labelKeyPattern.MatchString(parts[0]) {
+		return workerRoute{}, fmt.Errorf("invalid label key: %q", parts[0])
+	}
+	if info, err := os.Stat(parts[2]); err != nil {
+		return workerRoute{}, fmt.Errorf("worker: %w", err)
+	} else if info.IsDir() {
+		return workerRoute{}, fmt.Errorf("worker %s is a directory", parts[2])
+	}
+	return workerRoute{key: parts[0], value: parts[1], path: parts[2]}, nil
+}
+
+// routeWorker returns the worker for a task's labels: that of the first
+// matching route, or the default worker.
+func (q *Queue) routeWorker(labels map[string]string) (path string, route *workerRoute) {
+	for i, r := range q.routes {
+		if v, ok := labels[r.key]; ok && v == r.value {
+			return r.path, &q.routes[i]
+		}
+	}
+	return q.workerPath, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteWorkerByLabel(t *testing.T) {
+	defaultWorker := writeWorker(t, `import json, sys
+json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": "default"}))
+`)
+	stagingWorker := writeWorker(t, `import json, sys
+json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": "staging"}))
+`)
+	route, err := parseRoute("label:env=staging=" + stagingWorker)
+	if err != nil {
+		t.Fatalf("parseRoute: %v", err)
+	}
+	q := NewQueue(defaultWorker, 1)
+	q.routes = []workerRoute{route}
+	go q.Run()
+
+	labeled := q.Submit(TaskRequest{Goal: "test", Labels: map[string]string{"env": "staging"}}, "key")
+	other := q.Submit(TaskRequest{Goal: "test", Labels: map[string]string{"env": "prod"}}, "key")
+	unlabeled := q.Submit(TaskRequest{Goal: "test"}, "key")
+
+	for id, want := range map[string]string{labeled.ID: "staging", other.ID: "default", unlabeled.ID: "default"} {
+		if got := waitForStatus(t, q, id, "completed", "failed"); got.Result != want {
+			t.Errorf("task %s: expected the %s worker, got %q (%s)", id, want, got.Result, got.Error)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	worker := writeWorker(t, goalWorker)
+	route, err := parseRoute("label:team==" + worker)
+	if err != nil {
+		t.Fatalf("parseRoute: %v", err)
+	}
+	// An empty value matches tasks labelled team=""
+	if route.key != "team" || route.value != "" || route.path != worker {
+		t.Errorf("unexpected route %+v", route)
+	}
+
+	for _, spec := range []string{
+		"env=staging=" + worker,     // missing label: prefix
+		"label:env=staging",         // no path
+		"label:=staging=" + worker,  // empty key
+		"label:bad key=x=" + worker, // invalid key
+		"label:env=staging=" + filepath.Join(t.TempDir(), "missing.py"),
+		"label:env=staging=" + t.TempDir(), // directory
+	} {
+		if _, err := parseRoute(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
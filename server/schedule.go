@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronSpec is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week).
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64 // Bitsets of allowed values
+	domStar, dowStar              bool   // Field was "*" (affects day matching)
+}
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// parseCron parses a standard five-field cron expression. Each field accepts
+// "*", numbers, ranges ("1-5"), steps ("*/15", "0-30/10") and comma lists.
+// Day-of-week is 0-6 with Sunday as 0 (7 is also accepted for Sunday).
+func parseCron(expr string) (*cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+	}
+
+	spec := &cronSpec{}
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if spec.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1 // 7 is Sunday too
+	}
+	spec.domStar = fields[2] == "*"
+	spec.dowStar = fields[4] == "*"
+	return spec, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max // "5/10" means every 10 starting at 5
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	domOK := c.dom&(1<<uint(t.Day())) != 0
+	dowOK := c.dow&(1<<uint(t.Weekday())) != 0
+	// Like cron: if both day fields are restricted, either may match
+	if !c.domStar && !c.dowStar {
+		return domOK || dowOK
+	}
+	return domOK && dowOK
+}
+
+// Next returns the first matching minute strictly after t, or the zero time
+// if none is found within five years (e.g. "0 0 31 2 *").
+func (c *cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Schedule creates a task from Task every time Cron matches.
+// API keys are never stored: each fire uses the server-side provider key.
+type Schedule struct {
+	ID         string      `json:"id"`
+	Cron       string      `json:"cron"`
+	Task       TaskRequest `json:"task"`
+	CreatedAt  time.Time   `json:"created_at"`
+	NextRun    time.Time   `json:"next_run"`
+	LastRun    time.Time   `json:"last_run,omitempty"`
+	LastTaskID string      `json:"last_task_id,omitempty"`
+	LastError  string      `json:"last_error,omitempty"`
+
+	spec *cronSpec
+}
+
+// Scheduler submits tasks to a Queue for each due Schedule.
+type Scheduler struct {
+	mu        sync.Mutex
+	queue     *Queue
+	schedules map[string]*Schedule
+	now       func() time.Time
+	changes   int // Bumped by Add and Delete, so PersistState saves them
+}
+
+func NewScheduler(q *Queue) *Scheduler {
+	return &Scheduler{
+		queue:     q,
+		schedules: make(map[string]*Schedule),
+		now:       time.Now,
+	}
+}
+
+// Add registers a schedule for req. The request must already be validated.
+func (s *Scheduler) Add(cron string, req TaskRequest) (*Schedule, error) {
+	spec, err := parseCron(cron)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	now := s.now()
+	next := spec.Next(now)
+	if next.IsZero() {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("cron expression never matches")
+	}
+	req.APIKey = ""
+	sched := &Schedule{
+		ID:        randomID(),
+		Cron:      cron,
+		Task:      req,
+		CreatedAt: now,
+		NextRun:   next,
+		spec:      spec,
+	}
+	s.schedules[sched.ID] = sched
+	s.changes++
+	s.mu.Unlock()
+	s.queue.changed()
+	scheduleLog(sched.ID).Infof("Created (%s), next run %s", cron, next.Format(time.RFC3339))
+	return sched, nil
+}
+
+// List returns copies of all schedules, ordered by next run.
+func (s *Scheduler) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Schedule, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		list = append(list, *sched)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NextRun.Before(list[j].NextRun) })
+	return list
+}
+
+// Delete removes a schedule, reporting whether it existed. Tasks it already
+// fired are left alone.
+func (s *Scheduler) Delete(id string) bool {
+	s.mu.Lock()
+	if _, ok := s.schedules[id]; !ok {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.schedules, id)
+	s.changes++
+	s.mu.Unlock()
+	s.queue.changed()
+	return true
+}
+
+// restore adds schedules saved by SaveState, keeping their IDs and next
+// runs, so one that came due while the server was down fires once. A
+// schedule whose cron no longer parses is dropped with a warning.
+func (s *Scheduler) restore(list []Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sched := range list {
+		spec, err := parseCron(sched.Cron)
+		if err != nil {
+			scheduleLog(sched.ID).Warnf("Not restored: %v", err)
+			continue
+		}
+		sched.spec = spec
+		if sched.NextRun.IsZero() {
+			sched.NextRun = spec.Next(s.now())
+		}
+		s.schedules[sched.ID] = &sched
+	}
+}
+
+// changeCount returns how many times schedules were added or deleted.
+func (s *Scheduler) changeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changes
+}
+
+// RunDue submits a task for every schedule whose next run is at or before
+// now. A schedule that fell behind fires once, not once per missed minute.
+func (s *Scheduler) RunDue(now time.Time) {
+	type fire struct {
+		id  string
+		req TaskRequest
+	}
+	var due []fire
+
+	s.mu.Lock()
+	for _, sched := range s.schedules {
+		if sched.NextRun.After(now) {
+			continue
+		}
+		sched.LastRun = now
+		sched.NextRun = sched.spec.Next(now)
+		due = append(due, fire{sched.ID, sched.Task})
+	}
+	s.mu.Unlock()
+
+	// Submit without holding mu: the queue may block when full
+	for _, f := range due {
+		var taskID, errMsg string
+		if apiKey := serverProviderKey(f.req.Provider); apiKey == "" {
+			errMsg = "no server-side key for provider " + f.req.Provider
+		} else if task, err := s.queue.TrySubmit(context.Background(), f.req, apiKey); err != nil {
+			errMsg = err.Error()
+		} else {
+			taskID = task.ID
+		}
+
+		if errMsg != "" {
+			scheduleLog(f.id).Warnf("Not fired: %s", errMsg)
+		} else {
+			scheduleLog(f.id).Infof("Fired task %s", taskID)
+		}
+
+		s.mu.Lock()
+		if sched := s.schedules[f.id]; sched != nil {
+			sched.LastError = errMsg
+			if taskID != "" {
+				sched.LastTaskID = taskID
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Run checks for due schedules every few seconds. Call in a goroutine.
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.RunDue(s.now())
+	}
+}
+
+// ScheduleRequest is the body of POST /schedules.
+type ScheduleRequest struct {
+	Cron string      `json:"cron"`
+	Task TaskRequest `json:"task"`
+}
+
+// handleSchedules serves GET/POST /schedules and DELETE /schedules/{id}.
+func (a *API) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+
+	if id != "" {
+		if r.Method != "DELETE" {
+			writeError(w, CodeMethodNotAllowed, "DELETE only", http.StatusMethodNotAllowed)
+			return
+		}
+		if !a.schedules.Delete(id) {
+			writeError(w, CodeNotFound, "schedule not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{"status": "deleted"}); err != nil {
+			serverLog.Errorf("Failed to encode schedule delete response: %v", err)
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{"schedules": a.schedules.List()}); err != nil {
+			serverLog.Errorf("Failed to encode schedules response: %v", err)
+		}
+	case "POST":
+		var req ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, "invalid JSON", err)
+			return
+		}
+		if r.Header.Get("X-API-Key") != "" || req.Task.APIKey != "" {
+			writeError(w, CodeInvalidSchedule, "schedules cannot store API keys; load one on the server with -key-file", http.StatusBadRequest)
+			return
+		}
+		if req.Task.RunIf != nil {
+			writeError(w, CodeInvalidSchedule, "run_if is not supported in schedules", http.StatusBadRequest)
+			return
+		}
+		// Keys are resolved on every fire, so one must exist server-side now
+		if err := validateRequest(&req.Task, serverProviderKey(req.Task.Provider)); err != nil {
+			writeError(w, errorCode(err, CodeInvalidRequest), err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := identityFrom(r.Context())
+		if !id.Allows(req.Task.Provider) {
+			writeError(w, CodeForbidden, fmt.Sprintf("provider %s not allowed for key %q", req.Task.Provider, id.Label), http.StatusForbidden)
+			return
+		}
+		if req.Task.JumpQueue && !id.MayJumpQueue() {
+			writeError(w, CodeForbidden, fmt.Sprintf("jump_queue not allowed for key %q", id.Label), http.StatusForbidden)
+			return
+		}
+		sched, err := a.schedules.Add(req.Cron, req.Task)
+		if err != nil {
+			writeError(w, CodeInvalidSchedule, "invalid cron: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sched); err != nil {
+			serverLog.Errorf("Failed to encode schedule response: %v", err)
+		}
+	default:
+		writeError(w, CodeMethodNotAllowed, "GET, POST, or DELETE only", http.StatusMethodNotAllowed)
+	}
+}
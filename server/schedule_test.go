@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"0 8 * * *", false},
+		{"*/15 9-17 * * 1-5", false},
+		{"0,30 0-23/2 1,15 1-12 0", false},
+		{"0 0 * * 7", false},
+		{"@daily", false},
+		{"", true},
+		{"* * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+	}
+
+	for _, tt := range tests {
+		_, err := parseCron(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Wednesday
+	base := time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 15, 10, 21, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 8 * * *", time.Date(2025, 1, 16, 8, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2025, 1, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either matches (the 1st, or a Friday)
+		{"0 0 1 * 5", time.Date(2025, 1, 17, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := spec.Next(base); !got.Equal(tt.want) {
+			t.Errorf("Next(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	spec, _ := parseCron("0 0 31 2 *")
+	if got := spec.Next(base); !got.IsZero() {
+		t.Errorf("expected no match for Feb 31, got %v", got)
+	}
+}
+
+func TestScheduleDueEnqueuesTask(t *testing.T) {
+	serverProviderKeys["Google"] = "server-side-key"
+	defer func() { serverProviderKeys = map[string]string{} }()
+
+	q := NewQueue("./worker.py", 1)
+	s := NewScheduler(q)
+	now := time.Date(2025, 1, 15, 7, 59, 10, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	sched, err := s.Add("0 8 * * *", TaskRequest{Goal: "check notifications", Provider: "Google", Model: "gemini-2.0-flash", MaxSteps: 10})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// Not yet due
+	s.RunDue(now)
+	if n := q.Size(); n != 0 {
+		t.Fatalf("expected no tasks before the schedule is due, got %d", n)
+	}
+
+	s.RunDue(time.Date(2025, 1, 15, 8, 0, 5, 0, time.UTC))
+	all := q.All()
+	if len(all) != 1 {
+		t.Fatalf("expected 1 task after the schedule is due, got %d", len(all))
+	}
+	var fired *Task
+	for _, task := range all {
+		fired = task
+	}
+	if fired.Request.Goal != "check notifications" {
+		t.Errorf("unexpected task goal %q", fired.Request.Goal)
+	}
+	if fired.apiKey != "server-side-key" {
+		t.Errorf("expected fired task to use the server-side key, got %q", fired.apiKey)
+	}
+
+	got := s.List()[0]
+	if got.LastTaskID != fired.ID {
+		t.Errorf("expected last_task_id %q, got %q", fired.ID, got.LastTaskID)
+	}
+	if want := time.Date(2025, 1, 16, 8, 0, 0, 0, time.UTC); !got.NextRun.Equal(want) {
+		t.Errorf("expected next run %v, got %v", want, got.NextRun)
+	}
+
+	// Same minute again does not fire twice
+	s.RunDue(time.Date(2025, 1, 15, 8, 0, 30, 0, time.UTC))
+	if n := q.Size(); n != 1 {
+		t.Errorf("expected schedule to fire once, got %d tasks", n)
+	}
+
+	if !s.Delete(sched.ID) {
+		t.Error("expected Delete to succeed")
+	}
+	if len(s.List()) != 0 {
+		t.Error("expected no schedules after delete")
+	}
+}
+
+func TestSchedulesEndpoint(t *testing.T) {
+	serverProviderKeys["Google"] = "server-side-key"
+	defer func() { serverProviderKeys = map[string]string{} }()
+
+	api := NewAPI(NewQueue("./worker.py", 1))
+
+	post := func(body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/schedules", bytes.NewBufferString(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(`{"cron":"61 * * * *","task":{"goal":"test"}}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad cron, got %d", w.Code)
+	}
+	if w := post(`{"cron":"0 8 * * *","task":{"goal":""}}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing goal, got %d", w.Code)
+	}
+	if w := post(`{"cron":"0 8 * * *","task":{"goal":"test"}}`, map[string]string{"X-API-Key": "k"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when an API key is supplied, got %d", w.Code)
+	}
+	if w := post(`{"cron":"0 8 * * *","task":{"goal":"test","provider":"Anthropic"}}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a server-side key for the provider, got %d", w.Code)
+	}
+
+	w := post(`{"cron":"0 8 * * *","task":{"goal":"check notifications"}}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", w.Code, w.Body.String())
+	}
+	var created Schedule
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode schedule: %v", err)
+	}
+	if created.ID == "" || created.NextRun.IsZero() {
+		t.Errorf("expected id and next_run, got %+v", created)
+	}
+
+	req := httptest.NewRequest("GET", "/schedules", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	var list struct {
+		Schedules []Schedule `json:"schedules"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode list: %v", err)
+	}
+	if len(list.Schedules) != 1 || list.Schedules[0].ID != created.ID {
+		t.Fatalf("expected the created schedule in the list, got %+v", list.Schedules)
+	}
+
+	req = httptest.NewRequest("DELETE", "/schedules/"+created.ID, nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 on delete, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/schedules/"+created.ID, nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting a missing schedule, got %d", w.Code)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// stateFile is what -state keeps on disk. API keys are never written, as
+// Task doesn't serialize them and Scheduler.Add strips them from schedules.
+type stateFile struct {
+	Tasks     []*Task    `json:"tasks"` // Oldest first
+	Schedules []Schedule `json:"schedules,omitempty"`
+}
+
+// SaveState writes every task and schedule to path, replacing it atomically
+// so a crash mid-write leaves the previous state intact.
+func (q *Queue) SaveState(path string) error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	schedules := q.schedules.List()
+	q.mu.RLock()
+	state := stateFile{Tasks: make([]*Task, 0, len(q.tasks)), Schedules: schedules}
+	for _, task := range q.tasks {
+		state.Tasks = append(state.Tasks, task)
+	}
+	sort.Slice(state.Tasks, func(i, j int) bool {
+		return state.Tasks[i].CreatedAt.Before(state.Tasks[j].CreatedAt)
+	})
+	data, err := json.Marshal(state)
+	q.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState restores tasks saved by SaveState; call it before Run. Finished
+// tasks come back as they were. Queued and waiting tasks are queued (or wait)
+// again in their original order, using the server's provider key since the
+// submitter's key was never saved; without one they fail. Tasks that were
+// running when the server stopped fail. Schedules come back too. A missing
+// file is not an error, and nothing is restored from a file that doesn't
+// decode.
+func (q *Queue) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	for _, task := range state.Tasks {
+		if task == nil || task.ID == "" {
+			return fmt.Errorf("decode %s: task without an id", path)
+		}
+	}
+	for _, sched := range state.Schedules {
+		if sched.ID == "" {
+			return fmt.Errorf("decode %s: schedule without an id", path)
+		}
+	}
+	q.schedules.restore(state.Schedules)
+
+	q.mu.Lock()
+	now := time.Now()
+	for _, task := range state.Tasks {
+		q.tasks[task.ID] = task
+		switch task.Status {
+		case "queued", "waiting":
+			task.apiKey = serverProviderKey(task.Request.Provider)
+			if task.apiKey == "" && task.Request.Provider != "Ollama" {
+				task.Status = "failed"
+				task.Error = "API key lost in server restart; resubmit the task"
+				task.FinishedAt = now
+				task.setFailure(FailureWorker)
+				continue
+			}
+			if task.Status == "waiting" {
+				q.waiting = append(q.waiting, task.ID)
+				continue
+			}
+			q.push(task.ID)
+		case "running":
+			task.Status = "failed"
+			task.Error = "server restarted while the task was running"
+			task.FinishedAt = now
+			task.setFailure(FailureWorker)
+		}
+	}
+	q.releaseWaiting()
+	queued := len(q.pendingOrder)
+	q.notify()
+	q.mu.Unlock()
+
+	serverLog.Infof("Restored %d tasks and %d schedules from %s (%d queued)", len(state.Tasks), len(state.Schedules), path, queued)
+	return nil
+}
+
+// PersistState saves the state to path whenever a task changes status or
+// one is added or removed, or a schedule is, until stop is closed.
+func (q *Queue) PersistState(path string, stop <-chan struct{}) {
+	changed, unsubscribe := q.Subscribe()
+	defer unsubscribe()
+	saved := map[string]string{}
+	savedSchedules := q.schedules.changeCount()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changed:
+		}
+		q.mu.RLock()
+		statuses := make(map[string]string, len(q.tasks))
+		for id, task := range q.tasks {
+			statuses[id] = task.Status
+		}
+		q.mu.RUnlock()
+		schedules := q.schedules.changeCount()
+		if sameStatuses(saved, statuses) && schedules == savedSchedules {
+			continue
+		}
+		if err := q.SaveState(path); err != nil {
+			serverLog.Errorf("Failed to save state to %s: %v", path, err)
+			continue
+		}
+		saved, savedSchedules = statuses, schedules
+	}
+}
+
+func sameStatuses(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, status := range a {
+		if b[id] != status {
+			return false
+		}
+	}
+	return true
+}
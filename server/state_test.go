@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateSurvivesRestart(t *testing.T) {
+	worker := writeWorker(t, goalWorker)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	q := NewQueue(worker, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.PersistState(path, stop)
+	go q.Run()
+	done := q.Submit(TaskRequest{Goal: "done"}, "key")
+	waitForStatus(t, q, done.ID, "completed")
+
+	// Stop starting tasks, so these are still queued when the server "restarts"
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	local := q.Submit(TaskRequest{Goal: "local", Provider: "Ollama"}, "")
+	keyed := q.Submit(TaskRequest{Goal: "keyed", Provider: "Google"}, "secret-api-key")
+
+	deadline := time.Now().Add(5 * time.Second)
+	var data []byte
+	for time.Now().Before(deadline) {
+		data, _ = os.ReadFile(path)
+		if strings.Contains(string(data), keyed.ID) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(string(data), keyed.ID) {
+		t.Fatalf("state file never saved the queued tasks: %s", data)
+	}
+	if strings.Contains(string(data), "secret-api-key") {
+		t.Error("API key must not be saved")
+	}
+
+	restored := NewQueue(worker, 1)
+	if err := restored.LoadState(path); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	go restored.Run()
+	if got := waitForStatus(t, restored, done.ID, "completed"); got.Result != "done" {
+		t.Errorf("expected the finished task restored, got %+v", got)
+	}
+	if got := waitForStatus(t, restored, local.ID, "completed", "failed"); got.Status != "completed" || got.Result != "local" {
+		t.Errorf("expected the queued Ollama task to run after restart, got %s: %q", got.Status, got.Error)
+	}
+	// Its key wasn't saved and there's no server key for Google
+	if got := waitForStatus(t, restored, keyed.ID, "completed", "failed"); got.Status != "failed" || !strings.Contains(got.Error, "API key lost") {
+		t.Errorf("expected the keyed task to fail without its key, got %s: %q", got.Status, got.Error)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	q := NewQueue("./worker.py", 1)
+	if err := q.LoadState(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("expected a missing file to be ignored, got %v", err)
+	}
+
+	for name, data := range map[string]string{
+		"partial.json": `{"tasks": [{"id": "a", "status": "comp`,
+		"no-id.json":   `{"tasks": [{"status": "completed"}]}`,
+	} {
+		q := NewQueue("./worker.py", 1)
+		if err := q.LoadState(write(name, data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if len(q.All()) != 0 {
+			t.Errorf("%s: expected nothing restored, got %d tasks", name, len(q.All()))
+		}
+	}
+
+	q = NewQueue("./worker.py", 1)
+	if err := q.LoadState(write("running.json", `{"tasks": [{"id": "r1", "status": "running"}]}`)); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if got, _ := q.Snapshot("r1"); got.Status != "failed" || got.Error != "server restarted while the task was running" {
+		t.Errorf("expected the interrupted task to fail, got %s: %q", got.Status, got.Error)
+	}
+}
+
+func TestSchedulesSurviveRestart(t *testing.T) {
+	serverProviderKeys["Google"] = "server-side-key"
+	defer func() { serverProviderKeys = map[string]string{} }()
+	path := filepath.Join(t.TempDir(), "state.json")
+	saved := func(want string, present bool) string {
+		deadline := time.Now().Add(5 * time.Second)
+		var data []byte
+		for time.Now().Before(deadline) {
+			data, _ = os.ReadFile(path)
+			if strings.Contains(string(data), want) == present {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if strings.Contains(string(data), want) != present {
+			t.Fatalf("expected %q saved: %v, got %s", want, present, data)
+		}
+		return string(data)
+	}
+
+	q := NewQueue("./worker.py", 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.PersistState(path, stop)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		q.mu.RLock()
+		subscribed := len(q.subs) > 0
+		q.mu.RUnlock()
+		if subscribed {
+			break
+		}
+	}
+	kept, err := q.schedules.Add("0 8 * * *", TaskRequest{Goal: "kept", Provider: "Google", APIKey: "secret-api-key"})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	gone, err := q.schedules.Add("0 9 * * *", TaskRequest{Goal: "gone", Provider: "Google"})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if data := saved(gone.ID, true); strings.Contains(data, "secret-api-key") {
+		t.Error("API key must not be saved")
+	}
+	q.schedules.Delete(gone.ID)
+	saved(gone.ID, false)
+
+	restored := NewQueue("./worker.py", 1)
+	if err := restored.LoadState(path); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	list := restored.schedules.List()
+	if len(list) != 1 || list[0].ID != kept.ID || list[0].Cron != "0 8 * * *" || !list[0].NextRun.Equal(kept.NextRun) {
+		t.Fatalf("expected the kept schedule restored, got %+v", list)
+	}
+	restored.schedules.RunDue(kept.NextRun)
+	if all := restored.All(); len(all) != 1 {
+		t.Errorf("expected the restored schedule to fire, got %d tasks", len(all))
+	}
+}
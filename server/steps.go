@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Page size limits for GET /task/{id}/steps
+const (
+	defaultStepsLimit = 50
+	maxStepsLimit     = 500
+)
+
+// stepsPath is where a task's steps are logged when -steps-dir is set: one
+// JSON value per line.
+func (q *Queue) stepsPath(id string) string {
+	return filepath.Join(q.stepsDir, id+".jsonl")
+}
+
+// openStepLog creates (or truncates, on retry) the task's step log. It
+// returns nil when steps are kept in memory, or if the file can't be
+// created, in which case the task falls back to memory.
+func (q *Queue) openStepLog(id string) *os.File {
+	if q.stepsDir == "" {
+		return nil
+	}
+	f, err := os.Create(q.stepsPath(id))
+	if err != nil {
+		taskLog(id).Errorf("Failed to create step log, keeping steps in memory: %v", err)
+		return nil
+	}
+	return f
+}
+
+// recordStep stores one step streamed by the worker: appended to the step
+// log if there is one, otherwise to the task's in-memory steps.
+func (q *Queue) recordStep(task *Task, stepLog *os.File, raw json.RawMessage) {
+	var step any
+	_ = json.Unmarshal(raw, &step)
+	if stepLog != nil {
+		if _, err := stepLog.Write(append(raw, '\n')); err != nil {
+			taskLog(task.ID).Errorf("Failed to write step: %v", err)
+			return
+		}
+	}
+	q.mu.Lock()
+	if stepLog != nil {
+		task.StepCount++
+		task.LastStep = step
+	} else {
+		list, _ := task.Steps.([]any)
+		task.Steps = append(list, step)
+	}
+	q.notify()
+	q.mu.Unlock()
+}
+
+// keepSteps stores the steps of a finished worker run. Without a step log
+// they replace the in-memory steps; with one they're written to it unless
+// the worker already streamed them. Called with q.mu held.
+func (q *Queue) keepSteps(task *Task, stepLog *os.File, steps any) {
+	if stepLog == nil {
+		if steps != nil {
+			task.Steps = steps
+		}
+		return
+	}
+	if task.StepCount > 0 || steps == nil {
+		return
+	}
+	list, ok := steps.([]any)
+	if !ok {
+		list = []any{steps}
+	}
+	w := bufio.NewWriter(stepLog)
+	for _, step := range list {
+		line, err := json.Marshal(step)
+		if err != nil {
+			continue
+		}
+		_, _ = w.Write(append(line, '\n'))
+		task.StepCount++
+		task.LastStep = step
+	}
+	if err := w.Flush(); err != nil {
+		taskLog(task.ID).Errorf("Failed to write steps: %v", err)
+	}
+}
+
+// Steps returns up to limit of a task's steps starting at offset, along with
+// the total number of steps, reading them back from the step log when the
+// task has one.
+func (q *Queue) Steps(id string, offset, limit int) (steps []any, total int, err error) {
+	q.mu.RLock()
+	task := q.tasks[id]
+	if task == nil {
+		q.mu.RUnlock()
+		return nil, 0, errTaskNotFound
+	}
+	if task.StepCount == 0 {
+		list, _ := task.Steps.([]any)
+		total = len(list)
+		if offset < total {
+			steps = append(steps, list[offset:min(offset+limit, total)]...)
+		}
+		q.mu.RUnlock()
+		return steps, total, nil
+	}
+	total = task.StepCount
+	source := id
+	if task.ServedFromCache != "" {
+		source = task.ServedFromCache
+	}
+	q.mu.RUnlock()
+
+	f, err := os.Open(q.stepsPath(source))
+	if err != nil {
+		return nil, total, err
+	}
+	defer func() { _ = f.Close() }()
+	// Steps may be large (screenshots), so read whole lines without a limit
+	r := bufio.NewReader(f)
+	for i := 0; i < total && len(steps) < limit; i++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			break
+		}
+		if i < offset {
+			continue
+		}
+		var step any
+		if err := json.Unmarshal(bytes.TrimSpace(line), &step); err == nil {
+			steps = append(steps, step)
+		}
+	}
+	return steps, total, nil
+}
+
+var errTaskNotFound = errors.New("task not found")
+
+// Step is a worker step in the typed form served by
+// GET /task/{id}/steps?format=timeline. Workers send steps as arbitrary
+// JSON, so the fields are picked from the usual keys; a step that isn't an
+// object, or has none of them, is passed through in Raw instead.
+type Step struct {
+	Index      int    `json:"index"` // Position among the task's steps, from 0
+	Action     string `json:"action,omitempty"`
+	Screenshot string `json:"screenshot,omitempty"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	Raw        any    `json:"raw,omitempty"`
+}
+
+// Keys each Step field is read from, in order of preference.
+var (
+	stepActionKeys     = []string{"action", "type", "tool"}
+	stepScreenshotKeys = []string{"screenshot", "screenshot_path", "screenshot_url"}
+	stepTimestampKeys  = []string{"timestamp", "time", "at"}
+)
+
+// parseStep types a raw step.
+func parseStep(index int, raw any) Step {
+	step := Step{Index: index}
+	obj, ok := raw.(map[string]any)
+	if ok {
+		step.Action = stepField(obj, stepActionKeys)
+		step.Screenshot = stepField(obj, stepScreenshotKeys)
+		step.Timestamp = stepField(obj, stepTimestampKeys)
+	}
+	if step.Action == "" && step.Screenshot == "" && step.Timestamp == "" {
+		step.Raw = raw
+	}
+	return step
+}
+
+// stepField returns the first of keys that obj has as a string or number.
+func stepField(obj map[string]any, keys []string) string {
+	for _, key := range keys {
+		switch v := obj[key].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// handleTaskSteps serves GET /task/{id}/steps?offset=0&limit=50, with the
+// steps as the worker sent them or, with format=timeline, as Steps.
+func (a *API) handleTaskSteps(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" {
+		writeError(w, CodeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	offset, limit := 0, defaultStepsLimit
+	if s := r.URL.Query().Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, CodeInvalidParameter, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxStepsLimit {
+			writeError(w, CodeInvalidParameter, "limit must be between 1 and "+strconv.Itoa(maxStepsLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "timeline" {
+		writeError(w, CodeInvalidParameter, "invalid format (want timeline): "+format, http.StatusBadRequest)
+		return
+	}
+
+	steps, total, err := a.queue.Steps(id, offset, limit)
+	if errors.Is(err, errTaskNotFound) {
+		writeError(w, CodeNotFound, "task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		taskLog(id).Errorf("Failed to read steps: %v", err)
+		writeError(w, CodeInternal, "failed to read steps", http.StatusInternalServerError)
+		return
+	}
+	if steps == nil {
+		steps = []any{}
+	}
+	if format == "timeline" {
+		for i, raw := range steps {
+			steps[i] = parseStep(offset+i, raw)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"task_id": id,
+		"total":   total,
+		"offset":  offset,
+		"steps":   steps,
+	}); err != nil {
+		serverLog.Errorf("Failed to encode steps response: %v", err)
+	}
+}
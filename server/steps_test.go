@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStepsStreamedToFile(t *testing.T) {
+	worker := writeWorker(t, `import json, sys
+json.load(sys.stdin)
+steps = [{"action": "open app"}, {"action": "tap", "target": "Chats"}, {"action": "read"}]
+for s in steps:
+    print(json.dumps({"append_step": s}), flush=True)
+print(json.dumps({"ok": True, "success": True, "reason": "done", "steps": steps}))
+`)
+	q := NewQueue(worker, 1)
+	q.stepsDir = t.TempDir()
+	api := NewAPI(q)
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	got := waitForStatus(t, q, task.ID, "completed", "failed")
+	if got.Status != "completed" {
+		t.Fatalf("expected completed, got %q (%s)", got.Status, got.Error)
+	}
+	if got.Steps != nil {
+		t.Errorf("expected no in-memory steps, got %v", got.Steps)
+	}
+	if got.StepCount != 3 {
+		t.Errorf("expected step_count 3, got %d", got.StepCount)
+	}
+	if last, _ := got.LastStep.(map[string]any); last["action"] != "read" {
+		t.Errorf("unexpected last_step %v", got.LastStep)
+	}
+
+	data, err := os.ReadFile(filepath.Join(q.stepsDir, task.ID+".jsonl"))
+	if err != nil {
+		t.Fatalf("failed to read step log: %v", err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 3 {
+		t.Errorf("expected 3 logged steps (not duplicated by the final result), got %d", n)
+	}
+
+	req := httptest.NewRequest("GET", "/task/"+task.ID+"/steps?offset=1&limit=1", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Total int              `json:"total"`
+		Steps []map[string]any `json:"steps"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Total != 3 || len(resp.Steps) != 1 || resp.Steps[0]["target"] != "Chats" {
+		t.Errorf("expected the second of 3 steps, got total=%d steps=%v", resp.Total, resp.Steps)
+	}
+
+	req = httptest.NewRequest("GET", "/task/missing/steps", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown task, got %d", w.Code)
+	}
+}
+
+func TestStepsFromFinalResultWrittenToFile(t *testing.T) {
+	q := NewQueue(writeWorker(t, `import json, sys
+json.load(sys.stdin)
+print(json.dumps({"ok": True, "success": True, "reason": "done", "steps": ["a", "b"]}))
+`), 1)
+	q.stepsDir = t.TempDir()
+	go q.Run()
+
+	task := q.Submit(TaskRequest{Goal: "test"}, "key")
+	waitForStatus(t, q, task.ID, "completed", "failed")
+
+	steps, total, err := q.Steps(task.ID, 0, 10)
+	if err != nil {
+		t.Fatalf("Steps: %v", err)
+	}
+	if total != 2 || len(steps) != 2 || steps[1] != "b" {
+		t.Errorf("expected steps [a b], got total=%d %v", total, steps)
+	}
+}
+
+func TestStepsTimeline(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	task := &Task{ID: "t1", Status: "completed", Steps: []any{
+		map[string]any{"action": "tap", "x": 10.0, "screenshot": "shots/1.png", "timestamp": "2025-01-28T10:00:01Z"},
+		map[string]any{"type": "swipe", "time": 1738058402.5},
+		"Opened the chat list",
+		map[string]any{"thought": "looking for Alice"},
+	}}
+	q.tasks[task.ID] = task
+	api := NewAPI(q)
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/t1/steps?format=timeline&offset=0", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Steps []Step `json:"steps"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []Step{
+		{Index: 0, Action: "tap", Screenshot: "shots/1.png", Timestamp: "2025-01-28T10:00:01Z"},
+		{Index: 1, Action: "swipe", Timestamp: "1738058402.5"},
+		{Index: 2, Raw: "Opened the chat list"},
+		{Index: 3, Raw: map[string]any{"thought": "looking for Alice"}},
+	}
+	if len(resp.Steps) != len(want) {
+		t.Fatalf("expected %d steps, got %+v", len(want), resp.Steps)
+	}
+	for i, step := range resp.Steps {
+		got, _ := json.Marshal(step)
+		exp, _ := json.Marshal(want[i])
+		if !bytes.Equal(got, exp) {
+			t.Errorf("step %d: expected %s, got %s", i, exp, got)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/t1/steps?format=table", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", w.Code)
+	}
+}
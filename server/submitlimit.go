@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// submitLimiter caps how many submissions one submitter may have in flight
+// at once, so a runaway client loop can't pile up blocked /run requests.
+// Unlike a rate limit it counts requests still being handled, not requests
+// over time.
+type submitLimiter struct {
+	max      int // 0 = unlimited
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newSubmitLimiter(max int) *submitLimiter {
+	return &submitLimiter{max: max, inFlight: map[string]int{}}
+}
+
+// acquire reserves a slot for submitter, returning false if it already has
+// max submissions in flight. Each successful acquire must be released.
+func (l *submitLimiter) acquire(submitter string) bool {
+	if l.max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[submitter] >= l.max {
+		return false
+	}
+	l.inFlight[submitter]++
+	return true
+}
+
+// release frees a slot taken by acquire.
+func (l *submitLimiter) release(submitter string) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[submitter]--; l.inFlight[submitter] <= 0 {
+		delete(l.inFlight, submitter)
+	}
+}
+
+// submitterOf identifies who sent a submission: the server key's label and
+// the client's address, so clients sharing a key are still told apart.
+func submitterOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return identityFrom(r.Context()).Label + "@" + host
+}
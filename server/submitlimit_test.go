@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentSubmits(t *testing.T) {
+	// A full queue in block mode holds submissions in flight
+	q := NewQueue("./worker.py", 1)
+	q.maxQueue = 1
+	q.onFull = OnFullBlock
+	q.Submit(TaskRequest{Goal: "filler"}, "key")
+	api := NewAPI(q)
+	api.SetMaxConcurrentSubmits(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	post := func(ctx context.Context, remoteAddr string) int {
+		req := httptest.NewRequest("POST", "/run", bytes.NewBufferString(`{"goal":"test"}`)).WithContext(ctx)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	blocked := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { blocked <- post(ctx, "10.0.0.1:1234") }()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		api.submits.mu.Lock()
+		n := api.submits.inFlight["default@10.0.0.1"]
+		api.submits.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 submissions in flight, got %d", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if code := post(ctx, "10.0.0.1:5678"); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 beyond the cap, got %d", code)
+	}
+
+	// Another submitter has its own allowance
+	other := make(chan int, 1)
+	go func() { other <- post(ctx, "10.0.0.2:1234") }()
+	select {
+	case code := <-other:
+		t.Errorf("expected a different submitter to be let in and block, got %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		<-blocked
+	}
+	<-other
+
+	if len(api.submits.inFlight) != 0 {
+		t.Errorf("expected every slot released, got %v", api.submits.inFlight)
+	}
+	q.onFull = OnFullReject
+	if code := post(context.Background(), "10.0.0.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("expected a released slot to admit the submitter again (429 from the full queue), got %d", code)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lengths kept of each field in a TaskSummary, in characters.
+const (
+	summaryGoalLen   = 80
+	summaryResultLen = 200
+)
+
+// TaskSummary is a compact view of a task for chat integrations. Text is a
+// single line ready to post; Slack incoming webhooks accept the summary
+// as-is, since they only read "text".
+type TaskSummary struct {
+	Text     string `json:"text"`
+	TaskID   string `json:"task_id"`
+	Status   string `json:"status"`
+	Success  bool   `json:"success"`
+	Goal     string `json:"goal"`
+	Result   string `json:"result,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"` // Worker run time, e.g. 42s
+}
+
+// summarize builds the summary of a task's completion event (or of a task
+// still in progress, via completionEvent).
+func summarize(ev CompletionEvent) TaskSummary {
+	s := TaskSummary{
+		TaskID:  ev.TaskID,
+		Status:  ev.Status,
+		Success: ev.Success,
+		Goal:    oneLine(ev.Goal, summaryGoalLen),
+		Result:  oneLine(ev.Result, summaryResultLen),
+		Error:   oneLine(ev.Error, summaryResultLen),
+	}
+	if ev.runTime > 0 {
+		s.Duration = ev.runTime.Round(time.Second).String()
+	}
+
+	var outcome, detail string
+	switch {
+	case ev.Status == "completed" && ev.Success:
+		outcome, detail = "succeeded", s.Result
+	case ev.Status == "completed":
+		outcome, detail = "completed without success", s.Error
+		if detail == "" {
+			detail = s.Result
+		}
+	case ev.Status == "failed":
+		outcome, detail = "failed", s.Error
+	default:
+		outcome = ev.Status
+	}
+	if s.Duration != "" {
+		outcome += " in " + s.Duration
+	}
+	s.Text = fmt.Sprintf("Task %s %s: %s", ev.TaskID, outcome, s.Goal)
+	if detail != "" {
+		s.Text += " => " + detail
+	}
+	return s
+}
+
+// oneLine collapses whitespace runs (including newlines) in s to single
+// spaces and cuts it to n characters, marking the cut with "...".
+func oneLine(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
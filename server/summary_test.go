@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummaryHasStatusSuccessAndTruncatedResult(t *testing.T) {
+	finished := time.Now()
+	task := &Task{
+		ID:         "abc123",
+		Status:     "completed",
+		Success:    true,
+		Result:     strings.Repeat("x", summaryResultLen+50),
+		StartedAt:  finished.Add(-42 * time.Second),
+		FinishedAt: finished,
+	}
+	task.Request.Goal = "Open\nsettings"
+
+	s := summarize(completionEvent(task))
+	if s.Status != "completed" || !s.Success {
+		t.Errorf("expected completed and successful, got %+v", s)
+	}
+	if want := strings.Repeat("x", summaryResultLen) + "..."; s.Result != want {
+		t.Errorf("expected result cut to %d characters, got %d", summaryResultLen, len(s.Result))
+	}
+	if s.Duration != "42s" {
+		t.Errorf("expected duration 42s, got %q", s.Duration)
+	}
+	if want := "Task abc123 succeeded in 42s: Open settings => xxx"; !strings.HasPrefix(s.Text, want) {
+		t.Errorf("expected text starting %q, got %q", want, s.Text)
+	}
+	if strings.Contains(s.Text, "\n") {
+		t.Errorf("expected a single line, got %q", s.Text)
+	}
+}
+
+func TestTaskFormatSummary(t *testing.T) {
+	q := NewQueue("./worker.py", 1)
+	task := &Task{ID: "t1", Status: "failed", Error: "device offline", CreatedAt: time.Now()}
+	task.Request.Goal = "Open settings"
+	q.tasks[task.ID] = task
+	api := NewAPI(q)
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/t1?format=summary", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var s TaskSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Text != "Task t1 failed: Open settings => device offline" {
+		t.Errorf("unexpected summary text %q", s.Text)
+	}
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/task/t1?format=xml", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", w.Code)
+	}
+}
+
+func TestWebhookSummaryFormat(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	defer func(f string) { webhookFormat = f }(webhookFormat)
+	webhookFormat = WebhookFormatSummary
+	n, err := parseNotifier("webhook=" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := CompletionEvent{TaskID: "abc", Status: "completed", Success: true, Goal: "g", Result: "done"}
+	if err := n.Notify(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	if got["text"] != "Task abc succeeded: g => done" {
+		t.Errorf("expected the summary as the webhook body, got %v", got)
+	}
+}
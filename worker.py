@@ -5,6 +5,7 @@ DroidRun worker - reads task from stdin, runs agent, outputs result to stdout
 import sys
 import json
 import asyncio
+import signal
 import subprocess
 import time
 
@@ -21,16 +22,38 @@ def adb_go_home():
 
 
 def adb_launch_app(package: str):
-    """Launch an app by package name via ADB."""
+    """Launch an app by package name, or a specific activity given as
+    package/activity (e.g. com.app/.MainActivity), via ADB."""
+    if "/" in package:
+        cmd = ["adb", "shell", "am", "start", "-n", package]
+    else:
+        cmd = ["adb", "shell", "monkey", "-p", package,
+               "-c", "android.intent.category.LAUNCHER", "1"]
+    try:
+        subprocess.run(cmd, capture_output=True, timeout=10)
+        time.sleep(2)  # Wait for app to start
+    except Exception as e:
+        print(f"[worker] adb launch {package} failed: {e}", file=sys.stderr)
+
+
+def adb_close_app(package: str):
+    """Force-stop an app (package or package/activity) via ADB."""
     try:
         subprocess.run(
-            ["adb", "shell", "monkey", "-p", package,
-             "-c", "android.intent.category.LAUNCHER", "1"],
+            ["adb", "shell", "am", "force-stop", package.split("/")[0]],
             capture_output=True, timeout=10,
         )
-        time.sleep(2)  # Wait for app to start
     except Exception as e:
-        print(f"[worker] adb launch {package} failed: {e}", file=sys.stderr)
+        print(f"[worker] adb close {package} failed: {e}", file=sys.stderr)
+
+
+class LaunchAborted(BaseException):
+    """Raised by the SIGTERM handler while the app is being launched. A
+    BaseException so the adb helpers' `except Exception` can't swallow it."""
+
+
+def abort_launch(signum, frame):
+    raise LaunchAborted()
 
 
 def adb_open_deeplink(uri: str):
@@ -46,85 +69,276 @@ def adb_open_deeplink(uri: str):
         print(f"[worker] adb open deeplink {uri} failed: {e}", file=sys.stderr)
 
 
-def create_llm(provider: str, model: str, api_key: str = None):
-    """Create LLM instance based on provider"""
+def adb_input(*args):
+    """Run an `adb shell input` command, raising if it fails."""
+    proc = subprocess.run(["adb", "shell", "input", *map(str, args)],
+                          capture_output=True, timeout=10)
+    if proc.returncode != 0:
+        raise RuntimeError(f"adb input {' '.join(map(str, args))} failed: "
+                           f"{proc.stderr.decode(errors='replace').strip()}")
+
+
+def replay_steps(steps: list) -> dict:
+    """Repeat recorded steps via ADB, without the LLM (mode "replay").
+
+    Each step must be an object with an "action" this function knows: tap
+    (x, y), swipe (x1, y1, x2, y2, optional duration_ms), input_text (text),
+    press_key (keycode), back, home, start_app (package), or wait (seconds).
+    Anything else stops the replay with an error, so a replay never guesses.
+    """
+    for i, step in enumerate(steps, 1):
+        action = step.get("action") if isinstance(step, dict) else None
+        try:
+            if action == "tap":
+                adb_input("tap", int(step["x"]), int(step["y"]))
+            elif action == "swipe":
+                adb_input("swipe", int(step["x1"]), int(step["y1"]),
+                          int(step["x2"]), int(step["y2"]),
+                          int(step.get("duration_ms", 300)))
+            elif action == "input_text":
+                # `input text` splits on spaces; %s is its escape for one
+                adb_input("text", str(step["text"]).replace(" ", "%s"))
+            elif action == "press_key":
+                adb_input("keyevent", step["keycode"])
+            elif action == "back":
+                adb_input("keyevent", "KEYCODE_BACK")
+            elif action == "home":
+                adb_input("keyevent", "KEYCODE_HOME")
+            elif action == "start_app":
+                adb_launch_app(step["package"])
+            elif action == "wait":
+                time.sleep(float(step.get("seconds", 1)))
+            else:
+                raise ValueError(f"cannot replay action {action!r}")
+        except (KeyError, TypeError, ValueError) as e:
+            raise ValueError(f"step {i}: {e}") from e
+        print(f"[worker] replayed step {i}/{len(steps)}: {action}", file=sys.stderr)
+    return {"success": True, "reason": f"replayed {len(steps)} steps", "steps": steps}
+
+
+def setup_steps(task: dict) -> list:
+    """The app launches and deep links to go through before the goal. The
+    server sends them all, app and deeplink included, as setup; the
+    fallback is for input without it."""
+    if task.get("setup") is not None:
+        return task["setup"]
+    steps = []
+    if task.get("app"):
+        steps.append({"app": task["app"]})
+    if task.get("deeplink"):
+        steps.append({"deeplink": task["deeplink"]})
+    return steps
+
+
+def goal_with_context(task: dict) -> str:
+    """Append the task's timezone/locale to the goal, so time- and
+    format-dependent goals ("set an alarm for 7am") are read correctly."""
+    notes = []
+    if task.get("timezone"):
+        notes.append(f"timezone {task['timezone']}")
+    if task.get("locale"):
+        notes.append(f"locale {task['locale']}")
+    if not notes:
+        return task["goal"]
+    return f"{task['goal']}\n\n(Use {' and '.join(notes)} for times, dates, and formats.)"
+
+
+def create_llm(provider: str, model: str, api_key: str = None,
+               base_url: str = None, headers: dict = None):
+    """Create LLM instance based on provider. base_url and headers (from the
+    server's -provider-config) point the SDK at an API gateway."""
 
     if provider in ("Google", "GoogleGenAI", "Gemini"):
         from llama_index.llms.gemini import Gemini
         # Gemini models need "models/" prefix
         if not model.startswith("models/"):
             model = f"models/{model}"
-        return Gemini(model=model, api_key=api_key)
+        return Gemini(model=model, api_key=api_key,
+                      **gateway_kwargs(base_url, headers, "api_base", "default_headers"))
 
     elif provider == "Anthropic":
         from llama_index.llms.anthropic import Anthropic
-        return Anthropic(model=model, api_key=api_key)
+        return Anthropic(model=model, api_key=api_key,
+                         **gateway_kwargs(base_url, headers, "base_url", "default_headers"))
 
     elif provider == "OpenAI":
         from llama_index.llms.openai import OpenAI
-        return OpenAI(model=model, api_key=api_key)
+        return OpenAI(model=model, api_key=api_key,
+                      **gateway_kwargs(base_url, headers, "api_base", "default_headers"))
 
     elif provider == "DeepSeek":
         from llama_index.llms.deepseek import DeepSeek
-        return DeepSeek(model=model, api_key=api_key)
+        return DeepSeek(model=model, api_key=api_key,
+                        **gateway_kwargs(base_url, headers, "api_base", "default_headers"))
 
     elif provider == "Ollama":
         from llama_index.llms.ollama import Ollama
-        return Ollama(model=model)
+        return Ollama(model=model, **gateway_kwargs(base_url, None, "base_url", None))
 
     else:
         raise ValueError(f"Unknown provider: {provider}")
 
 
-async def run_task(task: dict) -> dict:
+def gateway_kwargs(base_url, headers, url_arg, headers_arg):
+    """Map gateway settings onto an SDK's keyword arguments, leaving out
+    those that aren't set so the SDK defaults apply."""
+    kwargs = {}
+    if base_url:
+        kwargs[url_arg] = base_url
+    if headers and headers_arg:
+        kwargs[headers_arg] = headers
+    return kwargs
+
+
+def emit_progress(out, **fields):
+    """Write a progress line to the server (one JSON object per line)."""
+    out.write(json.dumps(fields) + "\n")
+    out.flush()
+
+
+def request_more_steps(out, n: int, reason: str) -> int:
+    """Ask the server for n more steps and wait for its answer on stdin,
+    which it keeps open with -allow-step-extension. Returns the steps
+    granted, 0 if none."""
+    emit_progress(out, request_more_steps=n, reason=reason)
+    line = sys.stdin.readline()
+    if not line:
+        return 0
+    return json.loads(line).get("granted_steps", 0)
+
+
+def out_of_steps(result, max_steps: int) -> bool:
+    """Whether an unsuccessful run stopped because it hit max_steps."""
+    steps = getattr(result, "steps", None)
+    used = len(steps) if isinstance(steps, list) else steps
+    if isinstance(used, int) and used >= max_steps:
+        return True
+    reason = (getattr(result, "reason", "") or "").lower()
+    return "max" in reason and "step" in reason
+
+
+def count_output_tokens():
+    """Register a llama-index token counter, or return None if unavailable."""
+    try:
+        from llama_index.core import Settings
+        from llama_index.core.callbacks import CallbackManager, TokenCountingHandler
+    except ImportError:
+        return None
+    counter = TokenCountingHandler()
+    Settings.callback_manager = CallbackManager([counter])
+    return counter
+
+
+async def report_tokens(counter, out):
+    """Report cumulative output tokens whenever they change."""
+    last = 0
+    while True:
+        await asyncio.sleep(1)
+        used = counter.completion_llm_token_count
+        if used != last:
+            emit_progress(out, output_tokens=used)
+            last = used
+
+
+async def run_task(task: dict, progress_out) -> dict:
     from droidrun import DroidAgent, DroidrunConfig, AgentConfig
 
     api_key = task.get("api_key")
     if not api_key:
         raise ValueError("api_key is required")
 
-    llm = create_llm(task["provider"], task["model"], api_key)
+    # The server enforces max_output_tokens from these reports
+    counter = count_output_tokens() if task.get("max_output_tokens") else None
 
-    config = DroidrunConfig(
-        agent=AgentConfig(
-            reasoning=task.get("reasoning", True),
-            max_steps=task.get("max_steps", 30),
-            streaming=False,  # Disable streaming to avoid llama-index async generator bug
-        )
-    )
+    llm = create_llm(task["provider"], task["model"], api_key,
+                     task.get("base_url"), task.get("headers"))
 
-    agent = DroidAgent(
-        goal=task["goal"],
-        config=config,
-        llms=llm,  # Single LLM for all agents
-    )
+    def make_agent(max_steps: int):
+        config = DroidrunConfig(
+            agent=AgentConfig(
+                reasoning=task.get("reasoning", True),
+                max_steps=max_steps,
+                streaming=False,  # Disable streaming to avoid llama-index async generator bug
+            )
+        )
+        return DroidAgent(
+            goal=goal_with_context(task),
+            config=config,
+            llms=llm,  # Single LLM for all agents
+        )
 
-    result = await agent.run()
+    max_steps = task.get("max_steps", 30)
+    # With step extensions, a run that runs out of steps asks for more and
+    # carries on from where the device is, up to the server's allowance
+    allowance = task.get("step_extension", 0)
+    steps = []
+    reporter = asyncio.create_task(report_tokens(counter, progress_out)) if counter else None
+    try:
+        result = await make_agent(max_steps).run()
+        while not result.success and allowance > 0 and out_of_steps(result, max_steps):
+            granted = await asyncio.to_thread(
+                request_more_steps, progress_out,
+                min(allowance, max(5, max_steps // 3)),
+                f"ran out of steps: {result.reason}")
+            if granted <= 0:
+                break
+            allowance -= granted
+            if isinstance(getattr(result, "steps", None), list):
+                steps.extend(result.steps)
+            max_steps = granted
+            result = await make_agent(max_steps).run()
+    finally:
+        if reporter:
+            reporter.cancel()
 
+    final_steps = getattr(result, "steps", None)
+    if steps and isinstance(final_steps, list):
+        final_steps = steps + final_steps
     return {
         "success": result.success,
         "reason": result.reason,
-        "steps": result.steps if hasattr(result, 'steps') else None,
+        "steps": final_steps,
     }
 
 
 def main():
-    task = json.load(sys.stdin)
+    # The task is the first line; with -allow-step-extension the server keeps
+    # stdin open afterwards to answer request_more_steps
+    task = json.loads(sys.stdin.readline())
 
     # Redirect stdout to stderr during execution (droidrun prints thoughts)
     real_stdout = sys.stdout
     sys.stdout = sys.stderr
 
-    # Launch app and/or open deep link via ADB (deterministic, doesn't depend on LLM)
-    app = task.get("app")
-    deeplink = task.get("deeplink")
-    if app:
-        adb_launch_app(app)
-    if deeplink:
-        adb_open_deeplink(deeplink)
+    # Launch apps and/or open deep links via ADB, in order (deterministic,
+    # doesn't depend on LLM). A cancel (SIGTERM) during setup closes the
+    # apps instead of leaving them half-open; the server waits -cancel-grace
+    # for this before SIGKILL.
+    setup = setup_steps(task)
+    launched = []
+    signal.signal(signal.SIGTERM, abort_launch)
+    try:
+        for step in setup:
+            if step.get("app"):
+                launched.append(step["app"])
+                adb_launch_app(step["app"])
+            elif step.get("deeplink"):
+                adb_open_deeplink(step["deeplink"])
+    except LaunchAborted:
+        print("[worker] cancelled during launch, closing app", file=sys.stderr)
+        for app in launched:
+            adb_close_app(app)
+        adb_go_home()
+        sys.stdout = real_stdout
+        print(json.dumps({"ok": False, "error": "cancelled during app launch"}))
+        return
+    signal.signal(signal.SIGTERM, signal.SIG_DFL)
 
     try:
-        result = asyncio.run(run_task(task))
+        if task.get("mode") == "replay":
+            result = replay_steps(task.get("replay_steps") or [])
+        else:
+            result = asyncio.run(run_task(task, real_stdout))
         # Restore stdout for final JSON output
         sys.stdout = real_stdout
         print(json.dumps({"ok": True, **result}))